@@ -0,0 +1,236 @@
+package client
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/kyrillzorin/CS3031_Lab2/lab2"
+)
+
+// Key agent request, Op is "publickey", "sign" or "decrypt"
+// Hash is 0 for Ed25519 signatures and X25519 key unwrapping
+// The agent only performs operations with the key, it never sends the key itself
+type agentRequest struct {
+	Op         string
+	Data       []byte
+	Hash       crypto.Hash
+	PSS        bool
+	SaltLength int
+}
+
+// Key agent response
+type agentResponse struct {
+	Data  []byte
+	Error string
+}
+
+// Uid of the user the agent serves, connections from other users are refused
+var agentUid = os.Getuid
+
+// Private key held by a running key agent
+type agentKey struct {
+	socket    string
+	keys      KeySet
+	publicKey crypto.PublicKey
+}
+
+// Connect to the key agent listening on socket
+func connectAgent(socket string) (*agentKey, error) {
+	k := &agentKey{socket: socket}
+	data, err := k.call(agentRequest{Op: "publickey"})
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &k.keys)
+	if err != nil {
+		return nil, err
+	}
+	k.publicKey, err = k.keys.Signing.CryptoPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Send a request to the agent, one request per connection
+func (k *agentKey) call(req agentRequest) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", k.socket, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		return nil, err
+	}
+	var res agentResponse
+	err = json.NewDecoder(conn).Decode(&res)
+	if err != nil {
+		return nil, fmt.Errorf("Key agent: %s", err)
+	}
+	if res.Error != "" {
+		return nil, fmt.Errorf("Key agent: %s", res.Error)
+	}
+	return res.Data, nil
+}
+
+// Public signing key of the agent's private key
+func (k *agentKey) Public() crypto.PublicKey {
+	return k.publicKey
+}
+
+// Key set of the agent's private key
+func (k *agentKey) PublicKeys() KeySet {
+	return k.keys
+}
+
+// Sign a digest with the agent's private key, PKCS#1 v1.5 or PSS depending on opts
+// Ed25519 keys sign the message itself
+func (k *agentKey) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	req := agentRequest{Op: "sign", Data: digest, Hash: opts.HashFunc()}
+	if pss, ok := opts.(*rsa.PSSOptions); ok {
+		req.PSS = true
+		req.SaltLength = pss.SaltLength
+	}
+	return k.call(req)
+}
+
+// Decrypt an OAEP ciphertext or unwrap an X25519 wrapped key with the agent's private key
+func (k *agentKey) Decrypt(_ io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	if opts == nil {
+		return k.call(agentRequest{Op: "decrypt", Data: msg})
+	}
+	oaep, ok := opts.(*rsa.OAEPOptions)
+	if !ok || len(oaep.Label) != 0 {
+		return nil, errors.New("Key agent only supports OAEP decryption without a label")
+	}
+	return k.call(agentRequest{Op: "decrypt", Data: msg, Hash: oaep.Hash})
+}
+
+// Check a connection to the agent comes from the user it serves, in case the socket's permissions were changed
+func checkAgentPeer(conn net.Conn) error {
+	uid, err := peerUid(conn)
+	if err != nil {
+		return err
+	}
+	if uid != agentUid() {
+		return fmt.Errorf("Refused connection from uid %d", uid)
+	}
+	return nil
+}
+
+// Perform a request with the private key
+func handleAgentRequest(privateKey PrivateKey, req agentRequest) ([]byte, error) {
+	keys := privateKey.PublicKeys()
+	switch req.Op {
+	case "publickey":
+		return json.Marshal(keys)
+	case "sign":
+		if keys.Signing.Algorithm == lab2.AlgorithmEd25519 {
+			if req.Hash != 0 {
+				return nil, errors.New("Ed25519 keys sign messages without hashing")
+			}
+			return privateKey.Sign(rand.Reader, req.Data, crypto.Hash(0))
+		}
+		if !req.Hash.Available() {
+			return nil, errors.New("Unsupported hash function")
+		}
+		var opts crypto.SignerOpts = req.Hash
+		if req.PSS {
+			opts = &rsa.PSSOptions{SaltLength: req.SaltLength, Hash: req.Hash}
+		}
+		return privateKey.Sign(rand.Reader, req.Data, opts)
+	case "decrypt":
+		if keys.Encryption.Algorithm == lab2.AlgorithmX25519 {
+			if req.Hash != 0 {
+				return nil, errors.New("X25519 keys don't take decryption options")
+			}
+			return privateKey.Decrypt(rand.Reader, req.Data, nil)
+		}
+		if !req.Hash.Available() {
+			return nil, errors.New("Unsupported hash function")
+		}
+		return privateKey.Decrypt(rand.Reader, req.Data, &rsa.OAEPOptions{Hash: req.Hash})
+	}
+	return nil, errors.New("Unknown operation: " + req.Op)
+}
+
+// Default key agent socket, in a directory only the user can access under $XDG_RUNTIME_DIR
+// or in the client's directory if that isn't set
+func defaultAgentSocket(username string, device string) string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		return "agent.sock"
+	}
+	return filepath.Join(dir, "lab2", username+"-"+device+".sock")
+}
+
+// Serve private key operations on a Unix socket until the agent hasn't been used for timeout
+// or is interrupted, the key is forgotten when the agent exits
+func RunAgent(privateKey PrivateKey, socket string, timeout time.Duration) error {
+	if timeout <= 0 {
+		return errors.New("AgentTimeout must be positive")
+	}
+	if _, err := connectAgent(socket); err == nil {
+		return errors.New("Key agent is already running")
+	}
+	if err := os.MkdirAll(filepath.Dir(socket), 0700); err != nil {
+		return err
+	}
+	// Remove the socket of an agent that didn't exit cleanly
+	os.Remove(socket)
+	// Only the user can connect to the agent, the socket is created with these permissions
+	// rather than changed after, so nobody can connect in between
+	umask := syscall.Umask(0077)
+	listener, err := net.Listen("unix", socket)
+	syscall.Umask(umask)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	lock := time.AfterFunc(timeout, func() { listener.Close() })
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		lock.Stop()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			// The listener is closed when the agent locks or is interrupted
+			return nil
+		}
+		// Connections from other users don't keep the agent unlocked
+		if err := checkAgentPeer(conn); err != nil {
+			fmt.Fprintf(os.Stderr, "Key agent: %s\n", err.Error())
+			conn.Close()
+			continue
+		}
+		lock.Reset(timeout)
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		var req agentRequest
+		var res agentResponse
+		err = json.NewDecoder(conn).Decode(&req)
+		if err == nil {
+			res.Data, err = handleAgentRequest(privateKey, req)
+		}
+		if err != nil {
+			res.Error = err.Error()
+		}
+		json.NewEncoder(conn).Encode(res)
+		conn.Close()
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package client
+
+import (
+	"net"
+	"os"
+)
+
+// Uid of the process at the other end of a connection to the agent
+// Only Linux reports it, elsewhere the socket's permissions keep other users out
+func peerUid(conn net.Conn) (int, error) {
+	return os.Getuid(), nil
+}
@@ -0,0 +1,195 @@
+package client
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kyrillzorin/CS3031_Lab2/lab2"
+)
+
+// Change to a new temporary directory for the test, the client keeps its files in the working directory
+func chdirTemp(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "client-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+// Run a key agent on a socket in a new directory, returns the socket and the agent's result once it exits
+func startTestAgent(t *testing.T, privateKey PrivateKey, timeout time.Duration) (string, chan error) {
+	socket := filepath.Join(chdirTemp(t), "lab2", "agent.sock")
+	done := make(chan error, 1)
+	go func() { done <- RunAgent(privateKey, socket, timeout) }()
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(socket); err == nil {
+			return socket, done
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("key agent didn't start")
+	return "", nil
+}
+
+// Wait for a key agent to lock
+func waitForAgent(t *testing.T, done chan error) {
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("key agent: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("key agent didn't lock")
+	}
+}
+
+func newTestKey(t *testing.T, keyType string) PrivateKey {
+	key, err := lab2.GenerateKey(keyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestAgentSocketMode(t *testing.T) {
+	// The agent's own umask applies whatever the process's is
+	umask := syscall.Umask(0)
+	defer syscall.Umask(umask)
+	socket, done := startTestAgent(t, newTestKey(t, lab2.AlgorithmEd25519), 200*time.Millisecond)
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm()&0077 != 0 {
+		t.Errorf("socket mode = %v", info.Mode())
+	}
+	info, err = os.Stat(filepath.Dir(socket))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("socket directory mode = %v", info.Mode())
+	}
+	waitForAgent(t, done)
+	if current := syscall.Umask(0); current != 0 {
+		t.Errorf("umask after starting the agent = %o, want 0", current)
+	}
+}
+
+func TestAgentRefusesOtherUsers(t *testing.T) {
+	agentUid = func() int { return os.Getuid() + 1 }
+	defer func() { agentUid = os.Getuid }()
+	socket, done := startTestAgent(t, newTestKey(t, lab2.AlgorithmEd25519), 200*time.Millisecond)
+	if _, err := connectAgent(socket); err == nil {
+		t.Error("agent answered another user")
+	}
+	// Refused connections don't keep the agent unlocked
+	waitForAgent(t, done)
+}
+
+func TestAgentPeerUid(t *testing.T) {
+	listener, err := net.Listen("unix", filepath.Join(chdirTemp(t), "peer.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("unix", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if uid, err := peerUid(peer); err != nil || uid != os.Getuid() {
+		t.Errorf("peer uid = %d %v, want %d", uid, err, os.Getuid())
+	}
+	if err := checkAgentPeer(peer); err != nil {
+		t.Errorf("connection from the user refused: %v", err)
+	}
+}
+
+func TestAgentUnlockAndLock(t *testing.T) {
+	for _, keyType := range []string{lab2.AlgorithmEd25519, lab2.AlgorithmRSA} {
+		chdirTemp(t)
+		key := newTestKey(t, keyType)
+		if err := savePrivateKey(privateKeyFile, key, []byte("passphrase")); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv(passphraseEnv, "wrong passphrase")
+		if _, _, err := privateKeyFromFile(); err == nil {
+			t.Fatalf("%s: unlocked with the wrong passphrase", keyType)
+		}
+		t.Setenv(passphraseEnv, "passphrase")
+		unlocked, unencrypted, err := privateKeyFromFile()
+		if err != nil || unencrypted {
+			t.Fatalf("%s: unlock = %v %v", keyType, unencrypted, err)
+		}
+
+		timeout := 300 * time.Millisecond
+		socket, done := startTestAgent(t, unlocked, timeout)
+		agent, err := connectAgent(socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := key.PublicKeys()
+		if !agent.PublicKeys().Signing.Equal(keys.Signing) || !agent.PublicKeys().Encryption.Equal(keys.Encryption) {
+			t.Fatalf("%s: agent keys don't match the key file", keyType)
+		}
+		// Each use keeps the agent unlocked for another timeout
+		for i := 0; i < 3; i++ {
+			message := []byte("message")
+			signature, err := lab2.Sign(agent, message)
+			if err != nil || !lab2.VerifySignature(keys.Signing, message, signature) {
+				t.Fatalf("%s: agent signature: %v", keyType, err)
+			}
+			encrypted, err := lab2.Encrypt(keys.Encryption, message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decrypted, err := lab2.Decrypt(agent, encrypted)
+			if err != nil || !bytes.Equal(decrypted, message) {
+				t.Fatalf("%s: agent decryption = %q %v", keyType, decrypted, err)
+			}
+			time.Sleep(timeout * 2 / 3)
+		}
+
+		waitForAgent(t, done)
+		if _, err := os.Stat(socket); !os.IsNotExist(err) {
+			t.Errorf("%s: socket left after locking: %v", keyType, err)
+		}
+		if _, err := connectAgent(socket); err == nil {
+			t.Errorf("%s: agent answered after locking", keyType)
+		}
+	}
+}
+
+func TestDefaultAgentSocket(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+	if socket := defaultAgentSocket("alice", "laptop"); socket != "/run/user/1000/lab2/alice-laptop.sock" {
+		t.Errorf("socket under XDG_RUNTIME_DIR = %s", socket)
+	}
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	if socket := defaultAgentSocket("alice", "laptop"); socket != "agent.sock" {
+		t.Errorf("socket without XDG_RUNTIME_DIR = %s", socket)
+	}
+}
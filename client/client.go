@@ -1,169 +1,731 @@
-package main
+package client
 
 import (
-	"crypto/rsa"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 
-	"github.com/docopt/docopt-go"
+	"github.com/kyrillzorin/CS3031_Lab2/lab2"
 	"github.com/spf13/viper"
 )
 
 // Global Variables
-var ClientPrivateKey *rsa.PrivateKey
-var ClientPublicKey *rsa.PublicKey
-var ClientUser, Server string
+var ClientPrivateKey PrivateKey
+var ClientPublicKeys KeySet
+var ClientUser, ClientDevice, Server, KeyType string
+var ClientCert, AgentSocket, LogPublicKey string
+var AgentTimeout time.Duration
+var UseClientCert bool
 
-// Initialize config
-func init() {
+// Load config.toml from the working directory and the user's private key, from the key agent if it is running
+func LoadConfig() error {
 	var err error
-	// Load RSA private and public key
-	ClientPrivateKey, err = getPrivateKey()
-	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		os.Exit(1)
-	}
-	ClientPublicKey = &ClientPrivateKey.PublicKey
 	// Initialize config
 	viper.SetDefault("ClientUser", "test")
+	viper.SetDefault("Device", "default")
 	viper.SetDefault("Server", "127.0.0.1:3000")
+	viper.SetDefault("TLS", true)
+	viper.SetDefault("ServerFingerprint", "")
+	viper.SetDefault("ClientCert", "")
+	viper.SetDefault("KeyType", "ed25519")
+	viper.SetDefault("AgentSocket", "")
+	viper.SetDefault("AgentTimeout", "30m")
+	viper.SetDefault("LogKey", "")
 	viper.SetConfigName("config")
 	viper.AddConfigPath(".")
 	viper.SetConfigType("toml")
 	err = viper.ReadInConfig()
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		os.Exit(1)
+		return err
 	}
 	ClientUser = viper.GetString("ClientUser")
-	Server = "http://" + viper.GetString("Server")
+	ClientDevice = viper.GetString("Device")
+	KeyType = viper.GetString("KeyType")
+	AgentSocket = viper.GetString("AgentSocket")
+	if AgentSocket == "" {
+		AgentSocket = defaultAgentSocket(ClientUser, ClientDevice)
+	}
+	AgentTimeout = viper.GetDuration("AgentTimeout")
+	LogPublicKey = viper.GetString("LogKey")
+	// Use the key agent if it is running, otherwise load the private key
+	if agent, err := connectAgent(AgentSocket); err == nil {
+		ClientPrivateKey = agent
+	} else {
+		privateKey, unencrypted, err := getPrivateKey()
+		if err != nil {
+			return err
+		}
+		if unencrypted {
+			fmt.Fprintln(os.Stderr, "Warning: priv.pem is not protected by a passphrase, run the passphrase command to encrypt it")
+		}
+		ClientPrivateKey = privateKey
+	}
+	ClientPublicKeys = ClientPrivateKey.PublicKeys()
+	if viper.GetBool("TLS") {
+		Server = "https://" + viper.GetString("Server")
+	} else {
+		Server = "http://" + viper.GetString("Server")
+	}
+	// Once generated, the client certificate authenticates requests instead of signatures and session tokens
+	ClientCert = viper.GetString("ClientCert")
+	var clientCert *tls.Certificate
+	if _, statErr := os.Stat(ClientCert); ClientCert != "" && statErr == nil {
+		clientCert, err = loadClientCertificate(ClientPrivateKey, ClientCert)
+		if err != nil {
+			return err
+		}
+		UseClientCert = true
+	}
+	return configureTLS(viper.GetString("ServerFingerprint"), clientCert)
 }
 
-// Main function, parses cli args and runs appropriate function
-func main() {
-	usage := `CS3031 Lab2 Client.
+// Register user with server, will fail if username is taken
+func Register() error {
+	user := lab2.NewUser(ClientUser, ClientDevice, ClientPublicKeys)
+	err := RegisterUser(user)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Successfully registered")
+	return nil
+}
 
-Usage:
-  client register
-  client upload <filepath> <filename>
-  client download <user> <filename> <outputpath>
-  client share <filename> <user>...
-  client revoke <filename> <user>...
-  client -h | --help
+// Generate a client certificate for the user's key at the ClientCert path
+func GenerateCertificate() error {
+	if ClientCert == "" {
+		return errors.New("Set ClientCert in config.toml to the path to save the certificate to")
+	}
+	err := generateClientCertificate(ClientPrivateKey, ClientUser, ClientCert)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Saved client certificate to %s\n", ClientCert)
+	return nil
+}
 
-Options:
-  -h --help     Show this screen.`
+// Change the passphrase protecting the private key, or set one for an unencrypted key
+func ChangePassphrase() error {
+	// The key agent doesn't give out the key, so read it from priv.pem
+	privateKey := ClientPrivateKey
+	if _, ok := privateKey.(*agentKey); ok {
+		var err error
+		privateKey, _, err = privateKeyFromFile()
+		if err != nil {
+			return err
+		}
+	}
+	passphrase, err := readNewPassphrase(newPassphraseEnv)
+	if err != nil {
+		return err
+	}
+	err = savePrivateKey(privateKeyFile, privateKey, passphrase)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Successfully changed passphrase")
+	return nil
+}
 
-	args, _ := docopt.Parse(usage, nil, true, "", false)
-	if args["register"].(bool) == true {
-		Register()
-	} else if args["upload"].(bool) == true {
-		UploadFile(args["<filepath>"].(string), args["<filename>"].(string))
-	} else if args["download"].(bool) == true {
-		DownloadFile(args["<user>"].([]string)[0], args["<filename>"].(string), args["<outputpath>"].(string))
-	} else if args["share"].(bool) == true {
-		ShareFile(args["<filename>"].(string), args["<user>"].([]string), true)
-	} else if args["revoke"].(bool) == true {
-		RevokeFile(args["<filename>"].(string), args["<user>"].([]string))
+// Run the key agent so other commands don't have to ask for the passphrase
+func StartAgent() error {
+	if _, ok := ClientPrivateKey.(*agentKey); ok {
+		return errors.New("Key agent is already running")
 	}
+	fmt.Printf("Key agent listening on %s, locks after %s without use\n", AgentSocket, AgentTimeout)
+	err := RunAgent(ClientPrivateKey, AgentSocket, AgentTimeout)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Key agent locked")
+	return nil
 }
 
-// Register user with server, will fail if username is taken
-func Register() {
-	user := NewUser(ClientUser, ClientPublicKey)
-	err := user.Register()
+// Replace the user's key pair, re-encrypting every file key shared with the user to the new key
+// The server retires the old key once it accepts the new one
+func RotateKey() error {
+	// The key agent would keep using the old key
+	if _, ok := ClientPrivateKey.(*agentKey); ok {
+		return errors.New("Stop the key agent before rotating the key")
+	}
+	newKey, err := lab2.GenerateKey(KeyType)
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		os.Exit(1)
+		return err
 	}
-	fmt.Println("Successfully registered")
-	os.Exit(0)
+	rotation, err := NewKeyRotation(newKey)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "Choose a passphrase to protect your new private key")
+	passphrase, err := readNewPassphrase(newPassphraseEnv)
+	if err != nil {
+		return err
+	}
+	// Save the new key before the server starts using it
+	err = savePrivateKey(newPrivateKeyFile, newKey, passphrase)
+	if err != nil {
+		return err
+	}
+	err = rotation.Rotate()
+	if err != nil {
+		// The server may have accepted the new key even if the response was lost
+		user, getErr := GetUser(ClientUser)
+		if getErr != nil || user.Device(ClientDevice) == nil || !user.Device(ClientDevice).Keys.Signing.Equal(rotation.Keys.Signing) {
+			os.Remove(newPrivateKeyFile)
+			return err
+		}
+	}
+	err = os.Rename(newPrivateKeyFile, privateKeyFile)
+	if err != nil {
+		return fmt.Errorf("%s, the new key is in %s", err.Error(), newPrivateKeyFile)
+	}
+	// Session tokens and client certificates belong to the old key
+	err = RemoveToken()
+	if err != nil {
+		return err
+	}
+	if UseClientCert {
+		os.Remove(ClientCert)
+		fmt.Println("Run the certificate command to create a client certificate for the new key")
+	}
+	fmt.Printf("Successfully rotated key, re-encrypted %d file keys\n", len(rotation.FileKeys))
+	return nil
 }
 
-// Upload a file to server
-func UploadFile(filepath string, filename string) {
-	data, err := ioutil.ReadFile(filepath)
+// Ask to add this device to the user, an existing device must approve it
+func EnrollDevice() error {
+	enrollment, err := NewEnrollment(ClientDevice, ClientPrivateKey)
+	if err != nil {
+		return err
+	}
+	err = enrollment.Submit()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Enrollment %s for device %s, key fingerprint %s\n", enrollment.Id, enrollment.Device, fingerprint(enrollment.Keys))
+	fmt.Printf("Run the approve command on one of your devices before %s\n", enrollment.Expires.Local().Format(time.RFC1123))
+	return nil
+}
+
+// List the user's devices and enrollments waiting for approval
+func ListDevices() error {
+	devices, err := GetDevices()
+	if err != nil {
+		return err
+	}
+	for _, device := range devices.Devices {
+		current := ""
+		if device.Name == ClientDevice {
+			current = " (this device)"
+		}
+		fmt.Printf("%s%s, key fingerprint %s\n", device.Name, current, fingerprint(device.Keys))
+	}
+	for _, enrollment := range devices.Pending {
+		fmt.Printf("Pending enrollment %s for device %s, key fingerprint %s\n", enrollment.Id, enrollment.Device, fingerprint(enrollment.Keys))
+	}
+	return nil
+}
+
+// Approve a device enrollment, re-encrypting every file key shared with the user for the new device
+// Check the fingerprint printed by the enroll command matches before approving
+func ApproveDevice(id string) error {
+	devices, err := GetDevices()
+	if err != nil {
+		return err
+	}
+	var enrollment *Enrollment
+	for i := range devices.Pending {
+		if devices.Pending[i].Id == id {
+			enrollment = &devices.Pending[i]
+		}
+	}
+	if enrollment == nil {
+		return errors.New("Enrollment does not exist or has expired")
+	}
+	approval, err := NewDeviceApproval(*enrollment)
+	if err != nil {
+		return err
+	}
+	err = approval.Approve()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Successfully added device %s, key fingerprint %s\n", enrollment.Device, fingerprint(enrollment.Keys))
+	return nil
+}
+
+// Remove one of the user's other devices, re-encrypting every file key shared with the user for the remaining devices
+// Files the device already downloaded keep their keys, revoke them to re-encrypt the files under new keys
+func RemoveDevice(name string) error {
+	if name == ClientDevice {
+		return errors.New("Remove this device from one of your other devices")
+	}
+	removal, err := NewDeviceRemoval(name)
+	if err != nil {
+		return err
+	}
+	err = removal.Remove()
+	if err != nil {
+		return err
+	}
+	// Session tokens aren't tied to a device, so the server ends all of them
+	err = RemoveToken()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Successfully removed device %s, re-encrypted %d file keys\n", name, len(removal.FileKeys))
+	return nil
+}
+
+// Split a new recovery key between trusted users, any threshold of whom can later help recover the user's files
+// The recovery key is added as a device, replacing the one of an earlier setup
+func SetupRecovery(threshold string, trustees []string) error {
+	k, err := strconv.Atoi(threshold)
+	if err != nil {
+		return errors.New("Threshold must be a number")
+	}
+	recoveryKey, err := lab2.GenerateKeyPair()
+	if err != nil {
+		return err
+	}
+	recovery, err := NewRecovery(recoveryKey, k, trustees)
+	if err != nil {
+		return err
+	}
+	user, err := GetUser(ClientUser)
+	if err != nil {
+		return err
+	}
+	if user.Device(recoveryDevice) != nil {
+		removal, err := NewDeviceRemoval(recoveryDevice)
+		if err != nil {
+			return err
+		}
+		err = removal.Remove()
+		if err != nil {
+			return err
+		}
+		// Session tokens aren't tied to a device, so the server ends all of them
+		err = RemoveToken()
+		if err != nil {
+			return err
+		}
+	}
+	err = addRecoveryDevice(recoveryKey)
+	if err != nil {
+		return err
+	}
+	err = recovery.Setup()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Successfully set up recovery, any %d of %d trustees can help recover your files\n", k, len(trustees))
+	return nil
+}
+
+// Recover the user's files on this device after losing their other devices
+// The first run asks the user's trustees for their shares, later runs finish once enough have approved
+func Recover() error {
+	request, err := GetSavedRecoveryRequest()
+	if err != nil {
+		return err
+	}
+	if request == nil {
+		request, err = NewRecoveryRequest()
+		if err != nil {
+			return err
+		}
+		err = request.Save()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Recovery request %s for device %s, key fingerprint %s\n", request.Id, request.Device, fingerprint(request.Keys))
+		fmt.Printf("Ask your trustees to run the approve-recovery command before %s, then run the recover command again\n", request.Expires.Local().Format(time.RFC1123))
+		return nil
+	}
+	shares, err := request.GetShares()
+	if err != nil {
+		return fmt.Errorf("%s\nRemove recovery.json to make a new recovery request", err.Error())
+	}
+	if len(shares.Shares) < shares.Threshold {
+		fmt.Printf("%d of the %d trustees needed have approved recovery request %s\n", len(shares.Shares), shares.Threshold, request.Id)
+		return nil
+	}
+	recoveryKey, err := shares.RecoveryKey()
+	if err != nil {
+		return err
+	}
+	user, err := GetUser(ClientUser)
+	if err != nil {
+		return err
+	}
+	device := user.Device(recoveryDevice)
+	if device == nil || !device.Keys.Signing.Equal(recoveryKey.PublicKeys().Signing) {
+		return errors.New("The trustees' shares don't rebuild your recovery key")
+	}
+	enrollment, err := NewEnrollment(ClientDevice, ClientPrivateKey)
+	if err != nil {
+		return err
+	}
+	err = enrollment.Submit()
+	if err != nil {
+		return err
+	}
+	// Approve this device as the recovery device, which can decrypt every file key
+	ClientPrivateKey = recoveryKey
+	ClientDevice = recoveryDevice
+	approval, err := NewDeviceApproval(*enrollment)
+	if err != nil {
+		return err
+	}
+	err = approval.Approve()
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		os.Exit(1)
+		return err
 	}
-	key, err := generateAESKey()
+	err = RemoveRecoveryRequest()
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		os.Exit(1)
+		return err
 	}
-	encodedData, err := encryptAES(key, data)
+	// The session token was issued while acting as the recovery device
+	err = RemoveToken()
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		os.Exit(1)
+		return err
 	}
-	file := NewFile(ClientUser, filename, encodedData)
-	err = file.Upload()
+	fmt.Printf("Successfully recovered %d file keys for device %s\n", len(approval.FileKeys), enrollment.Device)
+	fmt.Println("Remove lost devices with the remove-device command and run the recovery-setup command again for a new recovery key")
+	return nil
+}
+
+// List the pending recovery requests the user is a trustee of
+func ListRecoveryRequests() error {
+	requests, err := GetTrusteeRequests()
+	if err != nil {
+		return err
+	}
+	for _, request := range requests.Requests {
+		fmt.Printf("Recovery request %s from %s for device %s, key fingerprint %s\n", request.Id, request.Username, request.Device, fingerprint(request.Keys))
+	}
+	return nil
+}
+
+// Approve a recovery request by sending the user's share to the new device
+// Check with the requesting user that the fingerprint matches before approving
+func ApproveRecovery(id string) error {
+	requests, err := GetTrusteeRequests()
+	if err != nil {
+		return err
+	}
+	var request *TrusteeRequest
+	for i := range requests.Requests {
+		if requests.Requests[i].Id == id {
+			request = &requests.Requests[i]
+		}
+	}
+	if request == nil {
+		return errors.New("Recovery request does not exist or has expired")
+	}
+	approval, err := NewRecoveryApproval(*request)
+	if err != nil {
+		return err
+	}
+	err = approval.Approve()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Successfully approved recovery of %s for device %s, key fingerprint %s\n", request.Username, request.Device, fingerprint(request.Keys))
+	return nil
+}
+
+// Print a user's key fingerprint and safety number to compare out of band, and whether their keys are pinned
+// With confirm, the user's current keys are pinned as verified
+func VerifyUser(username string, confirm bool) error {
+	user, err := GetUser(username)
+	if err != nil {
+		return err
+	}
+	self, err := GetUser(ClientUser)
+	if err != nil {
+		return err
+	}
+	// The safety number only matches if the server shows both users the same keys
+	if device := self.Device(ClientDevice); device == nil || !device.Keys.Signing.Equal(ClientPublicKeys.Signing) ||
+		!device.Keys.Encryption.Equal(ClientPublicKeys.Encryption) {
+		fmt.Println("WARNING: The server doesn't report this device's keys, it may be showing other users substituted keys")
+	}
+	fingerprint := userFingerprint(user)
+	fmt.Printf("Fingerprint of %s: %s\n", username, formatFingerprint(fingerprint))
+	if username == ClientUser {
+		return nil
+	}
+	fmt.Printf("Safety number with %s: %s\n", username, safetyNumber(userFingerprint(self), fingerprint))
+	fmt.Printf("%s sees the same safety number by running the verify command for %s\n", username, ClientUser)
+	knownUser, err := GetKnownUser(username)
+	if err != nil {
+		return err
+	}
+	if confirm {
+		err = PinUser(user, true)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Marked the current keys of %s as verified\n", username)
+	} else if knownUser == nil {
+		fmt.Printf("The keys of %s aren't pinned yet, run the verify command with --confirm once they match\n", username)
+	} else if knownUser.Fingerprint != fingerprint {
+		fmt.Printf("WARNING: The keys of %s have changed since %s, don't share with them until you have confirmed the new fingerprint\n",
+			username, knownUser.Pinned.Local().Format(time.RFC1123))
+	} else if knownUser.Verified {
+		fmt.Printf("The keys of %s are verified\n", username)
+	} else {
+		fmt.Printf("The keys of %s were pinned on first use, run the verify command with --confirm once they match\n", username)
+	}
+	return nil
+}
+
+// Check the key log still holds this device's keys and print the tree head to compare with other users
+func ShowTreeHead() error {
+	// Getting the user checks their keys are in the log
+	self, err := GetUser(ClientUser)
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		os.Exit(1)
+		return err
 	}
-	encodedKey, err := encrypt(ClientPublicKey, key)
+	if device := self.Device(ClientDevice); device == nil || !device.Keys.Signing.Equal(ClientPublicKeys.Signing) ||
+		!device.Keys.Encryption.Equal(ClientPublicKeys.Encryption) {
+		return errors.New("The key log doesn't hold this device's keys, someone may have changed your keys")
+	}
+	head, err := CurrentTreeHead()
+	if err != nil {
+		return err
+	}
+	token, err := head.Token()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Key log size %d, root hash %x, signed %s\n", head.TreeSize, head.RootHash, time.Unix(head.Timestamp, 0).Local().Format(time.RFC1123))
+	fmt.Println("Send this tree head to other users, they check the server shows them the same log with the gossip command:")
+	fmt.Println(token)
+	return nil
+}
+
+// Check a tree head from another user is consistent with the key log this client has seen
+func GossipWith(token string) error {
+	other, err := parseTreeHead(token)
+	if err != nil {
+		return err
+	}
+	head, err := GossipTreeHead(other)
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		os.Exit(1)
+		return err
+	}
+	fmt.Printf("The tree head of size %d is consistent with this client's key log of size %d\n", other.TreeSize, head.TreeSize)
+	return nil
+}
+
+// Upload a file to server
+// An interrupted upload is resumed when the command is run again for the same file
+func UploadFile(filepath string, owner string, filename string) error {
+	var key []byte
+	var session *UploadSession
+	// New versions of an existing file are encrypted with its current file key, so users it is shared with keep access
+	// and a file pending re-encryption after a revoke is re-encrypted
+	// Only a file the user has no key to is new, other errors mustn't give an existing file a new key
+	filekey, err := GetFileKey(owner, filename)
+	newFile := err == errNoFileAccess
+	// Writers can only upload new versions of files shared with them
+	if err != nil && (!newFile || owner != ClientUser) {
+		return err
 	}
-	filekey := NewFileKey(ClientUser, ClientUser, filename, encodedKey)
-	err = filekey.Share()
+	epoch := 0
+	if !newFile {
+		epoch = filekey.Epoch
+	}
+	pending, err := GetPendingUpload(filepath, owner, filename)
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		os.Exit(1)
+		return err
+	}
+	if pending != nil {
+		session, err = GetUploadSession(pending.Session)
+		if err == nil && session.Epoch != epoch {
+			err = errors.New("The file key changed since the upload started")
+		}
+		if err == nil {
+			key, err = lab2.Decrypt(ClientPrivateKey, pending.Key)
+		}
+		if err != nil {
+			fmt.Printf("Could not resume previous upload, starting over: %s\n", err.Error())
+			session = nil
+		} else {
+			fmt.Printf("Resuming upload, %d of %d chunks already uploaded\n", len(session.Received), session.Chunks)
+		}
+	}
+	if session == nil {
+		if newFile {
+			key, err = lab2.GenerateAESKey()
+		} else {
+			key, err = filekey.Unwrap(ClientPrivateKey, ClientDevice)
+		}
+		if err != nil {
+			return err
+		}
+		session, err = StartUpload(filepath, owner, filename, key, epoch, newFile)
+		if err != nil {
+			return err
+		}
+		encodedKey, err := lab2.Encrypt(ClientPublicKeys.Encryption, key)
+		if err != nil {
+			return err
+		}
+		err = SavePendingUpload(filepath, owner, filename, session, encodedKey)
+		if err != nil {
+			return err
+		}
+	}
+	err = session.Upload(filepath, key)
+	if err != nil {
+		return fmt.Errorf("%s\nRun the upload command again to resume", err.Error())
+	}
+	err = RemovePendingUpload(owner, filename)
+	if err != nil {
+		return err
+	}
+	if newFile {
+		user, err := GetUser(ClientUser)
+		if err != nil {
+			return err
+		}
+		filekey = lab2.NewFileKey(ClientUser, ClientUser, filename, nil)
+		err = filekey.Wrap(user, key)
+		if err != nil {
+			return err
+		}
+		err = ShareFileKey(filekey)
+		if err != nil {
+			return err
+		}
 	}
 	fmt.Println("Successfully uploaded file")
-	os.Exit(0)
+	return nil
 }
 
 // Download File and decrypt with shared key, output file to given path
-// If user doesn't have file access the program will exit with an error message
-func DownloadFile(owner string, filename string, outputPath string) {
-	file, err := GetFile(owner, filename)
-	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		os.Exit(1)
+// An earlier version is downloaded if version is set, its key is found from the current one
+// Returns an error if the user doesn't have access to the file
+func DownloadFile(owner string, filename string, outputPath string, version string) error {
+	v := 0
+	if version != "" {
+		var err error
+		v, err = strconv.Atoi(version)
+		if err != nil || v < 1 {
+			return errors.New("Version must be a positive number")
+		}
 	}
 	filekey, err := GetFileKey(owner, filename)
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		os.Exit(1)
+		return err
 	}
-	decodedKey, err := decrypt(ClientPrivateKey, filekey.Key)
+	decodedKey, err := versionKey(owner, filename, filekey, v)
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		os.Exit(1)
+		return err
 	}
-	decodedData, err := decryptAES(decodedKey, file.Data)
+	manifest, err := DownloadAndDecrypt(owner, filename, v, decodedKey, outputPath)
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		os.Exit(1)
+		return err
 	}
-	err = ioutil.WriteFile(outputPath, decodedData, 0644)
+	if manifest == nil {
+		fmt.Println("Successfully downloaded unsigned file")
+		return nil
+	}
+	fmt.Printf("Successfully downloaded version %d of file, signed by %s's device %s on %s\n", manifest.Version,
+		manifest.Signer(), manifest.Device, time.Unix(manifest.Timestamp, 0).Format(time.RFC1123))
+	return nil
+}
+
+// List the kept versions of one of the user's files
+func ListVersions(filename string) error {
+	versions, err := GetFileVersions(ClientUser, filename)
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		os.Exit(1)
+		return err
 	}
-	fmt.Println("Successfully downloaded file")
-	os.Exit(0)
+	for _, version := range versions.Versions {
+		signed := "unsigned"
+		if version.Manifest != nil {
+			signed = "signed by " + version.Manifest.Device
+			if version.Manifest.Author != "" {
+				signed = "signed by " + version.Manifest.Author + "'s device " + version.Manifest.Device
+			}
+		}
+		current := ""
+		if version.Pending {
+			current = " (current, pending re-encryption)"
+		} else if version.Current {
+			current = " (current)"
+		}
+		fmt.Printf("Version %d%s: %d bytes, uploaded %s, %s\n", version.Version, current, version.Size,
+			version.Created.Local().Format(time.RFC1123), signed)
+	}
+	return nil
 }
 
-// Share file with given users
-func ShareFile(filename string, users []string, command bool) {
-	// Get shared secret key
+// Restore an earlier version of one of the user's files by uploading it again as a new version
+// The current key is kept, so users the file is shared with can still read it
+func RestoreVersion(filename string, version string) error {
+	v, err := strconv.Atoi(version)
+	if err != nil || v < 1 {
+		return errors.New("Version must be a positive number")
+	}
 	filekey, err := GetFileKey(ClientUser, filename)
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		os.Exit(1)
+		return err
+	}
+	currentKey, err := filekey.Unwrap(ClientPrivateKey, ClientDevice)
+	if err != nil {
+		return err
+	}
+	key, err := versionKey(ClientUser, filename, filekey, v)
+	if err != nil {
+		return err
 	}
-	decodedKey, err := decrypt(ClientPrivateKey, filekey.Key)
+	tempDir, err := ioutil.TempDir("", "restore-")
+	if err != nil {
+		return err
+	}
+	tempPath := filepath.Join(tempDir, "file")
+	_, err = DownloadAndDecrypt(ClientUser, filename, v, key, tempPath)
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return err
+	}
+	err = EncryptAndUpload(tempPath, filename, currentKey, filekey.Epoch)
+	os.RemoveAll(tempDir)
+	if err != nil {
+		return err
+	}
+	file, err := GetFile(ClientUser, filename)
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		os.Exit(1)
+		return err
 	}
+	fmt.Printf("Successfully restored version %d of file as version %d\n", v, file.Version)
+	return nil
+}
+
+// Share owner's file with given users, giving them role
+// Sharing someone else's file needs the manager role, which only the owner can give out
+func ShareFile(owner string, filename string, users []string, role string, expires time.Time, command bool) error {
+	// Get shared secret key
+	filekey, err := GetFileKey(owner, filename)
+	if err != nil {
+		return err
+	}
+	decodedKey, err := filekey.Unwrap(ClientPrivateKey, ClientDevice)
+	if err != nil {
+		return err
+	}
+	// Managers pass on the owner's grant to them, so others can check they may share the file
+	managerGrant := filekey.Grant
 	// Share file access with given users
 	for _, username := range users {
 		if username == ClientUser {
@@ -171,98 +733,121 @@ func ShareFile(filename string, users []string, command bool) {
 		}
 		user, err := GetUser(username)
 		if err != nil {
-			fmt.Printf("Error: %s\n", err.Error())
-			os.Exit(1)
+			return err
+		}
+		// Refuse to encrypt to keys the server may have substituted
+		err = checkKnownUser(user)
+		if err != nil {
+			return err
 		}
 		filekey.Id = ""
 		filekey.User = username
-		encodedKey, err := encrypt(user.PubKey, decodedKey)
+		filekey.Role = role
+		filekey.Expires = expires
+		filekey.Grant, err = lab2.NewGrant(owner, filename, username, role, expires, ClientUser, ClientDevice, ClientPrivateKey, managerGrant)
+		if err != nil {
+			return err
+		}
+		err = filekey.Wrap(user, decodedKey)
 		if err != nil {
-			fmt.Printf("Error: %s\n", err.Error())
-			os.Exit(1)
+			return err
 		}
-		filekey.Key = encodedKey
-		err = filekey.Share()
+		err = ShareFileKey(filekey)
 		if err != nil {
-			fmt.Printf("Error: %s\n", err.Error())
-			os.Exit(1)
+			return err
 		}
 	}
-	// If run as terminal command exit with success message
+	// If run as terminal command print a success message
 	if command {
-		fmt.Println("Successfully shared file")
-		os.Exit(0)
+		if expires.IsZero() {
+			fmt.Println("Successfully shared file")
+		} else {
+			fmt.Printf("Successfully shared file until %s\n", expires.Local().Format(time.RFC1123))
+		}
 	}
+	return nil
 }
 
-// Revoke file access for given users
-func RevokeFile(filename string, users []string) {
-	// Get existing file and key
-	file, err := GetFile(ClientUser, filename)
+// Revoke access to owner's file for given users
+// The remaining users get a new key straight away, the file is re-encrypted with it at its next upload,
+// by the reencrypt command, or now if reencrypt is set
+// Managers can revoke the readers and writers of files shared with them
+func RevokeFile(owner string, filename string, users []string, reencrypt bool) error {
+	filekey, err := GetFileKey(owner, filename)
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		os.Exit(1)
+		return err
 	}
-	filekey, err := GetFileKey(ClientUser, filename)
+	newKey, err := lab2.GenerateAESKey()
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		os.Exit(1)
+		return err
 	}
-	decodedKey, err := decrypt(ClientPrivateKey, filekey.Key)
-	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		os.Exit(1)
+	if !reencrypt {
+		err = RotateFileKey(owner, filename, filekey, newKey, users)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Successfully revoked file, it is pending re-encryption with the new key")
+		fmt.Println("Until it is uploaded again or the reencrypt command is run, revoked users who kept the old key can still read it")
+		return nil
 	}
-	decodedData, err := decryptAES(decodedKey, file.Data)
+	// Download file to a temporary file
+	decodedKey, err := versionKey(owner, filename, filekey, 0)
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		os.Exit(1)
+		return err
 	}
-	// Create new key, re-encrypt and upload file
-	newKey, err := generateAESKey()
+	tempDir, err := ioutil.TempDir("", "revoke-")
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		os.Exit(1)
+		return err
 	}
-	encodedData, err := encryptAES(newKey, decodedData)
+	tempPath := filepath.Join(tempDir, "file")
+	_, err = DownloadAndDecrypt(owner, filename, 0, decodedKey, tempPath)
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		os.Exit(1)
+		os.RemoveAll(tempDir)
+		return err
 	}
-	file.Data = encodedData
-	err = file.Upload()
+	// Re-encrypt the file and replace it and every remaining user's key in one request
+	_, err = RekeyFile(tempPath, owner, filename, decodedKey, newKey, filekey.Epoch+1, users)
+	os.RemoveAll(tempDir)
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		os.Exit(1)
+		return err
 	}
-	encodedKey, err := encrypt(ClientPublicKey, newKey)
-	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		os.Exit(1)
+	fmt.Println("Successfully revoked file")
+	return nil
+}
+
+// Give the user's files a share of which expired a new key, the users whose shares expired may have kept the old one
+// Failures only warn, so the command the user ran still works
+func RotateExpiredShares() {
+	rotated, err := rotateExpiredShares()
+	for _, name := range rotated {
+		fmt.Printf("A share of %s expired, it has a new key and is pending re-encryption\n", name)
 	}
-	filekey.Key = encodedKey
-	err = filekey.Share()
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "Warning: couldn't give files with expired shares a new key: %s\n", err.Error())
 	}
-	// Revoke file access for given users
-	for _, user := range users {
-		filekey = NewFileKey(user, ClientUser, filename, nil)
-		err = filekey.Revoke()
+}
+
+// Re-encrypt a file pending re-encryption with its current key, or every one of the user's pending files if filename is empty
+// Can be run regularly in the background to keep revoked users from reading files they could before
+func ReencryptFiles(filename string) error {
+	names := []string{filename}
+	if filename == "" {
+		var err error
+		names, err = pendingFiles()
 		if err != nil {
-			fmt.Printf("Error: %s\n", err.Error())
-			os.Exit(1)
+			return err
+		}
+		if len(names) == 0 {
+			fmt.Println("No files are pending re-encryption")
+			return nil
 		}
 	}
-	// Get remaining file users
-	fileUsers, err := GetFileUsers(ClientUser, filename)
-	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		os.Exit(1)
+	for _, name := range names {
+		epoch, err := reencryptFile(name)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err.Error())
+		}
+		fmt.Printf("Re-encrypted %s with the file key of epoch %d\n", name, epoch)
 	}
-	// Reshare file with remaining file users
-	ShareFile(filename, fileUsers, false)
-	fmt.Println("Successfully revoked file")
-	os.Exit(0)
+	return nil
 }
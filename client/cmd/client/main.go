@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/docopt/docopt-go"
+	"github.com/kyrillzorin/CS3031_Lab2/client"
+	"github.com/kyrillzorin/CS3031_Lab2/lab2"
+)
+
+// Main function, parses cli args and runs appropriate function
+func main() {
+	usage := `CS3031 Lab2 Client.
+
+Usage:
+  client register
+  client upload <filepath> <filename> [--owner=<owner>]
+  client download <user> <filename> <outputpath> [--version=<version>]
+  client versions <filename>
+  client restore <filename> <version>
+  client share <filename> <user>... [--role=<role>] [--expires=<duration>] [--owner=<owner>]
+  client revoke <filename> <user>... [--now] [--owner=<owner>]
+  client reencrypt [<filename>]
+  client certificate
+  client passphrase
+  client agent
+  client rotate-key
+  client enroll
+  client devices
+  client approve <enrollment>
+  client remove-device <device>
+  client recovery-setup <threshold> <user>...
+  client recover
+  client recovery-requests
+  client approve-recovery <request>
+  client verify <user> [--confirm]
+  client log
+  client gossip <treehead>
+  client -h | --help
+
+Options:
+  -h --help              Show this screen.
+  --confirm              Mark the user's current keys as verified.
+  --expires=<duration>   End the share after a number of days like 7d or a duration like 12h.
+  --now                  Re-encrypt the file straight away instead of at its next upload.
+  --owner=<owner>        Change a file shared with you by owner, as a writer or manager.
+  --role=<role>          Let the users read, write or manage the file [default: reader].
+  --version=<version>    Download an earlier version of the file.`
+
+	args, _ := docopt.Parse(usage, nil, true, "", false)
+	err := client.LoadConfig()
+	if err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	// Files a share of which expired get a new key the next time their owner works with files
+	for _, command := range []string{"upload", "download", "versions", "restore", "share", "revoke", "reencrypt"} {
+		if args[command].(bool) == true {
+			client.RotateExpiredShares()
+			break
+		}
+	}
+	if args["register"].(bool) == true {
+		err = client.Register()
+	} else if args["upload"].(bool) == true {
+		err = client.UploadFile(args["<filepath>"].(string), fileOwner(args), args["<filename>"].(string))
+	} else if args["download"].(bool) == true {
+		version, _ := args["--version"].(string)
+		err = client.DownloadFile(args["<user>"].([]string)[0], args["<filename>"].(string), args["<outputpath>"].(string), version)
+	} else if args["versions"].(bool) == true {
+		err = client.ListVersions(args["<filename>"].(string))
+	} else if args["restore"].(bool) == true {
+		err = client.RestoreVersion(args["<filename>"].(string), args["<version>"].(string))
+	} else if args["share"].(bool) == true {
+		expires := time.Time{}
+		if expiry, ok := args["--expires"].(string); ok {
+			expires, err = lab2.ParseExpiry(expiry)
+			if err != nil {
+				fmt.Printf("Error: %s\n", err.Error())
+				os.Exit(1)
+			}
+		}
+		err = client.ShareFile(fileOwner(args), args["<filename>"].(string), args["<user>"].([]string), args["--role"].(string), expires, true)
+	} else if args["revoke"].(bool) == true {
+		err = client.RevokeFile(fileOwner(args), args["<filename>"].(string), args["<user>"].([]string), args["--now"].(bool))
+	} else if args["reencrypt"].(bool) == true {
+		filename, _ := args["<filename>"].(string)
+		err = client.ReencryptFiles(filename)
+	} else if args["certificate"].(bool) == true {
+		err = client.GenerateCertificate()
+	} else if args["passphrase"].(bool) == true {
+		err = client.ChangePassphrase()
+	} else if args["agent"].(bool) == true {
+		err = client.StartAgent()
+	} else if args["rotate-key"].(bool) == true {
+		err = client.RotateKey()
+	} else if args["enroll"].(bool) == true {
+		err = client.EnrollDevice()
+	} else if args["devices"].(bool) == true {
+		err = client.ListDevices()
+	} else if args["approve"].(bool) == true {
+		err = client.ApproveDevice(args["<enrollment>"].(string))
+	} else if args["remove-device"].(bool) == true {
+		err = client.RemoveDevice(args["<device>"].(string))
+	} else if args["recovery-setup"].(bool) == true {
+		err = client.SetupRecovery(args["<threshold>"].(string), args["<user>"].([]string))
+	} else if args["recover"].(bool) == true {
+		err = client.Recover()
+	} else if args["recovery-requests"].(bool) == true {
+		err = client.ListRecoveryRequests()
+	} else if args["approve-recovery"].(bool) == true {
+		err = client.ApproveRecovery(args["<request>"].(string))
+	} else if args["verify"].(bool) == true {
+		err = client.VerifyUser(args["<user>"].([]string)[0], args["--confirm"].(bool))
+	} else if args["log"].(bool) == true {
+		err = client.ShowTreeHead()
+	} else if args["gossip"].(bool) == true {
+		err = client.GossipWith(args["<treehead>"].(string))
+	}
+	if err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// Owner of the file a command changes, the user unless --owner is set
+func fileOwner(args map[string]interface{}) string {
+	if owner, ok := args["--owner"].(string); ok {
+		return owner
+	}
+	return client.ClientUser
+}
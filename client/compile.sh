@@ -1,2 +1,2 @@
 #! /bin/bash
-go build -o client
+go build -o client ./cmd/client
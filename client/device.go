@@ -0,0 +1,221 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kyrillzorin/CS3031_Lab2/lab2"
+)
+
+// Device Enrollment Struct, a new device asking to be added to the user
+// Signature is made with the new device's signing key, proving it holds the key
+type Enrollment struct {
+	Id        string
+	Username  string
+	Device    string
+	Keys      KeySet
+	Signature []byte
+	Expires   time.Time
+}
+
+// Data covered by the enrollment signature, must match the server's
+type enrollmentData struct {
+	Username string
+	Device   string
+	Keys     KeySet
+}
+
+// Device Approval Struct, carries the user's file keys re-encrypted for the new set of devices
+type DeviceApproval struct {
+	Username   string
+	Enrollment string
+	FileKeys   []FileKey
+}
+
+// Device Removal Struct, carries the user's file keys re-encrypted for the remaining devices only
+// and the manifests and grants the removed device signed, signed again by this device
+type DeviceRemoval struct {
+	Username  string
+	Device    string
+	FileKeys  []FileKey
+	Manifests []Manifest
+	Grants    []Grant
+}
+
+// User's Devices Struct, with the enrollments waiting for approval
+type UserDevices struct {
+	Devices []Device
+	Pending []Enrollment
+}
+
+// Short fingerprint of a key set, compared between devices before approving an enrollment
+func fingerprint(keys KeySet) string {
+	sum := sha256.Sum256(append(append([]byte(nil), keys.Signing.Key...), keys.Encryption.Key...))
+	pairs := make([]string, 0, 8)
+	for i := 0; i < 16; i += 2 {
+		pairs = append(pairs, hex.EncodeToString(sum[i:i+2]))
+	}
+	return strings.Join(pairs, ":")
+}
+
+// Create an enrollment for a device holding key, signed with the key
+func NewEnrollment(device string, key PrivateKey) (*Enrollment, error) {
+	e := &Enrollment{Username: ClientUser, Device: device, Keys: key.PublicKeys()}
+	data, err := json.Marshal(enrollmentData{e.Username, e.Device, e.Keys})
+	if err != nil {
+		return nil, err
+	}
+	e.Signature, err = lab2.Sign(key, data)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Send an enrollment to server, which fills in its Id
+func (e *Enrollment) Submit() error {
+	b := new(bytes.Buffer)
+	json.NewEncoder(b).Encode(e)
+	res, err := http.Post(Server+"/enroll", "application/json; charset=utf-8", b)
+	if res == nil {
+		if err == nil {
+			err = errors.New("Empty Response")
+		}
+		return err
+	}
+	if res.Body == nil {
+		return errors.New("Empty Response")
+	}
+	defer res.Body.Close()
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	var response Response
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&response)
+	if err != nil {
+		return err
+	}
+	if response.Status == "failure" {
+		return errors.New(response.Error)
+	}
+	return json.NewDecoder(bytes.NewReader(body)).Decode(e)
+}
+
+// Get the user's devices and pending enrollments from server
+func GetDevices() (devices *UserDevices, err error) {
+	res, err := AuthenticatedGet("/devices")
+	if res == nil {
+		if err == nil {
+			err = errors.New("Empty Response")
+		}
+		return
+	}
+	if res.Body == nil {
+		err = errors.New("Empty Response")
+		return
+	}
+	defer res.Body.Close()
+	if err != nil {
+		return
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return
+	}
+	var response Response
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&response)
+	if err != nil {
+		return
+	}
+	if response.Status == "failure" {
+		err = errors.New(response.Error)
+		return
+	}
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&devices)
+	return
+}
+
+// Re-encrypt every file key shared with the user for each of user's devices
+func rewrapFileKeys(user *User) ([]FileKey, error) {
+	filekeys, err := GetUserFileKeys()
+	if err != nil {
+		return nil, err
+	}
+	for i := range filekeys {
+		key, err := filekeys[i].Unwrap(ClientPrivateKey, ClientDevice)
+		if err != nil {
+			return nil, err
+		}
+		err = filekeys[i].Wrap(user, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return filekeys, nil
+}
+
+// Create an approval adding an enrolled device, re-encrypting every file key for it
+func NewDeviceApproval(enrollment Enrollment) (*DeviceApproval, error) {
+	user, err := GetUser(ClientUser)
+	if err != nil {
+		return nil, err
+	}
+	user.Devices = append(user.Devices, Device{Name: enrollment.Device, Keys: enrollment.Keys})
+	filekeys, err := rewrapFileKeys(user)
+	if err != nil {
+		return nil, err
+	}
+	return &DeviceApproval{ClientUser, enrollment.Id, filekeys}, nil
+}
+
+// Send a device approval to server, always signed with this device's key
+func (a *DeviceApproval) Approve() error {
+	return postSigned("/approvedevice", a, nil)
+}
+
+// Create a removal of one of the user's devices, re-encrypting every file key for the remaining devices
+func NewDeviceRemoval(name string) (*DeviceRemoval, error) {
+	user, err := GetUser(ClientUser)
+	if err != nil {
+		return nil, err
+	}
+	if user.Device(name) == nil {
+		return nil, errors.New("Device does not exist")
+	}
+	manifests, err := resignManifests(user, name, ClientPrivateKey, ClientDevice)
+	if err != nil {
+		return nil, err
+	}
+	grants, err := resignGrants(user, name, ClientPrivateKey, ClientDevice)
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]Device, 0, len(user.Devices))
+	for _, device := range user.Devices {
+		if device.Name != name {
+			devices = append(devices, device)
+		}
+	}
+	user.Devices = devices
+	filekeys, err := rewrapFileKeys(user)
+	if err != nil {
+		return nil, err
+	}
+	return &DeviceRemoval{ClientUser, name, filekeys, manifests, grants}, nil
+}
+
+// Send a device removal to server, always signed with this device's key
+func (r *DeviceRemoval) Remove() error {
+	return postSigned("/removedevice", r, nil)
+}
@@ -0,0 +1,39 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/kyrillzorin/CS3031_Lab2/lab2"
+)
+
+// Epoch Key Struct, the shared secret of the epoch before Epoch encrypted with Epoch's secret
+type EpochKey struct {
+	Epoch int
+	Key   []byte
+}
+
+// Get the shared secret a file's data is encrypted with from the secret of a file key of the given epoch
+// After a revoke the file keys are ahead of the data until it is re-encrypted,
+// so each older epoch's secret is decrypted from the next one's in turn
+func dataKey(file *File, epoch int, key []byte) ([]byte, error) {
+	if epoch < file.Epoch {
+		return nil, fmt.Errorf("Your key to %s is older than the file, ask its owner to share it again", file.Name)
+	}
+	for e := epoch; e > file.Epoch; e-- {
+		var encodedKey []byte
+		for _, epochKey := range file.EpochKeys {
+			if epochKey.Epoch == e {
+				encodedKey = epochKey.Key
+			}
+		}
+		if encodedKey == nil {
+			return nil, fmt.Errorf("The key of epoch %d of %s is missing", e-1, file.Name)
+		}
+		var err error
+		key, err = lab2.DecryptAES(key, encodedKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
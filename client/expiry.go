@@ -0,0 +1,77 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+
+	"github.com/kyrillzorin/CS3031_Lab2/lab2"
+)
+
+// Files Needing Rekey Struct, the user's files that had a share expire since their key last changed
+type RekeyFiles struct {
+	Names []string
+}
+
+// Get the names of the user's files that need a new key because a share of them expired
+func GetRekeyFiles() (names []string, err error) {
+	res, err := AuthenticatedGet("/rekeys")
+	if res == nil {
+		if err == nil {
+			err = errors.New("Empty Response")
+		}
+		return
+	}
+	if res.Body == nil {
+		err = errors.New("Empty Response")
+		return
+	}
+	defer res.Body.Close()
+	if err != nil {
+		return
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return
+	}
+	var response Response
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&response)
+	if err != nil {
+		return
+	}
+	if response.Status == "failure" {
+		err = errors.New(response.Error)
+		return
+	}
+	var rekeyFiles RekeyFiles
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&rekeyFiles)
+	names = rekeyFiles.Names
+	return
+}
+
+// Give each of the user's files a share of which expired a new key, so the users whose shares expired
+// can't read new versions with the secret they kept. Returns the names of the files given a new key
+func rotateExpiredShares() ([]string, error) {
+	names, err := GetRekeyFiles()
+	if err != nil {
+		return nil, err
+	}
+	rotated := make([]string, 0, len(names))
+	for _, name := range names {
+		filekey, err := GetFileKey(ClientUser, name)
+		if err != nil {
+			return rotated, err
+		}
+		newKey, err := lab2.GenerateAESKey()
+		if err != nil {
+			return rotated, err
+		}
+		err = RotateFileKey(ClientUser, name, filekey, newKey, nil)
+		if err != nil {
+			return rotated, err
+		}
+		rotated = append(rotated, name)
+	}
+	return rotated, nil
+}
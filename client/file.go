@@ -1,19 +1,60 @@
-package main
+package client
 
 import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/kyrillzorin/CS3031_Lab2/lab2"
 )
 
 // File Struct
+// Chunked files keep their stream header here and their data in the chunks
+// of the upload that created them, files uploaded in a single request keep
+// their data here and have no chunks
+// Manifest is the owner's signature over this version, files uploaded before manifests have none
+// PreviousKey is the previous version's shared secret encrypted with this version's
+// Epoch is the key epoch the data is encrypted under and KeyEpoch the epoch of the file keys,
+// which is ahead while the file is Pending re-encryption after a revoke
+// Format is set by the server, formatLegacy for files it has kept since before the envelope
 type File struct {
-	Id    string
-	Owner string
-	Name  string
-	Data  []byte
+	Id          string
+	Owner       string
+	Name        string
+	Data        []byte
+	Header      []byte
+	Chunks      int
+	Session     string
+	Manifest    *Manifest
+	Version     int
+	Size        int64
+	Created     time.Time
+	PreviousKey []byte
+	Epoch       int
+	KeyEpoch    int
+	EpochKeys   []EpochKey
+	Pending     bool
+	Format      int
+}
+
+// Format of files stored before the ciphertext envelope, which may be AES-CFB
+const formatLegacy = 0
+
+// File Chunk Struct, one encrypted segment of a chunked file
+type FileChunk struct {
+	Id      string
+	Owner   string
+	Name    string
+	Session string
+	Index   int
+	Data    []byte
 }
 
 // File Users Struct
@@ -37,15 +78,18 @@ func (f *File) Upload() error {
 		return err
 	}
 	// Sign the request
-	signature, err := sign(ClientPrivateKey, message)
+	signedRequest, err := NewSignedRequest("/uploadfile", message)
 	if err != nil {
 		return err
 	}
 	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(SignedRequest{message, signature})
+	json.NewEncoder(b).Encode(signedRequest)
 	res, err := http.Post(Server+"/uploadfile", "application/json; charset=utf-8", b)
 	if res == nil {
-		return errors.New("Empty Response")
+		if err == nil {
+			err = errors.New("Empty Response")
+		}
+		return err
 	}
 	if res.Body == nil {
 		return errors.New("Empty Response")
@@ -65,13 +109,180 @@ func (f *File) Upload() error {
 	return err
 }
 
-// Get file from server
-func GetFile(owner string, filename string) (file *File, err error) {
-	res, err := http.Get(Server + "/users/" + owner + "/" + filename)
+// Upload a file chunk to server, returns the server's response so callers can tell
+// a rejected chunk from one that never reached the server
+func (c *FileChunk) upload() (response Response, err error) {
+	message, err := json.Marshal(c)
+	if err != nil {
+		return
+	}
+	// Chunks are authenticated with the session token, signing each one would be slow
+	res, err := AuthenticatedPost("/uploadchunk", message)
 	if res == nil {
+		if err == nil {
+			err = errors.New("Empty Response")
+		}
+		return
+	}
+	if res.Body == nil {
 		err = errors.New("Empty Response")
 		return
 	}
+	defer res.Body.Close()
+	if err != nil {
+		return
+	}
+	err = json.NewDecoder(res.Body).Decode(&response)
+	if err != nil {
+		return
+	}
+	if response.Status != "success" {
+		err = errors.New(response.Error)
+	}
+	return
+}
+
+// Get file chunk of a version of a file from server, version 0 is the current version
+func GetFileChunk(owner string, filename string, version int, index int) (chunk *FileChunk, err error) {
+	res, err := AuthenticatedGet("/users/" + owner + "/" + filename + "/chunks/" + strconv.Itoa(index) + versionQuery(version))
+	if res == nil {
+		if err == nil {
+			err = errors.New("Empty Response")
+		}
+		return
+	}
+	if res.Body == nil {
+		err = errors.New("Empty Response")
+		return
+	}
+	defer res.Body.Close()
+	if err != nil {
+		return
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return
+	}
+	var response Response
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&response)
+	if err != nil {
+		return
+	}
+	if response.Status == "failure" {
+		err = errors.New(response.Error)
+		return
+	}
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&chunk)
+	return
+}
+
+// Encrypt a local file chunk by chunk with key, the file key of the given epoch, and upload it to server
+// The file only becomes visible once all of its chunks are on the server
+func EncryptAndUpload(inputPath string, filename string, key []byte, epoch int) error {
+	session, err := StartUpload(inputPath, ClientUser, filename, key, epoch, false)
+	if err != nil {
+		return err
+	}
+	return session.Upload(inputPath, key)
+}
+
+// Download a version of a file from server and decrypt it with key to outputPath, returns the owner's manifest
+// or nil for a file uploaded before manifests
+// Version 0 is the current version, which must not be older than the last version seen
+// Data is written to a temporary file first so a failed download leaves no partial output,
+// and the file is only kept if it matches the manifest's hash
+func DownloadAndDecrypt(owner string, filename string, version int, key []byte, outputPath string) (*Manifest, error) {
+	file, err := GetFileVersion(owner, filename, version)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyManifest(file)
+	if err != nil {
+		return nil, err
+	}
+	if file.Manifest != nil && version == 0 {
+		err = checkSeenVersion(file.Manifest)
+	} else if file.Manifest != nil && file.Manifest.Version != version {
+		err = fmt.Errorf("WARNING: The server gave version %d of %s instead of version %d", file.Manifest.Version, filename, version)
+	}
+	if err != nil {
+		return nil, err
+	}
+	output, err := ioutil.TempFile(filepath.Dir(outputPath), ".download-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(output.Name())
+	defer output.Close()
+	hasher := lab2.NewFileHasher(file.Header)
+	if file.Chunks == 0 {
+		// File uploaded in a single request
+		hasher.Add(file.Data)
+		decrypt := lab2.DecryptAES
+		if file.Format == formatLegacy && file.Manifest == nil {
+			// Only unsigned files the server has kept since before the envelope may be AES-CFB
+			decrypt = lab2.DecryptLegacyAES
+		}
+		decodedData, err := decrypt(key, file.Data)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = output.Write(decodedData); err != nil {
+			return nil, err
+		}
+	} else {
+		stream, err := lab2.NewStreamDecrypter(key, file.Header)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < file.Chunks; i++ {
+			chunk, err := GetFileChunk(owner, filename, version, i)
+			if err != nil {
+				return nil, err
+			}
+			hasher.Add(chunk.Data)
+			decodedData, err := stream.Open(chunk.Data, i == file.Chunks-1)
+			if err != nil {
+				return nil, err
+			}
+			if _, err = output.Write(decodedData); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if file.Manifest != nil && !bytes.Equal(hasher.Sum(nil), file.Manifest.Hash) {
+		return nil, errors.New("WARNING: The file doesn't match its owner's signature, the server may have changed it")
+	}
+	if err = output.Chmod(0644); err != nil {
+		return nil, err
+	}
+	if err = output.Close(); err != nil {
+		return nil, err
+	}
+	err = os.Rename(output.Name(), outputPath)
+	if err != nil {
+		return nil, err
+	}
+	if version != 0 || file.Manifest == nil {
+		return file.Manifest, nil
+	}
+	return file.Manifest, RecordVersion(file.Manifest)
+}
+
+// Get the current version of a file from server
+func GetFile(owner string, filename string) (*File, error) {
+	return GetFileVersion(owner, filename, 0)
+}
+
+// Get a version of a file from server, version 0 is the current version
+func GetFileVersion(owner string, filename string, version int) (file *File, err error) {
+	res, err := AuthenticatedGet("/users/" + owner + "/" + filename + versionQuery(version))
+	if res == nil {
+		if err == nil {
+			err = errors.New("Empty Response")
+		}
+		return
+	}
 	if res.Body == nil {
 		err = errors.New("Empty Response")
 		return
@@ -99,9 +310,11 @@ func GetFile(owner string, filename string) (file *File, err error) {
 
 // Get list of users who have access to file from server
 func GetFileUsers(owner string, filename string) (users []string, err error) {
-	res, err := http.Get(Server + "/users/" + owner + "/" + filename + "/users")
+	res, err := AuthenticatedGet("/users/" + owner + "/" + filename + "/users")
 	if res == nil {
-		err = errors.New("Empty Response")
+		if err == nil {
+			err = errors.New("Empty Response")
+		}
 		return
 	}
 	if res.Body == nil {
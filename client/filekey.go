@@ -1,4 +1,4 @@
-package main
+package client
 
 import (
 	"bytes"
@@ -6,79 +6,36 @@ import (
 	"errors"
 	"io/ioutil"
 	"net/http"
+
+	"github.com/kyrillzorin/CS3031_Lab2/lab2"
 )
 
-// File Key Struct
-type FileKey struct {
-	Id    string
-	User  string
-	Owner string
-	Name  string
-	Key   []byte
-}
+// File Key Struct, see lab2
+type FileKey = lab2.FileKey
 
-// Create New File Key
-func NewFileKey(user string, owner string, name string, key []byte) *FileKey {
-	f := new(FileKey)
-	f.User = user
-	f.Owner = owner
-	f.Name = name
-	f.Key = key
-	return f
-}
+// The server's error for a file the user has no key to, which for the owner means the file doesn't exist yet
+var errNoFileAccess = errors.New("You do not have access to this file")
 
 // Share a file key on server
-func (f *FileKey) Share() error {
+func ShareFileKey(f *FileKey) error {
 	message, err := json.Marshal(f)
 	if err != nil {
 		return err
 	}
 	// Sign the request
-	signature, err := sign(ClientPrivateKey, message)
+	signedRequest, err := NewSignedRequest("/sharefile", message)
 	if err != nil {
 		return err
 	}
 	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(SignedRequest{message, signature})
+	json.NewEncoder(b).Encode(signedRequest)
 	res, err := http.Post(Server+"/sharefile", "application/json; charset=utf-8", b)
 	if res == nil {
-		return errors.New("Empty Response")
-	}
-	if res.Body == nil {
-		return errors.New("Empty Response")
-	}
-	defer res.Body.Close()
-	if err != nil {
-		return err
-	}
-	var response Response
-	err = json.NewDecoder(res.Body).Decode(&response)
-	if err != nil {
-		return err
-	}
-	if response.Status != "success" {
-		return errors.New(response.Error)
-	}
-	return err
-}
-
-// Revoke a file key on server
-func (f *FileKey) Revoke() error {
-	message, err := json.Marshal(f)
-	if err != nil {
+		if err == nil {
+			err = errors.New("Empty Response")
+		}
 		return err
 	}
-	// Sign the request
-	signature, err := sign(ClientPrivateKey, message)
-	if err != nil {
-		return err
-	}
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(SignedRequest{message, signature})
-	res, err := http.Post(Server+"/revokefile", "application/json; charset=utf-8", b)
-	if res == nil {
-		return errors.New("Empty Response")
-	}
 	if res.Body == nil {
 		return errors.New("Empty Response")
 	}
@@ -99,9 +56,11 @@ func (f *FileKey) Revoke() error {
 
 // Get a file key from server
 func GetFileKey(owner string, filename string) (filekey *FileKey, err error) {
-	res, err := http.Get(Server + "/users/" + owner + "/" + filename + "/key/" + ClientUser)
+	res, err := AuthenticatedGet("/users/" + owner + "/" + filename + "/key/" + ClientUser)
 	if res == nil {
-		err = errors.New("Empty Response")
+		if err == nil {
+			err = errors.New("Empty Response")
+		}
 		return
 	}
 	if res.Body == nil {
@@ -123,6 +82,9 @@ func GetFileKey(owner string, filename string) (filekey *FileKey, err error) {
 	}
 	if response.Status == "failure" {
 		err = errors.New(response.Error)
+		if response.Error == errNoFileAccess.Error() {
+			err = errNoFileAccess
+		}
 		return
 	}
 	err = json.NewDecoder(bytes.NewReader(body)).Decode(&filekey)
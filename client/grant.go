@@ -0,0 +1,54 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+
+	"github.com/kyrillzorin/CS3031_Lab2/lab2"
+)
+
+// Grant Struct, see lab2
+type Grant = lab2.Grant
+
+// User's Grants Struct
+type UserGrants struct {
+	Grants []Grant
+}
+
+// Get the grants the user signed on the files they have a key to from server, without the grants of their managers
+func GetUserGrants() (grants []Grant, err error) {
+	res, err := AuthenticatedGet("/grants")
+	if res == nil {
+		if err == nil {
+			err = errors.New("Empty Response")
+		}
+		return
+	}
+	if res.Body == nil {
+		err = errors.New("Empty Response")
+		return
+	}
+	defer res.Body.Close()
+	if err != nil {
+		return
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return
+	}
+	var response Response
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&response)
+	if err != nil {
+		return
+	}
+	if response.Status == "failure" {
+		err = errors.New(response.Error)
+		return
+	}
+	var userGrants UserGrants
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&userGrants)
+	grants = userGrants.Grants
+	return
+}
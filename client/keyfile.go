@@ -0,0 +1,86 @@
+package client
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/kyrillzorin/CS3031_Lab2/lab2"
+	"golang.org/x/term"
+)
+
+// File the user's private key is stored in
+const privateKeyFile = "./priv.pem"
+
+// Environment variables a passphrase can be read from instead of prompting
+const (
+	passphraseEnv    = "LAB2_PASSPHRASE"
+	newPassphraseEnv = "LAB2_NEW_PASSPHRASE"
+)
+
+// Save a private key encrypted under a passphrase to path
+// The file is replaced atomically so an interrupted write can't lose the key
+func savePrivateKey(path string, privateKey PrivateKey, passphrase []byte) error {
+	block, err := lab2.EncryptPrivateKey(privateKey, passphrase)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = pem.Encode(tmp, block)
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Read a passphrase from an environment variable, or prompt for it on the terminal
+func readPassphrase(env string, prompt string) ([]byte, error) {
+	if passphrase := os.Getenv(env); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, fmt.Errorf("No terminal to read the passphrase from, set %s", env)
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	return passphrase, nil
+}
+
+// Read a new passphrase, asking twice when prompting so a typo doesn't lock the user out
+func readNewPassphrase(env string) ([]byte, error) {
+	if passphrase := os.Getenv(env); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	passphrase, err := readPassphrase(env, "New passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("Passphrase can't be empty")
+	}
+	confirm, err := readPassphrase(env, "Repeat new passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if string(confirm) != string(passphrase) {
+		return nil, errors.New("Passphrases don't match")
+	}
+	return passphrase, nil
+}
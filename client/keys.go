@@ -0,0 +1,10 @@
+package client
+
+import "github.com/kyrillzorin/CS3031_Lab2/lab2"
+
+// Key types, see lab2
+type (
+	PublicKey  = lab2.PublicKey
+	KeySet     = lab2.KeySet
+	PrivateKey = lab2.PrivateKey
+)
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// File the key fingerprints of other users are pinned in
+const knownUsersFile = "./known_users.json"
+
+// Known User Struct, the pinned fingerprint of a user's keys
+// Verified is set once the fingerprint has been confirmed out of band with the verify command
+type KnownUser struct {
+	Fingerprint string
+	Verified    bool
+	Pinned      time.Time
+}
+
+// Key fingerprint of all of a user's devices, changes whenever any of their keys do
+func userFingerprint(user *User) string {
+	devices := user.Devices
+	if len(devices) == 0 {
+		devices = []Device{{Keys: user.Keys}}
+	}
+	type deviceKeys struct {
+		Name string
+		Keys KeySet
+	}
+	keys := make([]deviceKeys, 0, len(devices))
+	for _, device := range devices {
+		keys = append(keys, deviceKeys{device.Name, device.Keys})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+	data, _ := json.Marshal(keys)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Format a hex fingerprint in groups of four for reading aloud
+func formatFingerprint(fingerprint string) string {
+	groups := make([]string, 0, len(fingerprint)/4)
+	for i := 0; i+4 <= len(fingerprint); i += 4 {
+		groups = append(groups, fingerprint[i:i+4])
+	}
+	return strings.Join(groups, ":")
+}
+
+// Safety number of two users' fingerprints, the same whichever of them computes it
+func safetyNumber(fingerprint string, other string) string {
+	if other < fingerprint {
+		fingerprint, other = other, fingerprint
+	}
+	sum := sha512.Sum512([]byte(fingerprint + other))
+	groups := make([]string, 0, 12)
+	for i := 0; i < 12; i++ {
+		chunk := make([]byte, 8)
+		copy(chunk[3:], sum[i*5:i*5+5])
+		groups = append(groups, fmt.Sprintf("%05d", binary.BigEndian.Uint64(chunk)%100000))
+	}
+	return strings.Join(groups, " ")
+}
+
+// Load the pinned users
+func loadKnownUsers() (map[string]KnownUser, error) {
+	known := make(map[string]KnownUser)
+	data, err := ioutil.ReadFile(knownUsersFile)
+	if os.IsNotExist(err) {
+		return known, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &known)
+	return known, err
+}
+
+// Save the pinned users
+func saveKnownUsers(known map[string]KnownUser) error {
+	data, err := json.MarshalIndent(known, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(knownUsersFile, data, 0600)
+}
+
+// Get the pinned fingerprint of a user, nil if the user isn't known yet
+func GetKnownUser(username string) (*KnownUser, error) {
+	known, err := loadKnownUsers()
+	if err != nil {
+		return nil, err
+	}
+	knownUser, ok := known[username]
+	if !ok {
+		return nil, nil
+	}
+	return &knownUser, nil
+}
+
+// Pin a user's current fingerprint
+func PinUser(user *User, verified bool) error {
+	known, err := loadKnownUsers()
+	if err != nil {
+		return err
+	}
+	known[user.Username] = KnownUser{userFingerprint(user), verified, time.Now()}
+	return saveKnownUsers(known)
+}
+
+// Check a user's keys match their pinned fingerprint before encrypting anything to them
+// A user seen for the first time is pinned, trusting the server this once
+func checkKnownUser(user *User) error {
+	knownUser, err := GetKnownUser(user.Username)
+	if err != nil {
+		return err
+	}
+	if knownUser == nil {
+		fmt.Fprintf(os.Stderr, "Pinned the keys of %s on first use, compare fingerprints with the verify command\n", user.Username)
+		return PinUser(user, false)
+	}
+	if knownUser.Fingerprint != userFingerprint(user) {
+		return fmt.Errorf("WARNING: The keys of %s have changed since %s, the server may be trying to read your files.\n"+
+			"Confirm the new fingerprint with %s out of band and run the verify command with --confirm before sharing with them",
+			user.Username, knownUser.Pinned.Local().Format(time.RFC1123), user.Username)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kyrillzorin/CS3031_Lab2/lab2"
+)
+
+// User with a new key on one device
+func newTestUser(t *testing.T, username string) *User {
+	return lab2.NewUser(username, "laptop", newTestKey(t, lab2.AlgorithmEd25519).PublicKeys())
+}
+
+func TestUserFingerprint(t *testing.T) {
+	bob := newTestUser(t, "bob")
+	fingerprint := userFingerprint(bob)
+	if !regexp.MustCompile("^[0-9a-f]{64}$").MatchString(fingerprint) {
+		t.Fatalf("fingerprint = %q", fingerprint)
+	}
+	formatted := formatFingerprint(fingerprint)
+	if len(strings.Split(formatted, ":")) != 16 || strings.Replace(formatted, ":", "", -1) != fingerprint {
+		t.Errorf("formatted fingerprint = %q", formatted)
+	}
+
+	// Adding a device changes the fingerprint, the order devices are listed in and when they were added don't
+	phone := Device{Name: "phone", Keys: newTestKey(t, lab2.AlgorithmRSA).PublicKeys(), Added: time.Now()}
+	twoDevices := *bob
+	twoDevices.Devices = append([]Device{phone}, bob.Devices...)
+	reordered := *bob
+	reordered.Devices = append(append([]Device{}, bob.Devices...), phone)
+	reordered.Devices[1].Added = time.Now().Add(time.Hour)
+	if userFingerprint(&twoDevices) == fingerprint {
+		t.Error("fingerprint didn't change with a new device")
+	}
+	if userFingerprint(&twoDevices) != userFingerprint(&reordered) {
+		t.Error("fingerprint depends on the order of devices")
+	}
+	rotated := *bob
+	rotated.Devices = []Device{{Name: "laptop", Keys: newTestKey(t, lab2.AlgorithmEd25519).PublicKeys()}}
+	if userFingerprint(&rotated) == fingerprint {
+		t.Error("fingerprint didn't change with a new key")
+	}
+	// Users registered before devices have only their keys
+	legacy := &User{Username: "bob", Keys: bob.Keys}
+	if userFingerprint(legacy) == "" || userFingerprint(legacy) == fingerprint {
+		t.Errorf("fingerprint of a user without devices = %q", userFingerprint(legacy))
+	}
+}
+
+func TestSafetyNumber(t *testing.T) {
+	zeros, fs := strings.Repeat("0", 64), strings.Repeat("f", 64)
+	want := "75915 31676 33130 41367 03716 35580 30710 03272 93347 37328 27288 60671"
+	if got := safetyNumber(zeros, fs); got != want {
+		t.Errorf("safety number = %q, want %q", got, want)
+	}
+	if got := safetyNumber(fs, zeros); got != want {
+		t.Errorf("safety number the other way round = %q, want %q", got, want)
+	}
+	if safetyNumber(zeros, strings.Repeat("e", 64)) == want {
+		t.Error("safety number didn't change with the fingerprint")
+	}
+}
+
+func TestKnownUsers(t *testing.T) {
+	chdirTemp(t)
+	bob := newTestUser(t, "bob")
+	if known, err := GetKnownUser("bob"); err != nil || known != nil {
+		t.Fatalf("unknown user = %+v %v", known, err)
+	}
+
+	// The first use pins the user's fingerprint, unverified
+	if err := checkKnownUser(bob); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	data, err := ioutil.ReadFile(knownUsersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pinned map[string]KnownUser
+	if err := json.Unmarshal(data, &pinned); err != nil {
+		t.Fatal(err)
+	}
+	if known := pinned["bob"]; known.Fingerprint != userFingerprint(bob) || known.Verified || known.Pinned.IsZero() {
+		t.Errorf("pinned on first use = %+v", known)
+	}
+	if info, err := os.Stat(knownUsersFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("%s mode = %v %v", knownUsersFile, info.Mode(), err)
+	}
+	if err := checkKnownUser(bob); err != nil {
+		t.Errorf("same keys: %v", err)
+	}
+
+	// Changed keys are refused and the old fingerprint stays pinned
+	changed := newTestUser(t, "bob")
+	err = checkKnownUser(changed)
+	if err == nil || !strings.Contains(err.Error(), "The keys of bob have changed") {
+		t.Errorf("changed keys: %v", err)
+	}
+	if known, err := GetKnownUser("bob"); err != nil || known.Fingerprint != userFingerprint(bob) {
+		t.Errorf("pin after changed keys = %+v %v", known, err)
+	}
+
+	// Confirming the new fingerprint with the verify command pins it as verified
+	if err := PinUser(changed, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkKnownUser(changed); err != nil {
+		t.Errorf("confirmed keys: %v", err)
+	}
+	if err := checkKnownUser(bob); err == nil {
+		t.Error("old keys accepted after confirming new ones")
+	}
+	if known, err := GetKnownUser("bob"); err != nil || !known.Verified || known.Fingerprint != userFingerprint(changed) {
+		t.Errorf("confirmed pin = %+v %v", known, err)
+	}
+
+	// Other users are pinned separately
+	if err := checkKnownUser(newTestUser(t, "carol")); err != nil {
+		t.Errorf("first use of another user: %v", err)
+	}
+	if known, err := GetKnownUser("bob"); err != nil || known.Fingerprint != userFingerprint(changed) {
+		t.Errorf("pin after pinning another user = %+v %v", known, err)
+	}
+}
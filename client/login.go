@@ -0,0 +1,194 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/kyrillzorin/CS3031_Lab2/lab2"
+)
+
+// File where the session token is cached between runs
+const tokenFile = "./token.json"
+
+// Tokens this close to expiring are replaced instead of used
+const tokenMargin = time.Minute
+
+// Login Challenge Struct
+type Challenge struct {
+	Username  string
+	Challenge []byte
+}
+
+// Login Request Struct
+type LoginRequest struct {
+	Username  string
+	Challenge []byte
+	Signature []byte
+}
+
+// Session Token Struct, Server records which server issued it
+type Token struct {
+	Username string
+	Server   string
+	Token    string
+	Expires  time.Time
+}
+
+// Data covered by a login signature, must match the server's
+type loginData struct {
+	Username  string
+	Challenge []byte
+}
+
+// Log in to server by signing a challenge, returns a new session token
+func Login() (*Token, error) {
+	message, err := json.Marshal(Challenge{Username: ClientUser})
+	if err != nil {
+		return nil, err
+	}
+	var challenge Challenge
+	err = postJSON("/challenge", message, &challenge)
+	if err != nil {
+		return nil, err
+	}
+	// Sign the challenge
+	data, err := json.Marshal(loginData{ClientUser, challenge.Challenge})
+	if err != nil {
+		return nil, err
+	}
+	signature, err := lab2.Sign(ClientPrivateKey, data)
+	if err != nil {
+		return nil, err
+	}
+	message, err = json.Marshal(LoginRequest{ClientUser, challenge.Challenge, signature})
+	if err != nil {
+		return nil, err
+	}
+	token := &Token{Server: Server}
+	err = postJSON("/login", message, token)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// Post an unsigned JSON message and decode the result into v
+func postJSON(path string, message []byte, v interface{}) error {
+	res, err := http.Post(Server+path, "application/json; charset=utf-8", bytes.NewReader(message))
+	if res == nil {
+		if err == nil {
+			err = errors.New("Empty Response")
+		}
+		return err
+	}
+	if res.Body == nil {
+		return errors.New("Empty Response")
+	}
+	defer res.Body.Close()
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	var response Response
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&response)
+	if err != nil {
+		return err
+	}
+	if response.Status == "failure" {
+		return errors.New(response.Error)
+	}
+	return json.NewDecoder(bytes.NewReader(body)).Decode(v)
+}
+
+// Get the cached session token, logging in again if it is missing or about to expire
+func GetToken() (*Token, error) {
+	var token Token
+	data, err := ioutil.ReadFile(tokenFile)
+	if err == nil && json.Unmarshal(data, &token) == nil &&
+		token.Username == ClientUser && token.Server == Server && time.Until(token.Expires) > tokenMargin {
+		return &token, nil
+	}
+	newToken, err := Login()
+	if err != nil {
+		return nil, err
+	}
+	data, err = json.MarshalIndent(newToken, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(tokenFile, data, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return newToken, nil
+}
+
+// Forget the cached session token
+func RemoveToken() error {
+	err := os.Remove(tokenFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Send a request authenticated with the session token, or the client certificate if there is one
+// If the server no longer accepts the token, e.g. after a restart, log in again and retry once
+func tokenRequest(method string, path string, body []byte) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		var token *Token
+		var err error
+		if !UseClientCert {
+			token, err = GetToken()
+			if err != nil {
+				return nil, err
+			}
+		}
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+		req, err := http.NewRequest(method, Server+path, reader)
+		if err != nil {
+			return nil, err
+		}
+		if token != nil {
+			req.Header.Set("Authorization", "Bearer "+token.Token)
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil || res.StatusCode != http.StatusUnauthorized || token == nil || attempt > 0 {
+			return res, err
+		}
+		res.Body.Close()
+		err = RemoveToken()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Send a GET request for path authenticated with the session token
+func AuthenticatedGet(path string) (*http.Response, error) {
+	return tokenRequest("GET", path, nil)
+}
+
+// Post a message to path authenticated with the session token instead of a signature
+func AuthenticatedPost(path string, message []byte) (*http.Response, error) {
+	body, err := json.Marshal(SignedRequest{Message: message, Path: path})
+	if err != nil {
+		return nil, err
+	}
+	return tokenRequest("POST", path, body)
+}
@@ -0,0 +1,238 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/kyrillzorin/CS3031_Lab2/lab2"
+)
+
+// File the newest version of each file this client has read or written is kept in
+const seenVersionsFile = "./versions.json"
+
+// Manifest Struct, see lab2
+type Manifest = lab2.Manifest
+
+// Seen Version Struct, the newest version of a file this client has read or written
+// Only signed versions are recorded, so a file in versions.json has been seen signed
+type SeenVersion struct {
+	Version int
+	Hash    []byte
+}
+
+// Sign a version of owner's file with this device's key, as a writer if the file is someone else's
+// Writers attach their grant, so readers can check the owner or a manager let them write the file
+func NewManifest(owner string, name string, version int, hash []byte) (*Manifest, error) {
+	m, err := lab2.NewManifest(owner, name, version, hash, ClientUser, ClientDevice, ClientPrivateKey)
+	if err != nil || owner == ClientUser {
+		return m, err
+	}
+	filekey, err := GetFileKey(owner, name)
+	if err != nil {
+		return nil, err
+	}
+	m.Grant = filekey.Grant
+	return m, nil
+}
+
+// Get a user whose signature is being checked, with their keys matching their pinned fingerprint
+func getSigner(username string) (*User, error) {
+	signer, err := GetUser(username)
+	if err != nil {
+		return nil, err
+	}
+	if signer.Username != ClientUser {
+		err = checkKnownUser(signer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return signer, nil
+}
+
+// Check a file is signed by the pinned keys of its owner or the writer who uploaded it
+// A writer's manifest must carry their grant, signed by the owner or a manager the owner signed a grant for,
+// so the server can't make someone a writer. Revoking a writer is still up to the server.
+// Files uploaded before manifests are accepted with a warning, unless a signed version of the file has been seen
+func verifyManifest(file *File) error {
+	m := file.Manifest
+	if m == nil {
+		seen, err := GetSeenVersion(file.Owner, file.Name)
+		if err != nil {
+			return err
+		}
+		if seen != nil {
+			return fmt.Errorf("WARNING: The server gave %s without its owner's signature, but version %d was seen signed. It may have changed the file",
+				file.Name, seen.Version)
+		}
+		fmt.Fprintf(os.Stderr, "Warning: %s isn't signed by its owner, ask them to upload it again\n", file.Name)
+		return nil
+	}
+	signer, err := getSigner(m.Signer())
+	if err != nil {
+		return err
+	}
+	err = m.Verify(signer, file.Owner, file.Name)
+	if err != nil {
+		return err
+	}
+	return m.VerifyGrant(getSigner)
+}
+
+// Check a manifest isn't older than, or a different file with the same version as, the last one seen
+func checkSeenVersion(m *Manifest) error {
+	seen, err := GetSeenVersion(m.Owner, m.Name)
+	if err != nil || seen == nil {
+		return err
+	}
+	if m.Version < seen.Version {
+		return fmt.Errorf("WARNING: The server gave version %d of %s, but version %d was seen before. It may be rolling the file back",
+			m.Version, m.Name, seen.Version)
+	}
+	if m.Version == seen.Version && !bytes.Equal(m.Hash, seen.Hash) {
+		return fmt.Errorf("WARNING: The server gave a different version %d of %s than the one seen before", m.Version, m.Name)
+	}
+	return nil
+}
+
+// Load the newest versions seen
+func loadSeenVersions() (map[string]SeenVersion, error) {
+	seen := make(map[string]SeenVersion)
+	data, err := ioutil.ReadFile(seenVersionsFile)
+	if os.IsNotExist(err) {
+		return seen, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &seen)
+	return seen, err
+}
+
+// Save the newest versions seen
+func saveSeenVersions(seen map[string]SeenVersion) error {
+	data, err := json.MarshalIndent(seen, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(seenVersionsFile, data, 0600)
+}
+
+// Get the newest version of a file seen, nil if it hasn't been seen yet
+func GetSeenVersion(owner string, filename string) (*SeenVersion, error) {
+	seen, err := loadSeenVersions()
+	if err != nil {
+		return nil, err
+	}
+	version, ok := seen[owner+"/"+filename]
+	if !ok {
+		return nil, nil
+	}
+	return &version, nil
+}
+
+// Record a manifest's version as seen, unless a newer one has been
+func RecordVersion(m *Manifest) error {
+	seen, err := loadSeenVersions()
+	if err != nil {
+		return err
+	}
+	key := m.Owner + "/" + m.Name
+	if version, ok := seen[key]; ok && version.Version > m.Version {
+		return nil
+	}
+	seen[key] = SeenVersion{m.Version, m.Hash}
+	return saveSeenVersions(seen)
+}
+
+// Version number of the next upload of owner's file
+func nextVersion(owner string, filename string) (int, error) {
+	version := 0
+	seen, err := GetSeenVersion(owner, filename)
+	if err != nil {
+		return 0, err
+	}
+	if seen != nil {
+		version = seen.Version
+	}
+	// Another device or writer may have written a newer version, the server refuses versions that aren't newer
+	file, err := GetFile(owner, filename)
+	if err == nil && file.Version > version {
+		version = file.Version
+	}
+	if err == nil && file.Manifest != nil && file.Manifest.Version > version {
+		version = file.Manifest.Version
+	}
+	return version + 1, nil
+}
+
+// Sign the manifests of every version the user signed with device again with key, as signingDevice
+// These are the versions of the user's files and the versions they wrote of files shared with them.
+// Used when a device's key changes or it is removed, each manifest is checked against user's current keys first
+// so a manifest made up by the server is never signed
+func resignManifests(user *User, device string, key PrivateKey, signingDevice string) ([]Manifest, error) {
+	filekeys, err := GetUserFileKeys()
+	if err != nil {
+		return nil, err
+	}
+	manifests := make([]Manifest, 0)
+	for _, filekey := range filekeys {
+		versions, err := GetFileVersions(filekey.Owner, filekey.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, version := range versions.Versions {
+			m := version.Manifest
+			if m == nil || m.Signer() != ClientUser || m.Device != device {
+				continue
+			}
+			err = m.Verify(user, filekey.Owner, filekey.Name)
+			if err != nil {
+				return nil, err
+			}
+			if version.Current {
+				err = checkSeenVersion(m)
+				if err != nil {
+					return nil, err
+				}
+			}
+			m.Device = signingDevice
+			err = m.Sign(key)
+			if err != nil {
+				return nil, err
+			}
+			manifests = append(manifests, *m)
+		}
+	}
+	return manifests, nil
+}
+
+// Sign the grants this user signed with device again with key, as signingDevice
+// Used along with resignManifests, each grant is checked against user's current keys first
+// so a grant made up by the server is never signed
+func resignGrants(user *User, device string, key PrivateKey, signingDevice string) ([]Grant, error) {
+	userGrants, err := GetUserGrants()
+	if err != nil {
+		return nil, err
+	}
+	grants := make([]Grant, 0)
+	for _, grant := range userGrants {
+		if grant.Signer != ClientUser || grant.Device != device {
+			continue
+		}
+		err = grant.VerifySignature(user)
+		if err != nil {
+			return nil, err
+		}
+		grant.Device = signingDevice
+		err = grant.Sign(key)
+		if err != nil {
+			return nil, err
+		}
+		grants = append(grants, grant)
+	}
+	return grants, nil
+}
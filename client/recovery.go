@@ -0,0 +1,285 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/kyrillzorin/CS3031_Lab2/lab2"
+)
+
+// Name of the device whose key is split between the user's trustees
+const recoveryDevice = "recovery"
+
+// File the recovery request of this device is kept in until it completes
+const recoveryRequestFile = "./recovery.json"
+
+// Recovery Struct, the user's recovery key split between trusted users
+// Each share is encrypted for each of its trustee's devices like a file key
+type Recovery struct {
+	Id        string
+	Username  string
+	Threshold int
+	Shares    []RecoveryShare
+}
+
+// Recovery Share Struct, one trustee's share of a recovery key
+type RecoveryShare struct {
+	Trustee    string
+	Key        []byte
+	DeviceKeys map[string][]byte
+}
+
+// Recovery Request Struct, a new device of a user who lost their keys asking trustees for their shares
+type RecoveryRequest struct {
+	Id       string
+	Username string
+	Device   string
+	Keys     KeySet
+	Expires  time.Time
+}
+
+// Recovery request as shown to a trustee, with the trustee's own share
+type TrusteeRequest struct {
+	Id       string
+	Username string
+	Device   string
+	Keys     KeySet
+	Expires  time.Time
+	Share    RecoveryShare
+}
+
+// Trustee's Recovery Requests Struct
+type TrusteeRequests struct {
+	Requests []TrusteeRequest
+}
+
+// Recovery Approval Struct, a trustee's share re-encrypted to the new device's key
+type RecoveryApproval struct {
+	Trustee string
+	Request string
+	Share   []byte
+}
+
+// Recovery Shares Struct, the approved shares of a recovery request
+type RecoveryShares struct {
+	Username  string
+	Request   string
+	Threshold int
+	Shares    [][]byte
+}
+
+// Split recoveryKey between trustees, any threshold of whom can rebuild it
+func NewRecovery(recoveryKey *lab2.KeyPair, threshold int, trustees []string) (*Recovery, error) {
+	shares, err := lab2.SplitSecret(recoveryKey.Marshal(), len(trustees), threshold)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recovery{Username: ClientUser, Threshold: threshold}
+	for i, username := range trustees {
+		if username == ClientUser {
+			return nil, errors.New("You can't be your own trustee")
+		}
+		user, err := GetUser(username)
+		if err != nil {
+			return nil, err
+		}
+		err = checkKnownUser(user)
+		if err != nil {
+			return nil, err
+		}
+		share := RecoveryShare{Trustee: username}
+		share.Key, share.DeviceKeys, err = lab2.WrapForUser(user, shares[i])
+		if err != nil {
+			return nil, err
+		}
+		r.Shares = append(r.Shares, share)
+	}
+	return r, nil
+}
+
+// Store the recovery shares on server, always signed with this device's key
+func (r *Recovery) Setup() error {
+	return postSigned("/recovery", r, nil)
+}
+
+// Add the recovery key as one of the user's devices, so every file key is also encrypted for it
+func addRecoveryDevice(recoveryKey *lab2.KeyPair) error {
+	enrollment, err := NewEnrollment(recoveryDevice, recoveryKey)
+	if err != nil {
+		return err
+	}
+	err = enrollment.Submit()
+	if err != nil {
+		return err
+	}
+	approval, err := NewDeviceApproval(*enrollment)
+	if err != nil {
+		return err
+	}
+	return approval.Approve()
+}
+
+// Ask the user's trustees to recover their keys for this device, signed with this device's key
+func NewRecoveryRequest() (*RecoveryRequest, error) {
+	r := &RecoveryRequest{Username: ClientUser, Device: ClientDevice, Keys: ClientPublicKeys}
+	err := postSigned("/recover", r, r)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Get this device's recovery request saved by an earlier run, nil if there is none
+func GetSavedRecoveryRequest() (*RecoveryRequest, error) {
+	data, err := ioutil.ReadFile(recoveryRequestFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r RecoveryRequest
+	err = json.Unmarshal(data, &r)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Save the recovery request until enough trustees approve it
+func (r *RecoveryRequest) Save() error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(recoveryRequestFile, data, 0600)
+}
+
+// Forget the saved recovery request
+func RemoveRecoveryRequest() error {
+	err := os.Remove(recoveryRequestFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Get the shares trustees have approved so far, signed with this device's key
+func (r *RecoveryRequest) GetShares() (*RecoveryShares, error) {
+	shares := &RecoveryShares{Username: r.Username, Request: r.Id}
+	err := postSigned("/recoveryshares", shares, shares)
+	if err != nil {
+		return nil, err
+	}
+	return shares, nil
+}
+
+// Decrypt the approved shares and rebuild the recovery key
+func (s *RecoveryShares) RecoveryKey() (*lab2.KeyPair, error) {
+	if len(s.Shares) < s.Threshold {
+		return nil, errors.New("Not enough trustees have approved the recovery")
+	}
+	shares := make([][]byte, 0, len(s.Shares))
+	for _, encrypted := range s.Shares {
+		share, err := lab2.Decrypt(ClientPrivateKey, encrypted)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	secret, err := lab2.CombineShares(shares)
+	if err != nil {
+		return nil, err
+	}
+	return lab2.ParseKeyPair(secret)
+}
+
+// Get the pending recovery requests the user is a trustee of from server
+func GetTrusteeRequests() (requests *TrusteeRequests, err error) {
+	res, err := AuthenticatedGet("/recoveryrequests")
+	if res == nil {
+		if err == nil {
+			err = errors.New("Empty Response")
+		}
+		return
+	}
+	if res.Body == nil {
+		err = errors.New("Empty Response")
+		return
+	}
+	defer res.Body.Close()
+	if err != nil {
+		return
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return
+	}
+	var response Response
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&response)
+	if err != nil {
+		return
+	}
+	if response.Status == "failure" {
+		err = errors.New(response.Error)
+		return
+	}
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&requests)
+	return
+}
+
+// Decrypt the user's share of a recovery request and encrypt it to the new device's key
+func NewRecoveryApproval(request TrusteeRequest) (*RecoveryApproval, error) {
+	share, err := lab2.UnwrapForDevice(ClientPrivateKey, ClientDevice, request.Share.Key, request.Share.DeviceKeys)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := lab2.Encrypt(request.Keys.Encryption, share)
+	if err != nil {
+		return nil, err
+	}
+	return &RecoveryApproval{ClientUser, request.Id, encrypted}, nil
+}
+
+// Send a recovery approval to server
+func (a *RecoveryApproval) Approve() error {
+	message, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	// Sign the request
+	signedRequest, err := NewSignedRequest("/approverecovery", message)
+	if err != nil {
+		return err
+	}
+	b := new(bytes.Buffer)
+	json.NewEncoder(b).Encode(signedRequest)
+	res, err := http.Post(Server+"/approverecovery", "application/json; charset=utf-8", b)
+	if res == nil {
+		if err == nil {
+			err = errors.New("Empty Response")
+		}
+		return err
+	}
+	if res.Body == nil {
+		return errors.New("Empty Response")
+	}
+	defer res.Body.Close()
+	if err != nil {
+		return err
+	}
+	var response Response
+	err = json.NewDecoder(res.Body).Decode(&response)
+	if err != nil {
+		return err
+	}
+	if response.Status != "success" {
+		return errors.New(response.Error)
+	}
+	return err
+}
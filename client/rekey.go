@@ -0,0 +1,185 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/kyrillzorin/CS3031_Lab2/lab2"
+)
+
+// Rekey Struct, moves a file to a new key epoch with a new shared secret in one request
+// FileKeys is the complete new set of file keys and Revoked the users who lose access.
+// Upload is a completed but uncommitted upload session holding the file encrypted with the new secret,
+// without one the file is left pending re-encryption and EpochKey holds the current secret encrypted with the new one
+type Rekey struct {
+	Owner       string
+	Name        string
+	Upload      string
+	Manifest    *Manifest
+	PreviousKey []byte
+	EpochKey    []byte
+	FileKeys    []FileKey
+	Revoked     []string
+}
+
+// Build the new file keys of owner's file in epoch, for the owner and every user with access except revoked
+// Each user's keys are checked against the keys pinned for them, so a changed key is caught before anything is uploaded
+func newFileKeys(owner string, filename string, key []byte, epoch int, revoked []string) ([]FileKey, error) {
+	fileUsers, err := GetFileUsers(owner, filename)
+	if err != nil {
+		return nil, err
+	}
+	hasAccess := make(map[string]bool)
+	for _, username := range fileUsers {
+		hasAccess[username] = true
+	}
+	skip := make(map[string]bool)
+	for _, username := range revoked {
+		if username == owner {
+			return nil, errors.New("Can't revoke own file access")
+		}
+		if !hasAccess[username] {
+			return nil, fmt.Errorf("%s does not have access to this file", username)
+		}
+		skip[username] = true
+	}
+	users := []string{owner}
+	for _, username := range fileUsers {
+		if username != owner && !skip[username] {
+			users = append(users, username)
+		}
+	}
+	filekeys := make([]FileKey, 0, len(users))
+	for _, username := range users {
+		user, err := GetUser(username)
+		if err != nil {
+			return nil, err
+		}
+		if username != ClientUser {
+			err = checkKnownUser(user)
+			if err != nil {
+				return nil, err
+			}
+		}
+		filekey := lab2.NewFileKey(username, owner, filename, nil)
+		filekey.Epoch = epoch
+		err = filekey.Wrap(user, key)
+		if err != nil {
+			return nil, err
+		}
+		filekeys = append(filekeys, *filekey)
+	}
+	return filekeys, nil
+}
+
+// Encrypt a local copy of owner's file with newKey, the file key of epoch, and replace the file on server,
+// sharing newKey with every user with access except revoked, who lose access at the same time
+// oldKey is the secret the current version is encrypted with, the user must be the owner or a manager
+// Nothing changes on the server unless the whole rekey is accepted, returns the new version's manifest
+func RekeyFile(inputPath string, owner string, filename string, oldKey []byte, newKey []byte, epoch int, revoked []string) (*Manifest, error) {
+	filekeys, err := newFileKeys(owner, filename, newKey, epoch, revoked)
+	if err != nil {
+		return nil, err
+	}
+	session, err := StartUpload(inputPath, owner, filename, newKey, epoch, false)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := session.SendChunks(inputPath, newKey)
+	if err != nil {
+		return nil, err
+	}
+	version, err := nextVersion(owner, filename)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := NewManifest(owner, filename, version, hash)
+	if err != nil {
+		return nil, err
+	}
+	// Users keeping access can still read earlier versions through the new key
+	previousKey, err := lab2.EncryptAES(newKey, oldKey)
+	if err != nil {
+		return nil, err
+	}
+	rekey := Rekey{Owner: owner, Name: filename, Upload: session.Id, Manifest: manifest, PreviousKey: previousKey, FileKeys: filekeys, Revoked: revoked}
+	err = postSigned("/rekey", rekey, nil)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, RecordVersion(manifest)
+}
+
+// Share newKey, the next epoch's secret, with every user with access to owner's file except revoked,
+// who lose access at the same time, without re-encrypting the file
+// The file is left pending re-encryption, until then revoked users who kept the old secret can still read its current version
+func RotateFileKey(owner string, filename string, filekey *FileKey, newKey []byte, revoked []string) error {
+	key, err := filekey.Unwrap(ClientPrivateKey, ClientDevice)
+	if err != nil {
+		return err
+	}
+	filekeys, err := newFileKeys(owner, filename, newKey, filekey.Epoch+1, revoked)
+	if err != nil {
+		return err
+	}
+	// Readers decrypt the current data's secret through the new one
+	epochKey, err := lab2.EncryptAES(newKey, key)
+	if err != nil {
+		return err
+	}
+	rekey := Rekey{Owner: owner, Name: filename, EpochKey: epochKey, FileKeys: filekeys, Revoked: revoked}
+	return postSigned("/rekey", rekey, nil)
+}
+
+// Re-encrypt one of the user's files with its current file key by downloading it and uploading it again
+// Returns the file key's epoch
+func reencryptFile(filename string) (int, error) {
+	filekey, err := GetFileKey(ClientUser, filename)
+	if err != nil {
+		return 0, err
+	}
+	key, err := filekey.Unwrap(ClientPrivateKey, ClientDevice)
+	if err != nil {
+		return 0, err
+	}
+	oldKey, err := versionKey(ClientUser, filename, filekey, 0)
+	if err != nil {
+		return 0, err
+	}
+	tempDir, err := ioutil.TempDir("", "reencrypt-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(tempDir)
+	tempPath := filepath.Join(tempDir, "file")
+	_, err = DownloadAndDecrypt(ClientUser, filename, 0, oldKey, tempPath)
+	if err != nil {
+		return 0, err
+	}
+	return filekey.Epoch, EncryptAndUpload(tempPath, filename, key, filekey.Epoch)
+}
+
+// Get the names of the user's files pending re-encryption
+func pendingFiles() ([]string, error) {
+	filekeys, err := GetUserFileKeys()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, filekey := range filekeys {
+		if filekey.Owner != ClientUser {
+			continue
+		}
+		file, err := GetFile(ClientUser, filekey.Name)
+		if err != nil {
+			return nil, err
+		}
+		if file.Pending {
+			names = append(names, filekey.Name)
+		}
+	}
+	return names, nil
+}
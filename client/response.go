@@ -1,4 +1,4 @@
-package main
+package client
 
 // Server response struct
 type Response struct {
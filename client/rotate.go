@@ -0,0 +1,117 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+
+	"github.com/kyrillzorin/CS3031_Lab2/lab2"
+)
+
+// File the new private key is kept in until the server has accepted it
+const newPrivateKeyFile = "./priv.pem.new"
+
+// Key Rotation Struct, replaces the keys of one of the user's devices
+// FileKeys carries the user's file keys re-encrypted for the new set of device keys
+// Manifests carries the manifests of the user's files the device signed, signed again with the new key
+// Grants carries the grants the device signed, signed again the same way
+// Signature is made with the new signing key, proving the user holds it
+type KeyRotation struct {
+	Username  string
+	Device    string
+	Keys      KeySet
+	FileKeys  []FileKey
+	Manifests []Manifest
+	Grants    []Grant
+	Signature []byte
+}
+
+// Data covered by the new key's signature, must match the server's
+type rotationData struct {
+	Username string
+	Device   string
+	Keys     KeySet
+}
+
+// User's File Keys Struct
+type UserFileKeys struct {
+	FileKeys []FileKey
+}
+
+// Create a key rotation of this device to newKey, re-encrypting every file key shared with the user
+func NewKeyRotation(newKey PrivateKey) (*KeyRotation, error) {
+	user, err := GetUser(ClientUser)
+	if err != nil {
+		return nil, err
+	}
+	device := user.Device(ClientDevice)
+	if device == nil {
+		return nil, errors.New("Device does not exist: " + ClientDevice)
+	}
+	k := &KeyRotation{Username: ClientUser, Device: ClientDevice, Keys: newKey.PublicKeys()}
+	k.Manifests, err = resignManifests(user, ClientDevice, newKey, ClientDevice)
+	if err != nil {
+		return nil, err
+	}
+	k.Grants, err = resignGrants(user, ClientDevice, newKey, ClientDevice)
+	if err != nil {
+		return nil, err
+	}
+	device.Keys = k.Keys
+	k.FileKeys, err = rewrapFileKeys(user)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(rotationData{k.Username, k.Device, k.Keys})
+	if err != nil {
+		return nil, err
+	}
+	k.Signature, err = lab2.Sign(newKey, data)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Send a key rotation to server, always signed with the old key
+// A client certificate can't replace the key it was made for, so the request is signed
+func (k *KeyRotation) Rotate() error {
+	return postSigned("/rotatekey", k, nil)
+}
+
+// Get all file keys shared with the user from server
+func GetUserFileKeys() (filekeys []FileKey, err error) {
+	res, err := AuthenticatedGet("/filekeys")
+	if res == nil {
+		if err == nil {
+			err = errors.New("Empty Response")
+		}
+		return
+	}
+	if res.Body == nil {
+		err = errors.New("Empty Response")
+		return
+	}
+	defer res.Body.Close()
+	if err != nil {
+		return
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return
+	}
+	var response Response
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&response)
+	if err != nil {
+		return
+	}
+	if response.Status == "failure" {
+		err = errors.New(response.Error)
+		return
+	}
+	var userFileKeys UserFileKeys
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&userFileKeys)
+	filekeys = userFileKeys.FileKeys
+	return
+}
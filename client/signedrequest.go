@@ -1,7 +1,46 @@
-package main
+package client
 
-// Signed Request Struct
-type SignedRequest struct {
-	Message   []byte
-	Signature []byte
+import (
+	"encoding/json"
+
+	"github.com/kyrillzorin/CS3031_Lab2/lab2"
+)
+
+// Signed Request Struct, see lab2
+type SignedRequest = lab2.SignedRequest
+
+// Create a request for the endpoint at path, signed with the client's private key
+// With a client certificate the TLS connection authenticates the request and it is left unsigned
+func NewSignedRequest(path string, message []byte) (*SignedRequest, error) {
+	if UseClientCert {
+		return &SignedRequest{Message: message, Path: path}, nil
+	}
+	return signRequest(path, message)
+}
+
+// Create a request for the endpoint at path signed with the client's private key, even with a client certificate
+func signRequest(path string, message []byte) (*SignedRequest, error) {
+	return lab2.NewSignedRequest(ClientUser, ClientPrivateKey, path, message)
+}
+
+// Post v to the endpoint at path signed with the client's private key, even with a client certificate,
+// and decode the result into result if it isn't nil
+// Used for changes to the user's keys, which the server only accepts with a signature
+func postSigned(path string, v interface{}, result interface{}) error {
+	message, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	signedRequest, err := signRequest(path, message)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(signedRequest)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		result = new(Response)
+	}
+	return postJSON(path, body, result)
 }
@@ -0,0 +1,315 @@
+package client
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/kyrillzorin/CS3031_Lab2/lab2"
+)
+
+// File the key log's public key and the latest tree head seen are kept in
+const logStateFile = "./log.json"
+
+// Log Entry Struct, a user's devices and keys after a registration or key change
+type LogEntry struct {
+	Index     int
+	Username  string
+	Devices   []LogDevice
+	Timestamp int64
+}
+
+// Logged Device Struct, a device's name and keys
+type LogDevice struct {
+	Name string
+	Keys KeySet
+}
+
+// Signed Tree Head Struct, the log's root hash at a size signed with the log key
+type SignedTreeHead struct {
+	TreeSize  int
+	RootHash  []byte
+	Timestamp int64
+	Signature []byte
+}
+
+// Data covered by the tree head signature, must match the server's
+type treeHeadData struct {
+	TreeSize  int
+	RootHash  []byte
+	Timestamp int64
+}
+
+// Log Key Struct, the public key tree heads are signed with
+type LogKey struct {
+	PublicKey []byte
+}
+
+// Inclusion proof of a user's latest entry in the tree of the given size
+type UserLogProof struct {
+	Entry     LogEntry
+	TreeSize  int
+	AuditPath [][]byte
+}
+
+// Consistency proof that the tree of size First is a prefix of the tree of size Second
+type ConsistencyProof struct {
+	First  int
+	Second int
+	Proof  [][]byte
+}
+
+// Log State Struct, the pinned log key and the latest tree head this client has verified
+type LogState struct {
+	PublicKey []byte
+	Head      *SignedTreeHead
+}
+
+// Check a tree head was signed with the log key
+func (h *SignedTreeHead) verify(publicKey []byte) bool {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	data, err := json.Marshal(treeHeadData{h.TreeSize, h.RootHash, h.Timestamp})
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(publicKey, data, h.Signature)
+}
+
+// Encode a tree head for sending to other users
+func (h *SignedTreeHead) Token() (string, error) {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// Decode a tree head sent by another user
+func parseTreeHead(token string) (*SignedTreeHead, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.New("Invalid tree head")
+	}
+	var head SignedTreeHead
+	err = json.Unmarshal(data, &head)
+	if err != nil {
+		return nil, errors.New("Invalid tree head")
+	}
+	return &head, nil
+}
+
+// Load the log state, empty if this client hasn't seen the log yet
+func loadLogState() (*LogState, error) {
+	state := new(LogState)
+	data, err := ioutil.ReadFile(logStateFile)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, state)
+	return state, err
+}
+
+// Save the log state
+func (s *LogState) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(logStateFile, data, 0600)
+}
+
+// Get the log's public key, from config if set, otherwise pinned the first time the log is used
+func (s *LogState) publicKey() ([]byte, error) {
+	if LogPublicKey != "" {
+		key, err := hex.DecodeString(LogPublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, errors.New("LogKey in config.toml must be the hex encoded key printed by the server")
+		}
+		if s.PublicKey != nil && !bytes.Equal(s.PublicKey, key) {
+			return nil, errors.New("LogKey in config.toml doesn't match the key log this client has seen, remove " + logStateFile + " if the server's log was reset")
+		}
+		s.PublicKey = key
+		return key, nil
+	}
+	if s.PublicKey == nil {
+		var logKey LogKey
+		err := getLog("/log/key", &logKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(logKey.PublicKey) != ed25519.PublicKeySize {
+			return nil, errors.New("Invalid key log public key")
+		}
+		fmt.Fprintf(os.Stderr, "Pinned the key log public key %x on first use, set LogKey in config.toml to check it\n", logKey.PublicKey)
+		s.PublicKey = logKey.PublicKey
+	}
+	return s.PublicKey, nil
+}
+
+// Check two signed tree heads are of the same log, asking server to prove the smaller tree is a prefix of the larger one
+func checkConsistency(a *SignedTreeHead, b *SignedTreeHead) error {
+	if a.TreeSize > b.TreeSize {
+		a, b = b, a
+	}
+	if a.TreeSize == 0 {
+		return nil
+	}
+	if a.TreeSize == b.TreeSize {
+		if !bytes.Equal(a.RootHash, b.RootHash) {
+			return errSplitView
+		}
+		return nil
+	}
+	var proof ConsistencyProof
+	err := getLog(fmt.Sprintf("/log/consistency?first=%d&second=%d", a.TreeSize, b.TreeSize), &proof)
+	if err != nil {
+		return err
+	}
+	if !lab2.VerifyConsistency(a.TreeSize, b.TreeSize, a.RootHash, b.RootHash, proof.Proof) {
+		return errSplitView
+	}
+	return nil
+}
+
+var errSplitView = errors.New("WARNING: The server has signed two key logs that don't agree, it may be showing users different keys.\n" +
+	"Keep " + logStateFile + " and the tree heads as evidence")
+
+// Get and verify the log's current tree head, checking it extends the last one this client saw
+func CurrentTreeHead() (*SignedTreeHead, error) {
+	state, err := loadLogState()
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := state.publicKey()
+	if err != nil {
+		return nil, err
+	}
+	var head SignedTreeHead
+	err = getLog("/log/head", &head)
+	if err != nil {
+		return nil, err
+	}
+	if !head.verify(publicKey) {
+		return nil, errors.New("Could not verify the key log's tree head signature")
+	}
+	if state.Head != nil {
+		if head.TreeSize < state.Head.TreeSize {
+			return nil, errors.New("WARNING: The key log is smaller than when this client last saw it, the server may have removed keys from it")
+		}
+		err = checkConsistency(state.Head, &head)
+		if err != nil {
+			return nil, err
+		}
+	}
+	state.Head = &head
+	err = state.save()
+	if err != nil {
+		return nil, err
+	}
+	return &head, nil
+}
+
+// Check the keys server gave for a user are their latest entry in the key log
+func verifyUserInLog(user *User) error {
+	head, err := CurrentTreeHead()
+	if err != nil {
+		return err
+	}
+	var proof UserLogProof
+	err = getLog(fmt.Sprintf("/log/users/%s?size=%d", user.Username, head.TreeSize), &proof)
+	if err != nil {
+		return err
+	}
+	devices := make([]LogDevice, 0, len(user.Devices))
+	for _, device := range user.Devices {
+		devices = append(devices, LogDevice{device.Name, device.Keys})
+	}
+	logged, err := json.Marshal(proof.Entry.Devices)
+	if err != nil {
+		return err
+	}
+	given, err := json.Marshal(devices)
+	if err != nil {
+		return err
+	}
+	entry, err := json.Marshal(proof.Entry)
+	if err != nil {
+		return err
+	}
+	if proof.Entry.Username != user.Username || !bytes.Equal(logged, given) ||
+		!lab2.VerifyInclusion(proof.Entry.Index, head.TreeSize, lab2.LeafHash(entry), proof.AuditPath, head.RootHash) {
+		return fmt.Errorf("WARNING: The keys the server gave for %s aren't in the key log, it may be trying to read your files", user.Username)
+	}
+	return nil
+}
+
+// Check a tree head another user saw is consistent with this client's view of the log
+// Returns this client's tree head, the other one is kept if it is newer
+func GossipTreeHead(other *SignedTreeHead) (*SignedTreeHead, error) {
+	head, err := CurrentTreeHead()
+	if err != nil {
+		return nil, err
+	}
+	state, err := loadLogState()
+	if err != nil {
+		return nil, err
+	}
+	if !other.verify(state.PublicKey) {
+		return nil, errors.New("Could not verify the tree head's signature, it wasn't signed by this client's key log")
+	}
+	err = checkConsistency(head, other)
+	if err != nil {
+		return nil, err
+	}
+	if other.TreeSize > head.TreeSize {
+		state.Head = other
+		err = state.save()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return head, nil
+}
+
+// Get a public key log path from server and decode the JSON result into v
+func getLog(path string, v interface{}) error {
+	res, err := http.Get(Server + path)
+	if res == nil {
+		if err == nil {
+			err = errors.New("Empty Response")
+		}
+		return err
+	}
+	if res.Body == nil {
+		return errors.New("Empty Response")
+	}
+	defer res.Body.Close()
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	var response Response
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&response)
+	if err != nil {
+		return err
+	}
+	if response.Status == "failure" {
+		return errors.New(response.Error)
+	}
+	return json.NewDecoder(bytes.NewReader(body)).Decode(v)
+}
@@ -0,0 +1,365 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kyrillzorin/CS3031_Lab2/lab2"
+)
+
+// Number of times a chunk upload is retried before giving up
+const chunkRetries = 4
+
+// File where unfinished uploads are recorded so they can be resumed
+const pendingUploadsFile = "./uploads.json"
+
+// Upload Session Struct
+// Manifest and PreviousKey are only sent with the commit, signing the file the chunks make up
+// and linking its shared secret to the version it replaces
+// Epoch is the key epoch of the file key the chunks are encrypted with
+type UploadSession struct {
+	Id          string
+	Owner       string
+	Name        string
+	Header      []byte
+	Chunks      int
+	Epoch       int
+	New         bool `json:",omitempty"`
+	Received    []int
+	Manifest    *Manifest `json:",omitempty"`
+	PreviousKey []byte    `json:",omitempty"`
+}
+
+// Unfinished upload, the file key is encrypted with the client's public key
+type PendingUpload struct {
+	Session string
+	Path    string
+	Size    int64
+	ModTime time.Time
+	Key     []byte
+}
+
+// Number of chunks needed for a file of the given size, empty files have one empty chunk
+func chunkCount(size int64) int {
+	if size == 0 {
+		return 1
+	}
+	return int((size + lab2.ChunkSize - 1) / lab2.ChunkSize)
+}
+
+// Start an upload session on server for a local file encrypted with key, the file key of the given epoch
+// owner is the file's owner, who is someone else when the user is one of the file's writers
+// newFile is set when the upload creates the file, the server refuses it if the owner already has a key to the file
+func StartUpload(inputPath string, owner string, filename string, key []byte, epoch int, newFile bool) (*UploadSession, error) {
+	info, err := os.Stat(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := lab2.NewStreamEncrypter(key)
+	if err != nil {
+		return nil, err
+	}
+	session := &UploadSession{Owner: owner, Name: filename, Header: stream.Header(), Chunks: chunkCount(info.Size()), Epoch: epoch, New: newFile}
+	message, err := json.Marshal(session)
+	if err != nil {
+		return nil, err
+	}
+	// Sign the request
+	signedRequest, err := NewSignedRequest("/startupload", message)
+	if err != nil {
+		return nil, err
+	}
+	b := new(bytes.Buffer)
+	json.NewEncoder(b).Encode(signedRequest)
+	res, err := http.Post(Server+"/startupload", "application/json; charset=utf-8", b)
+	if res == nil {
+		if err == nil {
+			err = errors.New("Empty Response")
+		}
+		return nil, err
+	}
+	if res.Body == nil {
+		return nil, errors.New("Empty Response")
+	}
+	defer res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	var response Response
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&response)
+	if err != nil {
+		return nil, err
+	}
+	if response.Status == "failure" {
+		return nil, errors.New(response.Error)
+	}
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&session)
+	return session, err
+}
+
+// Get an upload session and the chunks it has received from server
+func GetUploadSession(id string) (session *UploadSession, err error) {
+	res, err := AuthenticatedGet("/uploads/" + id)
+	if res == nil {
+		if err == nil {
+			err = errors.New("Empty Response")
+		}
+		return
+	}
+	if res.Body == nil {
+		err = errors.New("Empty Response")
+		return
+	}
+	defer res.Body.Close()
+	if err != nil {
+		return
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return
+	}
+	var response Response
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&response)
+	if err != nil {
+		return
+	}
+	if response.Status == "failure" {
+		err = errors.New(response.Error)
+		return
+	}
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&session)
+	return
+}
+
+// Encrypt and upload the chunks the server hasn't acknowledged yet, then sign and commit the upload
+func (s *UploadSession) Upload(inputPath string, key []byte) error {
+	hash, err := s.SendChunks(inputPath, key)
+	if err != nil {
+		return err
+	}
+	version, err := nextVersion(s.Owner, s.Name)
+	if err != nil {
+		return err
+	}
+	manifest, err := NewManifest(s.Owner, s.Name, version, hash)
+	if err != nil {
+		return err
+	}
+	previousKey, err := linkPreviousKey(s.Owner, s.Name, key)
+	if err != nil {
+		return err
+	}
+	err = s.Commit(manifest, previousKey)
+	if err != nil {
+		return err
+	}
+	return RecordVersion(manifest)
+}
+
+// Encrypt and upload the chunks the server hasn't acknowledged yet without committing them
+// Returns the hash of the encrypted file for its manifest
+func (s *UploadSession) SendChunks(inputPath string, key []byte) ([]byte, error) {
+	input, err := os.Open(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+	// Recreate the upload's stream cipher from its header
+	stream, err := lab2.NewStreamDecrypter(key, s.Header)
+	if err != nil {
+		return nil, err
+	}
+	// Resume from the first chunk the server doesn't have
+	next := 0
+	for _, index := range s.Received {
+		if index != next {
+			break
+		}
+		next++
+	}
+	// Chunks the server already has are encrypted again for the manifest's hash, chunk nonces are deterministic
+	hasher := lab2.NewFileHasher(s.Header)
+	buf := make([]byte, lab2.ChunkSize)
+	for index := 0; index < s.Chunks; index++ {
+		n, err := lab2.ReadChunk(input, buf)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 && index > 0 {
+			return nil, errors.New("File changed during upload")
+		}
+		encodedData, err := stream.Seal(buf[:n], index == s.Chunks-1)
+		if err != nil {
+			return nil, err
+		}
+		hasher.Add(encodedData)
+		if index < next {
+			continue
+		}
+		chunk := &FileChunk{Owner: s.Owner, Name: s.Name, Session: s.Id, Index: index, Data: encodedData}
+		err = chunk.UploadWithRetry()
+		if err != nil {
+			return nil, fmt.Errorf("Upload interrupted at chunk %d of %d: %s", index+1, s.Chunks, err)
+		}
+		s.Received = append(s.Received, index)
+	}
+	return hasher.Sum(nil), nil
+}
+
+// Commit the upload with its manifest and the replaced version's key, making it the current version of the file
+func (s *UploadSession) Commit(manifest *Manifest, previousKey []byte) error {
+	message, err := json.Marshal(UploadSession{Id: s.Id, Owner: s.Owner, Name: s.Name, Manifest: manifest, PreviousKey: previousKey})
+	if err != nil {
+		return err
+	}
+	// Sign the request
+	signedRequest, err := NewSignedRequest("/commitupload", message)
+	if err != nil {
+		return err
+	}
+	b := new(bytes.Buffer)
+	json.NewEncoder(b).Encode(signedRequest)
+	res, err := http.Post(Server+"/commitupload", "application/json; charset=utf-8", b)
+	if res == nil {
+		if err == nil {
+			err = errors.New("Empty Response")
+		}
+		return err
+	}
+	if res.Body == nil {
+		return errors.New("Empty Response")
+	}
+	defer res.Body.Close()
+	if err != nil {
+		return err
+	}
+	var response Response
+	err = json.NewDecoder(res.Body).Decode(&response)
+	if err != nil {
+		return err
+	}
+	if response.Status != "success" {
+		return errors.New(response.Error)
+	}
+	return err
+}
+
+// Upload a chunk, retrying with backoff if the server can't be reached
+func (c *FileChunk) UploadWithRetry() error {
+	var err error
+	delay := time.Second
+	for attempt := 0; attempt <= chunkRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		var res Response
+		res, err = c.upload()
+		// Only retry transport failures, the server rejecting the chunk is final
+		if err == nil || res.Status == "failure" {
+			return err
+		}
+	}
+	return err
+}
+
+// Load the unfinished uploads recorded by previous runs
+func loadPendingUploads() (map[string]PendingUpload, error) {
+	pending := make(map[string]PendingUpload)
+	data, err := ioutil.ReadFile(pendingUploadsFile)
+	if os.IsNotExist(err) {
+		return pending, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &pending)
+	return pending, err
+}
+
+// Save the unfinished uploads
+func savePendingUploads(pending map[string]PendingUpload) error {
+	data, err := json.MarshalIndent(pending, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(pendingUploadsFile, data, 0600)
+}
+
+// Key an unfinished upload is recorded under, uploads to other users' files are prefixed with their owner
+func pendingUploadKey(owner string, filename string) string {
+	if owner == ClientUser {
+		return filename
+	}
+	return owner + "/" + filename
+}
+
+// Get the unfinished upload of owner's file filename from inputPath, if the local file hasn't changed since
+func GetPendingUpload(inputPath string, owner string, filename string) (*PendingUpload, error) {
+	pending, err := loadPendingUploads()
+	if err != nil {
+		return nil, err
+	}
+	upload, ok := pending[pendingUploadKey(owner, filename)]
+	if !ok {
+		return nil, nil
+	}
+	absPath, err := filepath.Abs(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	if upload.Path != absPath || upload.Size != info.Size() || !upload.ModTime.Equal(info.ModTime()) {
+		return nil, nil
+	}
+	return &upload, nil
+}
+
+// Record an unfinished upload of owner's file filename so it can be resumed
+func SavePendingUpload(inputPath string, owner string, filename string, session *UploadSession, encodedKey []byte) error {
+	pending, err := loadPendingUploads()
+	if err != nil {
+		return err
+	}
+	absPath, err := filepath.Abs(inputPath)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(inputPath)
+	if err != nil {
+		return err
+	}
+	pending[pendingUploadKey(owner, filename)] = PendingUpload{session.Id, absPath, info.Size(), info.ModTime(), encodedKey}
+	return savePendingUploads(pending)
+}
+
+// Forget the unfinished upload of owner's file filename
+func RemovePendingUpload(owner string, filename string) error {
+	pending, err := loadPendingUploads()
+	if err != nil {
+		return err
+	}
+	key := pendingUploadKey(owner, filename)
+	if _, ok := pending[key]; !ok {
+		return nil
+	}
+	delete(pending, key)
+	if len(pending) == 0 {
+		return os.Remove(pendingUploadsFile)
+	}
+	return savePendingUploads(pending)
+}
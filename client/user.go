@@ -1,36 +1,31 @@
-package main
+package client
 
 import (
 	"bytes"
-	"crypto/rsa"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"net/http"
-)
 
-// User Struct
-type User struct {
-	Id       string
-	Username string
-	PubKey   *rsa.PublicKey
-}
+	"github.com/kyrillzorin/CS3031_Lab2/lab2"
+)
 
-// Create new user
-func NewUser(username string, pubkey *rsa.PublicKey) *User {
-	u := new(User)
-	u.Username = username
-	u.PubKey = pubkey
-	return u
-}
+// User and Device Structs, see lab2
+type (
+	User   = lab2.User
+	Device = lab2.Device
+)
 
 // Register user on server
-func (u *User) Register() error {
+func RegisterUser(u *User) error {
 	b := new(bytes.Buffer)
 	json.NewEncoder(b).Encode(u)
 	res, err := http.Post(Server+"/register", "application/json; charset=utf-8", b)
 	if res == nil {
-		return errors.New("Empty Response")
+		if err == nil {
+			err = errors.New("Empty Response")
+		}
+		return err
 	}
 	if res.Body == nil {
 		return errors.New("Empty Response")
@@ -54,7 +49,9 @@ func (u *User) Register() error {
 func GetUser(username string) (user *User, err error) {
 	res, err := http.Get(Server + "/users/" + username)
 	if res == nil {
-		err = errors.New("Empty Response")
+		if err == nil {
+			err = errors.New("Empty Response")
+		}
 		return
 	}
 	if res.Body == nil {
@@ -79,5 +76,10 @@ func GetUser(username string) (user *User, err error) {
 		return
 	}
 	err = json.NewDecoder(bytes.NewReader(body)).Decode(&user)
+	if err != nil {
+		return
+	}
+	// Only trust keys the server has committed to in the key log
+	err = verifyUserInLog(user)
 	return
 }
@@ -0,0 +1,122 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"github.com/kyrillzorin/CS3031_Lab2/lab2"
+)
+
+// File Version Struct, a summary of one stored version of a file
+// PreviousKey lets holders of this version's shared secret decrypt the version before it
+// Pending is set on the current version while it waits to be re-encrypted after a revoke
+type FileVersion struct {
+	Version     int
+	Size        int64
+	Created     time.Time
+	Current     bool
+	Pending     bool
+	Manifest    *Manifest
+	PreviousKey []byte
+}
+
+// File Versions Struct, oldest first
+type FileVersions struct {
+	Versions []FileVersion
+}
+
+// Query selecting a version of a file, version 0 is the current version
+func versionQuery(version int) string {
+	if version == 0 {
+		return ""
+	}
+	return "?version=" + strconv.Itoa(version)
+}
+
+// Get the kept versions of a file and its current version from server
+func GetFileVersions(owner string, filename string) (versions *FileVersions, err error) {
+	res, err := AuthenticatedGet("/users/" + owner + "/" + filename + "/versions")
+	if res == nil {
+		if err == nil {
+			err = errors.New("Empty Response")
+		}
+		return
+	}
+	if res.Body == nil {
+		err = errors.New("Empty Response")
+		return
+	}
+	defer res.Body.Close()
+	if err != nil {
+		return
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return
+	}
+	var response Response
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&response)
+	if err != nil {
+		return
+	}
+	if response.Status == "failure" {
+		err = errors.New(response.Error)
+		return
+	}
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&versions)
+	return
+}
+
+// Get the shared secret of a version of a file from the user's file key, version 0 is the current version
+// Each version holds the one before it's secret, so the chain is followed back from the current version
+func versionKey(owner string, filename string, filekey *FileKey, version int) ([]byte, error) {
+	key, err := filekey.Unwrap(ClientPrivateKey, ClientDevice)
+	if err != nil {
+		return nil, err
+	}
+	file, err := GetFile(owner, filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err = dataKey(file, filekey.Epoch, key)
+	if err != nil || version == 0 {
+		return key, err
+	}
+	versions, err := GetFileVersions(owner, filename)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(versions.Versions) - 1; i >= 0; i-- {
+		v := versions.Versions[i]
+		if v.Version == version {
+			return key, nil
+		}
+		if i == 0 || len(v.PreviousKey) == 0 {
+			break
+		}
+		key, err = lab2.DecryptAES(key, v.PreviousKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("Version %d of %s doesn't exist or can't be decrypted with the current key", version, filename)
+}
+
+// Encrypt the shared secret of the current version of owner's file with the next version's key
+// Returns nil if the file doesn't exist yet or the user has no key to it
+func linkPreviousKey(owner string, filename string, key []byte) ([]byte, error) {
+	filekey, err := GetFileKey(owner, filename)
+	if err != nil {
+		return nil, nil
+	}
+	previous, err := versionKey(owner, filename, filekey, 0)
+	if err != nil {
+		return nil, err
+	}
+	return lab2.EncryptAES(key, previous)
+}
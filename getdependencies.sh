@@ -4,3 +4,7 @@ go get -u "github.com/spf13/viper"
 go get -u "github.com/dancannon/gorethink"
 go get -u "github.com/julienschmidt/httprouter"
 go get -u "github.com/unrolled/render"
+go get -u "go.etcd.io/bbolt"
+go get -u "golang.org/x/crypto/scrypt"
+go get -u "golang.org/x/crypto/hkdf"
+go get -u "golang.org/x/term"
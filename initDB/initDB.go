@@ -61,6 +61,18 @@ func main() {
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
+	_, err = r.DB("Lab2").TableCreate("filechunks").RunWrite(dbSession)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	_, err = r.DB("Lab2").Table("filechunks").IndexCreate("name").RunWrite(dbSession)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	_, err = r.DB("Lab2").TableCreate("uploads").RunWrite(dbSession)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
 	_, err = r.DB("Lab2").TableCreate("filekeys").RunWrite(dbSession)
 	if err != nil {
 		log.Fatalln(err.Error())
@@ -77,4 +89,24 @@ func main() {
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
+	_, err = r.DB("Lab2").TableCreate("recoveries").RunWrite(dbSession)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	_, err = r.DB("Lab2").Table("recoveries").IndexCreate("username").RunWrite(dbSession)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	_, err = r.DB("Lab2").TableCreate("log").RunWrite(dbSession)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	_, err = r.DB("Lab2").TableCreate("versions").RunWrite(dbSession)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	_, err = r.DB("Lab2").Table("versions").IndexCreate("name").RunWrite(dbSession)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
 }
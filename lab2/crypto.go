@@ -0,0 +1,258 @@
+package lab2
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Encrypt data to a user's encryption key, RSA keys use OAEP and X25519 keys wrap with ECDH
+func Encrypt(publicKey PublicKey, plain_text []byte) ([]byte, error) {
+	switch publicKey.Algorithm {
+	case AlgorithmRSA:
+		public_key, err := x509.ParsePKCS1PublicKey(publicKey.Key)
+		if err != nil {
+			return nil, err
+		}
+		var label, encrypted []byte
+		if encrypted, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, public_key, plain_text, label); err != nil {
+			return nil, err
+		}
+		return encrypted, nil
+	case AlgorithmX25519:
+		return wrapX25519(publicKey.Key, plain_text)
+	}
+	return nil, errors.New("Unsupported encryption key algorithm: " + publicKey.Algorithm)
+}
+
+// Decrypt data using private key, which may be held by the key agent
+func Decrypt(private_key PrivateKey, encrypted []byte) ([]byte, error) {
+	var decrypted []byte
+	var err error
+	// X25519 unwrapping has no options
+	var opts crypto.DecrypterOpts
+	if private_key.PublicKeys().Encryption.Algorithm == AlgorithmRSA {
+		opts = &rsa.OAEPOptions{Hash: crypto.SHA256}
+	}
+	if decrypted, err = private_key.Decrypt(rand.Reader, encrypted, opts); err != nil {
+		return nil, err
+	}
+	return decrypted, nil
+}
+
+// Sign message using private key, which may be held by the key agent
+// RSA keys sign a SHA-256 hash with PSS, Ed25519 keys sign the message itself
+func Sign(privateKey PrivateKey, message []byte) ([]byte, error) {
+	if privateKey.PublicKeys().Signing.Algorithm == AlgorithmEd25519 {
+		return privateKey.Sign(rand.Reader, message, crypto.Hash(0))
+	}
+	hasher := crypto.SHA256.New()
+	hasher.Write(message)
+	hashed := hasher.Sum(nil)
+	opts := rsa.PSSOptions{Hash: crypto.SHA256}
+	signature, err := privateKey.Sign(rand.Reader, hashed, &opts)
+	if err != nil {
+		return nil, err
+	}
+	return signature, nil
+}
+
+// Verify a signature made with Sign by the holder of publicKey
+func VerifySignature(publicKey PublicKey, message []byte, signature []byte) bool {
+	key, err := publicKey.CryptoPublicKey()
+	if err != nil {
+		return false
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		hashed := sha256.Sum256(message)
+		return rsa.VerifyPSS(key, crypto.SHA256, hashed[:], signature, nil) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, message, signature)
+	}
+	return false
+}
+
+// HKDF info for keys wrapped to X25519 keys
+var x25519WrapInfo = []byte("CS3031 Lab2 X25519 key wrap")
+
+// Wrap data to an X25519 public key: an ephemeral key followed by an AES-GCM envelope
+// under a key derived from the shared secret
+func wrapX25519(recipient []byte, data []byte) ([]byte, error) {
+	publicKey, err := ecdh.X25519().NewPublicKey(recipient)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := deriveWrapKey(shared, ephemeral.PublicKey().Bytes(), recipient)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := EncryptAES(key, data)
+	if err != nil {
+		return nil, err
+	}
+	return append(ephemeral.PublicKey().Bytes(), wrapped...), nil
+}
+
+// Unwrap data wrapped to an X25519 private key
+func unwrapX25519(privateKey *ecdh.PrivateKey, wrapped []byte) ([]byte, error) {
+	// Wrapped keys are always GCM envelopes, never legacy CFB
+	if len(wrapped) < 32 || !bytes.HasPrefix(wrapped[32:], envelopeMagic) {
+		return nil, ErrIntegrity
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(wrapped[:32])
+	if err != nil {
+		return nil, ErrIntegrity
+	}
+	shared, err := privateKey.ECDH(ephemeral)
+	if err != nil {
+		return nil, ErrIntegrity
+	}
+	key, err := deriveWrapKey(shared, wrapped[:32], privateKey.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return decryptAESGCM(key, wrapped[32:])
+}
+
+// Derive the AES key for a key wrap from the ECDH shared secret, bound to both public keys
+func deriveWrapKey(shared []byte, ephemeral []byte, recipient []byte) ([]byte, error) {
+	info := append(append(append([]byte(nil), x25519WrapInfo...), ephemeral...), recipient...)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, nil, info), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Ciphertext envelope header: magic, format version, algorithm id, then the nonce
+var envelopeMagic = []byte("L2CE")
+
+const (
+	envelopeVersion   byte = 1
+	algorithmAESGCM   byte = 1
+	envelopeHeaderLen      = 6
+)
+
+// Returned when a ciphertext fails authentication
+var ErrIntegrity = errors.New("File integrity check failed: the file has been tampered with or the key is wrong")
+
+// Encrypt data using AES key in GCM mode, wrapped in a versioned envelope
+func EncryptAES(key, data []byte) ([]byte, error) {
+	var err error
+	var block cipher.Block
+	if block, err = aes.NewCipher(key); err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, envelopeHeaderLen+gcm.NonceSize())
+	copy(header, envelopeMagic)
+	header[4] = envelopeVersion
+	header[5] = algorithmAESGCM
+	nonce := header[envelopeHeaderLen:]
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	// The header is authenticated along with the data
+	return gcm.Seal(header, nonce, data, header), nil
+}
+
+// Decrypt a versioned envelope using AES key, data without an envelope fails the integrity check
+// so the server can't downgrade a file to unauthenticated AES-CFB by stripping the envelope
+func DecryptAES(key, encryptedData []byte) ([]byte, error) {
+	if !bytes.HasPrefix(encryptedData, envelopeMagic) || len(encryptedData) < envelopeHeaderLen {
+		return nil, ErrIntegrity
+	}
+	if encryptedData[4] != envelopeVersion {
+		return nil, fmt.Errorf("Unsupported ciphertext format version: %d", encryptedData[4])
+	}
+	switch encryptedData[5] {
+	case algorithmAESGCM:
+		return decryptAESGCM(key, encryptedData)
+	}
+	return nil, fmt.Errorf("Unsupported encryption algorithm: %d", encryptedData[5])
+}
+
+// Decrypt an AES-GCM envelope
+func decryptAESGCM(key, encryptedData []byte) ([]byte, error) {
+	var err error
+	var block cipher.Block
+	if block, err = aes.NewCipher(key); err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	headerLen := envelopeHeaderLen + gcm.NonceSize()
+	if len(encryptedData) < headerLen+gcm.Overhead() {
+		return nil, ErrIntegrity
+	}
+	header := encryptedData[:headerLen]
+	nonce := header[envelopeHeaderLen:]
+	data, err := gcm.Open(nil, nonce, encryptedData[headerLen:], header)
+	if err != nil {
+		return nil, ErrIntegrity
+	}
+	return data, nil
+}
+
+// Decrypt a file stored before the envelope was added, which may be legacy AES-CFB
+// Only for files the server recorded as legacy, CFB data has no integrity check
+func DecryptLegacyAES(key, encryptedData []byte) ([]byte, error) {
+	if bytes.HasPrefix(encryptedData, envelopeMagic) {
+		return DecryptAES(key, encryptedData)
+	}
+	return decryptAESCFB(key, encryptedData)
+}
+
+// Decrypt legacy data encrypted using AES key in CFB mode
+func decryptAESCFB(key, encryptedData []byte) ([]byte, error) {
+	var err error
+	var block cipher.Block
+	if block, err = aes.NewCipher(key); err != nil {
+		return nil, err
+	}
+
+	if len(encryptedData) < aes.BlockSize {
+		err = errors.New("encryptedData too short")
+		return nil, err
+	}
+	initVector := encryptedData[:aes.BlockSize]
+	encryptedData = encryptedData[aes.BlockSize:]
+	stream := cipher.NewCFBDecrypter(block, initVector)
+	stream.XORKeyStream(encryptedData, encryptedData)
+	return encryptedData, nil
+}
+
+// Generate new AES (256) key
+func GenerateAESKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
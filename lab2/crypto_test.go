@@ -0,0 +1,179 @@
+package lab2
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+)
+
+// Small RSA key to keep the tests fast, the client uses RSAKeyBits
+func newTestRSAKey(t *testing.T) RSAKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return RSAKey{key}
+}
+
+func newTestKeyPair(t *testing.T) *KeyPair {
+	key, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	for _, key := range []PrivateKey{newTestRSAKey(t), newTestKeyPair(t)} {
+		algorithm := key.PublicKeys().Encryption.Algorithm
+		encrypted, err := Encrypt(key.PublicKeys().Encryption, secret)
+		if err != nil {
+			t.Fatalf("%s encrypt: %v", algorithm, err)
+		}
+		decrypted, err := Decrypt(key, encrypted)
+		if err != nil || !bytes.Equal(decrypted, secret) {
+			t.Errorf("%s decrypt = %q %v", algorithm, decrypted, err)
+		}
+		encrypted[len(encrypted)-1] ^= 1
+		if _, err := Decrypt(key, encrypted); err == nil {
+			t.Errorf("%s decrypted a tampered key", algorithm)
+		}
+	}
+	if _, err := Encrypt(PublicKey{"dsa", []byte("key")}, secret); err == nil {
+		t.Error("encrypted to an unsupported algorithm")
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	message := []byte("message")
+	other := newTestKeyPair(t)
+	for _, key := range []PrivateKey{newTestRSAKey(t), newTestKeyPair(t)} {
+		algorithm := key.PublicKeys().Signing.Algorithm
+		signature, err := Sign(key, message)
+		if err != nil {
+			t.Fatalf("%s sign: %v", algorithm, err)
+		}
+		if !VerifySignature(key.PublicKeys().Signing, message, signature) {
+			t.Errorf("%s signature doesn't verify", algorithm)
+		}
+		if VerifySignature(key.PublicKeys().Signing, []byte("other message"), signature) {
+			t.Errorf("%s signature verifies another message", algorithm)
+		}
+		if VerifySignature(other.PublicKeys().Signing, message, signature) {
+			t.Errorf("%s signature verifies with another key", algorithm)
+		}
+	}
+	if VerifySignature(PublicKey{AlgorithmX25519, make([]byte, 32)}, message, nil) {
+		t.Error("verified with an encryption key")
+	}
+}
+
+func TestKeyPairMarshal(t *testing.T) {
+	key := newTestKeyPair(t)
+	parsed, err := ParseKeyPair(key.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.PublicKeys().Signing.Equal(key.PublicKeys().Signing) || !parsed.PublicKeys().Encryption.Equal(key.PublicKeys().Encryption) {
+		t.Errorf("parsed key set = %+v, want %+v", parsed.PublicKeys(), key.PublicKeys())
+	}
+	if _, err := ParseKeyPair(key.Marshal()[1:]); err == nil {
+		t.Error("parsed a truncated key pair")
+	}
+}
+
+func TestEncryptAES(t *testing.T) {
+	key, err := GenerateAESKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := EncryptAES(key, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := DecryptAES(key, encrypted)
+	if err != nil || string(decrypted) != "data" {
+		t.Errorf("decrypt = %q %v", decrypted, err)
+	}
+	otherKey, _ := GenerateAESKey()
+	if _, err := DecryptAES(otherKey, encrypted); err != ErrIntegrity {
+		t.Errorf("decrypt with another key: got %v, want ErrIntegrity", err)
+	}
+	for i := range encrypted {
+		tampered := append([]byte(nil), encrypted...)
+		tampered[i] ^= 1
+		if _, err := DecryptAES(key, tampered); err == nil {
+			t.Errorf("decrypted data with byte %d flipped", i)
+		}
+	}
+	if _, err := DecryptAES(key, encrypted[:len(encrypted)-1]); err != ErrIntegrity {
+		t.Errorf("decrypt truncated: got %v, want ErrIntegrity", err)
+	}
+	for _, data := range [][]byte{nil, []byte("L2C"), []byte("L2CE"), encrypted[len(envelopeMagic):]} {
+		if _, err := DecryptAES(key, data); err != ErrIntegrity {
+			t.Errorf("decrypt %x: got %v, want ErrIntegrity", data, err)
+		}
+	}
+}
+
+// Encrypt data with AES-CFB like clients did before the envelope
+func encryptLegacyAES(t *testing.T, key, data []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := make([]byte, aes.BlockSize+len(data))
+	if _, err := rand.Read(encrypted[:aes.BlockSize]); err != nil {
+		t.Fatal(err)
+	}
+	cipher.NewCFBEncrypter(block, encrypted[:aes.BlockSize]).XORKeyStream(encrypted[aes.BlockSize:], data)
+	return encrypted
+}
+
+func TestDecryptLegacyAES(t *testing.T) {
+	key, _ := GenerateAESKey()
+	legacy := encryptLegacyAES(t, key, []byte("legacy data"))
+	decrypted, err := DecryptLegacyAES(key, legacy)
+	if err != nil || string(decrypted) != "legacy data" {
+		t.Errorf("legacy decrypt = %q %v", decrypted, err)
+	}
+	// Without the legacy flag CFB data is refused rather than decrypted unauthenticated
+	if _, err := DecryptAES(key, legacy); err != ErrIntegrity {
+		t.Errorf("decrypt legacy data without the flag: got %v, want ErrIntegrity", err)
+	}
+	// Envelopes are still checked on the legacy path
+	encrypted, _ := EncryptAES(key, []byte("data"))
+	decrypted, err = DecryptLegacyAES(key, encrypted)
+	if err != nil || string(decrypted) != "data" {
+		t.Errorf("legacy decrypt of an envelope = %q %v", decrypted, err)
+	}
+	encrypted[len(encrypted)-1] ^= 1
+	if _, err := DecryptLegacyAES(key, encrypted); err != ErrIntegrity {
+		t.Errorf("legacy decrypt of a tampered envelope: got %v, want ErrIntegrity", err)
+	}
+	if _, err := DecryptLegacyAES(key, legacy[:aes.BlockSize-1]); err == nil {
+		t.Error("legacy decrypt of truncated data")
+	}
+}
+
+func TestSignedRequest(t *testing.T) {
+	key := newTestKeyPair(t)
+	s, err := NewSignedRequest("alice", key, "/uploadfile", []byte("message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Username != "alice" || s.Path != "/uploadfile" || len(s.Nonce) != 16 || s.Timestamp == 0 {
+		t.Errorf("signed request = %+v", s)
+	}
+	other, err := NewSignedRequest("alice", key, "/uploadfile", []byte("message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(s.Nonce, other.Nonce) {
+		t.Error("requests share a nonce")
+	}
+}
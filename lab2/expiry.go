@@ -0,0 +1,31 @@
+package lab2
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parse how long a share lasts, a number of days like 7d or a duration like 12h
+func ParseExpiry(expiry string) (time.Time, error) {
+	var duration time.Duration
+	if strings.HasSuffix(expiry, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(expiry, "d"))
+		if err != nil {
+			return time.Time{}, errors.New("Expiry must be a number of days like 7d or a duration like 12h")
+		}
+		duration = time.Duration(days) * 24 * time.Hour
+	} else {
+		var err error
+		duration, err = time.ParseDuration(expiry)
+		if err != nil {
+			return time.Time{}, errors.New("Expiry must be a number of days like 7d or a duration like 12h")
+		}
+	}
+	if duration <= 0 {
+		return time.Time{}, errors.New("Expiry must be in the future")
+	}
+	// Whole seconds, as the expiry is signed and some stores keep less precision
+	return time.Now().Add(duration).UTC().Truncate(time.Second), nil
+}
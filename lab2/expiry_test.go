@@ -0,0 +1,35 @@
+package lab2
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseExpiry(t *testing.T) {
+	tests := []struct {
+		expiry string
+		want   time.Duration
+	}{
+		{"7d", 7 * 24 * time.Hour},
+		{"1d", 24 * time.Hour},
+		{"12h", 12 * time.Hour},
+		{"90m", 90 * time.Minute},
+	}
+	for _, test := range tests {
+		before := time.Now()
+		expires, err := ParseExpiry(test.expiry)
+		if err != nil {
+			t.Errorf("%s: %v", test.expiry, err)
+			continue
+		}
+		if expires.Before(before.Add(test.want).Truncate(time.Second)) || expires.After(time.Now().Add(test.want)) ||
+			expires.Location() != time.UTC || expires.Nanosecond() != 0 {
+			t.Errorf("%s: expires %v, want about %v from now", test.expiry, expires, test.want)
+		}
+	}
+	for _, expiry := range []string{"", "d", "7", "xd", "1w", "0d", "-1d", "0h", "-2h"} {
+		if _, err := ParseExpiry(expiry); err == nil {
+			t.Errorf("%q: parsed", expiry)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package lab2
+
+import "time"
+
+// File Key Struct
+// DeviceKeys holds the shared secret encrypted for each of the user's devices by device name,
+// Key holds it encrypted for their first device
+// Epoch is the file's key epoch the secret belongs to, it goes up each time access is revoked
+// Role is reader, writer or manager, writers can upload new versions and managers can also share and revoke
+// Expires is when the share ends, zero if it doesn't
+// Grant is the role and expiry signed by whoever shared the key, writers and managers need one
+type FileKey struct {
+	Id         string
+	User       string
+	Owner      string
+	Name       string
+	Key        []byte
+	DeviceKeys map[string][]byte
+	Epoch      int
+	Role       string `json:",omitempty"`
+	Expires    time.Time
+	Grant      *Grant `json:",omitempty"`
+}
+
+// Create New File Key
+func NewFileKey(user string, owner string, name string, key []byte) *FileKey {
+	f := new(FileKey)
+	f.User = user
+	f.Owner = owner
+	f.Name = name
+	f.Key = key
+	return f
+}
+
+// Encrypt the shared secret for each of user's devices
+func (f *FileKey) Wrap(user *User, secret []byte) (err error) {
+	f.Key, f.DeviceKeys, err = WrapForUser(user, secret)
+	return
+}
+
+// Decrypt the shared secret with the private key of device
+func (f *FileKey) Unwrap(key PrivateKey, device string) ([]byte, error) {
+	return UnwrapForDevice(key, device, f.Key, f.DeviceKeys)
+}
+
+// Encrypt a secret for each of user's devices, and for their first device on its own for servers that predate devices
+func WrapForUser(user *User, secret []byte) (key []byte, deviceKeys map[string][]byte, err error) {
+	keys := user.Keys
+	if len(user.Devices) > 0 {
+		keys = user.Devices[0].Keys
+	}
+	key, err = Encrypt(keys.Encryption, secret)
+	if err != nil {
+		return
+	}
+	deviceKeys = make(map[string][]byte)
+	for _, device := range user.Devices {
+		deviceKeys[device.Name], err = Encrypt(device.Keys.Encryption, secret)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Decrypt a secret wrapped by WrapForUser with the private key of device
+func UnwrapForDevice(privateKey PrivateKey, device string, key []byte, deviceKeys map[string][]byte) ([]byte, error) {
+	if deviceKey, ok := deviceKeys[device]; ok {
+		return Decrypt(privateKey, deviceKey)
+	}
+	return Decrypt(privateKey, key)
+}
@@ -0,0 +1,36 @@
+package lab2
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFileKeyWrap(t *testing.T) {
+	laptop := newTestKeyPair(t)
+	phone := newTestRSAKey(t)
+	user := NewUser("alice", "laptop", laptop.PublicKeys())
+	user.Devices = append(user.Devices, Device{Name: "phone", Keys: phone.PublicKeys()})
+	secret := []byte("0123456789abcdef0123456789abcdef")
+
+	f := NewFileKey("alice", "alice", "a.txt", nil)
+	if err := f.Wrap(user, secret); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.DeviceKeys) != 2 || len(f.Key) == 0 {
+		t.Fatalf("wrapped key = %+v", f)
+	}
+	for device, key := range map[string]PrivateKey{"laptop": laptop, "phone": phone} {
+		got, err := f.Unwrap(key, device)
+		if err != nil || !bytes.Equal(got, secret) {
+			t.Errorf("%s unwrap = %x %v", device, got, err)
+		}
+	}
+	// Devices without a key of their own use the first device's key
+	got, err := f.Unwrap(laptop, "desktop")
+	if err != nil || !bytes.Equal(got, secret) {
+		t.Errorf("unwrap for unknown device = %x %v", got, err)
+	}
+	if _, err := f.Unwrap(phone, "laptop"); err == nil {
+		t.Error("unwrapped another device's key")
+	}
+}
@@ -0,0 +1,132 @@
+package lab2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Roles a file key can give its user, see FileKey
+const (
+	RoleReader  = "reader"
+	RoleWriter  = "writer"
+	RoleManager = "manager"
+)
+
+// Grant Struct, a role on owner's file given to User and signed by one of Signer's devices
+// Signer is the owner, or a manager whose own grant from the owner is Manager
+// Writers attach their grant to the manifests they sign, so readers can check the server didn't make them a writer
+type Grant struct {
+	Owner     string
+	Name      string
+	User      string
+	Role      string
+	Expires   time.Time
+	Signer    string
+	Device    string
+	Manager   *Grant `json:",omitempty"`
+	Signature []byte
+}
+
+// Data covered by the grant signature, must match the server's
+// The manager's grant is signed by the owner on its own, so it can be signed again without this one
+type grantData struct {
+	Owner   string
+	Name    string
+	User    string
+	Role    string
+	Expires time.Time
+	Signer  string
+	Device  string
+}
+
+// Give user role on owner's file until expires as signer with key, the key of signer's device
+// manager is the signer's own grant from the owner when the signer isn't the owner
+func NewGrant(owner string, name string, user string, role string, expires time.Time, signer string, device string, key PrivateKey, manager *Grant) (*Grant, error) {
+	g := &Grant{Owner: owner, Name: name, User: user, Role: role, Expires: expires, Signer: signer, Device: device}
+	if signer != owner {
+		g.Manager = manager
+	}
+	err := g.Sign(key)
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *Grant) data() ([]byte, error) {
+	return json.Marshal(grantData{g.Owner, g.Name, g.User, g.Role, g.Expires, g.Signer, g.Device})
+}
+
+// Sign the grant with key, which must be the key of the grant's device
+func (g *Grant) Sign(key PrivateKey) error {
+	data, err := g.data()
+	if err != nil {
+		return err
+	}
+	g.Signature, err = Sign(key, data)
+	return err
+}
+
+// Check the grant on its own, without the manager's grant within it, was signed by one of signer's devices
+func (g *Grant) VerifySignature(signer *User) error {
+	if signer.Username != g.Signer {
+		return errors.New("Grant does not match its signer")
+	}
+	device := signer.Device(g.Device)
+	if device == nil {
+		return fmt.Errorf("WARNING: %s's role on %s was granted by a device %s doesn't have, the server may have changed it", g.User, g.Name, g.Signer)
+	}
+	data, err := g.data()
+	if err != nil {
+		return err
+	}
+	if !VerifySignature(device.Keys.Signing, data, g.Signature) {
+		return fmt.Errorf("WARNING: The grant of %s's role on %s doesn't match %s's keys, the server may have changed it", g.User, g.Name, g.Signer)
+	}
+	return nil
+}
+
+// Whether the grant, or the grant of the manager who gave it, had expired at t
+func (g *Grant) Expired(t time.Time) bool {
+	if !g.Expires.IsZero() && !t.Before(g.Expires) {
+		return true
+	}
+	return g.Manager != nil && g.Manager.Expired(t)
+}
+
+// Check the grant gives user a role on owner's file name and was signed by the owner,
+// or by a manager with a grant of the manager role signed by the owner. users gets the keys of a signer
+func (g *Grant) Verify(owner string, name string, user string, users func(string) (*User, error)) error {
+	if g.Owner != owner || g.Name != name || g.User != user {
+		return errors.New("Grant does not match file")
+	}
+	ownerUser, err := users(owner)
+	if err != nil {
+		return err
+	}
+	if g.Signer == owner {
+		return g.VerifySignature(ownerUser)
+	}
+	// Only the owner can give out the manager role, so a grant from a manager needs the owner's grant to them
+	m := g.Manager
+	if g.Role == RoleManager || m == nil || m.Role != RoleManager || m.Signer != owner ||
+		m.Owner != owner || m.Name != name || m.User != g.Signer {
+		return fmt.Errorf("WARNING: %s's role on %s was granted by %s, who isn't a manager of it", g.User, g.Name, g.Signer)
+	}
+	err = m.VerifySignature(ownerUser)
+	if err != nil {
+		return err
+	}
+	signer, err := users(g.Signer)
+	if err != nil {
+		return err
+	}
+	return g.VerifySignature(signer)
+}
+
+// Whether the grant lets its user sign new versions of the file
+func (g *Grant) CanWrite() bool {
+	return g.Role == RoleWriter || g.Role == RoleManager
+}
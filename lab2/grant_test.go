@@ -0,0 +1,146 @@
+package lab2
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Users and keys of a file shared by alice with carol as a manager
+type grantTest struct {
+	t     *testing.T
+	keys  map[string]*KeyPair
+	users map[string]*User
+}
+
+func newGrantTest(t *testing.T) *grantTest {
+	g := &grantTest{t, make(map[string]*KeyPair), make(map[string]*User)}
+	for _, name := range []string{"alice", "bob", "carol", "mallory"} {
+		g.keys[name] = newTestKeyPair(t)
+		g.users[name] = NewUser(name, "laptop", g.keys[name].PublicKeys())
+	}
+	return g
+}
+
+func (g *grantTest) lookup(name string) (*User, error) {
+	if user, ok := g.users[name]; ok {
+		return user, nil
+	}
+	return nil, errors.New("User does not exist")
+}
+
+func (g *grantTest) grant(signer string, user string, role string, expires time.Time, manager *Grant) *Grant {
+	grant, err := NewGrant("alice", "a.txt", user, role, expires, signer, "laptop", g.keys[signer], manager)
+	if err != nil {
+		g.t.Fatal(err)
+	}
+	return grant
+}
+
+func TestGrant(t *testing.T) {
+	g := newGrantTest(t)
+	writer := g.grant("alice", "bob", RoleWriter, time.Time{}, nil)
+	if err := writer.Verify("alice", "a.txt", "bob", g.lookup); err != nil {
+		t.Errorf("owner's grant: %v", err)
+	}
+	manager := g.grant("alice", "carol", RoleManager, time.Time{}, nil)
+	chained := g.grant("carol", "bob", RoleWriter, time.Time{}, manager)
+	if err := chained.Verify("alice", "a.txt", "bob", g.lookup); err != nil {
+		t.Errorf("manager's grant: %v", err)
+	}
+	if g.grant("alice", "bob", RoleWriter, time.Time{}, manager).Manager != nil {
+		t.Error("owner's grant kept a manager grant")
+	}
+
+	tests := []struct {
+		name  string
+		grant *Grant
+		user  string
+	}{
+		{"other user", writer, "mallory"},
+		{"signed by a non-manager", g.grant("mallory", "bob", RoleWriter, time.Time{}, nil), "bob"},
+		{"manager's grant from a writer", g.grant("carol", "bob", RoleWriter, time.Time{}, g.grant("alice", "carol", RoleWriter, time.Time{}, nil)), "bob"},
+		{"manager's grant for another user", g.grant("mallory", "bob", RoleWriter, time.Time{}, manager), "bob"},
+		{"manager's grant signed by a manager", g.grant("carol", "bob", RoleWriter, time.Time{}, g.grant("carol", "carol", RoleManager, time.Time{}, manager)), "bob"},
+		{"manager grants manager", g.grant("carol", "bob", RoleManager, time.Time{}, manager), "bob"},
+		{"unknown signer", func() *Grant { w := *writer; w.Signer = "nobody"; return &w }(), "bob"},
+		{"role changed", func() *Grant { w := *writer; w.Role = RoleManager; return &w }(), "bob"},
+		{"expiry changed", func() *Grant { w := *writer; w.Expires = time.Now(); return &w }(), "bob"},
+		{"unknown device", func() *Grant { w := *writer; w.Device = "phone"; return &w }(), "bob"},
+		{"signed by another key", func() *Grant { w := *writer; w.Sign(g.keys["mallory"]); return &w }(), "bob"},
+		{"manager's grant changed", func() *Grant {
+			m := *manager
+			m.User = "mallory"
+			return g.grant("mallory", "bob", RoleWriter, time.Time{}, &m)
+		}(), "bob"},
+	}
+	for _, test := range tests {
+		if err := test.grant.Verify("alice", "a.txt", test.user, g.lookup); err == nil {
+			t.Errorf("%s: grant verified", test.name)
+		}
+	}
+	if err := writer.Verify("alice", "b.txt", "bob", g.lookup); err == nil {
+		t.Error("grant verified for another file")
+	}
+
+	// The manager's grant can be signed again on its own, when the owner's key changes
+	resigned := *manager
+	resigned.Sign(g.keys["alice"])
+	chained.Manager = &resigned
+	if err := chained.Verify("alice", "a.txt", "bob", g.lookup); err != nil {
+		t.Errorf("grant with a re-signed manager grant: %v", err)
+	}
+}
+
+func TestGrantExpiry(t *testing.T) {
+	g := newGrantTest(t)
+	now := time.Now()
+	expiring := g.grant("alice", "bob", RoleWriter, now, nil)
+	if expiring.Expired(now.Add(-time.Second)) || !expiring.Expired(now) {
+		t.Error("grant expiry")
+	}
+	manager := g.grant("alice", "carol", RoleManager, now, nil)
+	if !g.grant("carol", "bob", RoleWriter, time.Time{}, manager).Expired(now) {
+		t.Error("grant from a manager whose grant expired hasn't expired")
+	}
+	if g.grant("alice", "bob", RoleWriter, time.Time{}, nil).Expired(now.Add(time.Hour)) {
+		t.Error("grant without expiry expired")
+	}
+}
+
+func TestManifestGrant(t *testing.T) {
+	g := newGrantTest(t)
+	owned, err := NewManifest("alice", "a.txt", 1, []byte("hash"), "alice", "laptop", g.keys["alice"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := owned.VerifyGrant(g.lookup); err != nil {
+		t.Errorf("owner's manifest: %v", err)
+	}
+	written, err := NewManifest("alice", "a.txt", 2, []byte("hash"), "bob", "laptop", g.keys["bob"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := written.VerifyGrant(g.lookup); err == nil {
+		t.Error("writer's manifest without a grant verified")
+	}
+	written.Grant = g.grant("alice", "bob", RoleWriter, time.Time{}, nil)
+	if err := written.VerifyGrant(g.lookup); err != nil {
+		t.Errorf("writer's manifest: %v", err)
+	}
+	// The grant isn't covered by the manifest's signature
+	if err := written.Verify(g.users["bob"], "alice", "a.txt"); err != nil {
+		t.Errorf("writer's manifest with a grant: %v", err)
+	}
+
+	for name, grant := range map[string]*Grant{
+		"reader's grant":   g.grant("alice", "bob", RoleReader, time.Time{}, nil),
+		"expired grant":    g.grant("alice", "bob", RoleWriter, time.Unix(written.Timestamp, 0), nil),
+		"grant of another": g.grant("alice", "carol", RoleWriter, time.Time{}, nil),
+	} {
+		written.Grant = grant
+		if err := written.VerifyGrant(g.lookup); err == nil {
+			t.Errorf("writer's manifest with %s verified", name)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package lab2
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// PEM block types of passphrase protected RSA keys and Ed25519 X25519 key pairs
+const (
+	EncryptedKeyType     = "ENCRYPTED RSA PRIVATE KEY"
+	EncryptedKeyPairType = "ENCRYPTED ED25519 X25519 PRIVATE KEY"
+)
+
+// scrypt cost parameters for new key files, N=2^15 and r=8 need 32MB of memory per attempt
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// Range of N accepted when decrypting, so an edited key file can't weaken the KDF
+// or make decrypting it use gigabytes of memory
+const (
+	minScryptN = 1 << 15
+	maxScryptN = 1 << 20
+)
+
+// Version header of key files whose PEM type and headers are authenticated,
+// files without it are decrypted without them and should be saved again
+const KeyFileVersion = "2"
+
+// Returned when a private key can't be decrypted with the given passphrase
+var ErrPassphrase = errors.New("Incorrect passphrase")
+
+// Derive the AES key protecting a private key from the passphrase
+func deriveKeyFileKey(passphrase []byte, salt []byte, n, r, p int) ([]byte, error) {
+	return scrypt.Key(passphrase, salt, n, r, p, 32)
+}
+
+// Encrypt a private key under a passphrase, the KDF parameters are stored in the PEM headers
+func EncryptPrivateKey(privateKey PrivateKey, passphrase []byte) (*pem.Block, error) {
+	var blockType string
+	var der []byte
+	switch key := privateKey.(type) {
+	case RSAKey:
+		blockType, der = EncryptedKeyType, x509.MarshalPKCS1PrivateKey(key.PrivateKey)
+	case *KeyPair:
+		blockType, der = EncryptedKeyPairType, key.Marshal()
+	default:
+		return nil, errors.New("Private key held by the key agent can't be saved")
+	}
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	key, err := deriveKeyFileKey(passphrase, salt, scryptN, scryptR, scryptP)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newKeyFileCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	block := &pem.Block{
+		Type: blockType,
+		Headers: map[string]string{
+			"Version": KeyFileVersion,
+			"KDF":     "scrypt",
+			"Salt":    hex.EncodeToString(salt),
+			"N":       strconv.Itoa(scryptN),
+			"R":       strconv.Itoa(scryptR),
+			"P":       strconv.Itoa(scryptP),
+		},
+	}
+	block.Bytes = aead.Seal(nonce, nonce, der, keyFileData(block))
+	return block, nil
+}
+
+// Additional data authenticated with a key file, its PEM type and headers in sorted order
+func keyFileData(block *pem.Block) []byte {
+	names := make([]string, 0, len(block.Headers))
+	for name := range block.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString(block.Type + "\n")
+	for _, name := range names {
+		b.WriteString(name + ": " + block.Headers[name] + "\n")
+	}
+	return []byte(b.String())
+}
+
+// Decrypt a passphrase protected private key
+func DecryptPrivateKey(block *pem.Block, passphrase []byte) (PrivateKey, error) {
+	if block.Headers["KDF"] != "scrypt" {
+		return nil, fmt.Errorf("Unsupported key derivation function: %s", block.Headers["KDF"])
+	}
+	salt, err := hex.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, errors.New("Invalid private key salt")
+	}
+	n, errN := strconv.Atoi(block.Headers["N"])
+	r, errR := strconv.Atoi(block.Headers["R"])
+	p, errP := strconv.Atoi(block.Headers["P"])
+	if errN != nil || errR != nil || errP != nil ||
+		n < minScryptN || n > maxScryptN || n&(n-1) != 0 || r != scryptR || p != scryptP {
+		return nil, errors.New("Invalid private key KDF parameters")
+	}
+	key, err := deriveKeyFileKey(passphrase, salt, n, r, p)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newKeyFileCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(block.Bytes) < aead.NonceSize() {
+		return nil, errors.New("Invalid private key")
+	}
+	nonce, encrypted := block.Bytes[:aead.NonceSize()], block.Bytes[aead.NonceSize():]
+	var data []byte
+	if _, ok := block.Headers["Version"]; ok {
+		data = keyFileData(block)
+	}
+	der, err := aead.Open(nil, nonce, encrypted, data)
+	if err != nil {
+		return nil, ErrPassphrase
+	}
+	if block.Type == EncryptedKeyPairType {
+		return ParseKeyPair(der)
+	}
+	privateKey, err := x509.ParsePKCS1PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	return RSAKey{privateKey}, nil
+}
+
+func newKeyFileCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
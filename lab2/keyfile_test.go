@@ -0,0 +1,113 @@
+package lab2
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"strconv"
+	"testing"
+)
+
+// Copy a key file so tests can edit its headers
+func copyBlock(block *pem.Block) *pem.Block {
+	headers := make(map[string]string)
+	for name, value := range block.Headers {
+		headers[name] = value
+	}
+	return &pem.Block{Type: block.Type, Headers: headers, Bytes: block.Bytes}
+}
+
+func TestEncryptDecryptPrivateKey(t *testing.T) {
+	passphrase := []byte("passphrase")
+	for _, key := range []PrivateKey{newTestRSAKey(t), newTestKeyPair(t)} {
+		algorithm := key.PublicKeys().Signing.Algorithm
+		block, err := EncryptPrivateKey(key, passphrase)
+		if err != nil {
+			t.Fatalf("%s encrypt: %v", algorithm, err)
+		}
+		decrypted, err := DecryptPrivateKey(block, passphrase)
+		if err != nil {
+			t.Fatalf("%s decrypt: %v", algorithm, err)
+		}
+		if !decrypted.PublicKeys().Signing.Equal(key.PublicKeys().Signing) ||
+			!decrypted.PublicKeys().Encryption.Equal(key.PublicKeys().Encryption) {
+			t.Errorf("%s decrypted a different key", algorithm)
+		}
+		if _, err := DecryptPrivateKey(block, []byte("wrong")); err != ErrPassphrase {
+			t.Errorf("%s wrong passphrase: got %v", algorithm, err)
+		}
+	}
+}
+
+func TestDecryptPrivateKeyHeaders(t *testing.T) {
+	passphrase := []byte("passphrase")
+	block, err := EncryptPrivateKey(newTestKeyPair(t), passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// KDF parameters outside the accepted range are refused before deriving a key
+	for _, tc := range []struct{ name, value string }{
+		{"N", strconv.Itoa(1 << 14)},
+		{"N", strconv.Itoa(1 << 21)},
+		{"N", strconv.Itoa(3 << 15)},
+		{"N", "bogus"},
+		{"R", "1"},
+		{"R", "16"},
+		{"P", "2"},
+	} {
+		edited := copyBlock(block)
+		edited.Headers[tc.name] = tc.value
+		if _, err := DecryptPrivateKey(edited, passphrase); err == nil || err == ErrPassphrase {
+			t.Errorf("%s=%s: got %v", tc.name, tc.value, err)
+		}
+	}
+
+	// Headers within the range are authenticated, so editing them fails like a wrong passphrase
+	for _, edit := range []func(*pem.Block){
+		func(b *pem.Block) { b.Headers["N"] = strconv.Itoa(1 << 16) },
+		func(b *pem.Block) { b.Headers["Comment"] = "added" },
+		func(b *pem.Block) { b.Type = EncryptedKeyType },
+		func(b *pem.Block) { delete(b.Headers, "Version") },
+	} {
+		edited := copyBlock(block)
+		edit(edited)
+		if _, err := DecryptPrivateKey(edited, passphrase); err != ErrPassphrase {
+			t.Errorf("edited %+v: got %v", edited.Headers, err)
+		}
+	}
+}
+
+// Key files sealed before the headers were authenticated still decrypt
+func TestDecryptUnversionedPrivateKey(t *testing.T) {
+	passphrase := []byte("passphrase")
+	key := newTestRSAKey(t)
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	aesKey, err := deriveKeyFileKey(passphrase, salt, scryptN, scryptR, scryptP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := newKeyFileCipher(aesKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	block := &pem.Block{
+		Type: EncryptedKeyType,
+		Headers: map[string]string{
+			"KDF":  "scrypt",
+			"Salt": hex.EncodeToString(salt),
+			"N":    strconv.Itoa(scryptN),
+			"R":    strconv.Itoa(scryptR),
+			"P":    strconv.Itoa(scryptP),
+		},
+		Bytes: aead.Seal(nonce, nonce, x509.MarshalPKCS1PrivateKey(key.PrivateKey), nil),
+	}
+	decrypted, err := DecryptPrivateKey(block, passphrase)
+	if err != nil || !decrypted.PublicKeys().Signing.Equal(key.PublicKeys().Signing) {
+		t.Errorf("unversioned key file: got %v", err)
+	}
+}
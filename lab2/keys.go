@@ -0,0 +1,163 @@
+// Package lab2 holds the client side of the storage protocol: keys, file encryption, signed
+// requests, file keys and manifests. The client uses it and the server tests speak the protocol with it
+package lab2
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"io"
+)
+
+// Public key algorithms, must match the server's
+// RSA keys are PKCS#1 DER encoded, Ed25519 and X25519 keys are their raw 32 bytes
+const (
+	AlgorithmRSA     = "rsa"
+	AlgorithmEd25519 = "ed25519"
+	AlgorithmX25519  = "x25519"
+)
+
+// Size of new RSA keys
+const RSAKeyBits = 3072
+
+// Public key tagged with its algorithm
+type PublicKey struct {
+	Algorithm string
+	Key       []byte
+}
+
+// Public keys a user signs requests with and receives file keys under
+type KeySet struct {
+	Signing    PublicKey
+	Encryption PublicKey
+}
+
+// Tag a public key with its algorithm
+func PublicKeyFrom(publicKey crypto.PublicKey) (PublicKey, error) {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return PublicKey{AlgorithmRSA, x509.MarshalPKCS1PublicKey(key)}, nil
+	case ed25519.PublicKey:
+		return PublicKey{AlgorithmEd25519, []byte(key)}, nil
+	}
+	return PublicKey{}, errors.New("Unsupported key type")
+}
+
+// Parse a tagged signing key into the key type certificates and signatures use
+func (k PublicKey) CryptoPublicKey() (crypto.PublicKey, error) {
+	switch k.Algorithm {
+	case AlgorithmRSA:
+		return x509.ParsePKCS1PublicKey(k.Key)
+	case AlgorithmEd25519:
+		if len(k.Key) != ed25519.PublicKeySize {
+			return nil, errors.New("Invalid Ed25519 public key")
+		}
+		return ed25519.PublicKey(k.Key), nil
+	}
+	return nil, errors.New("Unsupported signing key algorithm: " + k.Algorithm)
+}
+
+// Check two tagged keys are the same key
+func (k PublicKey) Equal(other PublicKey) bool {
+	return k.Algorithm == other.Algorithm && bytes.Equal(k.Key, other.Key)
+}
+
+// Private key operations the client needs, done with the key itself or by the key agent
+type PrivateKey interface {
+	crypto.Signer
+	crypto.Decrypter
+	PublicKeys() KeySet
+}
+
+// RSA private key, used for both signing and key wrapping
+type RSAKey struct {
+	*rsa.PrivateKey
+}
+
+// Key set of the RSA key
+func (k RSAKey) PublicKeys() KeySet {
+	key := PublicKey{AlgorithmRSA, x509.MarshalPKCS1PublicKey(&k.PublicKey)}
+	return KeySet{Signing: key, Encryption: key}
+}
+
+// Ed25519 signing key and X25519 key file keys are wrapped under
+type KeyPair struct {
+	signing    ed25519.PrivateKey
+	encryption *ecdh.PrivateKey
+}
+
+// Generate a new Ed25519 and X25519 key pair
+func GenerateKeyPair() (*KeyPair, error) {
+	_, signing, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	encryption, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{signing, encryption}, nil
+}
+
+// Public signing key
+func (k *KeyPair) Public() crypto.PublicKey {
+	return k.signing.Public()
+}
+
+// Sign a message with the Ed25519 key, opts must not ask for a hash
+func (k *KeyPair) Sign(rand io.Reader, message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return k.signing.Sign(rand, message, opts)
+}
+
+// Unwrap a key wrapped to the X25519 key, there are no decryption options
+func (k *KeyPair) Decrypt(_ io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	if opts != nil {
+		return nil, errors.New("X25519 keys don't take decryption options")
+	}
+	return unwrapX25519(k.encryption, msg)
+}
+
+// Key set of the key pair
+func (k *KeyPair) PublicKeys() KeySet {
+	return KeySet{
+		Signing:    PublicKey{AlgorithmEd25519, k.signing.Public().(ed25519.PublicKey)},
+		Encryption: PublicKey{AlgorithmX25519, k.encryption.PublicKey().Bytes()},
+	}
+}
+
+// Serialize a key pair as the Ed25519 seed followed by the X25519 private key
+func (k *KeyPair) Marshal() []byte {
+	return append(append([]byte(nil), k.signing.Seed()...), k.encryption.Bytes()...)
+}
+
+// Parse a serialized key pair
+func ParseKeyPair(data []byte) (*KeyPair, error) {
+	if len(data) != ed25519.SeedSize+32 {
+		return nil, errors.New("Invalid Ed25519 X25519 private key")
+	}
+	encryption, err := ecdh.X25519().NewPrivateKey(data[ed25519.SeedSize:])
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{ed25519.NewKeyFromSeed(data[:ed25519.SeedSize]), encryption}, nil
+}
+
+// Generate a new private key of keyType, rsa or ed25519
+func GenerateKey(keyType string) (PrivateKey, error) {
+	switch keyType {
+	case AlgorithmEd25519:
+		return GenerateKeyPair()
+	case AlgorithmRSA:
+		privateKey, err := rsa.GenerateKey(rand.Reader, RSAKeyBits)
+		if err != nil {
+			return nil, err
+		}
+		return RSAKey{privateKey}, nil
+	}
+	return nil, errors.New("Unknown KeyType setting: " + keyType)
+}
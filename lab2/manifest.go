@@ -0,0 +1,128 @@
+package lab2
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"time"
+)
+
+// Manifest Struct, the signature of the owner or a writer over one version of a file
+// Hash covers the encrypted file as stored, so readers can tell if the server swapped it
+// Author is the writer who signed it, manifests signed by the owner have none
+// Grant is the author's grant of the writer role, it isn't covered by the signature as it is signed itself
+type Manifest struct {
+	Owner     string
+	Name      string
+	Version   int
+	Hash      []byte
+	Timestamp int64
+	Device    string
+	Author    string `json:",omitempty"`
+	Grant     *Grant `json:",omitempty"`
+	Signature []byte
+}
+
+// Data covered by the manifest signature, must match the server's
+// Author is left out when empty so manifests signed before writers still verify
+type manifestData struct {
+	Owner     string
+	Name      string
+	Version   int
+	Hash      []byte
+	Timestamp int64
+	Device    string
+	Author    string `json:",omitempty"`
+}
+
+// Hash of an encrypted file: its stream header, then its data or each of its chunks, each length prefixed
+type FileHasher struct {
+	hash.Hash
+}
+
+// Start the hash of a file with its stream header
+func NewFileHasher(header []byte) *FileHasher {
+	h := &FileHasher{sha256.New()}
+	h.Add(header)
+	return h
+}
+
+// Add the next part of the file to the hash
+func (h *FileHasher) Add(part []byte) {
+	var length [8]byte
+	binary.BigEndian.PutUint64(length[:], uint64(len(part)))
+	h.Write(length[:])
+	h.Write(part)
+}
+
+// Sign a version of owner's file as signer with key, the key of signer's device, as a writer if the file is someone else's
+func NewManifest(owner string, name string, version int, hash []byte, signer string, device string, key PrivateKey) (*Manifest, error) {
+	m := &Manifest{Owner: owner, Name: name, Version: version, Hash: hash, Timestamp: time.Now().Unix(), Device: device}
+	if owner != signer {
+		m.Author = signer
+	}
+	err := m.Sign(key)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Sign the manifest with key, which must be the key of the manifest's device
+func (m *Manifest) Sign(key PrivateKey) error {
+	data, err := json.Marshal(manifestData{m.Owner, m.Name, m.Version, m.Hash, m.Timestamp, m.Device, m.Author})
+	if err != nil {
+		return err
+	}
+	m.Signature, err = Sign(key, data)
+	return err
+}
+
+// The user who signed the manifest, the owner or one of the file's writers
+func (m *Manifest) Signer() string {
+	if m.Author == "" {
+		return m.Owner
+	}
+	return m.Author
+}
+
+// Check the manifest is for owner's file name and was signed by one of signer's devices
+func (m *Manifest) Verify(signer *User, owner string, name string) error {
+	if m.Signer() != signer.Username || m.Owner != owner || m.Name != name {
+		return errors.New("Manifest does not match file")
+	}
+	device := signer.Device(m.Device)
+	if device == nil {
+		return fmt.Errorf("WARNING: %s was signed by a device %s doesn't have, the server may have changed it", m.Name, m.Signer())
+	}
+	data, err := json.Marshal(manifestData{m.Owner, m.Name, m.Version, m.Hash, m.Timestamp, m.Device, m.Author})
+	if err != nil {
+		return err
+	}
+	if !VerifySignature(device.Keys.Signing, data, m.Signature) {
+		return fmt.Errorf("WARNING: The signature of %s doesn't match %s's keys, the server may have changed it", m.Name, m.Signer())
+	}
+	return nil
+}
+
+// Check a manifest signed by a writer holds a grant from the owner, or one of the owner's managers,
+// letting the writer write the file when they signed it. users gets the keys of a grant's signer
+func (m *Manifest) VerifyGrant(users func(string) (*User, error)) error {
+	if m.Author == "" {
+		return nil
+	}
+	if m.Grant == nil {
+		return fmt.Errorf("WARNING: %s was signed by %s without a grant from its owner, the server may have made them a writer", m.Name, m.Author)
+	}
+	err := m.Grant.Verify(m.Owner, m.Name, m.Author, users)
+	if err != nil {
+		return err
+	}
+	if !m.Grant.CanWrite() || m.Grant.Expired(time.Unix(m.Timestamp, 0)) {
+		return fmt.Errorf("WARNING: %s was signed by %s, who wasn't granted write access to it", m.Name, m.Author)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package lab2
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	alice := newTestKeyPair(t)
+	bob := newTestKeyPair(t)
+	aliceUser := NewUser("alice", "laptop", alice.PublicKeys())
+	bobUser := NewUser("bob", "laptop", bob.PublicKeys())
+
+	m, err := NewManifest("alice", "a.txt", 1, []byte("hash"), "alice", "laptop", alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Signer() != "alice" || m.Author != "" {
+		t.Errorf("owner manifest = %+v", m)
+	}
+	if err := m.Verify(aliceUser, "alice", "a.txt"); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+
+	// Writers sign as authors
+	w, err := NewManifest("alice", "a.txt", 2, []byte("hash"), "bob", "laptop", bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Signer() != "bob" {
+		t.Errorf("writer manifest signer = %s", w.Signer())
+	}
+	if err := w.Verify(bobUser, "alice", "a.txt"); err != nil {
+		t.Errorf("verify writer manifest: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(m *Manifest)
+		signer *User
+		owner  string
+		file   string
+	}{
+		{"other file", func(m *Manifest) {}, aliceUser, "alice", "b.txt"},
+		{"other owner", func(m *Manifest) {}, aliceUser, "bob", "a.txt"},
+		{"other signer", func(m *Manifest) {}, bobUser, "alice", "a.txt"},
+		{"version", func(m *Manifest) { m.Version++ }, aliceUser, "alice", "a.txt"},
+		{"hash", func(m *Manifest) { m.Hash = []byte("other") }, aliceUser, "alice", "a.txt"},
+		{"timestamp", func(m *Manifest) { m.Timestamp++ }, aliceUser, "alice", "a.txt"},
+		{"unknown device", func(m *Manifest) { m.Device = "phone" }, aliceUser, "alice", "a.txt"},
+		{"author added", func(m *Manifest) { m.Author = "alice" }, aliceUser, "alice", "a.txt"},
+		{"signed by another key", func(m *Manifest) { m.Sign(bob) }, aliceUser, "alice", "a.txt"},
+	}
+	for _, test := range tests {
+		changed := *m
+		test.change(&changed)
+		if err := changed.Verify(test.signer, test.owner, test.file); err == nil {
+			t.Errorf("%s: manifest verified", test.name)
+		}
+	}
+}
+
+func TestFileHasher(t *testing.T) {
+	hash := func(header string, parts ...string) []byte {
+		h := NewFileHasher([]byte(header))
+		for _, part := range parts {
+			h.Add([]byte(part))
+		}
+		return h.Sum(nil)
+	}
+	if !bytes.Equal(hash("header", "one", "two"), hash("header", "one", "two")) {
+		t.Error("hash isn't deterministic")
+	}
+	// Parts are length prefixed, so moving bytes between parts changes the hash
+	for _, other := range [][]byte{hash("header", "onet", "wo"), hash("header", "onetwo"), hash("headerone", "two"), hash("header", "one", "two", "")} {
+		if bytes.Equal(other, hash("header", "one", "two")) {
+			t.Error("different splits of the file hash the same")
+		}
+	}
+}
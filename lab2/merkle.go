@@ -0,0 +1,140 @@
+package lab2
+
+import (
+	"bytes"
+	"crypto/sha256"
+)
+
+// Merkle tree hashes and proofs of RFC 6962, used by the server's key log and checked by clients
+
+// Hash of a leaf, leaves and nodes are domain separated
+func LeafHash(data []byte) []byte {
+	sum := sha256.Sum256(append([]byte{0}, data...))
+	return sum[:]
+}
+
+// Hash of an interior node
+func NodeHash(left []byte, right []byte) []byte {
+	sum := sha256.Sum256(append(append([]byte{1}, left...), right...))
+	return sum[:]
+}
+
+// Largest power of two smaller than n
+func splitPoint(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// Root hash of a tree of leaf hashes
+func MerkleRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	case 1:
+		return leaves[0]
+	}
+	k := splitPoint(len(leaves))
+	return NodeHash(MerkleRoot(leaves[:k]), MerkleRoot(leaves[k:]))
+}
+
+// Audit path of the leaf at index, from the leaf up
+func InclusionPath(index int, leaves [][]byte) [][]byte {
+	if len(leaves) <= 1 {
+		return [][]byte{}
+	}
+	k := splitPoint(len(leaves))
+	if index < k {
+		return append(InclusionPath(index, leaves[:k]), MerkleRoot(leaves[k:]))
+	}
+	return append(InclusionPath(index-k, leaves[k:]), MerkleRoot(leaves[:k]))
+}
+
+// Proof that the tree of the first m leaves is a prefix of the tree of all of them
+func ConsistencyPath(m int, leaves [][]byte) [][]byte {
+	return subproof(m, leaves, true)
+}
+
+// Consistency proof of the first m leaves, complete is set while the subtree is the old tree's root
+func subproof(m int, leaves [][]byte, complete bool) [][]byte {
+	if m == len(leaves) {
+		if complete {
+			return [][]byte{}
+		}
+		return [][]byte{MerkleRoot(leaves)}
+	}
+	k := splitPoint(len(leaves))
+	if m <= k {
+		return append(subproof(m, leaves[:k], complete), MerkleRoot(leaves[k:]))
+	}
+	return append(subproof(m-k, leaves[k:], false), MerkleRoot(leaves[:k]))
+}
+
+// Check the audit path of the leaf at index leads to root, as in RFC 9162
+func VerifyInclusion(index int, size int, leaf []byte, path [][]byte, root []byte) bool {
+	if index < 0 || index >= size {
+		return false
+	}
+	fn, sn, r := index, size-1, leaf
+	for _, p := range path {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			r = NodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = NodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(r, root)
+}
+
+// Check the tree of size first is a prefix of the tree of size second, as in RFC 9162
+func VerifyConsistency(first int, second int, firstRoot []byte, secondRoot []byte, proof [][]byte) bool {
+	if first < 1 || first > second {
+		return false
+	}
+	if first == second {
+		return len(proof) == 0 && bytes.Equal(firstRoot, secondRoot)
+	}
+	// The old root is part of the proof unless it is a complete subtree of the new tree
+	if first&(first-1) == 0 {
+		proof = append([][]byte{firstRoot}, proof...)
+	}
+	if len(proof) == 0 {
+		return false
+	}
+	fn, sn := first-1, second-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = NodeHash(c, fr)
+			sr = NodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = NodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(fr, firstRoot) && bytes.Equal(sr, secondRoot)
+}
@@ -0,0 +1,199 @@
+package lab2
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+// Test tree of RFC 6962 and its reference implementation, eight leaves and the roots of each prefix
+var rfc6962Leaves = []string{
+	"",
+	"00",
+	"10",
+	"2021",
+	"3031",
+	"40414243",
+	"5051525354555657",
+	"606162636465666768696a6b6c6d6e6f",
+}
+
+var rfc6962Roots = []string{
+	"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+	"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+	"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+	"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+	"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+	"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+}
+
+var rfc6962Inclusion = []struct {
+	index int
+	size  int
+	path  []string
+}{
+	{0, 1, nil},
+	{0, 8, []string{
+		"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+	}},
+	{5, 8, []string{
+		"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+		"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+		"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	}},
+	{2, 3, []string{
+		"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	}},
+	{1, 5, []string{
+		"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+	}},
+}
+
+var rfc6962Consistency = []struct {
+	first  int
+	second int
+	proof  []string
+}{
+	{1, 1, nil},
+	{1, 8, []string{
+		"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+	}},
+	{6, 8, []string{
+		"0ebc5d3437fbe2db158b9f126a1d118e308181031d0a949f8dededebc558ef6a",
+		"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+		"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	}},
+	{2, 5, []string{
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+	}},
+}
+
+func decodeHashes(t *testing.T, hashes []string) [][]byte {
+	decoded := [][]byte{}
+	for _, h := range hashes {
+		b, err := hex.DecodeString(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded = append(decoded, b)
+	}
+	return decoded
+}
+
+func rfc6962LeafHashes(t *testing.T) [][]byte {
+	leaves := [][]byte{}
+	for _, l := range rfc6962Leaves {
+		data, err := hex.DecodeString(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaves = append(leaves, LeafHash(data))
+	}
+	return leaves
+}
+
+func TestMerkleRootVectors(t *testing.T) {
+	leaves := rfc6962LeafHashes(t)
+	roots := decodeHashes(t, rfc6962Roots)
+	for n := 1; n <= len(leaves); n++ {
+		if root := MerkleRoot(leaves[:n]); !bytes.Equal(root, roots[n-1]) {
+			t.Errorf("root of size %d = %x, want %x", n, root, roots[n-1])
+		}
+	}
+	empty, _ := hex.DecodeString("e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+	if root := MerkleRoot(nil); !bytes.Equal(root, empty) {
+		t.Errorf("root of the empty tree = %x", root)
+	}
+}
+
+func TestInclusionVectors(t *testing.T) {
+	leaves := rfc6962LeafHashes(t)
+	roots := decodeHashes(t, rfc6962Roots)
+	for _, tc := range rfc6962Inclusion {
+		want := decodeHashes(t, tc.path)
+		path := InclusionPath(tc.index, leaves[:tc.size])
+		if fmt.Sprintf("%x", path) != fmt.Sprintf("%x", want) {
+			t.Errorf("path of leaf %d in size %d = %x, want %x", tc.index, tc.size, path, want)
+		}
+		root := roots[tc.size-1]
+		if !VerifyInclusion(tc.index, tc.size, leaves[tc.index], want, root) {
+			t.Errorf("path of leaf %d in size %d does not verify", tc.index, tc.size)
+		}
+		if VerifyInclusion(tc.index, 2*tc.size, leaves[tc.index], want, root) ||
+			VerifyInclusion(tc.index+1, tc.size, leaves[tc.index], want, root) ||
+			VerifyInclusion(tc.index, tc.size, leaves[(tc.index+1)%len(leaves)], want, root) {
+			t.Errorf("path of leaf %d in size %d verifies for another leaf or tree", tc.index, tc.size)
+		}
+		if len(want) > 0 && VerifyInclusion(tc.index, tc.size, leaves[tc.index], want[:len(want)-1], root) {
+			t.Errorf("truncated path of leaf %d in size %d verifies", tc.index, tc.size)
+		}
+	}
+	if VerifyInclusion(-1, 8, leaves[0], nil, roots[7]) || VerifyInclusion(8, 8, leaves[0], nil, roots[7]) {
+		t.Error("path of a leaf outside the tree verifies")
+	}
+}
+
+func TestConsistencyVectors(t *testing.T) {
+	leaves := rfc6962LeafHashes(t)
+	roots := decodeHashes(t, rfc6962Roots)
+	for _, tc := range rfc6962Consistency {
+		want := decodeHashes(t, tc.proof)
+		proof := ConsistencyPath(tc.first, leaves[:tc.second])
+		if fmt.Sprintf("%x", proof) != fmt.Sprintf("%x", want) {
+			t.Errorf("proof of sizes %d and %d = %x, want %x", tc.first, tc.second, proof, want)
+		}
+		firstRoot, secondRoot := roots[tc.first-1], roots[tc.second-1]
+		if !VerifyConsistency(tc.first, tc.second, firstRoot, secondRoot, want) {
+			t.Errorf("proof of sizes %d and %d does not verify", tc.first, tc.second)
+		}
+		if tc.first < tc.second &&
+			(VerifyConsistency(tc.first, tc.second, secondRoot, secondRoot, want) ||
+				VerifyConsistency(tc.first, tc.second, firstRoot, firstRoot, want) ||
+				VerifyConsistency(tc.first, tc.second, firstRoot, secondRoot, want[1:])) {
+			t.Errorf("proof of sizes %d and %d verifies with the wrong roots or hashes", tc.first, tc.second)
+		}
+	}
+	if VerifyConsistency(0, 8, roots[0], roots[7], nil) || VerifyConsistency(8, 1, roots[7], roots[0], nil) {
+		t.Error("proof of sizes out of order verifies")
+	}
+}
+
+// Every proof in trees of up to 33 leaves, so each shape of tree is covered
+func TestMerkleProofs(t *testing.T) {
+	leaves := make([][]byte, 0)
+	roots := [][]byte{MerkleRoot(nil)}
+	for n := 1; n <= 33; n++ {
+		leaves = append(leaves, LeafHash([]byte(fmt.Sprint("leaf ", n))))
+		roots = append(roots, MerkleRoot(leaves))
+	}
+	for n := 1; n <= 33; n++ {
+		for i := 0; i < n; i++ {
+			path := InclusionPath(i, leaves[:n])
+			if !VerifyInclusion(i, n, leaves[i], path, roots[n]) {
+				t.Errorf("inclusion of leaf %d in tree of size %d does not verify", i, n)
+			}
+			if VerifyInclusion(i, n, leaves[(i+1)%33], path, roots[n]) {
+				t.Errorf("inclusion of the wrong leaf at %d in tree of size %d verifies", i, n)
+			}
+		}
+		for m := 1; m <= n; m++ {
+			proof := ConsistencyPath(m, leaves[:n])
+			if !VerifyConsistency(m, n, roots[m], roots[n], proof) {
+				t.Errorf("consistency of sizes %d and %d does not verify", m, n)
+			}
+			if m < n && VerifyConsistency(m, n, roots[m-1], roots[n], proof) {
+				t.Errorf("consistency with the wrong root of size %d and %d verifies", m, n)
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package lab2
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+// Shamir secret sharing over GF(2^8), each byte of the secret is shared separately
+// A share is its x coordinate followed by one y coordinate per byte of the secret
+
+// Exponent and logarithm tables of GF(2^8) with the AES polynomial and generator 3
+var gfExp, gfLog = gfTables()
+
+func gfTables() (exp [510]byte, log [256]byte) {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		exp[i] = x
+		exp[i+255] = x
+		log[x] = byte(i)
+		// Multiply by 3, i.e. x*2 + x, reducing by the AES polynomial
+		doubled := x << 1
+		if x&0x80 != 0 {
+			doubled ^= 0x1b
+		}
+		x ^= doubled
+	}
+	return
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// Split secret into n shares, any threshold of which rebuild it
+func SplitSecret(secret []byte, n int, threshold int) ([][]byte, error) {
+	if threshold < 1 || threshold > n || n > 255 {
+		return nil, errors.New("Threshold must be between 1 and the number of shares, at most 255")
+	}
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][0] = byte(i + 1)
+	}
+	coefficients := make([]byte, threshold)
+	for j, b := range secret {
+		// Random polynomial of degree threshold-1 with the secret byte as its constant term
+		coefficients[0] = b
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		for _, share := range shares {
+			x := share[0]
+			var y byte
+			for k := threshold - 1; k >= 0; k-- {
+				y = gfMul(y, x) ^ coefficients[k]
+			}
+			share[j+1] = y
+		}
+	}
+	return shares, nil
+}
+
+// Rebuild a secret from shares by interpolating each byte's polynomial at zero
+// Too few shares rebuild a wrong secret rather than fail, so the result must be checked
+func CombineShares(shares [][]byte) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("No shares to combine")
+	}
+	size := len(shares[0])
+	seen := make(map[byte]bool)
+	for _, share := range shares {
+		if len(share) != size || size < 2 || share[0] == 0 {
+			return nil, errors.New("Invalid share")
+		}
+		if seen[share[0]] {
+			return nil, errors.New("Duplicate share")
+		}
+		seen[share[0]] = true
+	}
+	secret := make([]byte, size-1)
+	for i, share := range shares {
+		// Lagrange basis polynomial of this share at zero
+		basis := byte(1)
+		for j, other := range shares {
+			if i != j {
+				basis = gfMul(basis, gfDiv(other[0], other[0]^share[0]))
+			}
+		}
+		for k := range secret {
+			secret[k] ^= gfMul(basis, share[k+1])
+		}
+	}
+	return secret, nil
+}
@@ -0,0 +1,92 @@
+package lab2
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGF256(t *testing.T) {
+	for a := 0; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			if got := gfDiv(gfMul(byte(a), byte(b)), byte(b)); got != byte(a) {
+				t.Fatalf("%d*%d/%d = %d", a, b, b, got)
+			}
+		}
+	}
+	// 0x53 and 0xca are inverses under the AES polynomial
+	if gfMul(0x53, 0xca) != 1 {
+		t.Errorf("0x53*0xca = %#x, want 1", gfMul(0x53, 0xca))
+	}
+}
+
+// Every subset of shares, as lists of indices
+func subsets(n int) [][]int {
+	var all [][]int
+	for mask := 1; mask < 1<<n; mask++ {
+		var subset []int
+		for i := 0; i < n; i++ {
+			if mask&(1<<i) != 0 {
+				subset = append(subset, i)
+			}
+		}
+		all = append(all, subset)
+	}
+	return all
+}
+
+func TestShamirSubsets(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	for n := 1; n <= 6; n++ {
+		for threshold := 1; threshold <= n; threshold++ {
+			shares, err := SplitSecret(secret, n, threshold)
+			if err != nil {
+				t.Fatalf("%d of %d: %v", threshold, n, err)
+			}
+			for _, subset := range subsets(n) {
+				picked := make([][]byte, len(subset))
+				for i, index := range subset {
+					picked[i] = shares[index]
+				}
+				got, err := CombineShares(picked)
+				if err != nil {
+					t.Fatalf("%d of %d, shares %v: %v", threshold, n, subset, err)
+				}
+				// Fewer than threshold shares give an unrelated secret
+				if enough := len(subset) >= threshold; bytes.Equal(got, secret) != enough {
+					t.Errorf("%d of %d, shares %v: got %x", threshold, n, subset, got)
+				}
+			}
+		}
+	}
+}
+
+func TestShamirErrors(t *testing.T) {
+	secret := []byte("secret")
+	for _, test := range []struct{ n, threshold int }{{3, 0}, {3, 4}, {256, 2}, {0, 0}} {
+		if _, err := SplitSecret(secret, test.n, test.threshold); err == nil {
+			t.Errorf("split %d of %d", test.threshold, test.n)
+		}
+	}
+	shares, err := SplitSecret(secret, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zero := append([]byte{0}, shares[0][1:]...)
+	tests := []struct {
+		name   string
+		shares [][]byte
+	}{
+		{"no shares", nil},
+		{"duplicate share", [][]byte{shares[0], shares[0]}},
+		{"duplicate x coordinate", [][]byte{shares[0], append([]byte{shares[0][0]}, shares[1][1:]...)}},
+		{"zero x coordinate", [][]byte{zero, shares[1]}},
+		{"different lengths", [][]byte{shares[0], shares[1][:len(shares[1])-1]}},
+		{"empty share", [][]byte{{}, {}}},
+		{"x coordinate only", [][]byte{{1}, {2}}},
+	}
+	for _, test := range tests {
+		if _, err := CombineShares(test.shares); err == nil {
+			t.Errorf("%s: combined", test.name)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package lab2
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"time"
+)
+
+// Signed Request Struct
+// The signature covers the message, the endpoint path, the timestamp and the
+// nonce, so a captured request can't be replayed or posted to another endpoint
+// Username names the signer, whose keys the server checks the signature against
+type SignedRequest struct {
+	Username  string
+	Message   []byte
+	Path      string
+	Timestamp int64
+	Nonce     []byte
+	Signature []byte
+}
+
+// Data covered by a request signature, must match the server's
+type signedData struct {
+	Path      string
+	Timestamp int64
+	Nonce     []byte
+	Message   []byte
+}
+
+// Create a request for the endpoint at path signed by username with key
+func NewSignedRequest(username string, key PrivateKey, path string, message []byte) (*SignedRequest, error) {
+	s := new(SignedRequest)
+	s.Message = message
+	s.Path = path
+	s.Username = username
+	s.Timestamp = time.Now().Unix()
+	s.Nonce = make([]byte, 16)
+	if _, err := rand.Read(s.Nonce); err != nil {
+		return nil, err
+	}
+	err := s.Sign(key)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Sign the request with key, replacing any signature it has
+func (s *SignedRequest) Sign(key PrivateKey) error {
+	data, err := json.Marshal(signedData{s.Path, s.Timestamp, s.Nonce, s.Message})
+	if err != nil {
+		return err
+	}
+	s.Signature, err = Sign(key, data)
+	return err
+}
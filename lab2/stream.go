@@ -0,0 +1,121 @@
+package lab2
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Plaintext size of each chunk of a chunked file
+const ChunkSize = 1 << 20
+
+// Stream header: envelope magic, format version, algorithm id, chunk size and nonce prefix
+// Each chunk nonce is the prefix followed by the chunk counter and a last chunk flag,
+// so chunks can't be reordered, dropped from the end or moved between files
+const (
+	algorithmAESGCMStream byte = 2
+	noncePrefixLen             = 7
+	streamHeaderLen            = envelopeHeaderLen + 4 + noncePrefixLen
+)
+
+// Chunk stream cipher state, one per file
+type StreamCipher struct {
+	aead    cipher.AEAD
+	header  []byte
+	counter uint32
+}
+
+// Create a new stream cipher with a random nonce prefix for encrypting a file
+func NewStreamEncrypter(key []byte) (*StreamCipher, error) {
+	header := make([]byte, streamHeaderLen)
+	copy(header, envelopeMagic)
+	header[4] = envelopeVersion
+	header[5] = algorithmAESGCMStream
+	binary.BigEndian.PutUint32(header[envelopeHeaderLen:], ChunkSize)
+	if _, err := io.ReadFull(rand.Reader, header[envelopeHeaderLen+4:]); err != nil {
+		return nil, err
+	}
+	return newStreamCipher(key, header)
+}
+
+// Create a stream cipher for decrypting a file with the given header
+func NewStreamDecrypter(key []byte, header []byte) (*StreamCipher, error) {
+	if len(header) != streamHeaderLen || !bytes.HasPrefix(header, envelopeMagic) {
+		return nil, ErrIntegrity
+	}
+	if header[4] != envelopeVersion {
+		return nil, fmt.Errorf("Unsupported ciphertext format version: %d", header[4])
+	}
+	if header[5] != algorithmAESGCMStream {
+		return nil, fmt.Errorf("Unsupported encryption algorithm: %d", header[5])
+	}
+	return newStreamCipher(key, header)
+}
+
+func newStreamCipher(key []byte, header []byte) (*StreamCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamCipher{aead: aead, header: header}, nil
+}
+
+// Header to store alongside the encrypted chunks
+func (s *StreamCipher) Header() []byte {
+	return s.header
+}
+
+// Nonce for the next chunk
+func (s *StreamCipher) nonce(last bool) ([]byte, error) {
+	if s.counter == ^uint32(0) {
+		return nil, errors.New("File has too many chunks")
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	copy(nonce, s.header[envelopeHeaderLen+4:])
+	binary.BigEndian.PutUint32(nonce[noncePrefixLen:], s.counter)
+	if last {
+		nonce[noncePrefixLen+4] = 1
+	}
+	s.counter++
+	return nonce, nil
+}
+
+// Encrypt the next chunk of the file
+func (s *StreamCipher) Seal(data []byte, last bool) ([]byte, error) {
+	nonce, err := s.nonce(last)
+	if err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nil, nonce, data, s.header), nil
+}
+
+// Decrypt and authenticate the next chunk of the file
+func (s *StreamCipher) Open(encryptedData []byte, last bool) ([]byte, error) {
+	nonce, err := s.nonce(last)
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.aead.Open(nil, nonce, encryptedData, s.header)
+	if err != nil {
+		return nil, ErrIntegrity
+	}
+	return data, nil
+}
+
+// Read up to a full chunk, a short read at the end of the file is not an error
+func ReadChunk(r io.Reader, buf []byte) (int, error) {
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return n, err
+}
@@ -0,0 +1,128 @@
+package lab2
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Encrypt chunks with a new stream, marking the last one
+func sealChunks(t *testing.T, key []byte, chunks ...string) ([]byte, [][]byte) {
+	stream, err := NewStreamEncrypter(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := make([][]byte, len(chunks))
+	for i, chunk := range chunks {
+		encrypted[i], err = stream.Seal([]byte(chunk), i == len(chunks)-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return stream.Header(), encrypted
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key, _ := GenerateAESKey()
+	header, encrypted := sealChunks(t, key, "one", "two", "three")
+	stream, err := NewStreamDecrypter(key, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	for i, chunk := range encrypted {
+		part, err := stream.Open(chunk, i == len(encrypted)-1)
+		if err != nil {
+			t.Fatalf("open chunk %d: %v", i, err)
+		}
+		data = append(data, part...)
+	}
+	if string(data) != "onetwothree" {
+		t.Errorf("decrypted %q", data)
+	}
+	otherKey, _ := GenerateAESKey()
+	stream, _ = NewStreamDecrypter(otherKey, header)
+	if _, err := stream.Open(encrypted[0], false); err != ErrIntegrity {
+		t.Errorf("open with another key: got %v, want ErrIntegrity", err)
+	}
+}
+
+func TestReadChunk(t *testing.T) {
+	buf := make([]byte, 4)
+	r := strings.NewReader("abcdef")
+	for _, want := range []string{"abcd", "ef", ""} {
+		n, err := ReadChunk(r, buf)
+		if err != nil || !bytes.Equal(buf[:n], []byte(want)) {
+			t.Errorf("read chunk = %q %v, want %q", buf[:n], err, want)
+		}
+	}
+}
+
+// Open chunks in order, marking the last one, like a download does
+func openChunks(key []byte, header []byte, chunks [][]byte) ([]byte, error) {
+	stream, err := NewStreamDecrypter(key, header)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	for i, chunk := range chunks {
+		part, err := stream.Open(chunk, i == len(chunks)-1)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, part...)
+	}
+	return data, nil
+}
+
+func TestStreamTampering(t *testing.T) {
+	key, _ := GenerateAESKey()
+	header, c := sealChunks(t, key, "one", "two", "three")
+	otherHeader, other := sealChunks(t, key, "one", "two", "three")
+	tests := []struct {
+		name   string
+		header []byte
+		chunks [][]byte
+	}{
+		{"missing last chunk", header, [][]byte{c[0], c[1]}},
+		{"only first chunk", header, [][]byte{c[0]}},
+		{"missing middle chunk", header, [][]byte{c[0], c[2]}},
+		{"missing first chunk", header, [][]byte{c[1], c[2]}},
+		{"reordered", header, [][]byte{c[1], c[0], c[2]}},
+		{"last chunk moved", header, [][]byte{c[0], c[2], c[1]}},
+		{"duplicate chunk", header, [][]byte{c[0], c[0], c[1], c[2]}},
+		{"duplicate last chunk", header, [][]byte{c[0], c[1], c[2], c[2]}},
+		{"chunk from another file", header, [][]byte{c[0], other[1], c[2]}},
+		{"another file's header", otherHeader, c},
+		{"no chunks", header, [][]byte{{}}},
+	}
+	for _, test := range tests {
+		if _, err := openChunks(key, test.header, test.chunks); err != ErrIntegrity {
+			t.Errorf("%s: got %v, want ErrIntegrity", test.name, err)
+		}
+	}
+
+	// The last flag is part of the nonce, so flipping it either way fails
+	stream, _ := NewStreamDecrypter(key, header)
+	if _, err := stream.Open(c[0], true); err != ErrIntegrity {
+		t.Errorf("first chunk opened as last: got %v, want ErrIntegrity", err)
+	}
+	stream, _ = NewStreamDecrypter(key, header)
+	stream.Open(c[0], false)
+	stream.Open(c[1], false)
+	if _, err := stream.Open(c[2], false); err != ErrIntegrity {
+		t.Errorf("last chunk opened as not last: got %v, want ErrIntegrity", err)
+	}
+
+	// Tampered headers are refused before any chunk is opened
+	for i := range header {
+		tampered := append([]byte(nil), header...)
+		tampered[i] ^= 1
+		if _, err := openChunks(key, tampered, c); err == nil {
+			t.Errorf("opened with header byte %d flipped", i)
+		}
+	}
+	if _, err := NewStreamDecrypter(key, header[:len(header)-1]); err != ErrIntegrity {
+		t.Errorf("truncated header: got %v, want ErrIntegrity", err)
+	}
+}
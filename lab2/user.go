@@ -0,0 +1,43 @@
+package lab2
+
+import (
+	"crypto/rsa"
+	"time"
+)
+
+// User Struct
+// PubKey is only set by the server for RSA users, for clients that predate key sets
+// Keys are the keys of the user's first device
+type User struct {
+	Id       string
+	Username string
+	PubKey   *rsa.PublicKey `json:",omitempty"`
+	Keys     KeySet
+	Devices  []Device
+}
+
+// Device Struct, a machine holding one of the user's key pairs
+type Device struct {
+	Name  string
+	Keys  KeySet
+	Added time.Time
+}
+
+// Create new user with their first device
+func NewUser(username string, device string, keys KeySet) *User {
+	u := new(User)
+	u.Username = username
+	u.Keys = keys
+	u.Devices = []Device{{Name: device, Keys: keys}}
+	return u
+}
+
+// Get one of the user's devices by name, nil if there is no such device
+func (u *User) Device(name string) *Device {
+	for i := range u.Devices {
+		if u.Devices[i].Name == name {
+			return &u.Devices[i]
+		}
+	}
+	return nil
+}
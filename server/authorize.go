@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Roles a file key can give its user, each can do everything the ones before it can
+// Readers can download the file, writers can upload new versions of it and managers can also share it
+// with and revoke readers and writers. File keys shared before roles have none and are readers
+const (
+	roleReader  = "reader"
+	roleWriter  = "writer"
+	roleManager = "manager"
+)
+
+var roleRanks = map[string]int{"": 0, roleReader: 0, roleWriter: 1, roleManager: 2}
+
+var (
+	errNotOwner    = errors.New("Only the file's owner can do this")
+	errNotWriter   = errors.New("Only the file's owner and its writers can do this")
+	errNotManager  = errors.New("Only the file's owner and its managers can do this")
+	errNotUploader = errors.New("Only the user who started the upload can do this")
+	errUnknownRole = errors.New("Role must be reader, writer or manager")
+)
+
+// Error for a user missing each role
+var errMissingRole = map[string]error{roleWriter: errNotWriter, roleManager: errNotManager}
+
+// Check role is one a file key can have
+func validRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// Check a file key's role allows what the required role does
+func hasRole(role string, required string) bool {
+	return roleRanks[role] >= roleRanks[required]
+}
+
+// Check the principal who made a request may change a file, which must exist unless the request creates it
+// The owner can do anything and can create the file, other users need a file key with the required role.
+// Roles are checked first, so users without one can't tell which files exist
+func authorizeFile(principal *User, owner string, filename string, role string, create bool, store Store) error {
+	if principal.Username == owner {
+		if create {
+			return nil
+		}
+		_, err := store.GetFile(owner, filename)
+		return err
+	}
+	filekey, err := GetFileKey(owner, filename, principal.Username, store)
+	if err == errNoFileAccess || (err == nil && !hasRole(filekey.Role, role)) {
+		return errMissingRole[role]
+	}
+	if err != nil {
+		return err
+	}
+	_, err = store.GetFile(owner, filename)
+	return err
+}
+
+// Check the principal may give user role on a file, or take their access away if role is empty
+// Only the owner can give out the manager role or change the access of a manager
+func authorizeGrant(principal *User, owner string, filename string, user string, role string, store Store) error {
+	if principal.Username == owner {
+		return nil
+	}
+	if user == owner || role == roleManager {
+		return errNotOwner
+	}
+	current, err := store.GetFileKey(owner, filename, user)
+	if err != nil && err != errNoFileAccess {
+		return err
+	}
+	if current != nil && current.Role == roleManager {
+		return errNotOwner
+	}
+	return nil
+}
+
+// Check the principal started an upload session, so writers can't add to each other's uploads
+func authorizeUpload(principal *User, session *UploadSession) error {
+	if session.uploader() != principal.Username {
+		return errNotUploader
+	}
+	return nil
+}
+
+// Check the principal may revoke each of the rekey's revoked users and commit its upload
+// The principal must already be authorized as a manager of the file
+func authorizeRekey(principal *User, rekey *Rekey, store Store) error {
+	for _, user := range rekey.Revoked {
+		err := authorizeGrant(principal, rekey.Owner, rekey.Name, user, "", store)
+		if err != nil {
+			return err
+		}
+	}
+	if rekey.Upload == "" {
+		return nil
+	}
+	session, err := store.GetUploadSession(rekey.Upload)
+	if err != nil {
+		return err
+	}
+	return authorizeUpload(principal, session)
+}
+
+// Status a failed request on a file is reported with, 404 if something it refers to is missing and 403 if it isn't allowed
+func errorStatus(err error) int {
+	switch err {
+	case errFileNotFound, errNoUpload, errUserNotFound:
+		return http.StatusNotFound
+	case errNotOwner, errNotWriter, errNotManager, errNotUploader, errShareExpired:
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
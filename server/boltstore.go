@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bolt buckets
+var userBucket = []byte("users")
+var fileBucket = []byte("files")
+var fileKeyBucket = []byte("filekeys")
+var fileChunkBucket = []byte("filechunks")
+var uploadBucket = []byte("uploads")
+var recoveryBucket = []byte("recoveries")
+var logBucket = []byte("log")
+var versionBucket = []byte("versions")
+
+// Embedded single-file storage backend using Bolt
+type boltStore struct {
+	db *bolt.DB
+}
+
+// Open (or create) the Bolt DB file and its buckets
+func newBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{userBucket, fileBucket, fileKeyBucket, fileChunkBucket, uploadBucket, recoveryBucket, logBucket, versionBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db}, nil
+}
+
+// Build a bucket key from its parts, names can't contain NUL, see validName
+func boltKey(parts ...string) []byte {
+	return []byte(strings.Join(parts, "\x00"))
+}
+
+// Chunk indices are zero padded so keys sort in chunk order
+func chunkIndexKey(index int) string {
+	return fmt.Sprintf("%010d", index)
+}
+
+// Store a value as JSON, reusing the stored id or generating a new one
+func boltPut(bucket *bolt.Bucket, key []byte, id *string, v interface{}) error {
+	var existing struct{ Id string }
+	if data := bucket.Get(key); data != nil {
+		if err := json.Unmarshal(data, &existing); err != nil {
+			return err
+		}
+	}
+	*id = existing.Id
+	if *id == "" {
+		generated, err := newId()
+		if err != nil {
+			return err
+		}
+		*id = generated
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, data)
+}
+
+// Load a JSON value, returns notFound if the key doesn't exist
+func (s *boltStore) get(bucket []byte, key []byte, v interface{}, notFound error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucket).Get(key)
+		if data == nil {
+			return notFound
+		}
+		return json.Unmarshal(data, v)
+	})
+}
+
+// Inserts user into DB
+func (s *boltStore) InsertUser(u *User) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(userBucket)
+		key := boltKey(u.Username)
+		if bucket.Get(key) != nil {
+			return errDuplicateUser
+		}
+		return boltPut(bucket, key, &u.Id, u)
+	})
+}
+
+// Gets a user from the DB
+func (s *boltStore) GetUser(username string) (*User, error) {
+	user := new(User)
+	err := s.get(userBucket, boltKey(username), user, errUserNotFound)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Replace an existing user's keys in the DB
+func (s *boltStore) UpdateUser(u *User) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(userBucket)
+		key := boltKey(u.Username)
+		if bucket.Get(key) == nil {
+			return errUserNotFound
+		}
+		return boltPut(bucket, key, &u.Id, u)
+	})
+}
+
+// Inserts file into DB, Updates file if it already exists
+func (s *boltStore) InsertFile(f *File) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx.Bucket(fileBucket), boltKey(f.Owner, f.Name), &f.Id, f)
+	})
+}
+
+// Get a file from DB
+func (s *boltStore) GetFile(owner string, filename string) (*File, error) {
+	file := new(File)
+	err := s.get(fileBucket, boltKey(owner, filename), file, errFileNotFound)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Replace a file and its file keys in DB in one transaction
+func (s *boltStore) RekeyFile(f *File, filekeys []FileKey, revoked []string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		files := tx.Bucket(fileBucket)
+		if files.Get(boltKey(f.Owner, f.Name)) == nil {
+			return errFileNotFound
+		}
+		err := boltPut(files, boltKey(f.Owner, f.Name), &f.Id, f)
+		if err != nil {
+			return err
+		}
+		bucket := tx.Bucket(fileKeyBucket)
+		for i := range filekeys {
+			filekey := &filekeys[i]
+			err = boltPut(bucket, boltKey(filekey.Owner, filekey.Name, filekey.User), &filekey.Id, filekey)
+			if err != nil {
+				return err
+			}
+		}
+		for _, user := range revoked {
+			err = bucket.Delete(boltKey(f.Owner, f.Name, user))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Keeps a replaced version of a file in DB, Updates the version if it is already kept
+// Versions are zero padded like chunk indices so keys sort in version order
+func (s *boltStore) InsertFileVersion(f *File) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx.Bucket(versionBucket), boltKey(f.Owner, f.Name, chunkIndexKey(f.Version)), &f.Id, f)
+	})
+}
+
+// Get a kept version of a file from DB
+func (s *boltStore) GetFileVersion(owner string, filename string, version int) (*File, error) {
+	file := new(File)
+	err := s.get(versionBucket, boltKey(owner, filename, chunkIndexKey(version)), file, errVersionNotFound)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Get the kept versions of a file from DB, oldest first
+func (s *boltStore) GetFileVersions(owner string, filename string) ([]File, error) {
+	versions := make([]File, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := boltKey(owner, filename, "")
+		c := tx.Bucket(versionBucket).Cursor()
+		for k, data := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, data = c.Next() {
+			var file File
+			if err := json.Unmarshal(data, &file); err != nil {
+				return err
+			}
+			versions = append(versions, file)
+		}
+		return nil
+	})
+	return versions, err
+}
+
+// Delete a kept version of a file from DB
+func (s *boltStore) DeleteFileVersion(owner string, filename string, version int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(versionBucket).Delete(boltKey(owner, filename, chunkIndexKey(version)))
+	})
+}
+
+// Inserts file chunk into DB, Updates file chunk if it already exists
+func (s *boltStore) InsertFileChunk(c *FileChunk) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx.Bucket(fileChunkBucket), boltKey(c.Owner, c.Name, c.Session, chunkIndexKey(c.Index)), &c.Id, c)
+	})
+}
+
+// Get file chunk from DB
+func (s *boltStore) GetFileChunk(owner string, filename string, upload string, index int) (*FileChunk, error) {
+	chunk := new(FileChunk)
+	err := s.get(fileChunkBucket, boltKey(owner, filename, upload, chunkIndexKey(index)), chunk, errChunkNotFound)
+	if err != nil {
+		return nil, err
+	}
+	return chunk, nil
+}
+
+// Get the sorted indices of an upload's chunks from DB
+func (s *boltStore) GetFileChunkIndices(owner string, filename string, upload string) ([]int, error) {
+	indices := make([]int, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := boltKey(owner, filename, upload, "")
+		c := tx.Bucket(fileChunkBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			index, err := strconv.Atoi(string(k[len(prefix):]))
+			if err != nil {
+				return err
+			}
+			indices = append(indices, index)
+		}
+		return nil
+	})
+	return indices, err
+}
+
+// Delete an upload's chunks from DB
+func (s *boltStore) DeleteFileChunks(owner string, filename string, upload string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(fileChunkBucket)
+		prefix := boltKey(owner, filename, upload, "")
+		// Collect keys first, deleting while iterating skips entries
+		var keys [][]byte
+		c := bucket.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Inserts upload session into DB
+func (s *boltStore) InsertUploadSession(u *UploadSession) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		data, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(uploadBucket).Put(boltKey(u.Id), data)
+	})
+}
+
+// Get upload session from DB
+func (s *boltStore) GetUploadSession(id string) (*UploadSession, error) {
+	session := new(UploadSession)
+	err := s.get(uploadBucket, boltKey(id), session, errNoUpload)
+	if err != nil {
+		return nil, err
+	}
+	session.Received = nil
+	return session, nil
+}
+
+// Delete upload session from DB
+func (s *boltStore) DeleteUploadSession(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(uploadBucket).Delete(boltKey(id))
+	})
+}
+
+// Inserts file key into DB, Updates file key if it already exists
+func (s *boltStore) InsertFileKey(f *FileKey) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx.Bucket(fileKeyBucket), boltKey(f.Owner, f.Name, f.User), &f.Id, f)
+	})
+}
+
+// Delete file key from DB
+func (s *boltStore) DeleteFileKey(owner string, filename string, user string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(fileKeyBucket).Delete(boltKey(owner, filename, user))
+	})
+}
+
+// Get file key from DB
+func (s *boltStore) GetFileKey(owner string, filename string, user string) (*FileKey, error) {
+	filekey := new(FileKey)
+	err := s.get(fileKeyBucket, boltKey(owner, filename, user), filekey, errNoFileAccess)
+	if err != nil {
+		return nil, err
+	}
+	return filekey, nil
+}
+
+// Get a slice (array) of users who have keys to the file
+func (s *boltStore) GetFileUsers(owner string, filename string) ([]string, error) {
+	users := make([]string, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := boltKey(owner, filename, "")
+		c := tx.Bucket(fileKeyBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			users = append(users, string(k[len(prefix):]))
+		}
+		return nil
+	})
+	return users, err
+}
+
+// Get all file keys shared with a user, file keys are keyed by owner so every key is checked
+func (s *boltStore) GetUserFileKeys(user string) ([]FileKey, error) {
+	filekeys := make([]FileKey, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(fileKeyBucket).ForEach(func(_, data []byte) error {
+			var filekey FileKey
+			if err := json.Unmarshal(data, &filekey); err != nil {
+				return err
+			}
+			if filekey.User == user {
+				filekeys = append(filekeys, filekey)
+			}
+			return nil
+		})
+	})
+	sortFileKeys(filekeys)
+	return filekeys, err
+}
+
+// Delete the file keys that expired by now and mark their files as needing a rekey in one transaction
+func (s *boltStore) PurgeExpiredFileKeys(now time.Time) ([]FileKey, error) {
+	purged := make([]FileKey, 0)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(fileKeyBucket)
+		c := bucket.Cursor()
+		for k, data := c.First(); k != nil; k, data = c.Next() {
+			var filekey FileKey
+			if err := json.Unmarshal(data, &filekey); err != nil {
+				return err
+			}
+			if filekey.expired(now) {
+				purged = append(purged, filekey)
+			}
+		}
+		// Keys are deleted after the cursor is done with the bucket
+		files := tx.Bucket(fileBucket)
+		for _, filekey := range purged {
+			err := bucket.Delete(boltKey(filekey.Owner, filekey.Name, filekey.User))
+			if err != nil {
+				return err
+			}
+			data := files.Get(boltKey(filekey.Owner, filekey.Name))
+			if data == nil {
+				continue
+			}
+			var file File
+			if err := json.Unmarshal(data, &file); err != nil {
+				return err
+			}
+			file.NeedsRekey = true
+			err = boltPut(files, boltKey(file.Owner, file.Name), &file.Id, &file)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortFileKeys(purged)
+	return purged, nil
+}
+
+// Inserts recovery into DB, replacing the user's earlier one
+func (s *boltStore) InsertRecovery(r *Recovery) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx.Bucket(recoveryBucket), boltKey(r.Username), &r.Id, r)
+	})
+}
+
+// Get a user's recovery from DB
+func (s *boltStore) GetRecovery(username string) (*Recovery, error) {
+	recovery := new(Recovery)
+	err := s.get(recoveryBucket, boltKey(username), recovery, errRecoveryNotFound)
+	if err != nil {
+		return nil, err
+	}
+	return recovery, nil
+}
+
+// Appends entry to the key log in DB, keys are zero padded so entries sort in log order
+func (s *boltStore) InsertLogEntry(entry *LogEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(logBucket).Put([]byte(chunkIndexKey(entry.Index)), data)
+	})
+}
+
+// Get all key log entries from DB
+func (s *boltStore) GetLogEntries() ([]LogEntry, error) {
+	entries := make([]LogEntry, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(logBucket).ForEach(func(_, data []byte) error {
+			var entry LogEntry
+			if err := json.Unmarshal(data, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// Close DB file
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
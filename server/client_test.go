@@ -0,0 +1,212 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kyrillzorin/CS3031_Lab2/client"
+	"github.com/kyrillzorin/CS3031_Lab2/lab2"
+)
+
+// User of the client program, with a key and a working directory for the files the client keeps
+type clientUser struct {
+	t      *testing.T
+	server *httptest.Server
+	name   string
+	key    lab2.PrivateKey
+	dir    string
+}
+
+// Create a client user with a new key of keyType
+func newClientUser(t *testing.T, server *httptest.Server, name string, keyType string) *clientUser {
+	key, err := lab2.GenerateKey(keyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "client-"+name+"-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	// The client's files are relative to the working directory, which use changes
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return &clientUser{t: t, server: server, name: name, key: key, dir: dir}
+}
+
+// Make the client act as the user, in the user's working directory
+func (u *clientUser) use() {
+	if err := os.Chdir(u.dir); err != nil {
+		u.t.Fatal(err)
+	}
+	client.ClientUser = u.name
+	client.ClientDevice = defaultDevice
+	client.ClientPrivateKey = u.key
+	client.ClientPublicKeys = u.key.PublicKeys()
+	client.Server = u.server.URL
+	client.LogPublicKey = ""
+	client.UseClientCert = false
+}
+
+// Run a client command as the user
+func (u *clientUser) run(command func() error) error {
+	u.use()
+	return command()
+}
+
+// Run a client command as the user, failing the test if it fails
+func (u *clientUser) must(name string, command func() error) {
+	if err := u.run(command); err != nil {
+		u.t.Fatalf("%s %s: %v", u.name, name, err)
+	}
+}
+
+// Write a file to upload in the user's working directory
+func (u *clientUser) writeFile(name string, data string) string {
+	path := filepath.Join(u.dir, name)
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		u.t.Fatal(err)
+	}
+	return path
+}
+
+// Download owner's file as the user, returning its contents
+func (u *clientUser) download(owner string, filename string, version string) (string, error) {
+	path := filepath.Join(u.dir, "download")
+	os.Remove(path)
+	err := u.run(func() error { return client.DownloadFile(owner, filename, path, version) })
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(path)
+	return string(data), err
+}
+
+// Check the user downloads want from owner's file
+func (u *clientUser) expectDownload(owner string, filename string, version string, want string) {
+	data, err := u.download(owner, filename, version)
+	if err != nil {
+		u.t.Fatalf("%s download %s/%s: %v", u.name, owner, filename, err)
+	}
+	if data != want {
+		u.t.Errorf("%s download %s/%s = %q, want %q", u.name, owner, filename, data, want)
+	}
+}
+
+// Check the user can't download owner's file
+func (u *clientUser) expectNoDownload(owner string, filename string) {
+	if data, err := u.download(owner, filename, ""); err == nil {
+		u.t.Errorf("%s downloaded %s/%s: %q", u.name, owner, filename, data)
+	}
+}
+
+func TestClientFlows(t *testing.T) {
+	server := newTestServer(t)
+	alice := newClientUser(t, server, "alice", lab2.AlgorithmEd25519)
+	bob := newClientUser(t, server, "bob", lab2.AlgorithmRSA)
+	carol := newClientUser(t, server, "carol", lab2.AlgorithmEd25519)
+	for _, u := range []*clientUser{alice, bob, carol} {
+		u.must("register", client.Register)
+	}
+	if err := alice.run(client.Register); err == nil {
+		t.Error("registered a taken username")
+	}
+
+	path := alice.writeFile("a.txt", "first version")
+	alice.must("upload", func() error { return client.UploadFile(path, "alice", "a.txt") })
+	alice.expectDownload("alice", "a.txt", "", "first version")
+	bob.expectNoDownload("alice", "a.txt")
+
+	alice.must("share", func() error {
+		return client.ShareFile("alice", "a.txt", []string{"bob"}, lab2.RoleReader, time.Time{}, false)
+	})
+	alice.must("share", func() error {
+		return client.ShareFile("alice", "a.txt", []string{"carol"}, lab2.RoleWriter, time.Time{}, false)
+	})
+	bob.expectDownload("alice", "a.txt", "", "first version")
+
+	// A new version keeps the file key, so the users the file is shared with can read it
+	path = carol.writeFile("a.txt", "second version")
+	carol.must("upload", func() error { return client.UploadFile(path, "alice", "a.txt") })
+	bob.expectDownload("alice", "a.txt", "", "second version")
+	bob.expectDownload("alice", "a.txt", "1", "first version")
+	path = bob.writeFile("a.txt", "reader's version")
+	if err := bob.run(func() error { return client.UploadFile(path, "alice", "a.txt") }); err == nil {
+		t.Error("reader uploaded a new version")
+	}
+	if err := bob.run(func() error {
+		return client.ShareFile("alice", "a.txt", []string{"carol"}, lab2.RoleReader, time.Time{}, false)
+	}); err == nil {
+		t.Error("reader shared the file")
+	}
+
+	// Revoking now re-encrypts the file, the remaining users get the new key
+	alice.must("revoke", func() error { return client.RevokeFile("alice", "a.txt", []string{"bob"}, true) })
+	bob.expectNoDownload("alice", "a.txt")
+	carol.expectDownload("alice", "a.txt", "", "second version")
+	alice.expectDownload("alice", "a.txt", "", "second version")
+
+	// Revoking later leaves the file pending re-encryption until its next upload
+	alice.must("revoke", func() error { return client.RevokeFile("alice", "a.txt", []string{"carol"}, false) })
+	carol.expectNoDownload("alice", "a.txt")
+	path = alice.writeFile("a.txt", "third version")
+	alice.must("upload", func() error { return client.UploadFile(path, "alice", "a.txt") })
+	alice.expectDownload("alice", "a.txt", "", "third version")
+	alice.expectDownload("alice", "a.txt", "1", "first version")
+}
+
+// Start a server whose file key requests fail while failing is set, like a server with a transient error
+func newFailingKeyServer(t *testing.T) (*httptest.Server, *int32) {
+	store = newMemoryStore()
+	newTestKeyLog(t)
+	router := newRouter()
+	failing := new(int32)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(failing) == 1 && strings.Contains(req.URL.Path, "/key/") {
+			render.JSON(w, http.StatusInternalServerError, map[string]string{"Status": "failure", "Error": "Internal Server Error"})
+			return
+		}
+		router.ServeHTTP(w, req)
+	}))
+	t.Cleanup(server.Close)
+	return server, failing
+}
+
+func TestUploadAfterFileKeyFailure(t *testing.T) {
+	server, failing := newFailingKeyServer(t)
+	alice := newClientUser(t, server, "alice", lab2.AlgorithmEd25519)
+	bob := newClientUser(t, server, "bob", lab2.AlgorithmEd25519)
+	alice.must("register", client.Register)
+	bob.must("register", client.Register)
+	path := alice.writeFile("a.txt", "first version")
+	alice.must("upload", func() error { return client.UploadFile(path, "alice", "a.txt") })
+	alice.must("share", func() error {
+		return client.ShareFile("alice", "a.txt", []string{"bob"}, lab2.RoleReader, time.Time{}, false)
+	})
+
+	// The upload fails instead of treating the file as new and giving it a new key
+	atomic.StoreInt32(failing, 1)
+	path = alice.writeFile("a.txt", "second version")
+	if err := alice.run(func() error { return client.UploadFile(path, "alice", "a.txt") }); err == nil {
+		t.Error("uploaded without the file key")
+	}
+	atomic.StoreInt32(failing, 0)
+	bob.expectDownload("alice", "a.txt", "", "first version")
+	alice.expectDownload("alice", "a.txt", "", "first version")
+
+	alice.must("upload", func() error { return client.UploadFile(path, "alice", "a.txt") })
+	bob.expectDownload("alice", "a.txt", "", "second version")
+	if file, err := store.GetFile("alice", "a.txt"); err != nil || file.KeyEpoch != 0 || file.Version != 2 {
+		t.Errorf("file after uploads = %+v %v", file, err)
+	}
+}
@@ -2,18 +2,100 @@ package main
 
 import (
 	"crypto"
+	"crypto/ecdh"
+	"crypto/ed25519"
 	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
 )
 
-// Verify an RSA signed message
-func verify(publicKey *rsa.PublicKey, message []byte, signature []byte) bool {
-	hasher := crypto.SHA256.New()
-	hasher.Write(message)
-	hashed := hasher.Sum(nil)
-	var opts rsa.PSSOptions
-	err := rsa.VerifyPSS(publicKey, crypto.SHA256, hashed, signature, &opts)
-	if err != nil {
-		return false
+// Public key algorithms
+// RSA keys are PKCS#1 DER encoded, Ed25519 and X25519 keys are their raw 32 bytes
+const (
+	algorithmRSA     = "rsa"
+	algorithmEd25519 = "ed25519"
+	algorithmX25519  = "x25519"
+)
+
+// Smallest RSA key new users can register with
+const minRSABits = 2048
+
+// Public key tagged with its algorithm
+type PublicKey struct {
+	Algorithm string
+	Key       []byte
+}
+
+// Check a public key can be parsed and is strong enough
+func (k PublicKey) validate() error {
+	switch k.Algorithm {
+	case algorithmRSA:
+		publicKey, err := x509.ParsePKCS1PublicKey(k.Key)
+		if err != nil {
+			return errors.New("Invalid RSA public key")
+		}
+		if publicKey.N.BitLen() < minRSABits {
+			return fmt.Errorf("RSA keys must be at least %d bits", minRSABits)
+		}
+		return nil
+	case algorithmEd25519:
+		if len(k.Key) != ed25519.PublicKeySize {
+			return errors.New("Invalid Ed25519 public key")
+		}
+		return nil
+	case algorithmX25519:
+		if _, err := ecdh.X25519().NewPublicKey(k.Key); err != nil {
+			return errors.New("Invalid X25519 public key")
+		}
+		return nil
+	}
+	return errors.New("Unsupported key algorithm: " + k.Algorithm)
+}
+
+// Tag a public key from a certificate with its algorithm
+func publicKeyFrom(publicKey crypto.PublicKey) (PublicKey, error) {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return PublicKey{algorithmRSA, x509.MarshalPKCS1PublicKey(key)}, nil
+	case ed25519.PublicKey:
+		return PublicKey{algorithmEd25519, []byte(key)}, nil
+	}
+	return PublicKey{}, errors.New("Unsupported key type")
+}
+
+// Verify a signed message, RSA signatures are PSS over SHA-256, Ed25519 signs the message itself
+func verify(publicKey PublicKey, message []byte, signature []byte) bool {
+	switch publicKey.Algorithm {
+	case algorithmRSA:
+		key, err := x509.ParsePKCS1PublicKey(publicKey.Key)
+		if err != nil {
+			return false
+		}
+		hasher := crypto.SHA256.New()
+		hasher.Write(message)
+		hashed := hasher.Sum(nil)
+		var opts rsa.PSSOptions
+		err = rsa.VerifyPSS(key, crypto.SHA256, hashed, signature, &opts)
+		if err != nil {
+			return false
+		}
+		return true
+	case algorithmEd25519:
+		if len(publicKey.Key) != ed25519.PublicKeySize {
+			return false
+		}
+		return ed25519.Verify(ed25519.PublicKey(publicKey.Key), message, signature)
+	}
+	return false
+}
+
+// Verify a message was signed with any of the public keys, such as the keys of a user's devices
+func verifyAny(publicKeys []PublicKey, message []byte, signature []byte) bool {
+	for _, publicKey := range publicKeys {
+		if verify(publicKey, message, signature) {
+			return true
+		}
 	}
-	return true
+	return false
 }
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// How long a device enrollment waits for approval
+const enrollmentLifetime = time.Hour
+
+var errDeviceNotFound = errors.New("Device does not exist")
+var errNoEnrollment = errors.New("Enrollment does not exist or has expired")
+
+// Device Enrollment Struct, a new device asking to be added to a user
+// Signature is made with the new device's signing key, proving it holds the key
+type Enrollment struct {
+	Id        string
+	Username  string
+	Device    string
+	Keys      KeySet
+	Signature []byte
+	Expires   time.Time
+}
+
+// Data covered by the enrollment signature, must match the client's
+type enrollmentData struct {
+	Username string
+	Device   string
+	Keys     KeySet
+}
+
+// Device Approval Struct, adds an enrolled device to the user
+// FileKeys carries the user's file keys re-encrypted for the new set of devices
+type DeviceApproval struct {
+	Username   string
+	Enrollment string
+	FileKeys   []FileKey
+}
+
+// Device Removal Struct
+// FileKeys carries the user's file keys re-encrypted for the remaining devices only
+// Manifests carries the manifests of the user's files the device signed, signed again by a remaining device
+// Grants carries the grants the device signed, see GetUserGrants, signed again the same way
+type DeviceRemoval struct {
+	Username  string
+	Device    string
+	FileKeys  []FileKey
+	Manifests []Manifest
+	Grants    []Grant
+}
+
+// User's Devices Struct, with the enrollments waiting for approval
+type UserDevices struct {
+	Devices []Device
+	Pending []Enrollment
+}
+
+// Enrollments waiting for approval
+var enrollments = newEnrollmentCache()
+
+type enrollmentCache struct {
+	mu      sync.Mutex
+	entries map[string]Enrollment
+}
+
+func newEnrollmentCache() *enrollmentCache {
+	return &enrollmentCache{entries: make(map[string]Enrollment)}
+}
+
+// Add an enrollment, removing expired ones
+func (c *enrollmentCache) Add(e Enrollment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for id, entry := range c.entries {
+		if entry.Expires.Before(now) {
+			delete(c.entries, id)
+		}
+	}
+	c.entries[e.Id] = e
+}
+
+// Get an enrollment for username, returns false if it is unknown or expired
+func (c *enrollmentCache) Get(id string, username string) (Enrollment, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[id]
+	if !ok || e.Username != username || e.Expires.Before(time.Now()) {
+		return Enrollment{}, false
+	}
+	return e, true
+}
+
+// Remove an enrollment once it has been approved
+func (c *enrollmentCache) Remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, id)
+}
+
+// Get the enrollments waiting for a user's approval
+func (c *enrollmentCache) User(username string) []Enrollment {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending := make([]Enrollment, 0)
+	now := time.Now()
+	for _, e := range c.entries {
+		if e.Username == username && !e.Expires.Before(now) {
+			pending = append(pending, e)
+		}
+	}
+	return pending
+}
+
+// Check a new device's enrollment and keep it until one of the user's devices approves it
+func (e *Enrollment) Submit(store Store) error {
+	user, err := GetUser(e.Username, store)
+	if err != nil {
+		return err
+	}
+	if user.Device(e.Device) != nil {
+		return errors.New("Device already exists: " + e.Device)
+	}
+	// Check the device would be accepted before asking for approval
+	candidate := *user
+	err = candidate.setDevices(append(append([]Device(nil), user.Devices...), Device{Name: e.Device, Keys: e.Keys}))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(enrollmentData{e.Username, e.Device, e.Keys})
+	if err != nil {
+		return err
+	}
+	if !verify(e.Keys.Signing, data, e.Signature) {
+		return errors.New("Could not verify enrollment signature")
+	}
+	b := make([]byte, 8)
+	if _, err = rand.Read(b); err != nil {
+		return err
+	}
+	e.Id = hex.EncodeToString(b)
+	e.Expires = time.Now().Add(enrollmentLifetime)
+	enrollments.Add(*e)
+	return nil
+}
+
+// Add an enrolled device to the user along with the re-encrypted file keys
+// The caller must have checked the request was signed by one of the user's devices
+func (a *DeviceApproval) Approve(store Store) error {
+	enrollment, ok := enrollments.Get(a.Enrollment, a.Username)
+	if !ok {
+		return errNoEnrollment
+	}
+	user, err := GetUser(a.Username, store)
+	if err != nil {
+		return err
+	}
+	if user.Device(enrollment.Device) != nil {
+		return errors.New("Device already exists: " + enrollment.Device)
+	}
+	devices := append(append([]Device(nil), user.Devices...), Device{enrollment.Device, enrollment.Keys, time.Now()})
+	err = user.setDevices(devices)
+	if err != nil {
+		return err
+	}
+	err = checkFileKeys(user, a.FileKeys, store)
+	if err != nil {
+		return err
+	}
+	err = replaceFileKeys(a.FileKeys, store)
+	if err != nil {
+		return err
+	}
+	err = keyLog.Write(user, store.UpdateUser)
+	if err != nil {
+		return err
+	}
+	enrollments.Remove(a.Enrollment)
+	return nil
+}
+
+// Remove one of the user's devices along with its encrypted file keys, retiring its keys
+// The caller must have checked the request was signed by one of the user's devices
+func (r *DeviceRemoval) Remove(store Store) error {
+	user, err := GetUser(r.Username, store)
+	if err != nil {
+		return err
+	}
+	if user.Device(r.Device) == nil {
+		return errDeviceNotFound
+	}
+	if len(user.Devices) == 1 {
+		return errors.New("Can't remove the user's only device")
+	}
+	devices := make([]Device, 0, len(user.Devices)-1)
+	for _, device := range user.Devices {
+		if device.Name != r.Device {
+			devices = append(devices, device)
+		}
+	}
+	err = user.setDevices(devices)
+	if err != nil {
+		return err
+	}
+	// Rekeys and new versions change files and their keys under rekeyMu, so the ones checked are the ones replaced
+	rekeyMu.Lock()
+	defer rekeyMu.Unlock()
+	err = checkFileKeys(user, r.FileKeys, store)
+	if err != nil {
+		return err
+	}
+	files, err := checkManifests(user, r.Device, r.Manifests, store)
+	if err != nil {
+		return err
+	}
+	grants, err := checkGrants(user, r.Device, r.Grants, store)
+	if err != nil {
+		return err
+	}
+	err = replaceFileKeys(r.FileKeys, store)
+	if err != nil {
+		return err
+	}
+	err = replaceManifests(files, store)
+	if err != nil {
+		return err
+	}
+	err = replaceGrants(user.Username, r.Device, grants, store)
+	if err != nil {
+		return err
+	}
+	err = keyLog.Write(user, store.UpdateUser)
+	if err != nil {
+		return err
+	}
+	// Sessions aren't tied to a device, so end them all in case the removed device holds one
+	tokens.RemoveUser(r.Username)
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+var errShareExpired = errors.New("Your access to this file has expired")
+
+// Files Needing Rekey Struct, the requesting user's files that had a share expire since their key last changed
+type RekeyFiles struct {
+	Names []string
+}
+
+// Check a file key's share has ended by now
+func (f *FileKey) expired(now time.Time) bool {
+	return !f.Expires.IsZero() && !now.Before(f.Expires)
+}
+
+// Purge expired file keys every interval, runs until the server stops
+func purgeExpiredFileKeys(interval time.Duration) {
+	for range time.Tick(interval) {
+		err := purgeFileKeys(store)
+		if err != nil {
+			log.Printf("Error purging expired file keys: %v\n", err)
+		}
+	}
+}
+
+// Delete the expired file keys and mark their files as needing a rekey, so their owners rotate the file secrets
+// the expired users may still know
+func purgeFileKeys(store Store) error {
+	rekeyMu.Lock()
+	defer rekeyMu.Unlock()
+	filekeys, err := store.PurgeExpiredFileKeys(time.Now())
+	if err != nil {
+		return err
+	}
+	for _, filekey := range filekeys {
+		log.Printf("Share of %s/%s with %s expired\n", filekey.Owner, filekey.Name, filekey.User)
+	}
+	return nil
+}
+
+// Get the names of user's files that need a rekey
+func GetRekeyFiles(user string, store Store) (*RekeyFiles, error) {
+	filekeys, err := GetUserFileKeys(user, store)
+	if err != nil {
+		return nil, err
+	}
+	files := &RekeyFiles{Names: make([]string, 0)}
+	for _, filekey := range filekeys {
+		if filekey.Owner != user {
+			continue
+		}
+		file, err := GetFile(filekey.Owner, filekey.Name, store)
+		if err == errFileNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if file.NeedsRekey {
+			files.Names = append(files.Names, file.Name)
+		}
+	}
+	return files, nil
+}
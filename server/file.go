@@ -2,58 +2,154 @@ package main
 
 import (
 	"errors"
-
-	r "github.com/dancannon/gorethink"
+	"fmt"
+	"time"
 )
 
-// File DB table
-var fileTable r.Term = r.Table("files")
+var errFileExists = errors.New("File already exists, only re-keying it can give it a new file key")
 
 // File Struct
+// Chunked files keep their stream header here and their data in the chunks
+// of the upload that created them, files uploaded in a single request keep
+// their data here and have no chunks
+// Manifest is the owner's signature over this version, files uploaded before manifests have none
+// Version counts up from 1 with each upload, signed versions use their manifest's version
+// PreviousKey is the previous version's shared secret encrypted with this version's
+// Epoch is the key epoch the data is encrypted under and KeyEpoch the epoch of the file keys,
+// which is ahead while the file is Pending re-encryption after a revoke.
+// EpochKeys then lets holders of the current file key decrypt the older epochs' secrets
+// NeedsRekey is set when a share of the file expires, until the owner gives it a new key
+// Format is set by the server, files stored before it was are formatLegacy and may be unauthenticated AES-CFB
+// New is set by the client when the upload creates the file, it isn't stored
 type File struct {
-	Id    string `gorethink:"id,omitempty"`
-	Owner string `gorethink:"owner"`
-	Name  string `gorethink:"name"`
-	Data  []byte `gorethink:"data"`
+	Id          string     `gorethink:"id,omitempty"`
+	Owner       string     `gorethink:"owner"`
+	Name        string     `gorethink:"name"`
+	Data        []byte     `gorethink:"data"`
+	Header      []byte     `gorethink:"header"`
+	Chunks      int        `gorethink:"chunks"`
+	Session     string     `gorethink:"session"`
+	Manifest    *Manifest  `gorethink:"manifest"`
+	Version     int        `gorethink:"version"`
+	Size        int64      `gorethink:"size"`
+	Created     time.Time  `gorethink:"created"`
+	PreviousKey []byte     `gorethink:"previouskey"`
+	Epoch       int        `gorethink:"epoch"`
+	KeyEpoch    int        `gorethink:"keyepoch"`
+	EpochKeys   []EpochKey `gorethink:"epochkeys"`
+	Pending     bool       `gorethink:"pending"`
+	NeedsRekey  bool       `gorethink:"needsrekey"`
+	Format      int        `gorethink:"format"`
+	New         bool       `gorethink:"-" json:",omitempty"`
+}
+
+// Ciphertext formats of stored files, clients only fall back to AES-CFB for formatLegacy files
+const (
+	formatLegacy   = 0
+	formatEnvelope = 1
+)
+
+// Epoch Key Struct, the shared secret of the epoch before Epoch encrypted with Epoch's secret
+type EpochKey struct {
+	Epoch int    `gorethink:"epoch"`
+	Key   []byte `gorethink:"key"`
 }
 
-// Inserts file into DB, Updates file if it already exists
-func (f *File) Insert(dbSession *r.Session) (res r.WriteResponse, err error) {
-	dbRes, err := fileTable.GetAllByIndex("name", f.Name).Filter(map[string]interface{}{"owner": f.Owner}).Run(dbSession)
+// Inserts file into store, Updates file if it already exists
+// The version it replaces is kept in the file's history
+func (f *File) Insert(store Store) error {
+	if !validName(f.Name) {
+		return errInvalidName
+	}
+	// Rekeys, the expiry purge and other new versions change the file under rekeyMu, so the version
+	// this one replaces is read once, and checked, numbered and archived as it was read
+	rekeyMu.Lock()
+	defer rekeyMu.Unlock()
+	old, err := store.GetFile(f.Owner, f.Name)
+	if err != nil && err != errFileNotFound {
+		return err
+	}
+	if err == errFileNotFound {
+		old = nil
+	}
+	if f.New && old != nil {
+		err = checkNoOwnerKey(f.Owner, f.Name, store)
+		if err != nil {
+			return err
+		}
+	}
+	// New versions are encrypted with the current file key, so everyone with access can read them
+	epoch := 0
+	if old != nil {
+		epoch = old.KeyEpoch
+		// The new version is encrypted with the same key, so a rekey the file needs still is
+		f.NeedsRekey = old.NeedsRekey
+	}
+	if f.Epoch != epoch {
+		return fmt.Errorf("File must be encrypted with the file key of epoch %d, the file key changed during the upload", epoch)
+	}
+	err = f.prepare(old, store)
 	if err != nil {
-		return
+		return err
 	}
-	if !dbRes.IsNil() {
-		file := new(File)
-		err = dbRes.One(&file)
+	if old != nil {
+		err = archiveFile(old, store)
 		if err != nil {
-			return
+			return err
 		}
-		f.Id = file.Id
-		res, err = f.Update(dbSession)
-		return
 	}
-	res, err = fileTable.Insert(f).RunWrite(dbSession)
-	return
+	return store.InsertFile(f)
 }
 
-// Updates file in DB
-func (f *File) Update(dbSession *r.Session) (res r.WriteResponse, err error) {
-	res, err = fileTable.Get(f.Id).Update(f).RunWrite(dbSession)
-	return
+// Check a new version of a file replacing old, nil for a new file, and set its version, size and time
+// The new version is encrypted under its own epoch, so it isn't pending re-encryption
+// The caller must hold rekeyMu and have read old under it
+func (f *File) prepare(old *File, store Store) error {
+	f.Version = 1
+	if old != nil {
+		// Files stored before versions were counted take their manifest's version, or 1
+		if old.Version == 0 {
+			old.Version = 1
+			if old.Manifest != nil {
+				old.Version = old.Manifest.Version
+			}
+		}
+		f.Version = old.Version + 1
+	}
+	sum, size, err := hashFile(f, store)
+	if err != nil {
+		return err
+	}
+	err = f.checkManifest(old, sum, store)
+	if err != nil {
+		return err
+	}
+	if f.Manifest != nil {
+		f.Version = f.Manifest.Version
+	}
+	f.Size = size
+	f.Created = time.Now().UTC()
+	f.Format = formatEnvelope
+	f.KeyEpoch = f.Epoch
+	f.EpochKeys = nil
+	f.Pending = false
+	return nil
 }
 
-// Get a file from DB
-func GetFile(owner string, filename string, dbSession *r.Session) (file *File, err error) {
-	res, err := fileTable.GetAllByIndex("name", filename).Filter(map[string]interface{}{"owner": owner}).Run(dbSession)
-	if err != nil {
-		return
+// Check the owner has no key to their file, a file they have one to only gets a new key by being re-keyed
+// so the users it is shared with keep access. Files nobody has the key to can be uploaded again as new files
+func checkNoOwnerKey(owner string, filename string, store Store) error {
+	_, err := store.GetFileKey(owner, filename, owner)
+	if err == errNoFileAccess {
+		return nil
 	}
-	if res.IsNil() {
-		err = errors.New("File does not exist")
-		return
+	if err != nil {
+		return err
 	}
-	file = new(File)
-	err = res.One(&file)
-	return
+	return errFileExists
+}
+
+// Get a file from store
+func GetFile(owner string, filename string, store Store) (*File, error) {
+	return store.GetFile(owner, filename)
 }
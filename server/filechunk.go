@@ -0,0 +1,29 @@
+package main
+
+// File Chunk Struct, one encrypted segment of a chunked file
+// Chunks belong to the upload session that sent them
+type FileChunk struct {
+	Id      string `gorethink:"id,omitempty"`
+	Owner   string `gorethink:"owner"`
+	Name    string `gorethink:"name"`
+	Session string `gorethink:"session"`
+	Index   int    `gorethink:"index"`
+	Data    []byte `gorethink:"data"`
+}
+
+// Inserts file chunk into store, Updates file chunk if it already exists
+func (c *FileChunk) Insert(store Store) error {
+	return store.InsertFileChunk(c)
+}
+
+// Get a chunk of a version of a file from store, version 0 is the current version
+func GetFileChunk(owner string, filename string, version int, index int, store Store) (*FileChunk, error) {
+	file, err := GetFileVersion(owner, filename, version, store)
+	if err != nil {
+		return nil, err
+	}
+	if index >= file.Chunks {
+		return nil, errChunkNotFound
+	}
+	return store.GetFileChunk(owner, filename, file.Session, index)
+}
@@ -2,20 +2,34 @@ package main
 
 import (
 	"errors"
-
-	r "github.com/dancannon/gorethink"
+	"fmt"
+	"sort"
+	"time"
 )
 
-// File Key DB table
-var fileKeyTable r.Term = r.Table("filekeys")
+var (
+	errDeviceKeys      = errors.New("Key must be encrypted for each of the user's devices")
+	errFileKeysChanged = errors.New("File keys changed while they were being re-encrypted, try again")
+)
 
 // File Key Struct
+// DeviceKeys holds the shared secret encrypted for each of the user's devices by device name,
+// Key holds it encrypted for their first device for clients that predate devices
+// Epoch is the file's key epoch the secret belongs to, it goes up each time access is revoked
+// Role is what the user can do with the file besides reading it, see roleReader
+// Expires is when the share ends, zero if it doesn't. Expired keys aren't served and are purged by purgeFileKeys
+// Grant is the role and expiry signed by whoever shared the key, writers and managers need one
 type FileKey struct {
-	Id    string `gorethink:"id,omitempty"`
-	User  string `gorethink:"user"`
-	Owner string `gorethink:"owner"`
-	Name  string `gorethink:"name"`
-	Key   []byte `gorethink:"key"`
+	Id         string            `gorethink:"id,omitempty"`
+	User       string            `gorethink:"user"`
+	Owner      string            `gorethink:"owner"`
+	Name       string            `gorethink:"name"`
+	Key        []byte            `gorethink:"key"`
+	DeviceKeys map[string][]byte `gorethink:"devicekeys"`
+	Epoch      int               `gorethink:"epoch"`
+	Role       string            `gorethink:"role"`
+	Expires    time.Time         `gorethink:"expires"`
+	Grant      *Grant            `gorethink:"grant,omitempty" json:",omitempty"`
 }
 
 // File Users Struct
@@ -23,85 +37,183 @@ type FileUsers struct {
 	Users []string
 }
 
-// Inserts file key into DB
-func (f *FileKey) Insert(dbSession *r.Session) (res r.WriteResponse, err error) {
-	dbRes, err := fileKeyTable.GetAllByIndex("name", f.Name).Filter(map[string]interface{}{"owner": f.Owner, "user": f.User}).Run(dbSession)
+// Inserts file key into store, Updates file key if it already exists
+func (f *FileKey) Insert(store Store) error {
+	if !validName(f.Name) {
+		return errInvalidName
+	}
+	if !validRole(f.Role) {
+		return errUnknownRole
+	}
+	if !f.Expires.IsZero() {
+		if f.User == f.Owner {
+			return errors.New("The owner's file key can't expire")
+		}
+		if f.expired(time.Now()) {
+			return errors.New("Share must expire in the future")
+		}
+	}
+	user, err := GetUser(f.User, store)
 	if err != nil {
-		return
+		return err
 	}
-	if !dbRes.IsNil() {
-		filekey := new(FileKey)
-		err = dbRes.One(&filekey)
+	err = f.checkDevices(user)
+	if err != nil {
+		return err
+	}
+	// Only the current secret can be shared, a revoked user may know the older ones
+	file, err := store.GetFile(f.Owner, f.Name)
+	if err != nil && err != errFileNotFound {
+		return err
+	}
+	if file != nil && f.Epoch != file.KeyEpoch {
+		return fmt.Errorf("File key is for key epoch %d but the file is at epoch %d", f.Epoch, file.KeyEpoch)
+	}
+	// Replacing the owner's key would leave everyone else's unable to read new versions
+	if file != nil && f.User == f.Owner {
+		err = checkNoOwnerKey(f.Owner, f.Name, store)
 		if err != nil {
-			return
+			return err
 		}
-		f.Id = filekey.Id
-		res, err = f.Update(dbSession)
-		return
 	}
-	res, err = fileKeyTable.Insert(f).RunWrite(dbSession)
-	return
+	return store.InsertFileKey(f)
 }
 
-// Updates file key in DB
-func (f *FileKey) Update(dbSession *r.Session) (res r.WriteResponse, err error) {
-	res, err = fileKeyTable.Get(f.Id).Update(f).RunWrite(dbSession)
-	return
+// Check a file key is encrypted for each of its user's devices
+func (f *FileKey) checkDevices(user *User) error {
+	return checkDeviceKeys(user, f.DeviceKeys)
 }
 
-// Revoke file key from DB
-func (f *FileKey) Revoke(dbSession *r.Session) (res r.WriteResponse, err error) {
-	if f.User == f.Owner {
-		err = errors.New("Can't revoke own file access")
-		return
+// Check a secret is encrypted for each of user's devices
+func checkDeviceKeys(user *User, deviceKeys map[string][]byte) error {
+	// Clients that predate devices only send Key, which is enough for a single device
+	if len(deviceKeys) == 0 && len(user.Devices) == 1 {
+		return nil
 	}
-	dbRes, err := fileKeyTable.GetAllByIndex("name", f.Name).Filter(map[string]interface{}{"owner": f.Owner, "user": f.User}).Run(dbSession)
+	if len(deviceKeys) != len(user.Devices) {
+		return errDeviceKeys
+	}
+	for _, device := range user.Devices {
+		if len(deviceKeys[device.Name]) == 0 {
+			return errDeviceKeys
+		}
+	}
+	return nil
+}
+
+// Check filekeys replace every file key shared with user, encrypted for each of their devices
+// Used when a user's devices change, so no file is left encrypted for keys they no longer have
+func checkFileKeys(user *User, filekeys []FileKey, store Store) error {
+	current, err := GetUserFileKeys(user.Username, store)
 	if err != nil {
-		return
+		return err
+	}
+	// Expired keys aren't replaced, they are left for the purge
+	if len(current) != len(filekeys) {
+		return errFileKeysChanged
 	}
-	if !dbRes.IsNil() {
-		filekey := new(FileKey)
-		err = dbRes.One(&filekey)
+	replaced := make(map[string]bool)
+	kept := make(map[string]FileKey)
+	for _, filekey := range current {
+		kept[filekey.Owner+"/"+filekey.Name] = filekey
+	}
+	for i := range filekeys {
+		if filekeys[i].User != user.Username {
+			return errors.New("File key belongs to another user")
+		}
+		err = filekeys[i].checkDevices(user)
 		if err != nil {
-			return
+			return err
 		}
-		res, err = fileKeyTable.Get(filekey.Id).Delete().RunWrite(dbSession)
-		return
+		replaced[filekeys[i].Owner+"/"+filekeys[i].Name] = true
+		// The secrets are only encrypted again, so they stay in their epoch and keep their role, expiry and grant
+		filekeys[i].Epoch = kept[filekeys[i].Owner+"/"+filekeys[i].Name].Epoch
+		filekeys[i].Role = kept[filekeys[i].Owner+"/"+filekeys[i].Name].Role
+		filekeys[i].Expires = kept[filekeys[i].Owner+"/"+filekeys[i].Name].Expires
+		filekeys[i].Grant = kept[filekeys[i].Owner+"/"+filekeys[i].Name].Grant
 	}
-	return
+	for _, filekey := range current {
+		if !replaced[filekey.Owner+"/"+filekey.Name] {
+			return errFileKeysChanged
+		}
+	}
+	return nil
 }
 
-// Get file key from DB
-func GetFileKey(owner string, filename string, user string, dbSession *r.Session) (filekey *FileKey, err error) {
-	res, err := fileKeyTable.GetAllByIndex("name", filename).Filter(map[string]interface{}{"owner": owner, "user": user}).Run(dbSession)
-	if err != nil {
-		return
+// Replace the file keys shared with a user, checked with checkFileKeys
+func replaceFileKeys(filekeys []FileKey, store Store) error {
+	for i := range filekeys {
+		err := store.InsertFileKey(&filekeys[i])
+		if err != nil {
+			return err
+		}
 	}
-	if res.IsNil() {
-		err = errors.New("You do not have access to this file")
-		return
+	return nil
+}
+
+// Revoke file key from store
+func (f *FileKey) Revoke(store Store) error {
+	if f.User == f.Owner {
+		return errors.New("Can't revoke own file access")
 	}
-	filekey = new(FileKey)
-	err = res.One(&filekey)
-	return
+	return store.DeleteFileKey(f.Owner, f.Name, f.User)
 }
 
-// Get a slice (array) of users who have keys to the file
-func GetFileUsers(owner string, filename string, dbSession *r.Session) (userList *FileUsers, err error) {
-	res, err := fileKeyTable.GetAllByIndex("name", filename).Filter(map[string]interface{}{"owner": owner}).Pluck("user").Run(dbSession)
+// Get file key from store, expired keys aren't returned even before they are purged
+func GetFileKey(owner string, filename string, user string, store Store) (*FileKey, error) {
+	filekey, err := store.GetFileKey(owner, filename, user)
 	if err != nil {
-		return
+		return nil, err
 	}
-	var userMap []map[string]string
-	err = res.All(&userMap)
+	if filekey.expired(time.Now()) {
+		return nil, errShareExpired
+	}
+	return filekey, nil
+}
+
+// Get a list of users who have keys to the file, users whose keys expired are left out
+func GetFileUsers(owner string, filename string, store Store) (userList *FileUsers, err error) {
+	users, err := store.GetFileUsers(owner, filename)
 	if err != nil {
 		return
 	}
-	users := make([]string, 0, len(userMap))
-	for _, user := range userMap {
-		users = append(users, user["user"])
-	}
 	userList = new(FileUsers)
-	userList.Users = users
+	userList.Users = make([]string, 0, len(users))
+	for _, user := range users {
+		_, err = GetFileKey(owner, filename, user, store)
+		if err == errShareExpired || err == errNoFileAccess {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		userList.Users = append(userList.Users, user)
+	}
 	return
 }
+
+// Get all file keys shared with a user that haven't expired
+func GetUserFileKeys(user string, store Store) ([]FileKey, error) {
+	filekeys, err := store.GetUserFileKeys(user)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	current := make([]FileKey, 0, len(filekeys))
+	for _, filekey := range filekeys {
+		if !filekey.expired(now) {
+			current = append(current, filekey)
+		}
+	}
+	return current, nil
+}
+
+// Sort file keys by owner and file name
+func sortFileKeys(filekeys []FileKey) {
+	sort.Slice(filekeys, func(i, j int) bool {
+		if filekeys[i].Owner != filekeys[j].Owner {
+			return filekeys[i].Owner < filekeys[j].Owner
+		}
+		return filekeys[i].Name < filekeys[j].Name
+	})
+}
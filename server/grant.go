@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var errGrantsChanged = errors.New("Every grant signed by the device must be signed again")
+
+// Grant Struct, a role on owner's file given to User and signed by one of Signer's devices
+// Signer is the owner, or a manager whose own grant from the owner is Manager
+// Writers attach their grant to the manifests they sign, so readers can check the server didn't make them a writer
+type Grant struct {
+	Owner     string    `gorethink:"owner"`
+	Name      string    `gorethink:"name"`
+	User      string    `gorethink:"user"`
+	Role      string    `gorethink:"role"`
+	Expires   time.Time `gorethink:"expires"`
+	Signer    string    `gorethink:"signer"`
+	Device    string    `gorethink:"device"`
+	Manager   *Grant    `gorethink:"manager,omitempty" json:",omitempty"`
+	Signature []byte    `gorethink:"signature"`
+}
+
+// Data covered by the grant signature, must match the client's
+// The manager's grant is signed by the owner on its own, so it can be signed again without this one
+type grantData struct {
+	Owner   string
+	Name    string
+	User    string
+	Role    string
+	Expires time.Time
+	Signer  string
+	Device  string
+}
+
+// User's Grants Struct
+type UserGrants struct {
+	Grants []Grant
+}
+
+// Identifies a grant, it stays the same when the grant is signed again by another device
+func (g *Grant) key() string {
+	return fmt.Sprintf("%s/%s/%s/%s/%d/%s", g.Owner, g.Name, g.User, g.Role, g.Expires.Unix(), g.Signer)
+}
+
+// Check the grant was signed by one of the signer's devices
+func (g *Grant) verifySignature(signer *User) error {
+	if signer.Username != g.Signer {
+		return errors.New("Grant does not match its signer")
+	}
+	device := signer.Device(g.Device)
+	if device == nil {
+		return errors.New("Grant was signed by an unknown device: " + g.Device)
+	}
+	data, err := json.Marshal(grantData{g.Owner, g.Name, g.User, g.Role, g.Expires, g.Signer, g.Device})
+	if err != nil {
+		return err
+	}
+	if !verify(device.Keys.Signing, data, g.Signature) {
+		return errors.New("Could not verify grant signature")
+	}
+	return nil
+}
+
+// Whether the grant, or the grant of the manager who gave it, had expired at t
+func (g *Grant) expired(t time.Time) bool {
+	if !g.Expires.IsZero() && !t.Before(g.Expires) {
+		return true
+	}
+	return g.Manager != nil && g.Manager.expired(t)
+}
+
+// Check the grant gives user a role on owner's file name and was signed by the owner,
+// or by a manager with a grant of the manager role signed by the owner
+func (g *Grant) verify(owner string, name string, user string, store Store) error {
+	if g.Owner != owner || g.Name != name || g.User != user {
+		return errors.New("Grant does not match file")
+	}
+	ownerUser, err := GetUser(owner, store)
+	if err != nil {
+		return err
+	}
+	if g.Signer == owner {
+		return g.verifySignature(ownerUser)
+	}
+	// Only the owner can give out the manager role, so a grant from a manager needs the owner's grant to them
+	m := g.Manager
+	if g.Role == roleManager || m == nil || m.Role != roleManager || m.Signer != owner ||
+		m.Owner != owner || m.Name != name || m.User != g.Signer {
+		return fmt.Errorf("Grant was signed by %s, who isn't a manager of this file", g.Signer)
+	}
+	err = m.verifySignature(ownerUser)
+	if err != nil {
+		return err
+	}
+	signer, err := GetUser(g.Signer, store)
+	if err != nil {
+		return err
+	}
+	return g.verifySignature(signer)
+}
+
+// The grant and the manager's grant within it signed by username
+func (g *Grant) signedBy(username string) []*Grant {
+	signed := make([]*Grant, 0)
+	for ; g != nil; g = g.Manager {
+		if g.Signer == username {
+			signed = append(signed, g)
+		}
+	}
+	return signed
+}
+
+// Check a file key shared by the principal carries the principal's grant of its role and expiry
+// Writers and managers need one, so readers can check who let them sign new versions
+func (f *FileKey) checkGrant(principal *User, store Store) error {
+	g := f.Grant
+	if g == nil {
+		if hasRole(f.Role, roleWriter) {
+			return errors.New("Writers and managers need a grant signed by the owner or a manager")
+		}
+		return nil
+	}
+	if g.Role != f.Role || !g.Expires.Equal(f.Expires) {
+		return errors.New("Grant does not match the file key's role and expiry")
+	}
+	if g.Signer != principal.Username {
+		return errors.New("Grant must be signed by the user sharing the file")
+	}
+	err := g.verify(f.Owner, f.Name, f.User, store)
+	if err != nil {
+		return err
+	}
+	if g.expired(time.Now()) {
+		return errShareExpired
+	}
+	return nil
+}
+
+// Call visit with each part of a grant signed by username on the keys and versions of the files they have a key to,
+// along with a function saving the file key or version holding it
+func visitGrants(username string, store Store, visit func(g *Grant, save func() error) error) error {
+	filekeys, err := GetUserFileKeys(username, store)
+	if err != nil {
+		return err
+	}
+	for _, own := range filekeys {
+		users, err := store.GetFileUsers(own.Owner, own.Name)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			filekey, err := store.GetFileKey(own.Owner, own.Name, user)
+			if err == errNoFileAccess {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			for _, g := range filekey.Grant.signedBy(username) {
+				err = visit(g, func() error { return store.InsertFileKey(filekey) })
+				if err != nil {
+					return err
+				}
+			}
+		}
+		file, err := store.GetFile(own.Owner, own.Name)
+		if err != nil {
+			return err
+		}
+		versions, err := store.GetFileVersions(own.Owner, own.Name)
+		if err != nil {
+			return err
+		}
+		for i := range versions {
+			version := &versions[i]
+			if version.Manifest == nil {
+				continue
+			}
+			for _, g := range version.Manifest.Grant.signedBy(username) {
+				err = visit(g, func() error { return store.InsertFileVersion(version) })
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if file.Manifest == nil {
+			continue
+		}
+		for _, g := range file.Manifest.Grant.signedBy(username) {
+			err = visit(g, func() error { return store.InsertFile(file) })
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Get every grant signed by a user on the files they have a key to, without the grants of their managers
+func GetUserGrants(username string, store Store) (*UserGrants, error) {
+	grants := &UserGrants{make([]Grant, 0)}
+	seen := make(map[string]bool)
+	err := visitGrants(username, store, func(g *Grant, _ func() error) error {
+		if !seen[g.key()+"/"+g.Device] {
+			seen[g.key()+"/"+g.Device] = true
+			grant := *g
+			grant.Manager = nil
+			grants.Grants = append(grants.Grants, grant)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
+
+// Check grants re-sign every grant signed by device on the files user has a key to, for when the device's key
+// changes or it is removed. user must already have their new devices, returns the grants by key
+func checkGrants(user *User, device string, grants []Grant, store Store) (map[string]*Grant, error) {
+	resigned := make(map[string]*Grant)
+	for i := range grants {
+		err := grants[i].verifySignature(user)
+		if err != nil {
+			return nil, err
+		}
+		resigned[grants[i].key()] = &grants[i]
+	}
+	signed := make(map[string]bool)
+	err := visitGrants(user.Username, store, func(g *Grant, _ func() error) error {
+		if g.Device != device {
+			return nil
+		}
+		if _, ok := resigned[g.key()]; !ok {
+			return errGrantsChanged
+		}
+		signed[g.key()] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(signed) != len(resigned) {
+		return nil, errGrantsChanged
+	}
+	return resigned, nil
+}
+
+// Store the file keys and versions holding grants signed by device with the grants checked by checkGrants
+func replaceGrants(username string, device string, resigned map[string]*Grant, store Store) error {
+	return visitGrants(username, store, func(g *Grant, save func() error) error {
+		if g.Device != device {
+			return nil
+		}
+		g.Device = resigned[g.key()].Device
+		g.Signature = resigned[g.key()].Signature
+		return save()
+	})
+}
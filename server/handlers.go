@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -19,7 +20,7 @@ func register(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
 		return
 	}
-	_, err = user.Insert(dbSession)
+	err = user.Insert(store)
 	if err != nil {
 		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
 		return
@@ -27,6 +28,46 @@ func register(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	render.JSON(w, http.StatusOK, map[string]string{"Status": "success", "Error": ""})
 }
 
+// Issue a login challenge
+func getChallenge(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var challenge Challenge
+	if req.Body == nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": "Invalid Request: Empty"})
+		return
+	}
+	err := json.NewDecoder(req.Body).Decode(&challenge)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	newChallenge, err := NewChallenge(challenge.Username, store)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	render.JSON(w, http.StatusOK, newChallenge)
+}
+
+// Log in with a signed challenge and issue a session token
+func login(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var loginRequest LoginRequest
+	if req.Body == nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": "Invalid Request: Empty"})
+		return
+	}
+	err := json.NewDecoder(req.Body).Decode(&loginRequest)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	token, err := loginRequest.Login(store)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	render.JSON(w, http.StatusOK, token)
+}
+
 // Handle a file upload
 func uploadFile(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	var signedRequest SignedRequest
@@ -45,13 +86,165 @@ func uploadFile(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
 		return
 	}
-	user, _ := GetUser(file.Owner, dbSession)
-	// Verify signed message
-	if !verify(user.PubKey, signedRequest.Message, signedRequest.Signature) {
-		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": "Could not verify signature"})
+	if file.Chunks != 0 || file.Session != "" {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": "Chunked files must be uploaded with an upload session"})
+		return
+	}
+	// Verify the request was made by the owner or a writer
+	principal, err := signedRequest.Principal(req, file.Owner)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = authorizeFile(principal, file.Owner, file.Name, roleWriter, true, store)
+	if err != nil {
+		render.JSON(w, errorStatus(err), map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = file.Insert(store)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	render.JSON(w, http.StatusOK, map[string]string{"Status": "success", "Error": ""})
+}
+
+// Start a chunked upload session
+func startUpload(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var signedRequest SignedRequest
+	if req.Body == nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": "Invalid Request: Empty"})
+		return
+	}
+	err := json.NewDecoder(req.Body).Decode(&signedRequest)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	var session UploadSession
+	err = json.Unmarshal(signedRequest.Message, &session)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	// Verify the request was made by the owner or a writer
+	principal, err := signedRequest.Principal(req, session.Owner)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = authorizeFile(principal, session.Owner, session.Name, roleWriter, true, store)
+	if err != nil {
+		render.JSON(w, errorStatus(err), map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	session.Uploader = principal.Username
+	err = session.Insert(store)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	render.JSON(w, http.StatusOK, session)
+}
+
+// Handle a file chunk upload
+func uploadChunk(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var signedRequest SignedRequest
+	if req.Body == nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": "Invalid Request: Empty"})
+		return
+	}
+	err := json.NewDecoder(req.Body).Decode(&signedRequest)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	var chunk FileChunk
+	err = json.Unmarshal(signedRequest.Message, &chunk)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	// Verify the request was made by the user who started the upload
+	principal, err := signedRequest.Principal(req, chunk.Owner)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	session, err := store.GetUploadSession(chunk.Session)
+	if err != nil {
+		render.JSON(w, errorStatus(err), map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = authorizeFile(principal, session.Owner, session.Name, roleWriter, true, store)
+	if err != nil {
+		render.JSON(w, errorStatus(err), map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = authorizeUpload(principal, session)
+	if err != nil {
+		render.JSON(w, errorStatus(err), map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = session.Accepts(&chunk)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = chunk.Insert(store)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	render.JSON(w, http.StatusOK, map[string]string{"Status": "success", "Error": ""})
+}
+
+// Commit an upload session, making it the current version of its file
+func commitUpload(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var signedRequest SignedRequest
+	if req.Body == nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": "Invalid Request: Empty"})
+		return
+	}
+	err := json.NewDecoder(req.Body).Decode(&signedRequest)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	var commit UploadSession
+	err = json.Unmarshal(signedRequest.Message, &commit)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	// Verify the request was made by the user who started the upload
+	principal, err := signedRequest.Principal(req, commit.Owner)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	session, err := store.GetUploadSession(commit.Id)
+	if err != nil {
+		render.JSON(w, errorStatus(err), map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = authorizeFile(principal, session.Owner, session.Name, roleWriter, true, store)
+	if err != nil {
+		render.JSON(w, errorStatus(err), map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = authorizeUpload(principal, session)
+	if err != nil {
+		render.JSON(w, errorStatus(err), map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	if commit.Owner != session.Owner || commit.Name != session.Name {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": "Commit does not match upload"})
 		return
 	}
-	_, err = file.Insert(dbSession)
+	session.Manifest = commit.Manifest
+	session.PreviousKey = commit.PreviousKey
+	err = session.Commit(store)
 	if err != nil {
 		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
 		return
@@ -77,13 +270,70 @@ func shareFile(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
 		return
 	}
-	user, _ := GetUser(filekey.Owner, dbSession)
-	// Verify signed message
-	if !verify(user.PubKey, signedRequest.Message, signedRequest.Signature) {
-		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": "Could not verify signature"})
+	// Verify the request was made by the owner or a manager
+	principal, err := signedRequest.Principal(req, filekey.Owner)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = authorizeFile(principal, filekey.Owner, filekey.Name, roleManager, false, store)
+	if err != nil {
+		render.JSON(w, errorStatus(err), map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = authorizeGrant(principal, filekey.Owner, filekey.Name, filekey.User, filekey.Role, store)
+	if err != nil {
+		render.JSON(w, errorStatus(err), map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = filekey.checkGrant(principal, store)
+	if err != nil {
+		render.JSON(w, errorStatus(err), map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = filekey.Insert(store)
+	if err != nil {
+		render.JSON(w, errorStatus(err), map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	render.JSON(w, http.StatusOK, map[string]string{"Status": "success", "Error": ""})
+}
+
+// Replace a user's keys and re-encrypted file keys
+func rotateKey(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var signedRequest SignedRequest
+	if req.Body == nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": "Invalid Request: Empty"})
+		return
+	}
+	err := json.NewDecoder(req.Body).Decode(&signedRequest)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	var rotation KeyRotation
+	err = json.Unmarshal(signedRequest.Message, &rotation)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	// Only a signature with the device's old key can replace it, not a session token or client certificate
+	user, err := GetUser(rotation.Username, store)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	device := user.Device(rotation.Device)
+	if device == nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": errDeviceNotFound.Error()})
+		return
+	}
+	err = signedRequest.Verify([]PublicKey{device.Keys.Signing}, req.URL.Path)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
 		return
 	}
-	_, err = filekey.Insert(dbSession)
+	err = rotation.Rotate(store)
 	if err != nil {
 		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
 		return
@@ -109,23 +359,81 @@ func revokeFile(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
 		return
 	}
-	user, _ := GetUser(filekey.Owner, dbSession)
-	// Verify signed message
-	if !verify(user.PubKey, signedRequest.Message, signedRequest.Signature) {
-		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": "Could not verify signature"})
+	// Verify the request was made by the owner or a manager
+	principal, err := signedRequest.Principal(req, filekey.Owner)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = authorizeFile(principal, filekey.Owner, filekey.Name, roleManager, false, store)
+	if err != nil {
+		render.JSON(w, errorStatus(err), map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = authorizeGrant(principal, filekey.Owner, filekey.Name, filekey.User, "", store)
+	if err != nil {
+		render.JSON(w, errorStatus(err), map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = filekey.Revoke(store)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	render.JSON(w, http.StatusOK, map[string]string{"Status": "success", "Error": ""})
+}
+
+// Replace a file with a new version under a new key, and its file keys, in one request
+func rekeyFile(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var signedRequest SignedRequest
+	if req.Body == nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": "Invalid Request: Empty"})
+		return
+	}
+	err := json.NewDecoder(req.Body).Decode(&signedRequest)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
 		return
 	}
-	_, err = filekey.Revoke(dbSession)
+	var rekey Rekey
+	err = json.Unmarshal(signedRequest.Message, &rekey)
 	if err != nil {
 		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
 		return
 	}
+	// Verify the request was made by the owner or a manager
+	principal, err := signedRequest.Principal(req, rekey.Owner)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = authorizeFile(principal, rekey.Owner, rekey.Name, roleManager, false, store)
+	if err != nil {
+		render.JSON(w, errorStatus(err), map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = authorizeRekey(principal, &rekey, store)
+	if err != nil {
+		render.JSON(w, errorStatus(err), map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = rekey.Apply(store)
+	if err != nil {
+		render.JSON(w, errorStatus(err), map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
 	render.JSON(w, http.StatusOK, map[string]string{"Status": "success", "Error": ""})
 }
 
 // Get a user
 func getUser(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-	user, err := GetUser(ps.ByName("username"), dbSession)
+	user, err := GetUser(ps.ByName("username"), store)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	// Users registered before the key log are logged the first time their keys are given out
+	err = keyLog.Ensure(user)
 	if err != nil {
 		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
 		return
@@ -135,7 +443,23 @@ func getUser(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 
 // Get a file
 func getFile(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-	file, err := GetFile(ps.ByName("username"), ps.ByName("filename"), dbSession)
+	user, err := authenticate(req)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	// Only users holding a key for the file can read it
+	_, err = GetFileKey(ps.ByName("username"), ps.ByName("filename"), user.Username, store)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	version, err := versionParam(req)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	file, err := GetFileVersion(ps.ByName("username"), ps.ByName("filename"), version, store)
 	if err != nil {
 		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
 		return
@@ -143,22 +467,467 @@ func getFile(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	render.JSON(w, http.StatusOK, file)
 }
 
-// Get a list of users with access to a file
-func getFileUsers(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-	users, err := GetFileUsers(ps.ByName("username"), ps.ByName("filename"), dbSession)
+// Get a file chunk
+func getFileChunk(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	user, err := authenticate(req)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	// Only users holding a key for the file can read it
+	_, err = GetFileKey(ps.ByName("username"), ps.ByName("filename"), user.Username, store)
 	if err != nil {
 		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
 		return
 	}
-	render.JSON(w, http.StatusOK, users)
+	index, err := strconv.Atoi(ps.ByName("index"))
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": "Invalid chunk index"})
+		return
+	}
+	version, err := versionParam(req)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	chunk, err := GetFileChunk(ps.ByName("username"), ps.ByName("filename"), version, index, store)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	render.JSON(w, http.StatusOK, chunk)
 }
 
-// Get a file key
-func getFileKey(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-	filekey, err := GetFileKey(ps.ByName("username"), ps.ByName("filename"), ps.ByName("user"), dbSession)
+// Get an upload session and the chunks it has received
+func getUploadSession(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	user, err := authenticate(req)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	session, err := GetUploadSession(ps.ByName("upload"), store)
 	if err != nil {
 		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
 		return
 	}
-	render.JSON(w, http.StatusOK, filekey)
+	// Only the user who started an upload can see it
+	if session.uploader() != user.Username {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": errNoUpload.Error()})
+		return
+	}
+	render.JSON(w, http.StatusOK, session)
+}
+
+// Get a list of users with access to a file
+func getFileUsers(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	user, err := authenticate(req)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	// Only users holding a key for the file can read it
+	_, err = GetFileKey(ps.ByName("username"), ps.ByName("filename"), user.Username, store)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	users, err := GetFileUsers(ps.ByName("username"), ps.ByName("filename"), store)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	render.JSON(w, http.StatusOK, users)
+}
+
+// Get the kept versions of a file and its current version
+func getFileVersions(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	user, err := authenticate(req)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	// Only users holding a key for the file can read it
+	_, err = GetFileKey(ps.ByName("username"), ps.ByName("filename"), user.Username, store)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	versions, err := GetFileVersions(ps.ByName("username"), ps.ByName("filename"), store)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	render.JSON(w, http.StatusOK, versions)
+}
+
+// Get a file key
+func getFileKey(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	user, err := authenticate(req)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	// Users can only get their own file keys
+	if ps.ByName("user") != user.Username {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": errNoFileAccess.Error()})
+		return
+	}
+	filekey, err := GetFileKey(ps.ByName("username"), ps.ByName("filename"), ps.ByName("user"), store)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	render.JSON(w, http.StatusOK, filekey)
+}
+
+// Get all file keys shared with the requesting user
+func getUserFileKeys(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	user, err := authenticate(req)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	filekeys, err := GetUserFileKeys(user.Username, store)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	render.JSON(w, http.StatusOK, UserFileKeys{filekeys})
+}
+
+// Get the grants the requesting user signed, to sign them again when one of their devices changes
+func getUserGrants(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	user, err := authenticate(req)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	grants, err := GetUserGrants(user.Username, store)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	render.JSON(w, http.StatusOK, grants)
+}
+
+// Get the requesting user's files that need a rekey because a share of them expired
+func getRekeyFiles(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	user, err := authenticate(req)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	files, err := GetRekeyFiles(user.Username, store)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	render.JSON(w, http.StatusOK, files)
+}
+
+// Ask to add a new device to a user, pending approval from one of the user's devices
+func enrollDevice(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var enrollment Enrollment
+	if req.Body == nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": "Invalid Request: Empty"})
+		return
+	}
+	err := json.NewDecoder(req.Body).Decode(&enrollment)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = enrollment.Submit(store)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	render.JSON(w, http.StatusOK, enrollment)
+}
+
+// Get the requesting user's devices and pending enrollments
+func getDevices(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	user, err := authenticate(req)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	render.JSON(w, http.StatusOK, UserDevices{user.Devices, enrollments.User(user.Username)})
+}
+
+// Approve a pending device enrollment
+func approveDevice(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var signedRequest SignedRequest
+	if req.Body == nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": "Invalid Request: Empty"})
+		return
+	}
+	err := json.NewDecoder(req.Body).Decode(&signedRequest)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	var approval DeviceApproval
+	err = json.Unmarshal(signedRequest.Message, &approval)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	// Only a signature from one of the user's devices can add a device, not a session token or client certificate
+	user, err := GetUser(approval.Username, store)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = signedRequest.Verify(user.SigningKeys(), req.URL.Path)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = approval.Approve(store)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	render.JSON(w, http.StatusOK, map[string]string{"Status": "success", "Error": ""})
+}
+
+// Remove one of the user's devices
+func removeDevice(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var signedRequest SignedRequest
+	if req.Body == nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": "Invalid Request: Empty"})
+		return
+	}
+	err := json.NewDecoder(req.Body).Decode(&signedRequest)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	var removal DeviceRemoval
+	err = json.Unmarshal(signedRequest.Message, &removal)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	// Only a signature from one of the user's devices can remove a device, not a session token or client certificate
+	user, err := GetUser(removal.Username, store)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = signedRequest.Verify(user.SigningKeys(), req.URL.Path)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = removal.Remove(store)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	render.JSON(w, http.StatusOK, map[string]string{"Status": "success", "Error": ""})
+}
+
+// Store the user's recovery shares
+func setupRecovery(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var signedRequest SignedRequest
+	if req.Body == nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": "Invalid Request: Empty"})
+		return
+	}
+	err := json.NewDecoder(req.Body).Decode(&signedRequest)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	var recovery Recovery
+	err = json.Unmarshal(signedRequest.Message, &recovery)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	// Only a signature from one of the user's devices can choose trustees, not a session token or client certificate
+	user, err := GetUser(recovery.Username, store)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = signedRequest.Verify(user.SigningKeys(), req.URL.Path)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = recovery.Insert(store)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	render.JSON(w, http.StatusOK, map[string]string{"Status": "success", "Error": ""})
+}
+
+// Ask the user's trustees to recover their keys for a new device
+func startRecovery(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var signedRequest SignedRequest
+	if req.Body == nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": "Invalid Request: Empty"})
+		return
+	}
+	err := json.NewDecoder(req.Body).Decode(&signedRequest)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	var recoveryRequest RecoveryRequest
+	err = json.Unmarshal(signedRequest.Message, &recoveryRequest)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	// The request is signed with the new device's key, proving it holds the key
+	err = signedRequest.Verify([]PublicKey{recoveryRequest.Keys.Signing}, req.URL.Path)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = recoveryRequest.Submit(store)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	render.JSON(w, http.StatusOK, recoveryRequest)
+}
+
+// Get the pending recovery requests the requesting user is a trustee of
+func getRecoveryRequests(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	user, err := authenticate(req)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	requests, err := GetTrusteeRequests(user.Username, store)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	render.JSON(w, http.StatusOK, requests)
+}
+
+// Approve a recovery request with the trustee's share
+func approveRecovery(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var signedRequest SignedRequest
+	if req.Body == nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": "Invalid Request: Empty"})
+		return
+	}
+	err := json.NewDecoder(req.Body).Decode(&signedRequest)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	var approval RecoveryApproval
+	err = json.Unmarshal(signedRequest.Message, &approval)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	// Verify the request was made by the trustee
+	err = signedRequest.Authenticate(req, approval.Trustee)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = approval.Approve(store)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	render.JSON(w, http.StatusOK, map[string]string{"Status": "success", "Error": ""})
+}
+
+// Get the approved shares of a recovery request
+func getRecoveryShares(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var signedRequest SignedRequest
+	if req.Body == nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": "Invalid Request: Empty"})
+		return
+	}
+	err := json.NewDecoder(req.Body).Decode(&signedRequest)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	var shares RecoveryShares
+	err = json.Unmarshal(signedRequest.Message, &shares)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	// Only the new device that made the recovery request can get its shares
+	recoveryRequest, ok := recoveryRequests.Get(shares.Request)
+	if !ok {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": errNoRecoveryRequest.Error()})
+		return
+	}
+	err = signedRequest.Verify([]PublicKey{recoveryRequest.Keys.Signing}, req.URL.Path)
+	if err != nil {
+		render.JSON(w, http.StatusUnauthorized, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	err = shares.Collect(store)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	render.JSON(w, http.StatusOK, shares)
+}
+
+// Get the key log's current signed tree head
+func getLogHead(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	head, err := keyLog.TreeHead()
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	render.JSON(w, http.StatusOK, head)
+}
+
+// Get the public key tree heads are signed with
+func getLogKey(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	render.JSON(w, http.StatusOK, keyLog.PublicKey())
+}
+
+// Get the inclusion proof of a user's latest keys in the tree of the requested size
+func getUserLogProof(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	size, err := strconv.Atoi(req.URL.Query().Get("size"))
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": "Invalid tree size"})
+		return
+	}
+	proof, err := keyLog.UserProof(ps.ByName("username"), size)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	render.JSON(w, http.StatusOK, proof)
+}
+
+// Get the consistency proof between two tree sizes
+func getLogConsistency(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	first, err := strconv.Atoi(req.URL.Query().Get("first"))
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": "Invalid tree sizes"})
+		return
+	}
+	second, err := strconv.Atoi(req.URL.Query().Get("second"))
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": "Invalid tree sizes"})
+		return
+	}
+	proof, err := keyLog.ConsistencyProof(first, second)
+	if err != nil {
+		render.JSON(w, http.StatusBadRequest, map[string]string{"Status": "failure", "Error": err.Error()})
+		return
+	}
+	render.JSON(w, http.StatusOK, proof)
 }
@@ -0,0 +1,2489 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kyrillzorin/CS3031_Lab2/lab2"
+)
+
+// Server response, mirrors the client's Response struct
+type testResponse struct {
+	Status string
+	Error  string
+}
+
+// Test client speaking the same wire protocol as the client program
+type testClient struct {
+	t        *testing.T
+	server   *httptest.Server
+	username string
+	key      *rsa.PrivateKey
+	client   *http.Client
+	// Signing key of clients using an Ed25519 key set instead of key, and their X25519 key
+	edKey  ed25519.PrivateKey
+	x25519 *ecdh.PrivateKey
+}
+
+// Start a server backed by a fresh in-memory store
+func newTestServer(t *testing.T) *httptest.Server {
+	store = newMemoryStore()
+	newTestKeyLog(t)
+	server := httptest.NewServer(newRouter())
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Start an empty key log over the current store with a new signing key
+func newTestKeyLog(t *testing.T) ed25519.PublicKey {
+	public, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyLog, err = newKeyLog(store, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public
+}
+
+// Create a test client with a new RSA key
+func newTestClient(t *testing.T, server *httptest.Server, username string) *testClient {
+	key, err := rsa.GenerateKey(rand.Reader, minRSABits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{t: t, server: server, username: username, key: key, client: server.Client()}
+}
+
+// Create a test client with a new Ed25519 signing key
+func newEd25519TestClient(t *testing.T, server *httptest.Server, username string) *testClient {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{t: t, server: server, username: username, client: server.Client(), edKey: edKey}
+}
+
+// Private key of the client as the client program holds it
+func (c *testClient) privateKey() lab2.PrivateKey {
+	if c.edKey == nil {
+		return lab2.RSAKey{PrivateKey: c.key}
+	}
+	if c.x25519 == nil {
+		var err error
+		c.x25519, err = ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	keyPair, err := lab2.ParseKeyPair(append(c.edKey.Seed(), c.x25519.Bytes()...))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return keyPair
+}
+
+// Sign message with the client's sign function
+func (c *testClient) sign(message []byte) []byte {
+	signature, err := lab2.Sign(c.privateKey(), message)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return signature
+}
+
+// Post a raw body and decode the status response
+func (c *testClient) post(path string, body []byte) (int, testResponse) {
+	res, err := c.client.Post(c.server.URL+path, "application/json; charset=utf-8", bytes.NewReader(body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var response testResponse
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		c.t.Fatal(err)
+	}
+	return res.StatusCode, response
+}
+
+// Build a request to path with the given timestamp and nonce, signed with the client's request signing
+func (c *testClient) signRequest(path string, message []byte, timestamp time.Time, nonce []byte) SignedRequest {
+	s := lab2.SignedRequest{Message: message, Path: path, Timestamp: timestamp.Unix(), Nonce: nonce, Username: c.username}
+	if err := s.Sign(c.privateKey()); err != nil {
+		c.t.Fatal(err)
+	}
+	return SignedRequest(s)
+}
+
+// Build a fresh request to path with the client's NewSignedRequest
+func (c *testClient) newSignedRequest(path string, message []byte) SignedRequest {
+	s, err := lab2.NewSignedRequest(c.username, c.privateKey(), path, message)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return SignedRequest(*s)
+}
+
+// Post a message signed with the client's key
+func (c *testClient) postSigned(path string, v interface{}) (int, testResponse) {
+	message, err := json.Marshal(v)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	body, err := json.Marshal(c.newSignedRequest(path, message))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return c.post(path, body)
+}
+
+// Get a path with signature headers like the client's SignedGet
+// The signature covers the path without its query, like the server checks it
+func (c *testClient) get(path string, v interface{}) (int, testResponse) {
+	signedPath := strings.SplitN(path, "?", 2)[0]
+	return c.getWithHeaders(path, c.signHeaders(c.newSignedRequest(signedPath, nil)), v)
+}
+
+// Signature headers for a signed request
+func (c *testClient) signHeaders(s SignedRequest) http.Header {
+	header := make(http.Header)
+	header.Set("X-User", c.username)
+	header.Set("X-Timestamp", strconv.FormatInt(s.Timestamp, 10))
+	header.Set("X-Nonce", base64.StdEncoding.EncodeToString(s.Nonce))
+	header.Set("X-Signature", base64.StdEncoding.EncodeToString(s.Signature))
+	return header
+}
+
+// Get a path and decode the JSON result into v, returns the failure response if any
+func (c *testClient) getWithHeaders(path string, header http.Header, v interface{}) (int, testResponse) {
+	req, err := http.NewRequest("GET", c.server.URL+path, nil)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header = header
+	res, err := c.client.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	var response testResponse
+	json.Unmarshal(body, &response)
+	if response.Status == "failure" {
+		return res.StatusCode, response
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		c.t.Fatal(err)
+	}
+	return res.StatusCode, response
+}
+
+// Register the client's user
+func (c *testClient) register() {
+	var user User
+	if c.edKey != nil {
+		user = User{Username: c.username, Keys: c.keySet()}
+	} else {
+		user = User{Username: c.username, PubKey: &c.key.PublicKey}
+	}
+	body, err := json.Marshal(user)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	expectSuccess(c.t, "register", func() (int, testResponse) { return c.post("/register", body) })
+}
+
+// Ed25519 key set of the client
+func (c *testClient) keySet() KeySet {
+	return serverKeySet(c.privateKey().PublicKeys())
+}
+
+// Key set as the server stores it
+func serverKeySet(keys lab2.KeySet) KeySet {
+	return KeySet{PublicKey(keys.Signing), PublicKey(keys.Encryption)}
+}
+
+// Upload file data and share its key with the owner if the file is new, like the client's UploadFile
+func (c *testClient) upload(filename string, data []byte, key []byte) {
+	var filekey FileKey
+	_, res := c.get("/users/"+c.username+"/"+filename+"/key/"+c.username, &filekey)
+	file := File{Owner: c.username, Name: filename, Data: data, New: res.Status == "failure"}
+	expectSuccess(c.t, "upload", func() (int, testResponse) { return c.postSigned("/uploadfile", file) })
+	if file.New {
+		c.share(filename, c, key)
+	}
+}
+
+// Share a file key with another client, like the client's ShareFile
+func (c *testClient) share(filename string, user *testClient, key []byte) {
+	encodedKey, err := lab2.Encrypt(user.privateKey().PublicKeys().Encryption, key)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	filekey := FileKey{User: user.username, Owner: c.username, Name: filename, Key: encodedKey}
+	expectSuccess(c.t, "share", func() (int, testResponse) { return c.postSigned("/sharefile", filekey) })
+}
+
+// Download a file and decrypt its key, like the client's DownloadFile
+func (c *testClient) download(owner string, filename string) (data []byte, key []byte) {
+	var file File
+	if _, res := c.get("/users/"+owner+"/"+filename, &file); res.Status == "failure" {
+		c.t.Fatalf("get file: %s", res.Error)
+	}
+	var filekey FileKey
+	if _, res := c.get("/users/"+owner+"/"+filename+"/key/"+c.username, &filekey); res.Status == "failure" {
+		c.t.Fatalf("get file key: %s", res.Error)
+	}
+	key, err := lab2.Decrypt(c.privateKey(), filekey.Key)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return file.Data, key
+}
+
+// Check that a request succeeded
+func expectSuccess(t *testing.T, name string, do func() (int, testResponse)) {
+	t.Helper()
+	status, res := do()
+	if status != http.StatusOK || res.Status != "success" {
+		t.Fatalf("%s: got %d %+v, want success", name, status, res)
+	}
+}
+
+// Check that a request failed with the given status and error text
+func expectFailure(t *testing.T, name string, status int, contains string, do func() (int, testResponse)) {
+	t.Helper()
+	gotStatus, res := do()
+	if gotStatus != status || res.Status != "failure" || !strings.Contains(res.Error, contains) {
+		t.Errorf("%s: got %d %+v, want %d failure containing %q", name, gotStatus, res, status, contains)
+	}
+}
+
+func TestUploadShareDownloadRevoke(t *testing.T) {
+	server := newTestServer(t)
+	alice := newTestClient(t, server, "alice")
+	bob := newTestClient(t, server, "bob")
+	carol := newTestClient(t, server, "carol")
+	alice.register()
+	bob.register()
+	carol.register()
+
+	var user User
+	if _, res := bob.get("/users/alice", &user); res.Status == "failure" {
+		t.Fatalf("get user: %s", res.Error)
+	}
+	if user.Username != "alice" || user.PubKey.N.Cmp(alice.key.N) != 0 {
+		t.Errorf("get user returned %+v", user)
+	}
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	alice.upload("a.txt", []byte("ciphertext"), key)
+	data, gotKey := alice.download("alice", "a.txt")
+	if string(data) != "ciphertext" || !bytes.Equal(gotKey, key) {
+		t.Errorf("owner download = %q %q", data, gotKey)
+	}
+	var file File
+	if alice.get("/users/alice/a.txt", &file); file.Format != formatEnvelope {
+		t.Errorf("new file format = %d, want %d", file.Format, formatEnvelope)
+	}
+
+	alice.share("a.txt", bob, key)
+	alice.share("a.txt", carol, key)
+	data, gotKey = bob.download("alice", "a.txt")
+	if string(data) != "ciphertext" || !bytes.Equal(gotKey, key) {
+		t.Errorf("shared download = %q %q", data, gotKey)
+	}
+
+	var users FileUsers
+	alice.get("/users/alice/a.txt/users", &users)
+	if strings.Join(users.Users, ",") != "alice,bob,carol" {
+		t.Errorf("file users = %v", users.Users)
+	}
+
+	// Revoke bob, the remaining users keep the key for new versions
+	revoke := FileKey{User: "bob", Owner: "alice", Name: "a.txt"}
+	expectSuccess(t, "revoke", func() (int, testResponse) { return alice.postSigned("/revokefile", revoke) })
+	alice.upload("a.txt", []byte("new ciphertext"), key)
+
+	expectFailure(t, "revoked download", http.StatusBadRequest, "You do not have access", func() (int, testResponse) {
+		var filekey FileKey
+		return bob.get("/users/alice/a.txt/key/bob", &filekey)
+	})
+	data, gotKey = carol.download("alice", "a.txt")
+	if string(data) != "new ciphertext" || !bytes.Equal(gotKey, key) {
+		t.Errorf("download after revoke = %q %q", data, gotKey)
+	}
+	alice.get("/users/alice/a.txt/users", &users)
+	if strings.Join(users.Users, ",") != "alice,carol" {
+		t.Errorf("file users after revoke = %v", users.Users)
+	}
+}
+
+// Answer a login challenge like the client's Login, returns the login request
+func (c *testClient) answerChallenge() LoginRequest {
+	body, _ := json.Marshal(Challenge{Username: c.username})
+	res, err := c.client.Post(c.server.URL+"/challenge", "application/json; charset=utf-8", bytes.NewReader(body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var challenge Challenge
+	if err := json.NewDecoder(res.Body).Decode(&challenge); err != nil || len(challenge.Challenge) == 0 {
+		c.t.Fatalf("challenge: got %d %v", res.StatusCode, err)
+	}
+	data, _ := json.Marshal(loginData{c.username, challenge.Challenge})
+	return LoginRequest{c.username, challenge.Challenge, c.sign(data)}
+}
+
+// Post a login request, returns the issued token if any
+func (c *testClient) login(loginRequest LoginRequest) (int, testResponse, Token) {
+	body, _ := json.Marshal(loginRequest)
+	res, err := c.client.Post(c.server.URL+"/login", "application/json; charset=utf-8", bytes.NewReader(body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, _ := io.ReadAll(res.Body)
+	var response testResponse
+	var token Token
+	json.Unmarshal(data, &response)
+	json.Unmarshal(data, &token)
+	return res.StatusCode, response, token
+}
+
+// Post an unsigned message authenticated with a session token
+func (c *testClient) postWithToken(path string, token string, v interface{}) (int, testResponse) {
+	message, _ := json.Marshal(v)
+	body, _ := json.Marshal(SignedRequest{Message: message, Path: path})
+	req, err := http.NewRequest("POST", c.server.URL+path, bytes.NewReader(body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := c.client.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var response testResponse
+	json.NewDecoder(res.Body).Decode(&response)
+	return res.StatusCode, response
+}
+
+func TestLogin(t *testing.T) {
+	server := newTestServer(t)
+	alice := newTestClient(t, server, "alice")
+	mallory := newTestClient(t, server, "mallory")
+	alice.register()
+	mallory.register()
+	alice.upload("a.txt", []byte("ciphertext"), []byte("key"))
+
+	status, res, token := alice.login(alice.answerChallenge())
+	if status != http.StatusOK || token.Username != "alice" || token.Token == "" || time.Until(token.Expires) <= 0 {
+		t.Fatalf("login: got %d %+v %+v", status, res, token)
+	}
+	bearer := make(http.Header)
+	bearer.Set("Authorization", "Bearer "+token.Token)
+	var file File
+	if status, res := alice.getWithHeaders("/users/alice/a.txt", bearer, &file); status != http.StatusOK || string(file.Data) != "ciphertext" {
+		t.Errorf("get with token: got %d %+v", status, res)
+	}
+	// Tokens can be reused until they expire
+	session := alice.startUpload("b.txt", 2)
+	for i := 0; i < 2; i++ {
+		chunk := FileChunk{Owner: "alice", Name: "b.txt", Session: session.Id, Index: i, Data: []byte("chunk")}
+		expectSuccess(t, "chunk with token", func() (int, testResponse) { return alice.postWithToken("/uploadchunk", token.Token, chunk) })
+	}
+
+	expectFailure(t, "token for another user", http.StatusForbidden, errNotWriter.Error(), func() (int, testResponse) {
+		return mallory.postWithToken("/uploadfile", token.Token, File{Owner: "mallory", Name: "m.txt"})
+	})
+	expectFailure(t, "post with invalid token", http.StatusUnauthorized, errInvalidToken.Error(), func() (int, testResponse) {
+		return alice.postWithToken("/uploadfile", "bogus", File{Owner: "alice", Name: "a.txt"})
+	})
+	tokens.Add("expired", "alice", time.Now().Add(-time.Second))
+	bearer.Set("Authorization", "Bearer expired")
+	expectFailure(t, "get with expired token", http.StatusUnauthorized, errInvalidToken.Error(), func() (int, testResponse) {
+		return alice.getWithHeaders("/users/alice/a.txt", bearer, &file)
+	})
+
+	// Challenges are single use and must be signed by the user they were issued to
+	answered := alice.answerChallenge()
+	alice.login(answered)
+	if status, res, _ := alice.login(answered); status != http.StatusUnauthorized || res.Error != "Invalid or expired challenge" {
+		t.Errorf("reused challenge: got %d %+v", status, res)
+	}
+	forged := mallory.answerChallenge()
+	forged.Username = "alice"
+	if status, res, _ := mallory.login(forged); status != http.StatusUnauthorized || res.Error != "Invalid or expired challenge" {
+		t.Errorf("challenge for another user: got %d %+v", status, res)
+	}
+	wrongSigner := alice.answerChallenge()
+	data, _ := json.Marshal(loginData{"alice", wrongSigner.Challenge})
+	wrongSigner.Signature = mallory.sign(data)
+	if status, res, _ := mallory.login(wrongSigner); status != http.StatusUnauthorized || res.Error != "Could not verify signature" {
+		t.Errorf("wrong signer: got %d %+v", status, res)
+	}
+	expectFailure(t, "challenge for missing user", http.StatusBadRequest, "User does not exist", func() (int, testResponse) {
+		body, _ := json.Marshal(Challenge{Username: "nobody"})
+		return alice.post("/challenge", body)
+	})
+
+	// Anyone can request challenges for alice, but that mustn't stop her logging in
+	for i := 0; i < 2*maxChallengesPerUser; i++ {
+		body, _ := json.Marshal(Challenge{Username: "alice"})
+		if status, res := mallory.post("/challenge", body); status != http.StatusOK {
+			t.Fatalf("challenge flood: got %d %+v", status, res)
+		}
+	}
+	if status, res, _ := alice.login(alice.answerChallenge()); status != http.StatusOK {
+		t.Errorf("login after challenge flood: got %d %+v", status, res)
+	}
+}
+
+func TestSessionCache(t *testing.T) {
+	cache := newSessionCache(2)
+	now := time.Now()
+	cache.Add("a1", "alice", now.Add(time.Minute))
+	cache.Add("a2", "alice", now.Add(-time.Second))
+	cache.Add("b1", "bob", now.Add(time.Minute))
+	// A third value for alice replaces her oldest
+	cache.Add("a3", "alice", now.Add(time.Minute))
+	if _, ok := cache.Get("a1"); ok {
+		t.Errorf("oldest value was kept past the limit")
+	}
+	if username, ok := cache.Get("a3"); !ok || username != "alice" {
+		t.Errorf("newest value: got %q %v", username, ok)
+	}
+	if username, ok := cache.Get("b1"); !ok || username != "bob" {
+		t.Errorf("another user's value: got %q %v", username, ok)
+	}
+
+	cache.Sweep(now)
+	if len(cache.entries) != 2 || len(cache.users["alice"]) != 1 {
+		t.Errorf("sweep: got %v %v", cache.entries, cache.users)
+	}
+	if username, ok := cache.Take("a3"); !ok || username != "alice" {
+		t.Errorf("take: got %q %v", username, ok)
+	}
+	if _, ok := cache.users["alice"]; ok {
+		t.Errorf("user without values was kept: %v", cache.users)
+	}
+	cache.RemoveUser("bob")
+	if len(cache.entries) != 0 || len(cache.users) != 0 {
+		t.Errorf("remove user: got %v %v", cache.entries, cache.users)
+	}
+}
+
+// Start an upload session
+func (c *testClient) startUpload(filename string, chunks int) UploadSession {
+	return c.startEpochUpload(filename, chunks, 0)
+}
+
+// Start an upload encrypted with the file key of the given epoch
+func (c *testClient) startEpochUpload(filename string, chunks int, epoch int) UploadSession {
+	message, err := json.Marshal(UploadSession{Owner: c.username, Name: filename, Header: []byte("header"), Chunks: chunks, Epoch: epoch})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	body, err := json.Marshal(c.newSignedRequest("/startupload", message))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	res, err := c.client.Post(c.server.URL+"/startupload", "application/json; charset=utf-8", bytes.NewReader(body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var session UploadSession
+	if err := json.NewDecoder(res.Body).Decode(&session); err != nil {
+		c.t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || session.Id == "" {
+		c.t.Fatalf("start upload: got %d %+v", res.StatusCode, session)
+	}
+	return session
+}
+
+// Upload chunks of an upload session
+func (c *testClient) uploadChunks(session UploadSession, chunks map[int]string) {
+	for i, data := range chunks {
+		chunk := FileChunk{Owner: session.Owner, Name: session.Name, Session: session.Id, Index: i, Data: []byte(data)}
+		expectSuccess(c.t, "upload chunk", func() (int, testResponse) { return c.postSigned("/uploadchunk", chunk) })
+	}
+}
+
+func TestChunkedUpload(t *testing.T) {
+	server := newTestServer(t)
+	alice := newTestClient(t, server, "alice")
+	alice.register()
+
+	session := alice.startUpload("a.txt", 3)
+	alice.uploadChunks(session, map[int]string{0: "one", 1: "two"})
+
+	// Uncommitted uploads aren't visible and report their progress
+	var file File
+	expectFailure(t, "uncommitted file", http.StatusBadRequest, errNoFileAccess.Error(), func() (int, testResponse) {
+		return alice.get("/users/alice/a.txt", &file)
+	})
+	var progress UploadSession
+	alice.get("/uploads/"+session.Id, &progress)
+	if !reflect.DeepEqual(progress.Received, []int{0, 1}) || progress.Chunks != 3 {
+		t.Errorf("progress = %+v", progress)
+	}
+	commit := UploadSession{Id: session.Id, Owner: "alice", Name: "a.txt"}
+	expectFailure(t, "incomplete commit", http.StatusBadRequest, "received 2 of 3 chunks", func() (int, testResponse) {
+		return alice.postSigned("/commitupload", commit)
+	})
+
+	// Resume and commit
+	alice.uploadChunks(session, map[int]string{2: "three"})
+	expectSuccess(t, "commit", func() (int, testResponse) { return alice.postSigned("/commitupload", commit) })
+	alice.share("a.txt", alice, []byte("key"))
+	alice.get("/users/alice/a.txt", &file)
+	if file.Chunks != 3 || string(file.Header) != "header" || file.Session != session.Id {
+		t.Errorf("file = %+v", file)
+	}
+	var chunk FileChunk
+	alice.get("/users/alice/a.txt/chunks/2", &chunk)
+	if chunk.Index != 2 || string(chunk.Data) != "three" {
+		t.Errorf("chunk = %+v", chunk)
+	}
+	expectFailure(t, "committed session", http.StatusBadRequest, "Upload session does not exist", func() (int, testResponse) {
+		return alice.get("/uploads/"+session.Id, &progress)
+	})
+
+	// A new version replaces the old chunks only once it is committed
+	next := alice.startUpload("a.txt", 1)
+	alice.uploadChunks(next, map[int]string{0: "four"})
+	alice.get("/users/alice/a.txt/chunks/1", &chunk)
+	if string(chunk.Data) != "two" {
+		t.Errorf("chunk before commit = %+v", chunk)
+	}
+	expectSuccess(t, "commit", func() (int, testResponse) {
+		return alice.postSigned("/commitupload", UploadSession{Id: next.Id, Owner: "alice", Name: "a.txt"})
+	})
+	alice.get("/users/alice/a.txt/chunks/0", &chunk)
+	if string(chunk.Data) != "four" {
+		t.Errorf("chunk after commit = %+v", chunk)
+	}
+	expectFailure(t, "chunk past end", http.StatusBadRequest, "File chunk does not exist", func() (int, testResponse) {
+		return alice.get("/users/alice/a.txt/chunks/1", &chunk)
+	})
+	// The replaced upload is kept as the file's first version
+	alice.get("/users/alice/a.txt/chunks/1?version=1", &chunk)
+	if string(chunk.Data) != "two" {
+		t.Errorf("chunk of replaced upload = %+v", chunk)
+	}
+	expectFailure(t, "invalid index", http.StatusBadRequest, "Invalid chunk index", func() (int, testResponse) {
+		return alice.get("/users/alice/a.txt/chunks/x", &chunk)
+	})
+}
+
+func TestUploadSessionErrors(t *testing.T) {
+	server := newTestServer(t)
+	alice := newTestClient(t, server, "alice")
+	alice.register()
+	session := alice.startUpload("a.txt", 2)
+
+	expectFailure(t, "no chunks", http.StatusBadRequest, "at least one chunk", func() (int, testResponse) {
+		return alice.postSigned("/startupload", UploadSession{Owner: "alice", Name: "a.txt"})
+	})
+	expectFailure(t, "unknown session", http.StatusNotFound, "Upload session does not exist", func() (int, testResponse) {
+		return alice.postSigned("/uploadchunk", FileChunk{Owner: "alice", Name: "a.txt", Session: "missing"})
+	})
+	expectFailure(t, "chunk for other file", http.StatusBadRequest, "does not belong", func() (int, testResponse) {
+		return alice.postSigned("/uploadchunk", FileChunk{Owner: "alice", Name: "b.txt", Session: session.Id})
+	})
+	for _, index := range []int{-1, 2} {
+		expectFailure(t, "chunk index out of range", http.StatusBadRequest, "Invalid chunk index", func() (int, testResponse) {
+			return alice.postSigned("/uploadchunk", FileChunk{Owner: "alice", Name: "a.txt", Session: session.Id, Index: index})
+		})
+	}
+	expectFailure(t, "commit unknown session", http.StatusNotFound, "Upload session does not exist", func() (int, testResponse) {
+		return alice.postSigned("/commitupload", UploadSession{Id: "missing", Owner: "alice", Name: "a.txt"})
+	})
+	expectFailure(t, "commit other file", http.StatusBadRequest, "Commit does not match upload", func() (int, testResponse) {
+		return alice.postSigned("/commitupload", UploadSession{Id: session.Id, Owner: "alice", Name: "b.txt"})
+	})
+	expectFailure(t, "chunked single request upload", http.StatusBadRequest, "upload session", func() (int, testResponse) {
+		return alice.postSigned("/uploadfile", File{Owner: "alice", Name: "a.txt", Chunks: 2})
+	})
+}
+
+func TestRegisterErrors(t *testing.T) {
+	server := newTestServer(t)
+	alice := newTestClient(t, server, "alice")
+	alice.register()
+
+	expectFailure(t, "invalid json", http.StatusBadRequest, "", func() (int, testResponse) {
+		return alice.post("/register", []byte("{"))
+	})
+	expectFailure(t, "duplicate", http.StatusBadRequest, "Duplicate account", func() (int, testResponse) {
+		body, _ := json.Marshal(User{Username: "alice", PubKey: &alice.key.PublicKey})
+		return alice.post("/register", body)
+	})
+
+	weak, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey := newEd25519TestClient(t, server, "bob").keySet()
+	for _, test := range []struct {
+		name  string
+		keys  KeySet
+		error string
+	}{
+		{"no keys", KeySet{}, "User has no public keys"},
+		{"weak RSA key", rsaKeySet(&weak.PublicKey), "RSA keys must be at least"},
+		{"invalid RSA key", KeySet{PublicKey{algorithmRSA, []byte("key")}, PublicKey{algorithmRSA, []byte("key")}}, "Invalid RSA public key"},
+		{"short Ed25519 key", KeySet{PublicKey{algorithmEd25519, []byte("key")}, edKey.Encryption}, "Invalid Ed25519 public key"},
+		{"short X25519 key", KeySet{edKey.Signing, PublicKey{algorithmX25519, []byte("key")}}, "Invalid X25519 public key"},
+		{"X25519 signing key", KeySet{edKey.Encryption, edKey.Encryption}, "can't be used for signing"},
+		{"Ed25519 encryption key", KeySet{edKey.Signing, edKey.Signing}, "can't be used for encryption"},
+		{"unknown algorithm", KeySet{PublicKey{"dsa", []byte("key")}, edKey.Encryption}, "Unsupported key algorithm: dsa"},
+	} {
+		expectFailure(t, test.name, http.StatusBadRequest, test.error, func() (int, testResponse) {
+			body, _ := json.Marshal(User{Username: "bob", Keys: test.keys})
+			return alice.post("/register", body)
+		})
+	}
+}
+
+func TestKeyTypes(t *testing.T) {
+	server := newTestServer(t)
+	alice := newEd25519TestClient(t, server, "alice")
+	bob := newTestClient(t, server, "bob")
+	alice.register()
+	bob.register()
+
+	// Ed25519 users sign requests, log in and present their key set
+	var user User
+	if _, res := bob.get("/users/alice", &user); res.Status == "failure" {
+		t.Fatalf("get user: %s", res.Error)
+	}
+	if user.Keys.Signing.Algorithm != algorithmEd25519 || user.Keys.Encryption.Algorithm != algorithmX25519 || user.PubKey != nil {
+		t.Errorf("get Ed25519 user returned %+v", user)
+	}
+	expectSuccess(t, "Ed25519 upload", func() (int, testResponse) {
+		return alice.postSigned("/uploadfile", File{Owner: "alice", Name: "a.txt", Data: []byte("ciphertext")})
+	})
+	expectSuccess(t, "Ed25519 share", func() (int, testResponse) {
+		return alice.postSigned("/sharefile", FileKey{User: "alice", Owner: "alice", Name: "a.txt", Key: []byte("key")})
+	})
+	var file File
+	if status, res := alice.get("/users/alice/a.txt", &file); status != http.StatusOK || string(file.Data) != "ciphertext" {
+		t.Errorf("Ed25519 get: got %d %+v", status, res)
+	}
+	if status, res, _ := alice.login(alice.answerChallenge()); status != http.StatusOK {
+		t.Errorf("Ed25519 login: got %d %+v", status, res)
+	}
+	expectFailure(t, "Ed25519 signature by another key", http.StatusUnauthorized, "Could not verify signature", func() (int, testResponse) {
+		_, alice.edKey, _ = ed25519.GenerateKey(rand.Reader)
+		return alice.postSigned("/uploadfile", File{Owner: "alice", Name: "a.txt"})
+	})
+
+	// RSA users get a key set from their legacy key
+	if _, res := alice.get("/users/bob", &user); res.Status == "failure" {
+		t.Fatalf("get user: %s", res.Error)
+	}
+	if !reflect.DeepEqual(user.Keys, rsaKeySet(&bob.key.PublicKey)) || user.PubKey.N.Cmp(bob.key.N) != 0 {
+		t.Errorf("get RSA user returned %+v", user)
+	}
+
+	// Users stored before key sets keep working
+	carol := newTestClient(t, server, "carol")
+	if err := store.InsertUser(&User{Username: "carol", PubKey: &carol.key.PublicKey}); err != nil {
+		t.Fatal(err)
+	}
+	expectSuccess(t, "legacy RSA upload", func() (int, testResponse) {
+		return carol.postSigned("/uploadfile", File{Owner: "carol", Name: "c.txt", Data: []byte("ciphertext")})
+	})
+}
+
+func TestVerify(t *testing.T) {
+	message := []byte("message")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, minRSABits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashed := sha256.Sum256(message)
+	rsaSignature, err := rsa.SignPSS(rand.Reader, rsaKey, crypto.SHA256, hashed[:], &rsa.PSSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edSignature := ed25519.Sign(edKey, message)
+	rsaPublic := rsaKeySet(&rsaKey.PublicKey).Signing
+	edPublicKey := PublicKey{algorithmEd25519, edPublic}
+	for _, test := range []struct {
+		name      string
+		key       PublicKey
+		signature []byte
+		want      bool
+	}{
+		{"RSA", rsaPublic, rsaSignature, true},
+		{"Ed25519", edPublicKey, edSignature, true},
+		{"RSA with Ed25519 signature", rsaPublic, edSignature, false},
+		{"Ed25519 with RSA signature", edPublicKey, rsaSignature, false},
+		{"X25519 key", PublicKey{algorithmX25519, edPublic}, edSignature, false},
+		{"invalid RSA key", PublicKey{algorithmRSA, []byte("key")}, rsaSignature, false},
+		{"short Ed25519 key", PublicKey{algorithmEd25519, edPublic[:16]}, edSignature, false},
+	} {
+		if got := verify(test.key, message, test.signature); got != test.want {
+			t.Errorf("%s: verify = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSignedRequestErrors(t *testing.T) {
+	server := newTestServer(t)
+	alice := newTestClient(t, server, "alice")
+	mallory := newTestClient(t, server, "mallory")
+	nobody := newTestClient(t, server, "nobody")
+	alice.register()
+	mallory.register()
+	alice.upload("a.txt", []byte("data"), []byte("key"))
+	session := alice.startUpload("a.txt", 1)
+	alice.uploadChunks(session, map[int]string{0: "data"})
+
+	messages := map[string]interface{}{
+		"/uploadfile":   File{Owner: "alice", Name: "a.txt", Data: []byte("forged")},
+		"/startupload":  UploadSession{Owner: "alice", Name: "a.txt", Chunks: 1},
+		"/uploadchunk":  FileChunk{Owner: "alice", Name: "a.txt", Session: session.Id, Data: []byte("forged")},
+		"/commitupload": UploadSession{Id: session.Id, Owner: "alice", Name: "a.txt"},
+		"/sharefile":    FileKey{User: "mallory", Owner: "alice", Name: "a.txt", Key: []byte("key")},
+		"/revokefile":   FileKey{User: "mallory", Owner: "alice", Name: "a.txt"},
+	}
+	for path, message := range messages {
+		expectFailure(t, path+" invalid json", http.StatusBadRequest, "", func() (int, testResponse) {
+			return alice.post(path, []byte("{"))
+		})
+		expectFailure(t, path+" invalid message", http.StatusBadRequest, "", func() (int, testResponse) {
+			body, _ := json.Marshal(alice.newSignedRequest(path, []byte("{")))
+			return alice.post(path, body)
+		})
+		expectFailure(t, path+" wrong signer", http.StatusForbidden, "Only the file's owner and its", func() (int, testResponse) {
+			return mallory.postSigned(path, message)
+		})
+		expectFailure(t, path+" unregistered signer", http.StatusUnauthorized, "User does not exist", func() (int, testResponse) {
+			return nobody.postSigned(path, message)
+		})
+	}
+	expectFailure(t, "unsigned upload for missing owner", http.StatusUnauthorized, "User does not exist", func() (int, testResponse) {
+		request := SignedRequest{Message: []byte(`{"Owner":"nobody","Name":"a.txt"}`), Path: "/uploadfile"}
+		body, _ := json.Marshal(request)
+		return alice.post("/uploadfile", body)
+	})
+
+	expectFailure(t, "revoke own access", http.StatusBadRequest, "Can't revoke own file access", func() (int, testResponse) {
+		return alice.postSigned("/revokefile", FileKey{User: "alice", Owner: "alice", Name: "a.txt"})
+	})
+}
+
+func TestAuthorization(t *testing.T) {
+	server := newTestServer(t)
+	alice := newTestClient(t, server, "alice")
+	bob := newTestClient(t, server, "bob")
+	alice.register()
+	bob.register()
+	alice.upload("a.txt", []byte("data"), []byte("key"))
+	session := alice.startUpload("a.txt", 1)
+
+	// Requests that can't be tied to a registered user are unauthenticated
+	impostor := newTestClient(t, server, "bob")
+	expectFailure(t, "forged signature", http.StatusUnauthorized, "Could not verify signature", func() (int, testResponse) {
+		return impostor.postSigned("/uploadfile", File{Owner: "bob", Name: "b.txt"})
+	})
+	unknown := newTestClient(t, server, "mallory")
+	expectFailure(t, "unknown user", http.StatusUnauthorized, errUserNotFound.Error(), func() (int, testResponse) {
+		return unknown.postSigned("/uploadfile", File{Owner: "mallory", Name: "m.txt"})
+	})
+
+	// Authenticated users can't change files they don't own
+	messages := map[string]interface{}{
+		"/uploadfile":   File{Owner: "alice", Name: "a.txt", Data: []byte("forged")},
+		"/startupload":  UploadSession{Owner: "alice", Name: "a.txt", Chunks: 1},
+		"/uploadchunk":  FileChunk{Owner: "bob", Name: "a.txt", Session: session.Id, Data: []byte("forged")},
+		"/commitupload": UploadSession{Id: session.Id, Owner: "bob", Name: "a.txt"},
+		"/sharefile":    FileKey{User: "bob", Owner: "alice", Name: "a.txt", Key: []byte("key")},
+		"/revokefile":   FileKey{User: "alice", Owner: "alice", Name: "a.txt"},
+		"/rekey":        Rekey{Owner: "alice", Name: "a.txt"},
+	}
+	for path, message := range messages {
+		expectFailure(t, path+" by another user", http.StatusForbidden, "Only the file's owner and its", func() (int, testResponse) {
+			return bob.postSigned(path, message)
+		})
+	}
+
+	// Owners get a 404 for files, uploads and users that don't exist
+	missing := map[string]interface{}{
+		"/uploadchunk":  FileChunk{Owner: "alice", Name: "a.txt", Session: "missing"},
+		"/commitupload": UploadSession{Id: "missing", Owner: "alice", Name: "a.txt"},
+		"/sharefile":    FileKey{User: "bob", Owner: "alice", Name: "b.txt", Key: []byte("key")},
+		"/revokefile":   FileKey{User: "bob", Owner: "alice", Name: "b.txt"},
+		"/rekey":        Rekey{Owner: "alice", Name: "b.txt"},
+	}
+	for path, message := range missing {
+		expectFailure(t, path+" missing", http.StatusNotFound, "does not exist", func() (int, testResponse) {
+			return alice.postSigned(path, message)
+		})
+	}
+	expectFailure(t, "share with unknown user", http.StatusNotFound, errUserNotFound.Error(), func() (int, testResponse) {
+		return alice.postSigned("/sharefile", FileKey{User: "mallory", Owner: "alice", Name: "a.txt", Key: []byte("key")})
+	})
+	var file File
+	if _, res := bob.get("/users/alice/a.txt", &file); res.Error != errNoFileAccess.Error() {
+		t.Errorf("file after rejected requests: got %+v", res)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	server := newTestServer(t)
+	alice := newEd25519TestClient(t, server, "alice")
+	bob := newEd25519TestClient(t, server, "bob")
+	carol := newEd25519TestClient(t, server, "carol")
+	dave := newEd25519TestClient(t, server, "dave")
+	erin := newEd25519TestClient(t, server, "erin")
+	for _, c := range []*testClient{alice, bob, carol, dave, erin} {
+		c.register()
+	}
+	// Grants are signed by the user sharing, managers pass on the owner's grant to them
+	shareGrant := func(c *testClient, user string, role string, g *Grant) func() (int, testResponse) {
+		return func() (int, testResponse) {
+			return c.postSigned("/sharefile", FileKey{User: user, Owner: "alice", Name: "a.txt", Key: []byte("key"), Role: role, Grant: g})
+		}
+	}
+	share := func(c *testClient, user string, role string) func() (int, testResponse) {
+		return func() (int, testResponse) {
+			var manager *Grant
+			if c != alice {
+				manager = c.fileKey("alice", "a.txt").Grant
+			}
+			return shareGrant(c, user, role, c.grant("alice", "a.txt", user, role, manager))()
+		}
+	}
+	upload := func(c *testClient, data string, m *Manifest) func() (int, testResponse) {
+		return func() (int, testResponse) {
+			return c.postSigned("/uploadfile", File{Owner: "alice", Name: "a.txt", Data: []byte(data), Manifest: m})
+		}
+	}
+	// Writers sign the versions they upload with their own keys
+	written := func(c *testClient, version int, header []byte, data string) *Manifest {
+		m := c.manifest("a.txt", version, header, []byte(data))
+		m.Owner = "alice"
+		m.Author = c.username
+		c.signManifest(&m)
+		var filekey FileKey
+		c.get("/users/alice/a.txt/key/"+c.username, &filekey)
+		m.Grant = filekey.Grant
+		return &m
+	}
+	m := alice.manifest("a.txt", 1, nil, []byte("one"))
+	expectSuccess(t, "owner upload", upload(alice, "one", &m))
+	expectSuccess(t, "share owner", share(alice, "alice", ""))
+	expectFailure(t, "writer without a grant", http.StatusBadRequest, "need a grant", shareGrant(alice, "bob", roleWriter, nil))
+	expectFailure(t, "grant of another role", http.StatusBadRequest, "Grant does not match the file key's role",
+		shareGrant(alice, "bob", roleWriter, alice.grant("alice", "a.txt", "bob", roleReader, nil)))
+	expectFailure(t, "grant for another user", http.StatusBadRequest, "Grant does not match file",
+		shareGrant(alice, "bob", roleWriter, alice.grant("alice", "a.txt", "erin", roleWriter, nil)))
+	expectFailure(t, "grant signed by another user", http.StatusBadRequest, "Grant must be signed by the user sharing",
+		shareGrant(alice, "bob", roleWriter, bob.grant("alice", "a.txt", "bob", roleWriter, nil)))
+	forged := alice.grant("alice", "a.txt", "bob", roleWriter, nil)
+	forged.Role = roleManager
+	expectFailure(t, "grant with a changed role", http.StatusBadRequest, "Could not verify grant signature", shareGrant(alice, "bob", roleManager, forged))
+	expectSuccess(t, "share writer", share(alice, "bob", roleWriter))
+	expectSuccess(t, "share manager", share(alice, "carol", roleManager))
+	expectSuccess(t, "share reader", share(alice, "dave", roleReader))
+	expectFailure(t, "unknown role", http.StatusBadRequest, errUnknownRole.Error(), share(alice, "erin", "admin"))
+
+	expectFailure(t, "reader upload", http.StatusForbidden, errNotWriter.Error(), upload(dave, "two", written(dave, 2, nil, "two")))
+	expectFailure(t, "signed by a reader", http.StatusBadRequest, "Manifest was signed by dave, who can't write to this file",
+		upload(bob, "two", written(dave, 2, nil, "two")))
+	expectFailure(t, "writer's manifest without a grant", http.StatusBadRequest, "must carry their grant", func() (int, testResponse) {
+		m := written(bob, 2, nil, "two")
+		m.Grant = nil
+		return upload(bob, "two", m)()
+	})
+	expectFailure(t, "writer's manifest with a reader's grant", http.StatusBadRequest, "does not let its author write", func() (int, testResponse) {
+		m := written(bob, 2, nil, "two")
+		m.Grant = alice.grant("alice", "a.txt", "bob", roleReader, nil)
+		return upload(bob, "two", m)()
+	})
+	expectSuccess(t, "writer upload", upload(bob, "two", written(bob, 2, nil, "two")))
+	var file File
+	dave.get("/users/alice/a.txt", &file)
+	if string(file.Data) != "two" || file.Manifest == nil || file.Manifest.Author != "bob" || file.Version != 2 {
+		t.Errorf("file written by writer: got %+v", file)
+	}
+	expectFailure(t, "writer share", http.StatusForbidden, errNotManager.Error(), share(bob, "erin", roleReader))
+
+	// Uploads belong to the writer who started them
+	var session UploadSession
+	start := UploadSession{Owner: "alice", Name: "a.txt", Header: []byte("header"), Chunks: 1}
+	if status, res := bob.postSignedResult("/startupload", start, &session); status != http.StatusOK {
+		t.Fatalf("writer start upload: got %d %+v", status, res)
+	}
+	if status, res := bob.get("/uploads/"+session.Id, &session); status != http.StatusOK || session.Uploader != "bob" {
+		t.Errorf("writer get upload: got %d %+v %+v", status, res, session)
+	}
+	expectFailure(t, "owner get writer's upload", http.StatusBadRequest, errNoUpload.Error(), func() (int, testResponse) {
+		return alice.get("/uploads/"+session.Id, &session)
+	})
+	expectFailure(t, "chunk for another writer's upload", http.StatusForbidden, errNotUploader.Error(), func() (int, testResponse) {
+		return carol.postSigned("/uploadchunk", FileChunk{Owner: "alice", Name: "a.txt", Session: session.Id, Data: []byte("three")})
+	})
+	bob.uploadChunks(session, map[int]string{0: "three"})
+	expectSuccess(t, "writer commit", func() (int, testResponse) {
+		m := written(bob, 3, []byte("header"), "three")
+		return bob.postSigned("/commitupload", UploadSession{Id: session.Id, Owner: "alice", Name: "a.txt", Manifest: m})
+	})
+
+	// Managers share with and revoke readers and writers, only the owner changes managers
+	expectFailure(t, "manager's grant without the owner's", http.StatusBadRequest, "who isn't a manager of this file",
+		shareGrant(carol, "erin", roleWriter, carol.grant("alice", "a.txt", "erin", roleWriter, nil)))
+	expectFailure(t, "writer's grant passed on as a manager's", http.StatusBadRequest, "who isn't a manager of this file",
+		shareGrant(carol, "erin", roleWriter, carol.grant("alice", "a.txt", "erin", roleWriter, bob.fileKey("alice", "a.txt").Grant)))
+	expectSuccess(t, "manager share", share(carol, "erin", roleWriter))
+	if g := erin.fileKey("alice", "a.txt").Grant; g == nil || g.Signer != "carol" || g.Manager == nil || g.Manager.User != "carol" {
+		t.Errorf("grant from a manager: got %+v", g)
+	}
+	expectFailure(t, "manager shares manager role", http.StatusForbidden, errNotOwner.Error(), share(carol, "erin", roleManager))
+	expectFailure(t, "manager changes owner", http.StatusForbidden, errNotOwner.Error(), share(carol, "alice", roleReader))
+	expectFailure(t, "manager revokes owner", http.StatusForbidden, errNotOwner.Error(), func() (int, testResponse) {
+		return carol.postSigned("/revokefile", FileKey{User: "alice", Owner: "alice", Name: "a.txt"})
+	})
+	expectSuccess(t, "manager revokes writer", func() (int, testResponse) {
+		return carol.postSigned("/revokefile", FileKey{User: "bob", Owner: "alice", Name: "a.txt"})
+	})
+	expectFailure(t, "revoked writer upload", http.StatusForbidden, errNotWriter.Error(), upload(bob, "four", written(bob, 4, nil, "four")))
+	expectSuccess(t, "owner shares manager role", share(alice, "erin", roleManager))
+	expectFailure(t, "manager revokes manager", http.StatusForbidden, errNotOwner.Error(), func() (int, testResponse) {
+		return carol.postSigned("/revokefile", FileKey{User: "erin", Owner: "alice", Name: "a.txt"})
+	})
+
+	// Managers can rotate the file key and the remaining users keep their roles
+	rekey := func(revoked ...string) func() (int, testResponse) {
+		return func() (int, testResponse) {
+			filekeys := []FileKey{}
+			for _, user := range []string{"alice", "carol", "dave", "erin"} {
+				if len(revoked) == 0 || user != revoked[0] {
+					filekeys = append(filekeys, FileKey{User: user, Owner: "alice", Name: "a.txt", Key: []byte("new key"), Epoch: 1})
+				}
+			}
+			return carol.postSigned("/rekey", Rekey{Owner: "alice", Name: "a.txt", EpochKey: []byte("epoch key"), FileKeys: filekeys, Revoked: revoked})
+		}
+	}
+	expectFailure(t, "manager rekey revoking manager", http.StatusForbidden, errNotOwner.Error(), rekey("erin"))
+	expectSuccess(t, "manager rekey", rekey("dave"))
+	var filekey FileKey
+	erin.get("/users/alice/a.txt/key/erin", &filekey)
+	if filekey.Epoch != 1 || filekey.Role != roleManager || string(filekey.Key) != "new key" {
+		t.Errorf("manager's key after rekey: got %+v", filekey)
+	}
+	if _, res := dave.get("/users/alice/a.txt", &file); res.Error != errNoFileAccess.Error() {
+		t.Errorf("revoked reader get file: got %+v", res)
+	}
+}
+
+func TestSignedRequestReplay(t *testing.T) {
+	server := newTestServer(t)
+	alice := newTestClient(t, server, "alice")
+	alice.register()
+	message, _ := json.Marshal(File{Owner: "alice", Name: "a.txt", Data: []byte("data")})
+	post := func(s SignedRequest) func() (int, testResponse) {
+		return func() (int, testResponse) {
+			body, _ := json.Marshal(s)
+			return alice.post("/uploadfile", body)
+		}
+	}
+
+	signed := alice.newSignedRequest("/uploadfile", message)
+	expectSuccess(t, "first use", post(signed))
+	expectFailure(t, "replayed request", http.StatusUnauthorized, "Request has already been used", post(signed))
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	expectFailure(t, "wrong endpoint", http.StatusUnauthorized, "Request was signed for another endpoint",
+		post(alice.signRequest("/sharefile", message, time.Now(), nonce)))
+	expectFailure(t, "stale timestamp", http.StatusUnauthorized, "Request has expired",
+		post(alice.signRequest("/uploadfile", message, time.Now().Add(-requestWindow-time.Minute), nonce)))
+	expectFailure(t, "future timestamp", http.StatusUnauthorized, "Request has expired",
+		post(alice.signRequest("/uploadfile", message, time.Now().Add(requestWindow+time.Minute), nonce)))
+	expectFailure(t, "short nonce", http.StatusUnauthorized, "Request nonce is too short",
+		post(alice.signRequest("/uploadfile", message, time.Now(), nonce[:8])))
+	// The rejected requests above must not have used up the nonce
+	expectSuccess(t, "unused nonce", post(alice.signRequest("/uploadfile", message, time.Now(), nonce)))
+
+	tampered := alice.newSignedRequest("/uploadfile", message)
+	tampered.Path = "/sharefile"
+	expectFailure(t, "tampered path", http.StatusUnauthorized, "Could not verify signature", func() (int, testResponse) {
+		body, _ := json.Marshal(tampered)
+		return alice.post("/sharefile", body)
+	})
+}
+
+func TestNonceCache(t *testing.T) {
+	cache := newNonceCache(2)
+	now := time.Now()
+	if err := cache.Use([]byte("a"), now.Add(time.Minute)); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := cache.Use([]byte("a"), now.Add(time.Minute)); err != errReplayed {
+		t.Fatalf("replayed nonce: got %v", err)
+	}
+	if err := cache.Use([]byte("b"), now.Add(-time.Second)); err != nil {
+		t.Fatalf("second nonce: %v", err)
+	}
+	// A full cache refuses new nonces instead of forgetting ones that could be replayed
+	if err := cache.Use([]byte("c"), now.Add(time.Minute)); err != errTooManyRequests {
+		t.Fatalf("full cache: got %v", err)
+	}
+	cache.Sweep(now)
+	if err := cache.Use([]byte("c"), now.Add(time.Minute)); err != nil {
+		t.Fatalf("after sweep: %v", err)
+	}
+	if err := cache.Use([]byte("a"), now.Add(time.Minute)); err != errReplayed {
+		t.Fatalf("sweep removed an unexpired nonce: got %v", err)
+	}
+}
+
+func TestGetErrors(t *testing.T) {
+	server := newTestServer(t)
+	alice := newTestClient(t, server, "alice")
+	alice.register()
+	var v interface{}
+
+	expectFailure(t, "missing user", http.StatusBadRequest, "User does not exist", func() (int, testResponse) {
+		return alice.get("/users/bob", &v)
+	})
+	expectFailure(t, "missing file", http.StatusBadRequest, "You do not have access", func() (int, testResponse) {
+		return alice.get("/users/alice/a.txt", &v)
+	})
+	expectFailure(t, "missing file key", http.StatusBadRequest, "You do not have access", func() (int, testResponse) {
+		return alice.get("/users/alice/a.txt/key/alice", &v)
+	})
+	expectFailure(t, "missing file users", http.StatusBadRequest, "You do not have access", func() (int, testResponse) {
+		return alice.get("/users/alice/a.txt/users", &v)
+	})
+	expectFailure(t, "share without file", http.StatusNotFound, "File does not exist", func() (int, testResponse) {
+		return alice.postSigned("/sharefile", FileKey{User: "alice", Owner: "alice", Name: "a.txt", Key: []byte("key")})
+	})
+}
+
+func TestInvalidNames(t *testing.T) {
+	server := newTestServer(t)
+	alice := newTestClient(t, server, "alice")
+	alice.register()
+
+	// The backends join names with NUL, so a name containing it could collide with another file's keys
+	expectFailure(t, "register with NUL", http.StatusBadRequest, errInvalidName.Error(), func() (int, testResponse) {
+		body, _ := json.Marshal(User{Username: "bob\x00a.txt", PubKey: &alice.key.PublicKey})
+		return alice.post("/register", body)
+	})
+	expectFailure(t, "upload with NUL", http.StatusBadRequest, errInvalidName.Error(), func() (int, testResponse) {
+		return alice.postSigned("/uploadfile", File{Owner: "alice", Name: "a.txt\x00bob", Data: []byte("one")})
+	})
+	expectFailure(t, "start upload with NUL", http.StatusBadRequest, errInvalidName.Error(), func() (int, testResponse) {
+		return alice.postSigned("/startupload", UploadSession{Owner: "alice", Name: "a.txt\x00bob", Chunks: 1})
+	})
+	expectFailure(t, "upload without a name", http.StatusBadRequest, errInvalidName.Error(), func() (int, testResponse) {
+		return alice.postSigned("/uploadfile", File{Owner: "alice", Data: []byte("one")})
+	})
+}
+
+func TestAuthenticatedReads(t *testing.T) {
+	server := newTestServer(t)
+	alice := newTestClient(t, server, "alice")
+	bob := newTestClient(t, server, "bob")
+	mallory := newTestClient(t, server, "mallory")
+	alice.register()
+	bob.register()
+	mallory.register()
+	alice.upload("a.txt", []byte("ciphertext"), []byte("key"))
+	alice.share("a.txt", bob, []byte("key"))
+	session := alice.startUpload("b.txt", 1)
+	var v interface{}
+
+	// Only keyholders can read a file, its chunks and its users
+	for _, path := range []string{"/users/alice/a.txt", "/users/alice/a.txt/users", "/users/alice/a.txt/chunks/0"} {
+		expectFailure(t, path+" unsigned", http.StatusUnauthorized, "Request is not signed", func() (int, testResponse) {
+			return mallory.getWithHeaders(path, make(http.Header), &v)
+		})
+		expectFailure(t, path+" not shared", http.StatusBadRequest, "You do not have access", func() (int, testResponse) {
+			return mallory.get(path, &v)
+		})
+	}
+	var users FileUsers
+	if _, res := bob.get("/users/alice/a.txt/users", &users); res.Status == "failure" || strings.Join(users.Users, ",") != "alice,bob" {
+		t.Errorf("file users for keyholder = %+v %v", res, users.Users)
+	}
+
+	// File keys are only served to their own user
+	expectFailure(t, "other user's key", http.StatusBadRequest, "You do not have access", func() (int, testResponse) {
+		return bob.get("/users/alice/a.txt/key/alice", &v)
+	})
+	// Upload sessions are only visible to their owner
+	expectFailure(t, "other user's upload", http.StatusBadRequest, "Upload session does not exist", func() (int, testResponse) {
+		return bob.get("/uploads/"+session.Id, &v)
+	})
+
+	// Signature headers must be signed by the named user for the requested path
+	path := "/users/alice/a.txt"
+	forged := mallory.signHeaders(mallory.newSignedRequest(path, nil))
+	forged.Set("X-User", "bob")
+	expectFailure(t, "forged user", http.StatusUnauthorized, "Could not verify signature", func() (int, testResponse) {
+		return mallory.getWithHeaders(path, forged, &v)
+	})
+	expectFailure(t, "wrong path", http.StatusUnauthorized, "Could not verify signature", func() (int, testResponse) {
+		return bob.getWithHeaders(path, bob.signHeaders(bob.newSignedRequest("/users/alice/b.txt", nil)), &v)
+	})
+	header := bob.signHeaders(bob.newSignedRequest(path, nil))
+	if status, res := bob.getWithHeaders(path, header, &v); status != http.StatusOK {
+		t.Fatalf("signed read: got %d %+v", status, res)
+	}
+	expectFailure(t, "replayed read", http.StatusUnauthorized, "Request has already been used", func() (int, testResponse) {
+		return bob.getWithHeaders(path, header, &v)
+	})
+	header.Set("X-Timestamp", "x")
+	expectFailure(t, "invalid timestamp", http.StatusUnauthorized, "Invalid request timestamp", func() (int, testResponse) {
+		return bob.getWithHeaders(path, header, &v)
+	})
+}
+
+// Key rotation for the client's user to keys, signed by the new key's owner like the client's rotate-key command
+func (c *testClient) rotation(newKey *testClient, keys KeySet, filekeys []FileKey) KeyRotation {
+	data, err := json.Marshal(rotationData{c.username, defaultDevice, keys})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return KeyRotation{c.username, defaultDevice, keys, filekeys, nil, nil, newKey.sign(data)}
+}
+
+func TestRotateKey(t *testing.T) {
+	server := newTestServer(t)
+	alice := newTestClient(t, server, "alice")
+	bob := newTestClient(t, server, "bob")
+	carol := newEd25519TestClient(t, server, "carol")
+	alice.register()
+	bob.register()
+	carol.register()
+	alice.upload("a.txt", []byte("ciphertext"), []byte("key"))
+	alice.share("a.txt", bob, []byte("key"))
+	expectSuccess(t, "carol upload", func() (int, testResponse) {
+		return carol.postSigned("/uploadfile", File{Owner: "carol", Name: "c.txt", Data: []byte("ciphertext")})
+	})
+	expectSuccess(t, "carol share", func() (int, testResponse) {
+		return carol.postSigned("/sharefile", FileKey{User: "bob", Owner: "carol", Name: "c.txt", Key: []byte("key")})
+	})
+	_, _, token := bob.login(bob.answerChallenge())
+
+	var filekeys UserFileKeys
+	if status, res := bob.get("/filekeys", &filekeys); status != http.StatusOK || len(filekeys.FileKeys) != 2 ||
+		filekeys.FileKeys[0].Owner != "alice" || filekeys.FileKeys[1].Owner != "carol" {
+		t.Fatalf("get file keys: got %d %+v %+v", status, res, filekeys)
+	}
+	rewrapped := make([]FileKey, 0)
+	for _, filekey := range filekeys.FileKeys {
+		filekey.Key = []byte("rewrapped " + filekey.Name)
+		rewrapped = append(rewrapped, filekey)
+	}
+	newBob := newEd25519TestClient(t, server, "bob")
+	keys := newBob.keySet()
+
+	expectFailure(t, "signed with the new key", http.StatusUnauthorized, "Could not verify signature", func() (int, testResponse) {
+		return newBob.postSigned("/rotatekey", bob.rotation(newBob, keys, rewrapped))
+	})
+	expectFailure(t, "session token", http.StatusUnauthorized, "Could not verify signature", func() (int, testResponse) {
+		return bob.postWithToken("/rotatekey", token.Token, bob.rotation(newBob, keys, rewrapped))
+	})
+	expectFailure(t, "missing user", http.StatusUnauthorized, "User does not exist", func() (int, testResponse) {
+		return bob.postSigned("/rotatekey", KeyRotation{Username: "nobody", Keys: keys})
+	})
+	expectFailure(t, "missing file key", http.StatusBadRequest, errFileKeysChanged.Error(), func() (int, testResponse) {
+		return bob.postSigned("/rotatekey", bob.rotation(newBob, keys, rewrapped[:1]))
+	})
+	expectFailure(t, "repeated file key", http.StatusBadRequest, errFileKeysChanged.Error(), func() (int, testResponse) {
+		return bob.postSigned("/rotatekey", bob.rotation(newBob, keys, []FileKey{rewrapped[0], rewrapped[0]}))
+	})
+	expectFailure(t, "another user's file key", http.StatusBadRequest, "File key belongs to another user", func() (int, testResponse) {
+		stolen := append([]FileKey{}, rewrapped...)
+		stolen[1].User = "carol"
+		return bob.postSigned("/rotatekey", bob.rotation(newBob, keys, stolen))
+	})
+	expectFailure(t, "new key signature by the old key", http.StatusBadRequest, "Could not verify new key signature", func() (int, testResponse) {
+		return bob.postSigned("/rotatekey", bob.rotation(bob, keys, rewrapped))
+	})
+	expectFailure(t, "same key", http.StatusBadRequest, "same as the old one", func() (int, testResponse) {
+		return bob.postSigned("/rotatekey", bob.rotation(bob, rsaKeySet(&bob.key.PublicKey), rewrapped))
+	})
+	expectFailure(t, "invalid new key", http.StatusBadRequest, "Invalid Ed25519 public key", func() (int, testResponse) {
+		return bob.postSigned("/rotatekey", bob.rotation(newBob, KeySet{PublicKey{algorithmEd25519, []byte("key")}, keys.Encryption}, rewrapped))
+	})
+
+	expectSuccess(t, "rotate key", func() (int, testResponse) {
+		return bob.postSigned("/rotatekey", bob.rotation(newBob, keys, rewrapped))
+	})
+	var user User
+	if _, res := alice.get("/users/bob", &user); res.Status == "failure" || !reflect.DeepEqual(user.Keys, keys) || user.PubKey != nil {
+		t.Errorf("get rotated user: got %+v %+v", res, user)
+	}
+	var filekey FileKey
+	if status, res := newBob.get("/users/alice/a.txt/key/bob", &filekey); status != http.StatusOK || string(filekey.Key) != "rewrapped a.txt" {
+		t.Errorf("get rewrapped file key: got %d %+v %q", status, res, filekey.Key)
+	}
+
+	// The old key and sessions opened with it are retired
+	expectFailure(t, "old key", http.StatusUnauthorized, "Could not verify signature", func() (int, testResponse) {
+		return bob.get("/users/alice/a.txt/key/bob", &filekey)
+	})
+	expectFailure(t, "old session token", http.StatusUnauthorized, errInvalidToken.Error(), func() (int, testResponse) {
+		return bob.postWithToken("/uploadfile", token.Token, File{Owner: "bob", Name: "b.txt"})
+	})
+	if status, res, _ := newBob.login(newBob.answerChallenge()); status != http.StatusOK {
+		t.Errorf("login with new key: got %d %+v", status, res)
+	}
+}
+
+// Key rotation like rotation, with the client's file keys as they are and grants
+func (c *testClient) grantRotation(newKey *testClient, grants []Grant) KeyRotation {
+	var filekeys UserFileKeys
+	if status, res := c.get("/filekeys", &filekeys); status != http.StatusOK {
+		c.t.Fatalf("get file keys: got %d %+v", status, res)
+	}
+	rotation := c.rotation(newKey, newKey.keySet(), filekeys.FileKeys)
+	rotation.Grants = grants
+	return rotation
+}
+
+func TestRotateGrants(t *testing.T) {
+	server := newTestServer(t)
+	alice := newEd25519TestClient(t, server, "alice")
+	bob := newEd25519TestClient(t, server, "bob")
+	carol := newEd25519TestClient(t, server, "carol")
+	for _, c := range []*testClient{alice, bob, carol} {
+		c.register()
+	}
+	// Only grants are signed by the owner, so the rotations don't need manifests
+	alice.upload("a.txt", []byte("one"), []byte("key"))
+	managerGrant := alice.grant("alice", "a.txt", "carol", roleManager, nil)
+	expectSuccess(t, "share manager", func() (int, testResponse) {
+		return alice.postSigned("/sharefile", FileKey{User: "carol", Owner: "alice", Name: "a.txt", Key: []byte("key"), Role: roleManager, Grant: managerGrant})
+	})
+	writerGrant := carol.grant("alice", "a.txt", "bob", roleWriter, managerGrant)
+	expectSuccess(t, "share writer", func() (int, testResponse) {
+		return carol.postSigned("/sharefile", FileKey{User: "bob", Owner: "alice", Name: "a.txt", Key: []byte("key"), Role: roleWriter, Grant: writerGrant})
+	})
+	expectSuccess(t, "writer upload", func() (int, testResponse) {
+		written := bob.manifest("a.txt", 2, nil, []byte("two"))
+		written.Owner = "alice"
+		written.Author = "bob"
+		bob.signManifest(&written)
+		written.Grant = writerGrant
+		return bob.postSigned("/uploadfile", File{Owner: "alice", Name: "a.txt", Data: []byte("two"), Manifest: &written})
+	})
+
+	// Each grant is listed once, though the manager's grant is also in the writer's file key and manifest
+	var owner, manager UserGrants
+	if status, res := alice.get("/grants", &owner); status != http.StatusOK || len(owner.Grants) != 1 ||
+		owner.Grants[0].User != "carol" || owner.Grants[0].Manager != nil {
+		t.Fatalf("owner's grants: got %d %+v %+v", status, res, owner)
+	}
+	if status, res := carol.get("/grants", &manager); status != http.StatusOK || len(manager.Grants) != 1 || manager.Grants[0].User != "bob" {
+		t.Fatalf("manager's grants: got %d %+v %+v", status, res, manager)
+	}
+	ownerGrants, managerGrants := owner.Grants, manager.Grants
+
+	// Grants signed by the old key must be signed again with the new one
+	newCarol := newEd25519TestClient(t, server, "carol")
+	expectFailure(t, "rotate without grants", http.StatusBadRequest, errGrantsChanged.Error(), func() (int, testResponse) {
+		return carol.postSigned("/rotatekey", carol.grantRotation(newCarol, nil))
+	})
+	expectFailure(t, "rotate with grants signed by the old key", http.StatusBadRequest, "Could not verify grant signature", func() (int, testResponse) {
+		return carol.postSigned("/rotatekey", carol.grantRotation(newCarol, managerGrants))
+	})
+	newCarol.signGrant(&managerGrants[0])
+	expectSuccess(t, "rotate manager", func() (int, testResponse) {
+		return carol.postSigned("/rotatekey", carol.grantRotation(newCarol, managerGrants))
+	})
+	newAlice := newEd25519TestClient(t, server, "alice")
+	newAlice.signGrant(&ownerGrants[0])
+	expectSuccess(t, "rotate owner", func() (int, testResponse) {
+		return alice.postSigned("/rotatekey", alice.grantRotation(newAlice, ownerGrants))
+	})
+
+	// The writer's grant and the manager's grant within it verify with the new keys wherever they are kept
+	filekey := bob.fileKey("alice", "a.txt")
+	if err := filekey.Grant.verify("alice", "a.txt", "bob", store); err != nil {
+		t.Errorf("writer's grant after rotations: %v", err)
+	}
+	if err := newCarol.fileKey("alice", "a.txt").Grant.verify("alice", "a.txt", "carol", store); err != nil {
+		t.Errorf("manager's grant after rotations: %v", err)
+	}
+	var file File
+	if _, res := bob.get("/users/alice/a.txt", &file); res.Status == "failure" || file.Manifest == nil || file.Manifest.Grant == nil {
+		t.Fatalf("get file: %+v %+v", res, file)
+	}
+	if err := file.Manifest.Grant.verify("alice", "a.txt", "bob", store); err != nil {
+		t.Errorf("manifest's grant after rotations: %v", err)
+	}
+}
+
+// Enroll a new device for the client's user, self-signed like the client's enroll command
+func (c *testClient) enroll(device string, keys KeySet) (int, testResponse, Enrollment) {
+	data, err := json.Marshal(enrollmentData{c.username, device, keys})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	body, err := json.Marshal(Enrollment{Username: c.username, Device: device, Keys: keys, Signature: c.sign(data)})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	res, err := c.client.Post(c.server.URL+"/enroll", "application/json; charset=utf-8", bytes.NewReader(body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	raw, err := io.ReadAll(res.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	var response testResponse
+	var enrollment Enrollment
+	json.Unmarshal(raw, &response)
+	json.Unmarshal(raw, &enrollment)
+	return res.StatusCode, response, enrollment
+}
+
+// File keys shared with the client's user, wrapped for each of devices
+func (c *testClient) deviceFileKeys(devices ...string) []FileKey {
+	var filekeys UserFileKeys
+	if status, res := c.get("/filekeys", &filekeys); status != http.StatusOK {
+		c.t.Fatalf("get file keys: got %d %+v", status, res)
+	}
+	for i := range filekeys.FileKeys {
+		filekeys.FileKeys[i].DeviceKeys = make(map[string][]byte)
+		for _, device := range devices {
+			filekeys.FileKeys[i].DeviceKeys[device] = []byte(device + " " + filekeys.FileKeys[i].Name)
+		}
+	}
+	return filekeys.FileKeys
+}
+
+func TestDevices(t *testing.T) {
+	server := newTestServer(t)
+	alice := newEd25519TestClient(t, server, "alice")
+	bob := newTestClient(t, server, "bob")
+	alice.register()
+	bob.register()
+	expectSuccess(t, "upload", func() (int, testResponse) {
+		return alice.postSigned("/uploadfile", File{Owner: "alice", Name: "a.txt", Data: []byte("ciphertext")})
+	})
+	expectSuccess(t, "share", func() (int, testResponse) {
+		return alice.postSigned("/sharefile", FileKey{User: "alice", Owner: "alice", Name: "a.txt", Key: []byte("key")})
+	})
+	bob.upload("b.txt", []byte("ciphertext"), []byte("key"))
+	expectSuccess(t, "share with alice", func() (int, testResponse) {
+		return bob.postSigned("/sharefile", FileKey{User: "alice", Owner: "bob", Name: "b.txt", Key: []byte("key")})
+	})
+	_, _, token := alice.login(alice.answerChallenge())
+
+	laptop := newEd25519TestClient(t, server, "alice")
+	keys := laptop.keySet()
+	enrollFailures := []struct {
+		name     string
+		client   *testClient
+		device   string
+		keys     KeySet
+		contains string
+	}{
+		{"missing user", newEd25519TestClient(t, server, "nobody"), "laptop", keys, "User does not exist"},
+		{"existing device", laptop, defaultDevice, keys, "Device already exists"},
+		{"empty name", laptop, "", keys, "Device name can't be empty"},
+		{"signed by another key", alice, "laptop", keys, "Could not verify enrollment signature"},
+		{"shared signing key", alice, "laptop", alice.keySet(), "Devices can't share a signing key"},
+		{"invalid keys", laptop, "laptop", KeySet{keys.Signing, keys.Signing}, "Ed25519 keys can't be used for encryption"},
+	}
+	for _, tt := range enrollFailures {
+		status, res, _ := tt.client.enroll(tt.device, tt.keys)
+		if status != http.StatusBadRequest || !strings.Contains(res.Error, tt.contains) {
+			t.Errorf("enroll %s: got %d %+v, want %q", tt.name, status, res, tt.contains)
+		}
+	}
+	status, res, enrollment := laptop.enroll("laptop", keys)
+	if status != http.StatusOK || enrollment.Id == "" {
+		t.Fatalf("enroll: got %d %+v", status, res)
+	}
+
+	var devices UserDevices
+	if status, res := alice.get("/devices", &devices); status != http.StatusOK || len(devices.Devices) != 1 ||
+		len(devices.Pending) != 1 || devices.Pending[0].Id != enrollment.Id {
+		t.Fatalf("get devices: got %d %+v %+v", status, res, devices)
+	}
+	expectFailure(t, "devices of an unapproved device", http.StatusUnauthorized, "Could not verify signature", func() (int, testResponse) {
+		return laptop.get("/devices", &devices)
+	})
+
+	filekeys := alice.deviceFileKeys(defaultDevice, "laptop")
+	approval := DeviceApproval{"alice", enrollment.Id, filekeys}
+	expectFailure(t, "approve from the new device", http.StatusUnauthorized, "Could not verify signature", func() (int, testResponse) {
+		return laptop.postSigned("/approvedevice", approval)
+	})
+	expectFailure(t, "approve with a session token", http.StatusUnauthorized, "Could not verify signature", func() (int, testResponse) {
+		return alice.postWithToken("/approvedevice", token.Token, approval)
+	})
+	expectFailure(t, "approve another user's enrollment", http.StatusBadRequest, errNoEnrollment.Error(), func() (int, testResponse) {
+		return bob.postSigned("/approvedevice", DeviceApproval{"bob", enrollment.Id, nil})
+	})
+	expectFailure(t, "missing file key", http.StatusBadRequest, errFileKeysChanged.Error(), func() (int, testResponse) {
+		return alice.postSigned("/approvedevice", DeviceApproval{"alice", enrollment.Id, filekeys[:1]})
+	})
+	expectFailure(t, "file key for one device", http.StatusBadRequest, errDeviceKeys.Error(), func() (int, testResponse) {
+		return alice.postSigned("/approvedevice", DeviceApproval{"alice", enrollment.Id, alice.deviceFileKeys(defaultDevice)})
+	})
+	expectSuccess(t, "approve", func() (int, testResponse) {
+		return alice.postSigned("/approvedevice", approval)
+	})
+	expectFailure(t, "approve twice", http.StatusBadRequest, errNoEnrollment.Error(), func() (int, testResponse) {
+		return alice.postSigned("/approvedevice", approval)
+	})
+
+	// Both devices sign requests and get file keys wrapped for them
+	var filekey FileKey
+	if status, res := laptop.get("/users/bob/b.txt/key/alice", &filekey); status != http.StatusOK || string(filekey.DeviceKeys["laptop"]) != "laptop b.txt" {
+		t.Errorf("get file key from the new device: got %d %+v %+v", status, res, filekey)
+	}
+	if status, res := alice.get("/devices", &devices); status != http.StatusOK || len(devices.Devices) != 2 || len(devices.Pending) != 0 {
+		t.Errorf("get devices after approval: got %d %+v %+v", status, res, devices)
+	}
+	expectFailure(t, "share for one device", http.StatusBadRequest, errDeviceKeys.Error(), func() (int, testResponse) {
+		return bob.postSigned("/sharefile", FileKey{User: "alice", Owner: "bob", Name: "b.txt", Key: []byte("key")})
+	})
+	expectSuccess(t, "share for both devices", func() (int, testResponse) {
+		return bob.postSigned("/sharefile", FileKey{User: "alice", Owner: "bob", Name: "b.txt", Key: []byte("key"),
+			DeviceKeys: map[string][]byte{defaultDevice: []byte("key"), "laptop": []byte("key")}})
+	})
+
+	// Removing the first device leaves the laptop's keys as the user's keys
+	expectFailure(t, "remove missing device", http.StatusBadRequest, errDeviceNotFound.Error(), func() (int, testResponse) {
+		return laptop.postSigned("/removedevice", DeviceRemoval{"alice", "phone", nil, nil, nil})
+	})
+	expectFailure(t, "remove with file keys for the removed device", http.StatusBadRequest, errDeviceKeys.Error(), func() (int, testResponse) {
+		return laptop.postSigned("/removedevice", DeviceRemoval{"alice", defaultDevice, laptop.deviceFileKeys(defaultDevice, "laptop"), nil, nil})
+	})
+	expectSuccess(t, "remove device", func() (int, testResponse) {
+		return laptop.postSigned("/removedevice", DeviceRemoval{"alice", defaultDevice, laptop.deviceFileKeys("laptop"), nil, nil})
+	})
+	expectFailure(t, "removed device", http.StatusUnauthorized, "Could not verify signature", func() (int, testResponse) {
+		return alice.get("/users/bob/b.txt/key/alice", &filekey)
+	})
+	expectFailure(t, "removed device's session token", http.StatusUnauthorized, errInvalidToken.Error(), func() (int, testResponse) {
+		return alice.postWithToken("/uploadfile", token.Token, File{Owner: "alice", Name: "b.txt"})
+	})
+	expectFailure(t, "remove only device", http.StatusBadRequest, "only device", func() (int, testResponse) {
+		return laptop.postSigned("/removedevice", DeviceRemoval{"alice", "laptop", nil, nil, nil})
+	})
+	var user User
+	if _, res := bob.get("/users/alice", &user); res.Status == "failure" || !reflect.DeepEqual(user.Keys, keys) || len(user.Devices) != 1 {
+		t.Errorf("get user after removal: got %+v %+v", res, user)
+	}
+}
+
+// Grants signed by one of the client's user's devices, as listed by the server
+func (c *testClient) deviceGrants(device string) []Grant {
+	var grants UserGrants
+	if status, res := c.get("/grants", &grants); status != http.StatusOK {
+		c.t.Fatalf("get grants: got %d %+v", status, res)
+	}
+	signed := make([]Grant, 0)
+	for _, g := range grants.Grants {
+		if g.Device == device {
+			signed = append(signed, g)
+		}
+	}
+	return signed
+}
+
+// Check the grant in a user's file key and in the file's manifest verify and were signed by the manager's device
+func expectGrant(t *testing.T, name string, user *testClient, device string, manifest bool) {
+	grants := []*Grant{user.fileKey("alice", "a.txt").Grant}
+	if manifest {
+		var file File
+		if _, res := user.get("/users/alice/a.txt", &file); res.Status == "failure" || file.Manifest == nil {
+			t.Fatalf("%s: get file: %+v %+v", name, res, file)
+		}
+		grants = append(grants, file.Manifest.Grant)
+	}
+	for _, g := range grants {
+		if g == nil || g.Device != device || g.Manager == nil || g.Manager.Signer != "alice" {
+			t.Errorf("%s: %s's grant = %+v", name, user.username, g)
+			continue
+		}
+		if err := g.verify("alice", "a.txt", user.username, store); err != nil {
+			t.Errorf("%s: %s's grant: %v", name, user.username, err)
+		}
+	}
+}
+
+func TestDeviceGrants(t *testing.T) {
+	server := newTestServer(t)
+	alice := newEd25519TestClient(t, server, "alice")
+	bob := newEd25519TestClient(t, server, "bob")
+	carol := newEd25519TestClient(t, server, "carol")
+	dave := newEd25519TestClient(t, server, "dave")
+	for _, c := range []*testClient{alice, bob, carol, dave} {
+		c.register()
+	}
+	laptop := newEd25519TestClient(t, server, "carol")
+	status, res, enrollment := laptop.enroll("laptop", laptop.keySet())
+	if status != http.StatusOK {
+		t.Fatalf("enroll: got %d %+v", status, res)
+	}
+	expectSuccess(t, "approve", func() (int, testResponse) {
+		return carol.postSigned("/approvedevice", DeviceApproval{"carol", enrollment.Id, nil})
+	})
+
+	// Carol manages alice's file, her laptop makes bob a writer and her first device makes dave a reader
+	alice.upload("a.txt", []byte("one"), []byte("key"))
+	managerGrant := alice.grant("alice", "a.txt", "carol", roleManager, nil)
+	expectSuccess(t, "share manager", func() (int, testResponse) {
+		return alice.postSigned("/sharefile", FileKey{User: "carol", Owner: "alice", Name: "a.txt", Role: roleManager, Grant: managerGrant,
+			DeviceKeys: map[string][]byte{defaultDevice: []byte("key"), "laptop": []byte("key")}})
+	})
+	writerGrant := carol.grant("alice", "a.txt", "bob", roleWriter, managerGrant)
+	writerGrant.Device = "laptop"
+	laptop.signGrant(writerGrant)
+	expectSuccess(t, "share writer", func() (int, testResponse) {
+		return laptop.postSigned("/sharefile", FileKey{User: "bob", Owner: "alice", Name: "a.txt", Key: []byte("key"), Role: roleWriter, Grant: writerGrant})
+	})
+	readerGrant := carol.grant("alice", "a.txt", "dave", roleReader, managerGrant)
+	expectSuccess(t, "share reader", func() (int, testResponse) {
+		return carol.postSigned("/sharefile", FileKey{User: "dave", Owner: "alice", Name: "a.txt", Key: []byte("key"), Role: roleReader, Grant: readerGrant})
+	})
+	expectSuccess(t, "writer upload", func() (int, testResponse) {
+		written := bob.manifest("a.txt", 2, nil, []byte("two"))
+		written.Owner = "alice"
+		written.Author = "bob"
+		bob.signManifest(&written)
+		written.Grant = writerGrant
+		return bob.postSigned("/uploadfile", File{Owner: "alice", Name: "a.txt", Data: []byte("two"), Manifest: &written})
+	})
+
+	// Removing the laptop needs exactly the grants it signed, signed again by the remaining device
+	laptopGrants, defaultGrants := carol.deviceGrants("laptop"), carol.deviceGrants(defaultDevice)
+	if len(laptopGrants) != 1 || laptopGrants[0].User != "bob" || len(defaultGrants) != 1 || defaultGrants[0].User != "dave" {
+		t.Fatalf("grants by device: laptop %+v, default %+v", laptopGrants, defaultGrants)
+	}
+	removal := DeviceRemoval{"carol", "laptop", carol.deviceFileKeys(defaultDevice), nil, nil}
+	expectFailure(t, "remove without grants", http.StatusBadRequest, errGrantsChanged.Error(), func() (int, testResponse) {
+		return carol.postSigned("/removedevice", removal)
+	})
+	laptopGrants[0].Device = defaultDevice
+	carol.signGrant(&laptopGrants[0])
+	removal.Grants = append(laptopGrants, defaultGrants...)
+	expectFailure(t, "remove with grants of another device", http.StatusBadRequest, errGrantsChanged.Error(), func() (int, testResponse) {
+		return carol.postSigned("/removedevice", removal)
+	})
+	removal.Grants = laptopGrants
+	expectSuccess(t, "remove laptop", func() (int, testResponse) {
+		return carol.postSigned("/removedevice", removal)
+	})
+	expectGrant(t, "after removing the laptop", bob, defaultDevice, true)
+	expectGrant(t, "after removing the laptop", dave, defaultDevice, false)
+	expectFailure(t, "share from the removed laptop", http.StatusUnauthorized, "Could not verify signature", func() (int, testResponse) {
+		return laptop.postSigned("/sharefile", FileKey{User: "dave", Owner: "alice", Name: "a.txt", Key: []byte("key"), Role: roleReader, Grant: readerGrant})
+	})
+
+	// Rotating the remaining device's key then needs both grants signed again
+	newCarol := newEd25519TestClient(t, server, "carol")
+	grants := carol.deviceGrants(defaultDevice)
+	if len(grants) != 2 {
+		t.Fatalf("grants after removing the laptop: %+v", grants)
+	}
+	for i := range grants {
+		newCarol.signGrant(&grants[i])
+	}
+	expectFailure(t, "rotate with one grant", http.StatusBadRequest, errGrantsChanged.Error(), func() (int, testResponse) {
+		return carol.postSigned("/rotatekey", carol.grantRotation(newCarol, grants[:1]))
+	})
+	expectSuccess(t, "rotate manager", func() (int, testResponse) {
+		return carol.postSigned("/rotatekey", carol.grantRotation(newCarol, grants))
+	})
+	expectGrant(t, "after rotating", bob, defaultDevice, true)
+	expectGrant(t, "after rotating", dave, defaultDevice, false)
+}
+
+// Post a message signed with the client's key and decode the JSON result into v, returns the failure response if any
+func (c *testClient) postSignedResult(path string, message interface{}, v interface{}) (int, testResponse) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	body, err := json.Marshal(c.newSignedRequest(path, data))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	res, err := c.client.Post(c.server.URL+path, "application/json; charset=utf-8", bytes.NewReader(body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	raw, err := io.ReadAll(res.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	var response testResponse
+	json.Unmarshal(raw, &response)
+	if response.Status == "failure" {
+		return res.StatusCode, response
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		c.t.Fatal(err)
+	}
+	return res.StatusCode, response
+}
+
+func TestRecovery(t *testing.T) {
+	server := newTestServer(t)
+	alice := newEd25519TestClient(t, server, "alice")
+	bob := newTestClient(t, server, "bob")
+	carol := newEd25519TestClient(t, server, "carol")
+	dave := newEd25519TestClient(t, server, "dave")
+	for _, c := range []*testClient{alice, bob, carol, dave} {
+		c.register()
+	}
+	_, _, token := alice.login(alice.answerChallenge())
+	newAlice := newEd25519TestClient(t, server, "alice")
+	request := RecoveryRequest{Username: "alice", Device: "laptop", Keys: newAlice.keySet()}
+	var started RecoveryRequest
+	expectFailure(t, "recover without recovery", http.StatusBadRequest, errRecoveryNotFound.Error(), func() (int, testResponse) {
+		return newAlice.postSignedResult("/recover", request, &started)
+	})
+
+	shares := []RecoveryShare{
+		{Trustee: "bob", Key: []byte("bob share")},
+		{Trustee: "carol", Key: []byte("carol share")},
+		{Trustee: "dave", Key: []byte("dave share")},
+	}
+	setupFailures := []struct {
+		name     string
+		recovery Recovery
+		contains string
+	}{
+		{"no trustees", Recovery{Username: "alice", Threshold: 1}, "between 1 and 255 trustees"},
+		{"zero threshold", Recovery{Username: "alice", Threshold: 0, Shares: shares}, "threshold"},
+		{"threshold above trustees", Recovery{Username: "alice", Threshold: 4, Shares: shares}, "threshold"},
+		{"own trustee", Recovery{Username: "alice", Threshold: 1, Shares: []RecoveryShare{{Trustee: "alice", Key: []byte("share")}}}, "own trustee"},
+		{"duplicate trustee", Recovery{Username: "alice", Threshold: 1, Shares: []RecoveryShare{shares[0], shares[0]}}, "Duplicate trustee"},
+		{"missing trustee", Recovery{Username: "alice", Threshold: 1, Shares: []RecoveryShare{{Trustee: "nobody", Key: []byte("share")}}}, "User does not exist"},
+		{"share for another device", Recovery{Username: "alice", Threshold: 1,
+			Shares: []RecoveryShare{{Trustee: "bob", DeviceKeys: map[string][]byte{"phone": []byte("share")}}}}, errDeviceKeys.Error()},
+	}
+	for _, tt := range setupFailures {
+		expectFailure(t, tt.name, http.StatusBadRequest, tt.contains, func() (int, testResponse) {
+			return alice.postSigned("/recovery", tt.recovery)
+		})
+	}
+	recovery := Recovery{Username: "alice", Threshold: 2, Shares: shares}
+	expectFailure(t, "recovery with a session token", http.StatusUnauthorized, "Could not verify signature", func() (int, testResponse) {
+		return alice.postWithToken("/recovery", token.Token, recovery)
+	})
+	expectFailure(t, "recovery signed by another user", http.StatusUnauthorized, "Could not verify signature", func() (int, testResponse) {
+		return bob.postSigned("/recovery", recovery)
+	})
+	expectSuccess(t, "set up recovery", func() (int, testResponse) { return alice.postSigned("/recovery", recovery) })
+
+	expectFailure(t, "recover signed by another key", http.StatusUnauthorized, "Could not verify signature", func() (int, testResponse) {
+		return alice.postSignedResult("/recover", request, &started)
+	})
+	expectFailure(t, "recover existing device", http.StatusBadRequest, "Device already exists", func() (int, testResponse) {
+		return newAlice.postSignedResult("/recover", RecoveryRequest{Username: "alice", Device: defaultDevice, Keys: request.Keys}, &started)
+	})
+	if status, res := newAlice.postSignedResult("/recover", request, &started); status != http.StatusOK || started.Id == "" {
+		t.Fatalf("recover: got %d %+v", status, res)
+	}
+
+	var requests TrusteeRequests
+	if status, res := bob.get("/recoveryrequests", &requests); status != http.StatusOK || len(requests.Requests) != 1 ||
+		requests.Requests[0].Id != started.Id || string(requests.Requests[0].Share.Key) != "bob share" {
+		t.Fatalf("get recovery requests: got %d %+v %+v", status, res, requests)
+	}
+	if status, res := alice.get("/recoveryrequests", &requests); status != http.StatusOK || len(requests.Requests) != 0 {
+		t.Errorf("get recovery requests of a user without shares: got %d %+v %+v", status, res, requests)
+	}
+
+	expectFailure(t, "approve by a non-trustee", http.StatusBadRequest, "not a trustee", func() (int, testResponse) {
+		return alice.postSigned("/approverecovery", RecoveryApproval{"alice", started.Id, []byte("share")})
+	})
+	expectFailure(t, "approve for another trustee", http.StatusUnauthorized, "Could not verify signature", func() (int, testResponse) {
+		return bob.postSigned("/approverecovery", RecoveryApproval{"carol", started.Id, []byte("share")})
+	})
+	expectFailure(t, "approve missing request", http.StatusBadRequest, errNoRecoveryRequest.Error(), func() (int, testResponse) {
+		return bob.postSigned("/approverecovery", RecoveryApproval{"bob", "missing", []byte("share")})
+	})
+	expectSuccess(t, "bob approves", func() (int, testResponse) {
+		return bob.postSigned("/approverecovery", RecoveryApproval{"bob", started.Id, []byte("bob rewrapped")})
+	})
+
+	var collected RecoveryShares
+	expectFailure(t, "shares signed by another key", http.StatusUnauthorized, "Could not verify signature", func() (int, testResponse) {
+		return alice.postSignedResult("/recoveryshares", RecoveryShares{Username: "alice", Request: started.Id}, &collected)
+	})
+	expectFailure(t, "shares of missing request", http.StatusUnauthorized, errNoRecoveryRequest.Error(), func() (int, testResponse) {
+		return newAlice.postSignedResult("/recoveryshares", RecoveryShares{Username: "alice", Request: "missing"}, &collected)
+	})
+	if status, res := newAlice.postSignedResult("/recoveryshares", RecoveryShares{Username: "alice", Request: started.Id}, &collected); status != http.StatusOK ||
+		collected.Threshold != 2 || len(collected.Shares) != 1 || string(collected.Shares[0]) != "bob rewrapped" {
+		t.Fatalf("get recovery shares: got %d %+v %+v", status, res, collected)
+	}
+	expectSuccess(t, "carol approves", func() (int, testResponse) {
+		return carol.postSigned("/approverecovery", RecoveryApproval{"carol", started.Id, []byte("carol rewrapped")})
+	})
+	if status, res := newAlice.postSignedResult("/recoveryshares", RecoveryShares{Username: "alice", Request: started.Id}, &collected); status != http.StatusOK ||
+		len(collected.Shares) != 2 {
+		t.Errorf("get recovery shares after second approval: got %d %+v %+v", status, res, collected)
+	}
+}
+
+// Manifest of a version of one of the client's files, signed like the client's uploads
+// The hash covers header followed by the file's data or chunks
+func (c *testClient) manifest(name string, version int, header []byte, parts ...[]byte) Manifest {
+	h := lab2.NewFileHasher(header)
+	for _, part := range parts {
+		h.Add(part)
+	}
+	m, err := lab2.NewManifest(c.username, name, version, h.Sum(nil), c.username, defaultDevice, c.privateKey())
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	var converted Manifest
+	convertJSON(c.t, m, &converted)
+	return converted
+}
+
+// Sign a manifest with the client's key
+func (c *testClient) signManifest(m *Manifest) {
+	var lm lab2.Manifest
+	convertJSON(c.t, m, &lm)
+	if err := lm.Sign(c.privateKey()); err != nil {
+		c.t.Fatal(err)
+	}
+	m.Signature = lm.Signature
+}
+
+// Convert between the server's and the client's form of a type, which share their JSON encoding
+// Types holding grants can't be converted directly, as each side has its own Grant
+func convertJSON(t *testing.T, from interface{}, to interface{}) {
+	data, err := json.Marshal(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, to); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Grant of role on owner's file to user signed by the client, like the client's ShareFile
+// manager is the client's own grant when they aren't the owner
+func (c *testClient) grant(owner string, filename string, user string, role string, manager *Grant) *Grant {
+	var lm *lab2.Grant
+	if manager != nil {
+		lm = new(lab2.Grant)
+		convertJSON(c.t, manager, lm)
+	}
+	g, err := lab2.NewGrant(owner, filename, user, role, time.Time{}, c.username, defaultDevice, c.privateKey(), lm)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	var converted Grant
+	convertJSON(c.t, g, &converted)
+	return &converted
+}
+
+// Sign a grant again with the client's key, like the client's resignGrants
+func (c *testClient) signGrant(g *Grant) {
+	var lg lab2.Grant
+	convertJSON(c.t, g, &lg)
+	if err := lg.Sign(c.privateKey()); err != nil {
+		c.t.Fatal(err)
+	}
+	g.Signature = lg.Signature
+}
+
+// The client's own file key of owner's file
+func (c *testClient) fileKey(owner string, filename string) FileKey {
+	var filekey FileKey
+	if status, res := c.get("/users/"+owner+"/"+filename+"/key/"+c.username, &filekey); status != http.StatusOK {
+		c.t.Fatalf("get file key: got %d %+v", status, res)
+	}
+	return filekey
+}
+
+func TestManifests(t *testing.T) {
+	server := newTestServer(t)
+	alice := newEd25519TestClient(t, server, "alice")
+	bob := newEd25519TestClient(t, server, "bob")
+	alice.register()
+	bob.register()
+	upload := func(data string, m *Manifest) func() (int, testResponse) {
+		return func() (int, testResponse) {
+			return alice.postSigned("/uploadfile", File{Owner: "alice", Name: "a.txt", Data: []byte(data), Manifest: m})
+		}
+	}
+	m := alice.manifest("a.txt", 1, nil, []byte("one"))
+	expectSuccess(t, "signed upload", upload("one", &m))
+	expectSuccess(t, "share", func() (int, testResponse) {
+		return alice.postSigned("/sharefile", FileKey{User: "alice", Owner: "alice", Name: "a.txt", Key: []byte("key")})
+	})
+	first := m
+	var file File
+	if status, res := alice.get("/users/alice/a.txt", &file); status != http.StatusOK || file.Manifest == nil || !reflect.DeepEqual(*file.Manifest, m) {
+		t.Fatalf("get signed file: got %d %+v %+v", status, res, file.Manifest)
+	}
+
+	stale := alice.manifest("a.txt", 1, nil, []byte("two"))
+	expectFailure(t, "same version", http.StatusBadRequest, "Manifest version must be newer than the current version 1", upload("two", &stale))
+	expectFailure(t, "unsigned version", http.StatusBadRequest, "File is signed, new versions must be signed too", upload("two", nil))
+	wrongHash := alice.manifest("a.txt", 2, nil, []byte("one"))
+	expectFailure(t, "wrong hash", http.StatusBadRequest, "Manifest hash does not match file", upload("two", &wrongHash))
+	forged := alice.manifest("a.txt", 2, nil, []byte("two"))
+	bob.signManifest(&forged)
+	expectFailure(t, "signed by another user", http.StatusBadRequest, "Could not verify manifest signature", upload("two", &forged))
+	unknown := alice.manifest("a.txt", 2, nil, []byte("two"))
+	unknown.Device = "laptop"
+	alice.signManifest(&unknown)
+	expectFailure(t, "unknown device", http.StatusBadRequest, "Manifest was signed by an unknown device: laptop", upload("two", &unknown))
+	other := alice.manifest("b.txt", 2, nil, []byte("two"))
+	expectFailure(t, "other file", http.StatusBadRequest, "Manifest does not match file", upload("two", &other))
+	zero := alice.manifest("a.txt", 0, nil, []byte("two"))
+	expectFailure(t, "version zero", http.StatusBadRequest, "Manifest version must be at least 1", upload("two", &zero))
+
+	// Chunked uploads are signed when they are committed
+	session := alice.startUpload("a.txt", 2)
+	alice.uploadChunks(session, map[int]string{0: "three", 1: "four"})
+	commit := func(m *Manifest) func() (int, testResponse) {
+		return func() (int, testResponse) {
+			return alice.postSigned("/commitupload", UploadSession{Id: session.Id, Owner: "alice", Name: "a.txt", Manifest: m})
+		}
+	}
+	wrongChunks := alice.manifest("a.txt", 2, []byte("header"), []byte("threefour"))
+	expectFailure(t, "chunks hashed together", http.StatusBadRequest, "Manifest hash does not match file", commit(&wrongChunks))
+	m = alice.manifest("a.txt", 2, []byte("header"), []byte("three"), []byte("four"))
+	expectSuccess(t, "signed commit", commit(&m))
+	alice.get("/users/alice/a.txt", &file)
+	if file.Manifest == nil || file.Manifest.Version != 2 {
+		t.Fatalf("get committed file: got %+v", file.Manifest)
+	}
+
+	// Rotating a key signs its files again with the new key
+	newAlice := newEd25519TestClient(t, server, "alice")
+	var filekeys UserFileKeys
+	alice.get("/filekeys", &filekeys)
+	expectFailure(t, "rotate without manifests", http.StatusBadRequest, errManifestsChanged.Error(), func() (int, testResponse) {
+		return alice.postSigned("/rotatekey", alice.rotation(newAlice, newAlice.keySet(), filekeys.FileKeys))
+	})
+	rotation := alice.rotation(newAlice, newAlice.keySet(), filekeys.FileKeys)
+	changed := m
+	changed.Version = 3
+	newAlice.signManifest(&changed)
+	rotation.Manifests = []Manifest{changed}
+	expectFailure(t, "rotate with a new version", http.StatusBadRequest, errManifestsChanged.Error(), func() (int, testResponse) {
+		return alice.postSigned("/rotatekey", rotation)
+	})
+	// Kept versions are signed again too
+	resignedFirst := first
+	newAlice.signManifest(&resignedFirst)
+	resigned := m
+	newAlice.signManifest(&resigned)
+	rotation.Manifests = []Manifest{resigned}
+	expectFailure(t, "rotate without kept versions", http.StatusBadRequest, errManifestsChanged.Error(), func() (int, testResponse) {
+		return alice.postSigned("/rotatekey", rotation)
+	})
+	oldSigned := m
+	alice.signManifest(&oldSigned)
+	rotation.Manifests = []Manifest{resignedFirst, oldSigned}
+	expectFailure(t, "rotate signed with the old key", http.StatusBadRequest, "Could not verify manifest signature", func() (int, testResponse) {
+		return alice.postSigned("/rotatekey", rotation)
+	})
+	rotation.Manifests = []Manifest{resignedFirst, resigned, resigned}
+	expectFailure(t, "rotate with duplicate manifests", http.StatusBadRequest, errManifestsChanged.Error(), func() (int, testResponse) {
+		return alice.postSigned("/rotatekey", rotation)
+	})
+	rotation.Manifests = []Manifest{resignedFirst, resigned}
+	expectSuccess(t, "rotate", func() (int, testResponse) { return alice.postSigned("/rotatekey", rotation) })
+	newAlice.get("/users/alice/a.txt", &file)
+	if file.Manifest == nil || !reflect.DeepEqual(*file.Manifest, resigned) {
+		t.Errorf("file after rotating: got %+v", file.Manifest)
+	}
+	newAlice.get("/users/alice/a.txt?version=1", &file)
+	if file.Manifest == nil || !reflect.DeepEqual(*file.Manifest, resignedFirst) {
+		t.Errorf("first version after rotating: got %+v", file.Manifest)
+	}
+}
+
+func TestFileVersions(t *testing.T) {
+	server := newTestServer(t)
+	alice := newTestClient(t, server, "alice")
+	bob := newTestClient(t, server, "bob")
+	alice.register()
+	bob.register()
+	kept := KeepVersions
+	KeepVersions = 1
+	defer func() { KeepVersions = kept }()
+
+	alice.upload("a.txt", []byte("one"), []byte("key"))
+	for _, data := range []string{"two", "three"} {
+		file := File{Owner: "alice", Name: "a.txt", Data: []byte(data), PreviousKey: []byte("previous " + data)}
+		expectSuccess(t, "upload "+data, func() (int, testResponse) { return alice.postSigned("/uploadfile", file) })
+	}
+	var versions FileVersions
+	if status, res := alice.get("/users/alice/a.txt/versions", &versions); status != http.StatusOK {
+		t.Fatalf("get versions: got %d %+v", status, res)
+	}
+	if len(versions.Versions) != 2 {
+		t.Fatalf("versions: got %+v", versions)
+	}
+	old, current := versions.Versions[0], versions.Versions[1]
+	if old.Version != 2 || old.Current || old.Size != 3 || string(old.PreviousKey) != "previous two" || old.Created.IsZero() {
+		t.Errorf("kept version: got %+v", old)
+	}
+	if current.Version != 3 || !current.Current || current.Size != 5 || string(current.PreviousKey) != "previous three" {
+		t.Errorf("current version: got %+v", current)
+	}
+
+	var file File
+	alice.get("/users/alice/a.txt?version=2", &file)
+	if string(file.Data) != "two" || file.Version != 2 {
+		t.Errorf("get version 2: got %+v", file)
+	}
+	alice.get("/users/alice/a.txt?version=3", &file)
+	if string(file.Data) != "three" {
+		t.Errorf("get current version: got %+v", file)
+	}
+	expectFailure(t, "removed version", http.StatusBadRequest, errVersionNotFound.Error(), func() (int, testResponse) {
+		return alice.get("/users/alice/a.txt?version=1", &file)
+	})
+	for _, version := range []string{"0", "x", "-1"} {
+		expectFailure(t, "version "+version, http.StatusBadRequest, "Invalid file version", func() (int, testResponse) {
+			return alice.get("/users/alice/a.txt?version="+version, &file)
+		})
+	}
+	expectFailure(t, "versions without access", http.StatusBadRequest, errNoFileAccess.Error(), func() (int, testResponse) {
+		return bob.get("/users/alice/a.txt/versions", &versions)
+	})
+	expectFailure(t, "version without access", http.StatusBadRequest, errNoFileAccess.Error(), func() (int, testResponse) {
+		return bob.get("/users/alice/a.txt?version=2", &file)
+	})
+}
+
+// Store that is slow to read files, so concurrent requests interleave
+type slowStore struct {
+	Store
+}
+
+func (s slowStore) GetFile(owner string, filename string) (*File, error) {
+	time.Sleep(time.Millisecond)
+	return s.Store.GetFile(owner, filename)
+}
+
+// Versions committed at the same time each archive the version they replace exactly once
+func TestConcurrentVersions(t *testing.T) {
+	store = slowStore{newMemoryStore()}
+	kept := KeepVersions
+	KeepVersions = 100
+	defer func() { KeepVersions = kept }()
+	if err := (&File{Owner: "alice", Name: "a.txt", Data: []byte("0")}).Insert(store); err != nil {
+		t.Fatal(err)
+	}
+	const commits = 20
+	var wg sync.WaitGroup
+	for i := 1; i <= commits; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := (&File{Owner: "alice", Name: "a.txt", Data: []byte(strconv.Itoa(i))}).Insert(store); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	current, err := store.GetFile("alice", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Version != commits+1 {
+		t.Errorf("current version = %d, want %d", current.Version, commits+1)
+	}
+	versions, err := store.GetFileVersions("alice", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != commits {
+		t.Fatalf("kept %d versions, want %d", len(versions), commits)
+	}
+	data := map[string]bool{string(current.Data): true}
+	for i, version := range versions {
+		if version.Version != i+1 || data[string(version.Data)] {
+			t.Errorf("version %d = %d %q, archived twice or out of order", i, version.Version, version.Data)
+		}
+		data[string(version.Data)] = true
+	}
+}
+
+func TestRekey(t *testing.T) {
+	server := newTestServer(t)
+	alice := newTestClient(t, server, "alice")
+	bob := newTestClient(t, server, "bob")
+	carol := newTestClient(t, server, "carol")
+	alice.register()
+	bob.register()
+	carol.register()
+	alice.upload("a.txt", []byte("one"), []byte("key"))
+	alice.share("a.txt", bob, []byte("key"))
+	alice.share("a.txt", carol, []byte("key"))
+
+	session := alice.startEpochUpload("a.txt", 2, 1)
+	alice.uploadChunks(session, map[int]string{0: "two"})
+	epoch := 1
+	filekeys := func(users ...string) []FileKey {
+		filekeys := make([]FileKey, 0, len(users))
+		for _, user := range users {
+			filekeys = append(filekeys, FileKey{User: user, Owner: "alice", Name: "a.txt", Key: []byte("new " + user), Epoch: epoch})
+		}
+		return filekeys
+	}
+	rekey := func(c *testClient, filekeys []FileKey, revoked ...string) func() (int, testResponse) {
+		return func() (int, testResponse) {
+			return c.postSigned("/rekey", Rekey{Owner: "alice", Name: "a.txt", Upload: session.Id,
+				PreviousKey: []byte("previous"), FileKeys: filekeys, Revoked: revoked})
+		}
+	}
+	expectFailure(t, "incomplete upload", http.StatusBadRequest, "Upload is incomplete: received 1 of 2 chunks", rekey(alice, filekeys("alice", "carol"), "bob"))
+	alice.uploadChunks(session, map[int]string{1: "three"})
+	expectFailure(t, "signed by another user", http.StatusForbidden, errNotManager.Error(), rekey(bob, filekeys("alice", "carol"), "bob"))
+	expectFailure(t, "revoke owner", http.StatusBadRequest, "Can't revoke own file access", rekey(alice, filekeys("bob", "carol"), "alice"))
+	expectFailure(t, "revoke user without access", http.StatusBadRequest, "dave does not have access to this file", rekey(alice, filekeys("alice", "carol"), "dave"))
+	expectFailure(t, "key for revoked user", http.StatusBadRequest, "Unexpected file key for bob", rekey(alice, filekeys("alice", "bob", "carol"), "bob"))
+	expectFailure(t, "missing key", http.StatusBadRequest, errFileKeysChanged.Error(), rekey(alice, filekeys("alice"), "bob"))
+	wrongFile := filekeys("alice", "carol")
+	wrongFile[1].Name = "b.txt"
+	expectFailure(t, "key for another file", http.StatusBadRequest, "File key does not match file", rekey(alice, wrongFile, "bob"))
+	epoch = 2
+	expectFailure(t, "key for a later epoch", http.StatusBadRequest, "File keys must be for the new key epoch 1", rekey(alice, filekeys("alice", "carol"), "bob"))
+	epoch = 1
+	// Nothing changes until a rekey is accepted
+	data, key := bob.download("alice", "a.txt")
+	if string(data) != "one" || string(key) != "key" {
+		t.Fatalf("download before rekey: got %q %q", data, key)
+	}
+
+	expectSuccess(t, "rekey", rekey(alice, filekeys("alice", "carol"), "bob"))
+	var file File
+	if _, res := bob.get("/users/alice/a.txt", &file); res.Error != errNoFileAccess.Error() {
+		t.Errorf("revoked user get file: got %+v", res)
+	}
+	var filekey FileKey
+	carol.get("/users/alice/a.txt/key/carol", &filekey)
+	if string(filekey.Key) != "new carol" {
+		t.Errorf("remaining user's key: got %q", filekey.Key)
+	}
+	carol.get("/users/alice/a.txt", &file)
+	if file.Version != 2 || file.Chunks != 2 || string(file.PreviousKey) != "previous" || file.Epoch != 1 || file.KeyEpoch != 1 || file.Pending {
+		t.Errorf("rekeyed file: got %+v", file)
+	}
+	carol.get("/users/alice/a.txt?version=1", &file)
+	if string(file.Data) != "one" {
+		t.Errorf("version before rekey: got %+v", file)
+	}
+	epoch = 2
+	expectFailure(t, "reused upload", http.StatusNotFound, errNoUpload.Error(), rekey(alice, filekeys("alice", "carol")))
+	stale := alice.startEpochUpload("a.txt", 1, 1)
+	alice.uploadChunks(stale, map[int]string{0: "four"})
+	session = stale
+	expectFailure(t, "upload under the old epoch", http.StatusBadRequest, "Upload must be encrypted with the new file key of epoch 2", rekey(alice, filekeys("alice", "carol")))
+}
+
+func TestKeyEpochs(t *testing.T) {
+	server := newTestServer(t)
+	alice := newTestClient(t, server, "alice")
+	bob := newTestClient(t, server, "bob")
+	carol := newTestClient(t, server, "carol")
+	alice.register()
+	bob.register()
+	carol.register()
+	alice.upload("a.txt", []byte("one"), []byte("key"))
+	alice.share("a.txt", bob, []byte("key"))
+	alice.share("a.txt", carol, []byte("key"))
+
+	rekey := func(epoch int, epochKey string, users ...string) func() (int, testResponse) {
+		filekeys := make([]FileKey, 0, len(users))
+		for _, user := range users {
+			filekeys = append(filekeys, FileKey{User: user, Owner: "alice", Name: "a.txt", Key: []byte("key " + strconv.Itoa(epoch)), Epoch: epoch})
+		}
+		return func() (int, testResponse) {
+			return alice.postSigned("/rekey", Rekey{Owner: "alice", Name: "a.txt", EpochKey: []byte(epochKey), FileKeys: filekeys, Revoked: []string{"carol"}})
+		}
+	}
+	expectFailure(t, "lazy rekey without epoch key", http.StatusBadRequest, "Rekey needs an upload or the current key encrypted with the new one", rekey(1, "", "alice", "bob"))
+	expectSuccess(t, "lazy rekey", rekey(1, "key 0 under key 1", "alice", "bob"))
+
+	// The data isn't touched, it stays under epoch 0 until the next upload
+	var file File
+	bob.get("/users/alice/a.txt", &file)
+	if string(file.Data) != "one" || file.Version != 1 || file.Epoch != 0 || file.KeyEpoch != 1 || !file.Pending ||
+		len(file.EpochKeys) != 1 || file.EpochKeys[0].Epoch != 1 || string(file.EpochKeys[0].Key) != "key 0 under key 1" {
+		t.Errorf("file pending re-encryption: got %+v", file)
+	}
+	var filekey FileKey
+	bob.get("/users/alice/a.txt/key/bob", &filekey)
+	if filekey.Epoch != 1 || string(filekey.Key) != "key 1" {
+		t.Errorf("remaining user's key: got %+v", filekey)
+	}
+	if _, res := carol.get("/users/alice/a.txt/key/carol", &filekey); res.Error != errNoFileAccess.Error() {
+		t.Errorf("revoked user's key: got %+v", res)
+	}
+	var versions FileVersions
+	alice.get("/users/alice/a.txt/versions", &versions)
+	if len(versions.Versions) != 1 || !versions.Versions[0].Pending {
+		t.Errorf("versions of pending file: got %+v", versions)
+	}
+
+	expectFailure(t, "share the old key", http.StatusBadRequest, "File key is for key epoch 0 but the file is at epoch 1", func() (int, testResponse) {
+		return alice.postSigned("/sharefile", FileKey{User: "carol", Owner: "alice", Name: "a.txt", Key: []byte("key 0")})
+	})
+	expectFailure(t, "upload under the old epoch", http.StatusBadRequest, "File must be encrypted with the file key of epoch 1", func() (int, testResponse) {
+		return alice.postSigned("/uploadfile", File{Owner: "alice", Name: "a.txt", Data: []byte("two")})
+	})
+
+	// A second revoke before the file is re-encrypted adds to the chain of epoch keys
+	expectSuccess(t, "share the current key", func() (int, testResponse) {
+		return alice.postSigned("/sharefile", FileKey{User: "carol", Owner: "alice", Name: "a.txt", Key: []byte("key 1"), Epoch: 1})
+	})
+	expectFailure(t, "rekey from an old epoch", http.StatusBadRequest, "File keys must be for the new key epoch 2", rekey(1, "key 0 under key 1", "alice", "bob"))
+	expectSuccess(t, "second lazy rekey", rekey(2, "key 1 under key 2", "alice", "bob"))
+	alice.get("/users/alice/a.txt", &file)
+	if file.Epoch != 0 || file.KeyEpoch != 2 || len(file.EpochKeys) != 2 || string(file.EpochKeys[1].Key) != "key 1 under key 2" {
+		t.Errorf("file after second rekey: got %+v", file)
+	}
+
+	// Uploading under the current epoch re-encrypts the file
+	expectSuccess(t, "upload under the current epoch", func() (int, testResponse) {
+		return alice.postSigned("/uploadfile", File{Owner: "alice", Name: "a.txt", Data: []byte("two"), Epoch: 2})
+	})
+	alice.get("/users/alice/a.txt", &file)
+	if string(file.Data) != "two" || file.Epoch != 2 || file.KeyEpoch != 2 || file.Pending || len(file.EpochKeys) != 0 {
+		t.Errorf("re-encrypted file: got %+v", file)
+	}
+
+	// Rotating a key keeps the epoch of the user's file keys
+	newBob := newEd25519TestClient(t, server, "bob")
+	filekeys := []FileKey{{User: "bob", Owner: "alice", Name: "a.txt", Key: []byte("key 2")}}
+	expectSuccess(t, "rotate", func() (int, testResponse) {
+		return bob.postSigned("/rotatekey", bob.rotation(newBob, newBob.keySet(), filekeys))
+	})
+	newBob.get("/users/alice/a.txt/key/bob", &filekey)
+	if filekey.Epoch != 2 {
+		t.Errorf("file key after rotating: got epoch %d", filekey.Epoch)
+	}
+}
+
+// A version encrypted under the old key epoch that commits as a revoke rekeys the file either lands
+// before the rekey or is refused, it never drops the epoch keys the file still needs
+func TestRekeyDuringUpload(t *testing.T) {
+	server := newTestServer(t)
+	alice := newTestClient(t, server, "alice")
+	bob := newTestClient(t, server, "bob")
+	alice.register()
+	bob.register()
+	store = slowStore{store}
+	for i := 0; i < 10; i++ {
+		name := "a" + strconv.Itoa(i) + ".txt"
+		alice.upload(name, []byte("one"), []byte("key"))
+		alice.share(name, bob, []byte("key"))
+		rekey := &Rekey{Owner: "alice", Name: name, EpochKey: []byte("key 0 under key 1"), FileKeys: []FileKey{
+			{User: "alice", Owner: "alice", Name: name, Key: []byte("key 1"), Epoch: 1},
+			{User: "bob", Owner: "alice", Name: name, Key: []byte("key 1"), Epoch: 1},
+		}}
+		var wg sync.WaitGroup
+		var rekeyErr error
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			rekeyErr = rekey.Apply(store)
+		}()
+		go func() {
+			defer wg.Done()
+			(&File{Owner: "alice", Name: name, Data: []byte("two"), Epoch: 0}).Insert(store)
+		}()
+		wg.Wait()
+		if rekeyErr != nil {
+			t.Fatalf("%s rekey: %v", name, rekeyErr)
+		}
+		file, err := store.GetFile("alice", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if file.Epoch != 0 || file.KeyEpoch != 1 || !file.Pending || len(file.EpochKeys) != 1 {
+			t.Errorf("%s after rekey and stale upload: epoch %d key epoch %d pending %v epoch keys %d",
+				name, file.Epoch, file.KeyEpoch, file.Pending, len(file.EpochKeys))
+		}
+	}
+}
+
+func TestNewFiles(t *testing.T) {
+	server := newTestServer(t)
+	alice := newTestClient(t, server, "alice")
+	bob := newTestClient(t, server, "bob")
+	alice.register()
+	bob.register()
+	key := []byte("0123456789abcdef0123456789abcdef")
+	alice.upload("a.txt", []byte("one"), key)
+	alice.share("a.txt", bob, key)
+
+	// A client that couldn't get the file key mustn't create the file again or replace the owner's key
+	expectFailure(t, "new upload session", http.StatusBadRequest, errFileExists.Error(), func() (int, testResponse) {
+		return alice.postSigned("/startupload", UploadSession{Owner: "alice", Name: "a.txt", Header: []byte("header"), Chunks: 1, New: true})
+	})
+	expectFailure(t, "new upload", http.StatusBadRequest, errFileExists.Error(), func() (int, testResponse) {
+		return alice.postSigned("/uploadfile", File{Owner: "alice", Name: "a.txt", Data: []byte("two"), New: true})
+	})
+	expectFailure(t, "owner's key", http.StatusBadRequest, errFileExists.Error(), func() (int, testResponse) {
+		return alice.postSigned("/sharefile", FileKey{User: "alice", Owner: "alice", Name: "a.txt", Key: []byte("new key")})
+	})
+	data, gotKey := bob.download("alice", "a.txt")
+	if string(data) != "one" || !bytes.Equal(gotKey, key) {
+		t.Errorf("shared download = %q %q", data, gotKey)
+	}
+
+	// The file may be created while a new file's upload is running
+	var session UploadSession
+	if _, res := alice.postSignedResult("/startupload", UploadSession{Owner: "alice", Name: "b.txt", Header: []byte("header"), Chunks: 1, New: true}, &session); res.Status == "failure" {
+		t.Fatalf("start upload: %s", res.Error)
+	}
+	alice.uploadChunks(session, map[int]string{0: "data"})
+	alice.upload("b.txt", []byte("one"), key)
+	expectFailure(t, "commit new file", http.StatusBadRequest, errFileExists.Error(), func() (int, testResponse) {
+		return alice.postSigned("/commitupload", UploadSession{Id: session.Id, Owner: "alice", Name: "b.txt"})
+	})
+
+	// Nobody can read a file the owner has no key to, so it can be uploaded again as a new file
+	expectSuccess(t, "keyless upload", func() (int, testResponse) {
+		return alice.postSigned("/uploadfile", File{Owner: "alice", Name: "c.txt", Data: []byte("one"), New: true})
+	})
+	alice.upload("c.txt", []byte("two"), key)
+	data, gotKey = alice.download("alice", "c.txt")
+	if string(data) != "two" || !bytes.Equal(gotKey, key) {
+		t.Errorf("download of file uploaded again = %q %q", data, gotKey)
+	}
+}
+
+func TestShareExpiry(t *testing.T) {
+	server := newTestServer(t)
+	alice := newTestClient(t, server, "alice")
+	bob := newTestClient(t, server, "bob")
+	carol := newTestClient(t, server, "carol")
+	dave := newTestClient(t, server, "dave")
+	for _, c := range []*testClient{alice, bob, carol, dave} {
+		c.register()
+	}
+	alice.upload("a.txt", []byte("one"), []byte("key"))
+	alice.share("a.txt", carol, []byte("key"))
+	share := func(user string, expires time.Time) func() (int, testResponse) {
+		return func() (int, testResponse) {
+			return alice.postSigned("/sharefile", FileKey{User: user, Owner: "alice", Name: "a.txt", Key: []byte("key"), Expires: expires})
+		}
+	}
+	expectFailure(t, "expiry in the past", http.StatusBadRequest, "Share must expire in the future", share("bob", time.Now().Add(-time.Hour)))
+	expectFailure(t, "expiring owner key", http.StatusBadRequest, "The owner's file key can't expire", share("alice", time.Now().Add(time.Hour)))
+	expectSuccess(t, "expiring share", share("bob", time.Now().Add(time.Hour)))
+	expectSuccess(t, "second expiring share", share("dave", time.Now().Add(time.Hour)))
+	var filekey FileKey
+	if status, _ := bob.get("/users/alice/a.txt/key/bob", &filekey); status != http.StatusOK || filekey.Expires.IsZero() {
+		t.Errorf("key before expiry: got %d %+v", status, filekey)
+	}
+
+	// Expired keys aren't served even before the purge removes them
+	expire := func(user string) {
+		filekey, err := store.GetFileKey("alice", "a.txt", user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filekey.Expires = time.Now().Add(-time.Second)
+		if err := store.InsertFileKey(filekey); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expire("bob")
+	if _, res := bob.get("/users/alice/a.txt/key/bob", &filekey); res.Error != errShareExpired.Error() {
+		t.Errorf("expired key: got %+v", res)
+	}
+	var file File
+	if _, res := bob.get("/users/alice/a.txt", &file); res.Error != errShareExpired.Error() {
+		t.Errorf("file with expired key: got %+v", res)
+	}
+	var filekeys UserFileKeys
+	bob.get("/filekeys", &filekeys)
+	if len(filekeys.FileKeys) != 0 {
+		t.Errorf("file keys with expired key: got %+v", filekeys)
+	}
+	var users FileUsers
+	alice.get("/users/alice/a.txt/users", &users)
+	if want := []string{"alice", "carol", "dave"}; !reflect.DeepEqual(users.Users, want) {
+		t.Errorf("users with expired key: got %v, want %v", users.Users, want)
+	}
+
+	// The purge deletes the key and flags the file until its owner gives it a new key
+	var rekeys RekeyFiles
+	alice.get("/rekeys", &rekeys)
+	if len(rekeys.Names) != 0 {
+		t.Errorf("files needing a rekey before the purge: got %v", rekeys.Names)
+	}
+	if err := purgeFileKeys(store); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetFileKey("alice", "a.txt", "bob"); err != errNoFileAccess {
+		t.Errorf("purged key: got %v", err)
+	}
+	alice.get("/rekeys", &rekeys)
+	if want := []string{"a.txt"}; !reflect.DeepEqual(rekeys.Names, want) {
+		t.Errorf("files needing a rekey after the purge: got %v, want %v", rekeys.Names, want)
+	}
+	carol.get("/rekeys", &rekeys)
+	if len(rekeys.Names) != 0 {
+		t.Errorf("shared files needing a rekey: got %v", rekeys.Names)
+	}
+	expectSuccess(t, "upload", func() (int, testResponse) {
+		return alice.postSigned("/uploadfile", File{Owner: "alice", Name: "a.txt", Data: []byte("two")})
+	})
+	alice.get("/users/alice/a.txt", &file)
+	if !file.NeedsRekey {
+		t.Errorf("new version with the old key: got %+v", file)
+	}
+
+	// A rekey revokes users whose shares expired but weren't purged yet
+	expire("dave")
+	rekey := []FileKey{
+		{User: "alice", Owner: "alice", Name: "a.txt", Key: []byte("key 1"), Epoch: 1},
+		{User: "carol", Owner: "alice", Name: "a.txt", Key: []byte("key 1"), Epoch: 1},
+	}
+	expectSuccess(t, "rekey", func() (int, testResponse) {
+		return alice.postSigned("/rekey", Rekey{Owner: "alice", Name: "a.txt", EpochKey: []byte("key 0 under key 1"), FileKeys: rekey})
+	})
+	if _, err := store.GetFileKey("alice", "a.txt", "dave"); err != errNoFileAccess {
+		t.Errorf("expired key after rekey: got %v", err)
+	}
+	alice.get("/users/alice/a.txt", &file)
+	if file.NeedsRekey || file.KeyEpoch != 1 {
+		t.Errorf("file after rekey: got %+v", file)
+	}
+	alice.get("/rekeys", &rekeys)
+	if len(rekeys.Names) != 0 {
+		t.Errorf("files needing a rekey after the rekey: got %v", rekeys.Names)
+	}
+}
+
+type failingStore struct {
+	Store
+}
+
+var errStoreFailure = errors.New("store failure")
+
+func (failingStore) InsertUser(*User) error                     { return errStoreFailure }
+func (failingStore) InsertFile(*File) error                     { return errStoreFailure }
+func (failingStore) InsertUploadSession(*UploadSession) error   { return errStoreFailure }
+func (failingStore) InsertFileChunk(*FileChunk) error           { return errStoreFailure }
+func (failingStore) InsertFileKey(*FileKey) error               { return errStoreFailure }
+func (failingStore) DeleteFileKey(string, string, string) error { return errStoreFailure }
+func (failingStore) GetFileUsers(string, string) ([]string, error) {
+	return nil, errStoreFailure
+}
+
+func TestStoreErrors(t *testing.T) {
+	server := newTestServer(t)
+	alice := newTestClient(t, server, "alice")
+	bob := newTestClient(t, server, "bob")
+	alice.register()
+	bob.register()
+	alice.upload("a.txt", []byte("data"), []byte("key"))
+	session := alice.startUpload("a.txt", 1)
+	store = failingStore{store}
+
+	expectFailure(t, "register", http.StatusBadRequest, errStoreFailure.Error(), func() (int, testResponse) {
+		body, _ := json.Marshal(User{Username: "carol", PubKey: &alice.key.PublicKey})
+		return alice.post("/register", body)
+	})
+	expectFailure(t, "upload", http.StatusBadRequest, errStoreFailure.Error(), func() (int, testResponse) {
+		return alice.postSigned("/uploadfile", File{Owner: "alice", Name: "a.txt"})
+	})
+	expectFailure(t, "start upload", http.StatusBadRequest, errStoreFailure.Error(), func() (int, testResponse) {
+		return alice.postSigned("/startupload", UploadSession{Owner: "alice", Name: "a.txt", Chunks: 1})
+	})
+	expectFailure(t, "upload chunk", http.StatusBadRequest, errStoreFailure.Error(), func() (int, testResponse) {
+		return alice.postSigned("/uploadchunk", FileChunk{Owner: "alice", Name: "a.txt", Session: session.Id})
+	})
+	expectFailure(t, "share", http.StatusBadRequest, errStoreFailure.Error(), func() (int, testResponse) {
+		return alice.postSigned("/sharefile", FileKey{User: "bob", Owner: "alice", Name: "a.txt"})
+	})
+	expectFailure(t, "revoke", http.StatusBadRequest, errStoreFailure.Error(), func() (int, testResponse) {
+		return alice.postSigned("/revokefile", FileKey{User: "bob", Owner: "alice", Name: "a.txt"})
+	})
+	expectFailure(t, "file users", http.StatusBadRequest, errStoreFailure.Error(), func() (int, testResponse) {
+		var users FileUsers
+		return alice.get("/users/alice/a.txt/users", &users)
+	})
+}
+
+func TestEmptyBody(t *testing.T) {
+	store = newMemoryStore()
+	handlers := map[string]func(http.ResponseWriter, *http.Request){
+		"/register":      func(w http.ResponseWriter, req *http.Request) { register(w, req, nil) },
+		"/challenge":     func(w http.ResponseWriter, req *http.Request) { getChallenge(w, req, nil) },
+		"/login":         func(w http.ResponseWriter, req *http.Request) { login(w, req, nil) },
+		"/uploadfile":    func(w http.ResponseWriter, req *http.Request) { uploadFile(w, req, nil) },
+		"/startupload":   func(w http.ResponseWriter, req *http.Request) { startUpload(w, req, nil) },
+		"/uploadchunk":   func(w http.ResponseWriter, req *http.Request) { uploadChunk(w, req, nil) },
+		"/commitupload":  func(w http.ResponseWriter, req *http.Request) { commitUpload(w, req, nil) },
+		"/sharefile":     func(w http.ResponseWriter, req *http.Request) { shareFile(w, req, nil) },
+		"/revokefile":    func(w http.ResponseWriter, req *http.Request) { revokeFile(w, req, nil) },
+		"/rekey":         func(w http.ResponseWriter, req *http.Request) { rekeyFile(w, req, nil) },
+		"/rotatekey":     func(w http.ResponseWriter, req *http.Request) { rotateKey(w, req, nil) },
+		"/enroll":        func(w http.ResponseWriter, req *http.Request) { enrollDevice(w, req, nil) },
+		"/approvedevice": func(w http.ResponseWriter, req *http.Request) { approveDevice(w, req, nil) },
+		"/removedevice":  func(w http.ResponseWriter, req *http.Request) { removeDevice(w, req, nil) },
+	}
+	for path, handler := range handlers {
+		req := httptest.NewRequest("POST", path, nil)
+		req.Body = nil
+		w := httptest.NewRecorder()
+		handler(w, req)
+		var res testResponse
+		json.NewDecoder(w.Body).Decode(&res)
+		if w.Code != http.StatusBadRequest || res.Error != "Invalid Request: Empty" {
+			t.Errorf("%s with empty body: got %d %+v", path, w.Code, res)
+		}
+	}
+}
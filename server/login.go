@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a login challenge can be answered and a session token used
+const (
+	challengeLifetime = time.Minute
+	tokenLifetime     = 15 * time.Minute
+)
+
+var errInvalidToken = errors.New("Invalid or expired token")
+
+// Login Challenge Struct
+type Challenge struct {
+	Username  string
+	Challenge []byte
+}
+
+// Login Request Struct, the signature covers the username and challenge
+type LoginRequest struct {
+	Username  string
+	Challenge []byte
+	Signature []byte
+}
+
+// Session Token Struct
+type Token struct {
+	Username string
+	Token    string
+	Expires  time.Time
+}
+
+// Data covered by a login signature, must match the client's
+type loginData struct {
+	Username  string
+	Challenge []byte
+}
+
+// Most challenges and tokens a user can have outstanding, adding another replaces the oldest
+const (
+	maxChallengesPerUser = 8
+	maxTokensPerUser     = 64
+)
+
+// Outstanding login challenges and issued session tokens
+var challenges = newSessionCache(maxChallengesPerUser)
+var tokens = newSessionCache(maxTokensPerUser)
+
+// Cache of values belonging to a user until they expire, expired ones are removed by Sweep
+type sessionCache struct {
+	mu         sync.Mutex
+	entries    map[string]sessionEntry
+	users      map[string][]string // values of each user, oldest first
+	maxPerUser int
+}
+
+type sessionEntry struct {
+	Username string
+	Expires  time.Time
+}
+
+func newSessionCache(maxPerUser int) *sessionCache {
+	return &sessionCache{entries: make(map[string]sessionEntry), users: make(map[string][]string), maxPerUser: maxPerUser}
+}
+
+// Add a value for username until it expires
+func (c *sessionCache) Add(value string, username string, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Replacing the oldest value rather than refusing the new one means
+	// requesting challenges for someone else can't lock them out
+	if values := c.users[username]; len(values) >= c.maxPerUser {
+		c.remove(values[0])
+	}
+	c.entries[value] = sessionEntry{username, expires}
+	c.users[username] = append(c.users[username], value)
+}
+
+// Remove a value, the caller must hold mu
+func (c *sessionCache) remove(value string) {
+	e, ok := c.entries[value]
+	if !ok {
+		return
+	}
+	delete(c.entries, value)
+	values := c.users[e.Username]
+	for i, v := range values {
+		if v == value {
+			values = append(values[:i:i], values[i+1:]...)
+			break
+		}
+	}
+	if len(values) == 0 {
+		delete(c.users, e.Username)
+	} else {
+		c.users[e.Username] = values
+	}
+}
+
+// Get the user a value belongs to, returns false if it is unknown or expired
+func (c *sessionCache) Get(value string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[value]
+	if !ok || e.Expires.Before(time.Now()) {
+		return "", false
+	}
+	return e.Username, true
+}
+
+// Get the user a value belongs to and remove it so it can only be used once
+func (c *sessionCache) Take(value string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[value]
+	c.remove(value)
+	if !ok || e.Expires.Before(time.Now()) {
+		return "", false
+	}
+	return e.Username, true
+}
+
+// Remove all values belonging to a user
+func (c *sessionCache) RemoveUser(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, v := range c.users[username] {
+		delete(c.entries, v)
+	}
+	delete(c.users, username)
+}
+
+// Remove the values that expired by now
+func (c *sessionCache) Sweep(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for v, e := range c.entries {
+		if e.Expires.Before(now) {
+			c.remove(v)
+		}
+	}
+}
+
+// Remove expired challenges and tokens every interval, runs until the server stops
+func sweepSessions(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		challenges.Sweep(now)
+		tokens.Sweep(now)
+	}
+}
+
+// Create a login challenge for a user
+func NewChallenge(username string, store Store) (*Challenge, error) {
+	_, err := GetUser(username, store)
+	if err != nil {
+		return nil, err
+	}
+	challenge := &Challenge{Username: username, Challenge: make([]byte, 32)}
+	if _, err = rand.Read(challenge.Challenge); err != nil {
+		return nil, err
+	}
+	challenges.Add(string(challenge.Challenge), username, time.Now().Add(challengeLifetime))
+	return challenge, nil
+}
+
+// Check a signed login challenge and issue a session token for the user
+func (l *LoginRequest) Login(store Store) (*Token, error) {
+	// Challenges can only be answered once, even if the signature is wrong
+	username, ok := challenges.Take(string(l.Challenge))
+	if !ok || username != l.Username {
+		return nil, errors.New("Invalid or expired challenge")
+	}
+	user, err := GetUser(l.Username, store)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(loginData{l.Username, l.Challenge})
+	if err != nil {
+		return nil, err
+	}
+	if !verifyAny(user.SigningKeys(), data, l.Signature) {
+		return nil, errors.New("Could not verify signature")
+	}
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return nil, err
+	}
+	token := &Token{Username: l.Username, Token: hex.EncodeToString(b), Expires: time.Now().Add(tokenLifetime)}
+	tokens.Add(token.Token, token.Username, token.Expires)
+	return token, nil
+}
+
+// Get the bearer token sent with a request, if any
+func bearerToken(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	return strings.TrimPrefix(auth, "Bearer ")
+}
+
+// Get the user a session token was issued to
+func tokenUser(token string) (string, error) {
+	username, ok := tokens.Get(token)
+	if !ok {
+		return "", errInvalidToken
+	}
+	return username, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"time"
+)
+
+var errManifestsChanged = errors.New("Every file signed by the device must be signed again")
+
+// Manifest Struct, the signature of the owner or a writer over one version of a file
+// Hash covers the encrypted file as stored, so readers can tell if the server swapped it
+// Author is the writer who signed it, manifests signed by the owner have none
+// Grant is the author's grant of the writer role, it isn't covered by the signature as it is signed itself
+type Manifest struct {
+	Owner     string `gorethink:"owner"`
+	Name      string `gorethink:"name"`
+	Version   int    `gorethink:"version"`
+	Hash      []byte `gorethink:"hash"`
+	Timestamp int64  `gorethink:"timestamp"`
+	Device    string `gorethink:"device"`
+	Author    string `gorethink:"author" json:",omitempty"`
+	Grant     *Grant `gorethink:"grant,omitempty" json:",omitempty"`
+	Signature []byte `gorethink:"signature"`
+}
+
+// Data covered by the manifest signature, must match the client's
+// Author is left out when empty so manifests signed before writers still verify
+type manifestData struct {
+	Owner     string
+	Name      string
+	Version   int
+	Hash      []byte
+	Timestamp int64
+	Device    string
+	Author    string `json:",omitempty"`
+}
+
+// The user who signed the manifest
+func (m *Manifest) signer() string {
+	if m.Author == "" {
+		return m.Owner
+	}
+	return m.Author
+}
+
+// Check the manifest was signed by one of the signer's devices
+func (m *Manifest) verify(signer *User) error {
+	device := signer.Device(m.Device)
+	if device == nil {
+		return errors.New("Manifest was signed by an unknown device: " + m.Device)
+	}
+	data, err := json.Marshal(manifestData{m.Owner, m.Name, m.Version, m.Hash, m.Timestamp, m.Device, m.Author})
+	if err != nil {
+		return err
+	}
+	if !verify(device.Keys.Signing, data, m.Signature) {
+		return errors.New("Could not verify manifest signature")
+	}
+	return nil
+}
+
+// Check a re-signed manifest covers the same version as the current one
+func (m *Manifest) sameVersion(other *Manifest) bool {
+	return m.Owner == other.Owner && m.Name == other.Name && m.Version == other.Version &&
+		bytes.Equal(m.Hash, other.Hash) && m.Timestamp == other.Timestamp && m.Author == other.Author
+}
+
+// Add one part of a file to its hash, each part is length prefixed
+func hashPart(h hash.Hash, part []byte) {
+	var length [8]byte
+	binary.BigEndian.PutUint64(length[:], uint64(len(part)))
+	h.Write(length[:])
+	h.Write(part)
+}
+
+// Hash and size of the encrypted file: its stream header, then its data or each of its chunks
+func hashFile(f *File, store Store) ([]byte, int64, error) {
+	h := sha256.New()
+	hashPart(h, f.Header)
+	if f.Chunks == 0 {
+		hashPart(h, f.Data)
+		return h.Sum(nil), int64(len(f.Data)), nil
+	}
+	var size int64
+	for i := 0; i < f.Chunks; i++ {
+		chunk, err := store.GetFileChunk(f.Owner, f.Name, f.Session, i)
+		if err != nil {
+			return nil, 0, err
+		}
+		hashPart(h, chunk.Data)
+		size += int64(len(chunk.Data))
+	}
+	return h.Sum(nil), size, nil
+}
+
+// Check a new version of a file is signed by its owner or one of its writers and newer than the version it replaces
+// Files uploaded without a manifest are accepted until their owner first signs one, sum is the file's hash
+func (f *File) checkManifest(old *File, sum []byte, store Store) error {
+	m := f.Manifest
+	if m == nil {
+		if old != nil && old.Manifest != nil {
+			return errors.New("File is signed, new versions must be signed too")
+		}
+		return nil
+	}
+	if m.Owner != f.Owner || m.Name != f.Name {
+		return errors.New("Manifest does not match file")
+	}
+	if m.Version < 1 {
+		return errors.New("Manifest version must be at least 1")
+	}
+	if old != nil && m.Version <= old.Version {
+		return fmt.Errorf("Manifest version must be newer than the current version %d", old.Version)
+	}
+	signer, err := GetUser(m.signer(), store)
+	if err != nil {
+		return err
+	}
+	if signer.Username != f.Owner {
+		filekey, err := GetFileKey(f.Owner, f.Name, signer.Username, store)
+		if err != nil && err != errNoFileAccess && err != errShareExpired {
+			return err
+		}
+		if filekey == nil || !hasRole(filekey.Role, roleWriter) {
+			return fmt.Errorf("Manifest was signed by %s, who can't write to this file", signer.Username)
+		}
+		// Readers check the writer's grant, so a manifest without one would be refused by them
+		if m.Grant == nil {
+			return errors.New("Manifest signed by a writer must carry their grant")
+		}
+		err = m.Grant.verify(f.Owner, f.Name, signer.Username, store)
+		if err != nil {
+			return err
+		}
+		if !hasRole(m.Grant.Role, roleWriter) || m.Grant.expired(time.Unix(m.Timestamp, 0)) {
+			return errors.New("Manifest grant does not let its author write to this file")
+		}
+	}
+	err = m.verify(signer)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, m.Hash) {
+		return errors.New("Manifest hash does not match file")
+	}
+	return nil
+}
+
+// Check manifests re-sign every version signed by device of the files user can access, for when the device's key
+// changes or it is removed. These are the user's own files and the versions they wrote of files shared with them.
+// user must already have their new devices, returns the current files and kept versions with their new manifests
+func checkManifests(user *User, device string, manifests []Manifest, store Store) ([]File, error) {
+	resigned := make(map[string]*Manifest)
+	for i := range manifests {
+		if manifests[i].signer() != user.Username {
+			return nil, errors.New("Manifest belongs to another user")
+		}
+		resigned[fmt.Sprintf("%s/%s/%d", manifests[i].Owner, manifests[i].Name, manifests[i].Version)] = &manifests[i]
+	}
+	filekeys, err := GetUserFileKeys(user.Username, store)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]File, 0, len(manifests))
+	for _, filekey := range filekeys {
+		file, err := GetFile(filekey.Owner, filekey.Name, store)
+		if err != nil {
+			return nil, err
+		}
+		versions, err := store.GetFileVersions(filekey.Owner, filekey.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, version := range append(versions, *file) {
+			if version.Manifest == nil || version.Manifest.signer() != user.Username || version.Manifest.Device != device {
+				continue
+			}
+			m, ok := resigned[fmt.Sprintf("%s/%s/%d", version.Owner, version.Name, version.Manifest.Version)]
+			if !ok || !m.sameVersion(version.Manifest) {
+				return nil, errManifestsChanged
+			}
+			err = m.verify(user)
+			if err != nil {
+				return nil, err
+			}
+			// The grant isn't covered by the signature, it is signed again by replaceGrants if need be
+			m.Grant = version.Manifest.Grant
+			version.Manifest = m
+			files = append(files, version)
+		}
+	}
+	if len(files) != len(manifests) {
+		return nil, errManifestsChanged
+	}
+	return files, nil
+}
+
+// Store files and kept versions with the manifests checked by checkManifests
+func replaceManifests(files []File, store Store) error {
+	for i := range files {
+		current, err := store.GetFile(files[i].Owner, files[i].Name)
+		if err != nil {
+			return err
+		}
+		if current.Id == files[i].Id {
+			// Keep a rekey the expiry purge asked for since the files were checked
+			files[i].NeedsRekey = current.NeedsRekey
+			err = store.InsertFile(&files[i])
+		} else {
+			err = store.InsertFileVersion(&files[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In-memory storage backend, contents are lost when the server stops
+type memoryStore struct {
+	mu         sync.RWMutex
+	users      map[string]User
+	files      map[string]File
+	versions   map[string]File
+	chunks     map[string]FileChunk
+	uploads    map[string]UploadSession
+	filekeys   map[string]FileKey
+	recoveries map[string]Recovery
+	log        []LogEntry
+}
+
+// Create an empty in-memory store
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:      make(map[string]User),
+		files:      make(map[string]File),
+		versions:   make(map[string]File),
+		chunks:     make(map[string]FileChunk),
+		uploads:    make(map[string]UploadSession),
+		filekeys:   make(map[string]FileKey),
+		recoveries: make(map[string]Recovery),
+	}
+}
+
+// Build a map key from its parts, names can't contain NUL, see validName
+func memoryKey(parts ...string) string {
+	return strings.Join(parts, "\x00")
+}
+
+// Copy a byte slice so stored values don't alias caller memory
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
+// Copy a user's devices so stored users don't alias caller memory
+func copyDevices(devices []Device) []Device {
+	if devices == nil {
+		return nil
+	}
+	return append([]Device(nil), devices...)
+}
+
+// Copy a file's manifest so stored files don't alias caller memory
+func copyManifest(m *Manifest) *Manifest {
+	if m == nil {
+		return nil
+	}
+	copied := *m
+	copied.Hash = copyBytes(m.Hash)
+	copied.Grant = copyGrant(m.Grant)
+	copied.Signature = copyBytes(m.Signature)
+	return &copied
+}
+
+// Copy a grant and the manager's grant within it so stored grants don't alias caller memory
+func copyGrant(g *Grant) *Grant {
+	if g == nil {
+		return nil
+	}
+	copied := *g
+	copied.Manager = copyGrant(g.Manager)
+	copied.Signature = copyBytes(g.Signature)
+	return &copied
+}
+
+// Copy recovery shares so stored recoveries don't alias caller memory
+func copyShares(shares []RecoveryShare) []RecoveryShare {
+	if shares == nil {
+		return nil
+	}
+	copied := make([]RecoveryShare, len(shares))
+	for i, share := range shares {
+		copied[i] = share
+		copied[i].Key = copyBytes(share.Key)
+		copied[i].DeviceKeys = copyDeviceKeys(share.DeviceKeys)
+	}
+	return copied
+}
+
+// Copy a file key's device keys so stored file keys don't alias caller memory
+func copyDeviceKeys(keys map[string][]byte) map[string][]byte {
+	if keys == nil {
+		return nil
+	}
+	copied := make(map[string][]byte, len(keys))
+	for device, key := range keys {
+		copied[device] = copyBytes(key)
+	}
+	return copied
+}
+
+// Inserts user into store
+func (s *memoryStore) InsertUser(u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[u.Username]; ok {
+		return errDuplicateUser
+	}
+	id, err := newId()
+	if err != nil {
+		return err
+	}
+	u.Id = id
+	user := *u
+	user.Devices = copyDevices(u.Devices)
+	s.users[u.Username] = user
+	return nil
+}
+
+// Gets a user from the store
+func (s *memoryStore) GetUser(username string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, ok := s.users[username]
+	if !ok {
+		return nil, errUserNotFound
+	}
+	user.Devices = copyDevices(user.Devices)
+	return &user, nil
+}
+
+// Replace an existing user's keys in the store
+func (s *memoryStore) UpdateUser(u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.users[u.Username]
+	if !ok {
+		return errUserNotFound
+	}
+	u.Id = existing.Id
+	user := *u
+	user.Devices = copyDevices(u.Devices)
+	s.users[u.Username] = user
+	return nil
+}
+
+// Inserts file into store, Updates file if it already exists
+func (s *memoryStore) InsertFile(f *File) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := memoryKey(f.Owner, f.Name)
+	if existing, ok := s.files[key]; ok {
+		f.Id = existing.Id
+	} else {
+		id, err := newId()
+		if err != nil {
+			return err
+		}
+		f.Id = id
+	}
+	s.files[key] = copyFile(*f)
+	return nil
+}
+
+// Get a file from store
+func (s *memoryStore) GetFile(owner string, filename string) (*File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	file, ok := s.files[memoryKey(owner, filename)]
+	if !ok {
+		return nil, errFileNotFound
+	}
+	file = copyFile(file)
+	return &file, nil
+}
+
+// Replace a file and its file keys in store under one lock
+func (s *memoryStore) RekeyFile(f *File, filekeys []FileKey, revoked []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.files[memoryKey(f.Owner, f.Name)]
+	if !ok {
+		return errFileNotFound
+	}
+	f.Id = existing.Id
+	for i := range filekeys {
+		key := memoryKey(filekeys[i].Owner, filekeys[i].Name, filekeys[i].User)
+		if existing, ok := s.filekeys[key]; ok {
+			filekeys[i].Id = existing.Id
+		} else {
+			id, err := newId()
+			if err != nil {
+				return err
+			}
+			filekeys[i].Id = id
+		}
+	}
+	s.files[memoryKey(f.Owner, f.Name)] = copyFile(*f)
+	for _, filekey := range filekeys {
+		filekey.Key = copyBytes(filekey.Key)
+		filekey.DeviceKeys = copyDeviceKeys(filekey.DeviceKeys)
+		filekey.Grant = copyGrant(filekey.Grant)
+		s.filekeys[memoryKey(filekey.Owner, filekey.Name, filekey.User)] = filekey
+	}
+	for _, user := range revoked {
+		delete(s.filekeys, memoryKey(f.Owner, f.Name, user))
+	}
+	return nil
+}
+
+// Copy a file so stored files don't alias caller memory
+func copyFile(f File) File {
+	f.Data = copyBytes(f.Data)
+	f.Header = copyBytes(f.Header)
+	f.Manifest = copyManifest(f.Manifest)
+	f.PreviousKey = copyBytes(f.PreviousKey)
+	if f.EpochKeys != nil {
+		epochKeys := make([]EpochKey, len(f.EpochKeys))
+		for i, epochKey := range f.EpochKeys {
+			epochKeys[i] = EpochKey{epochKey.Epoch, copyBytes(epochKey.Key)}
+		}
+		f.EpochKeys = epochKeys
+	}
+	return f
+}
+
+// Keeps a replaced version of a file in store, Updates the version if it is already kept
+func (s *memoryStore) InsertFileVersion(f *File) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := memoryKey(f.Owner, f.Name, strconv.Itoa(f.Version))
+	if existing, ok := s.versions[key]; ok {
+		f.Id = existing.Id
+	} else {
+		id, err := newId()
+		if err != nil {
+			return err
+		}
+		f.Id = id
+	}
+	s.versions[key] = copyFile(*f)
+	return nil
+}
+
+// Get a kept version of a file from store
+func (s *memoryStore) GetFileVersion(owner string, filename string, version int) (*File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	file, ok := s.versions[memoryKey(owner, filename, strconv.Itoa(version))]
+	if !ok {
+		return nil, errVersionNotFound
+	}
+	file = copyFile(file)
+	return &file, nil
+}
+
+// Get the kept versions of a file from store, oldest first
+func (s *memoryStore) GetFileVersions(owner string, filename string) ([]File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	versions := make([]File, 0)
+	for _, file := range s.versions {
+		if file.Owner == owner && file.Name == filename {
+			versions = append(versions, copyFile(file))
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	return versions, nil
+}
+
+// Delete a kept version of a file from store
+func (s *memoryStore) DeleteFileVersion(owner string, filename string, version int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.versions, memoryKey(owner, filename, strconv.Itoa(version)))
+	return nil
+}
+
+// Inserts file chunk into store, Updates file chunk if it already exists
+func (s *memoryStore) InsertFileChunk(c *FileChunk) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := memoryKey(c.Owner, c.Name, c.Session, strconv.Itoa(c.Index))
+	if existing, ok := s.chunks[key]; ok {
+		c.Id = existing.Id
+	} else {
+		id, err := newId()
+		if err != nil {
+			return err
+		}
+		c.Id = id
+	}
+	chunk := *c
+	chunk.Data = copyBytes(c.Data)
+	s.chunks[key] = chunk
+	return nil
+}
+
+// Get file chunk from store
+func (s *memoryStore) GetFileChunk(owner string, filename string, upload string, index int) (*FileChunk, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	chunk, ok := s.chunks[memoryKey(owner, filename, upload, strconv.Itoa(index))]
+	if !ok {
+		return nil, errChunkNotFound
+	}
+	chunk.Data = copyBytes(chunk.Data)
+	return &chunk, nil
+}
+
+// Get the sorted indices of an upload's chunks from store
+func (s *memoryStore) GetFileChunkIndices(owner string, filename string, upload string) ([]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	indices := make([]int, 0)
+	for _, chunk := range s.chunks {
+		if chunk.Owner == owner && chunk.Name == filename && chunk.Session == upload {
+			indices = append(indices, chunk.Index)
+		}
+	}
+	sort.Ints(indices)
+	return indices, nil
+}
+
+// Delete an upload's chunks from store
+func (s *memoryStore) DeleteFileChunks(owner string, filename string, upload string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, chunk := range s.chunks {
+		if chunk.Owner == owner && chunk.Name == filename && chunk.Session == upload {
+			delete(s.chunks, key)
+		}
+	}
+	return nil
+}
+
+// Inserts upload session into store
+func (s *memoryStore) InsertUploadSession(u *UploadSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session := *u
+	session.Header = copyBytes(u.Header)
+	session.Received = nil
+	s.uploads[u.Id] = session
+	return nil
+}
+
+// Get upload session from store
+func (s *memoryStore) GetUploadSession(id string) (*UploadSession, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	session, ok := s.uploads[id]
+	if !ok {
+		return nil, errNoUpload
+	}
+	session.Header = copyBytes(session.Header)
+	return &session, nil
+}
+
+// Delete upload session from store
+func (s *memoryStore) DeleteUploadSession(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.uploads, id)
+	return nil
+}
+
+// Inserts file key into store, Updates file key if it already exists
+func (s *memoryStore) InsertFileKey(f *FileKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := memoryKey(f.Owner, f.Name, f.User)
+	if existing, ok := s.filekeys[key]; ok {
+		f.Id = existing.Id
+	} else {
+		id, err := newId()
+		if err != nil {
+			return err
+		}
+		f.Id = id
+	}
+	filekey := *f
+	filekey.Key = copyBytes(f.Key)
+	filekey.DeviceKeys = copyDeviceKeys(f.DeviceKeys)
+	filekey.Grant = copyGrant(f.Grant)
+	s.filekeys[key] = filekey
+	return nil
+}
+
+// Delete file key from store
+func (s *memoryStore) DeleteFileKey(owner string, filename string, user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.filekeys, memoryKey(owner, filename, user))
+	return nil
+}
+
+// Get file key from store
+func (s *memoryStore) GetFileKey(owner string, filename string, user string) (*FileKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	filekey, ok := s.filekeys[memoryKey(owner, filename, user)]
+	if !ok {
+		return nil, errNoFileAccess
+	}
+	filekey.Key = copyBytes(filekey.Key)
+	filekey.DeviceKeys = copyDeviceKeys(filekey.DeviceKeys)
+	filekey.Grant = copyGrant(filekey.Grant)
+	return &filekey, nil
+}
+
+// Get a slice (array) of users who have keys to the file
+func (s *memoryStore) GetFileUsers(owner string, filename string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := make([]string, 0)
+	for _, filekey := range s.filekeys {
+		if filekey.Owner == owner && filekey.Name == filename {
+			users = append(users, filekey.User)
+		}
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+// Get all file keys shared with a user
+func (s *memoryStore) GetUserFileKeys(user string) ([]FileKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	filekeys := make([]FileKey, 0)
+	for _, filekey := range s.filekeys {
+		if filekey.User == user {
+			filekey.Key = copyBytes(filekey.Key)
+			filekey.DeviceKeys = copyDeviceKeys(filekey.DeviceKeys)
+			filekey.Grant = copyGrant(filekey.Grant)
+			filekeys = append(filekeys, filekey)
+		}
+	}
+	sortFileKeys(filekeys)
+	return filekeys, nil
+}
+
+// Delete the file keys that expired by now and mark their files as needing a rekey
+func (s *memoryStore) PurgeExpiredFileKeys(now time.Time) ([]FileKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	purged := make([]FileKey, 0)
+	for key, filekey := range s.filekeys {
+		if !filekey.expired(now) {
+			continue
+		}
+		delete(s.filekeys, key)
+		purged = append(purged, filekey)
+		fileKey := memoryKey(filekey.Owner, filekey.Name)
+		if file, ok := s.files[fileKey]; ok {
+			file.NeedsRekey = true
+			s.files[fileKey] = file
+		}
+	}
+	sortFileKeys(purged)
+	return purged, nil
+}
+
+// Inserts recovery into store, replacing the user's earlier one
+func (s *memoryStore) InsertRecovery(r *Recovery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.recoveries[r.Username]; ok {
+		r.Id = existing.Id
+	} else {
+		id, err := newId()
+		if err != nil {
+			return err
+		}
+		r.Id = id
+	}
+	recovery := *r
+	recovery.Shares = copyShares(r.Shares)
+	s.recoveries[r.Username] = recovery
+	return nil
+}
+
+// Get a user's recovery from store
+func (s *memoryStore) GetRecovery(username string) (*Recovery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	recovery, ok := s.recoveries[username]
+	if !ok {
+		return nil, errRecoveryNotFound
+	}
+	recovery.Shares = copyShares(recovery.Shares)
+	return &recovery, nil
+}
+
+// Appends entry to the key log
+func (s *memoryStore) InsertLogEntry(entry *LogEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	logged := *entry
+	logged.Devices = append([]LogDevice(nil), entry.Devices...)
+	s.log = append(s.log, logged)
+	return nil
+}
+
+// Get all key log entries from store
+func (s *memoryStore) GetLogEntries() ([]LogEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append(make([]LogEntry, 0, len(s.log)), s.log...), nil
+}
+
+// Nothing to close for the in-memory store
+func (s *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// How long a recovery request waits for trustees to approve it
+const recoveryLifetime = 72 * time.Hour
+
+// Most trustees a user can split their recovery key between, share indices are a single byte
+const maxTrustees = 255
+
+var errNoRecoveryRequest = errors.New("Recovery request does not exist or has expired")
+
+// Recovery Struct, a user's recovery key split between trusted users
+// Each share is encrypted for each of its trustee's devices like a file key,
+// any Threshold of them rebuild the key of the user's recovery device
+type Recovery struct {
+	Id        string          `gorethink:"id,omitempty"`
+	Username  string          `gorethink:"username"`
+	Threshold int             `gorethink:"threshold"`
+	Shares    []RecoveryShare `gorethink:"shares"`
+}
+
+// Recovery Share Struct, one trustee's share of a recovery key
+type RecoveryShare struct {
+	Trustee    string            `gorethink:"trustee"`
+	Key        []byte            `gorethink:"key"`
+	DeviceKeys map[string][]byte `gorethink:"devicekeys"`
+}
+
+// Recovery Request Struct, a new device of a user who lost their keys asking trustees for their shares
+// Approvals holds each approving trustee's share encrypted to the new device's key
+type RecoveryRequest struct {
+	Id        string
+	Username  string
+	Device    string
+	Keys      KeySet
+	Expires   time.Time
+	Approvals map[string][]byte `json:"-"`
+}
+
+// Recovery request as shown to a trustee, with the trustee's own share
+type TrusteeRequest struct {
+	Id       string
+	Username string
+	Device   string
+	Keys     KeySet
+	Expires  time.Time
+	Share    RecoveryShare
+}
+
+// Trustee's Recovery Requests Struct
+type TrusteeRequests struct {
+	Requests []TrusteeRequest
+}
+
+// Recovery Approval Struct, a trustee's share re-encrypted to the new device's key
+type RecoveryApproval struct {
+	Trustee string
+	Request string
+	Share   []byte
+}
+
+// Recovery Shares Struct, the approved shares of a recovery request
+type RecoveryShares struct {
+	Username  string
+	Request   string
+	Threshold int
+	Shares    [][]byte
+}
+
+// Recovery requests waiting for approval
+var recoveryRequests = newRecoveryCache()
+
+type recoveryCache struct {
+	mu      sync.Mutex
+	entries map[string]*RecoveryRequest
+}
+
+func newRecoveryCache() *recoveryCache {
+	return &recoveryCache{entries: make(map[string]*RecoveryRequest)}
+}
+
+// Add a recovery request, removing expired ones
+func (c *recoveryCache) Add(r *RecoveryRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for id, entry := range c.entries {
+		if entry.Expires.Before(now) {
+			delete(c.entries, id)
+		}
+	}
+	c.entries[r.Id] = r
+}
+
+// Get a copy of a recovery request, returns false if it is unknown or expired
+func (c *recoveryCache) Get(id string) (RecoveryRequest, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, ok := c.entries[id]
+	if !ok || r.Expires.Before(time.Now()) {
+		return RecoveryRequest{}, false
+	}
+	request := *r
+	request.Approvals = make(map[string][]byte)
+	for trustee, share := range r.Approvals {
+		request.Approvals[trustee] = share
+	}
+	return request, true
+}
+
+// Record a trustee's approval of a recovery request
+func (c *recoveryCache) Approve(id string, trustee string, share []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, ok := c.entries[id]
+	if !ok || r.Expires.Before(time.Now()) {
+		return errNoRecoveryRequest
+	}
+	r.Approvals[trustee] = share
+	return nil
+}
+
+// Get copies of the pending recovery requests
+func (c *recoveryCache) Pending() []RecoveryRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending := make([]RecoveryRequest, 0)
+	now := time.Now()
+	for _, r := range c.entries {
+		if !r.Expires.Before(now) {
+			pending = append(pending, *r)
+		}
+	}
+	return pending
+}
+
+// Check and store a user's recovery shares, replacing any earlier ones
+// The caller must have checked the request was signed by one of the user's devices
+func (r *Recovery) Insert(store Store) error {
+	if len(r.Shares) == 0 || len(r.Shares) > maxTrustees {
+		return errors.New("Recovery needs between 1 and 255 trustees")
+	}
+	if r.Threshold < 1 || r.Threshold > len(r.Shares) {
+		return errors.New("Recovery threshold must be between 1 and the number of trustees")
+	}
+	trustees := make(map[string]bool)
+	for _, share := range r.Shares {
+		if share.Trustee == r.Username {
+			return errors.New("Users can't be their own trustee")
+		}
+		if trustees[share.Trustee] {
+			return errors.New("Duplicate trustee: " + share.Trustee)
+		}
+		trustees[share.Trustee] = true
+		trustee, err := GetUser(share.Trustee, store)
+		if err != nil {
+			return err
+		}
+		err = checkDeviceKeys(trustee, share.DeviceKeys)
+		if err != nil {
+			return err
+		}
+	}
+	return store.InsertRecovery(r)
+}
+
+// Get the share a trustee holds, nil if they aren't one of the recovery's trustees
+func (r *Recovery) Share(trustee string) *RecoveryShare {
+	for i := range r.Shares {
+		if r.Shares[i].Trustee == trustee {
+			return &r.Shares[i]
+		}
+	}
+	return nil
+}
+
+// Check a new device's recovery request and keep it until enough trustees approve it
+// The caller must have checked the request was signed with the new device's key
+func (r *RecoveryRequest) Submit(store Store) error {
+	user, err := GetUser(r.Username, store)
+	if err != nil {
+		return err
+	}
+	_, err = store.GetRecovery(r.Username)
+	if err != nil {
+		return err
+	}
+	if user.Device(r.Device) != nil {
+		return errors.New("Device already exists: " + r.Device)
+	}
+	err = r.Keys.validate()
+	if err != nil {
+		return err
+	}
+	b := make([]byte, 8)
+	if _, err = rand.Read(b); err != nil {
+		return err
+	}
+	r.Id = hex.EncodeToString(b)
+	r.Expires = time.Now().Add(recoveryLifetime)
+	r.Approvals = make(map[string][]byte)
+	recoveryRequests.Add(r)
+	return nil
+}
+
+// Get the pending recovery requests a user holds a share for
+func GetTrusteeRequests(trustee string, store Store) (*TrusteeRequests, error) {
+	requests := make([]TrusteeRequest, 0)
+	for _, r := range recoveryRequests.Pending() {
+		recovery, err := store.GetRecovery(r.Username)
+		if err == errRecoveryNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		share := recovery.Share(trustee)
+		if share == nil {
+			continue
+		}
+		requests = append(requests, TrusteeRequest{r.Id, r.Username, r.Device, r.Keys, r.Expires, *share})
+	}
+	return &TrusteeRequests{requests}, nil
+}
+
+// Record a trustee's approval of a recovery request
+// The caller must have authenticated the trustee
+func (a *RecoveryApproval) Approve(store Store) error {
+	request, ok := recoveryRequests.Get(a.Request)
+	if !ok {
+		return errNoRecoveryRequest
+	}
+	recovery, err := store.GetRecovery(request.Username)
+	if err != nil {
+		return err
+	}
+	if recovery.Share(a.Trustee) == nil {
+		return errors.New("You are not a trustee of " + request.Username)
+	}
+	if len(a.Share) == 0 {
+		return errors.New("Recovery share can't be empty")
+	}
+	return recoveryRequests.Approve(a.Request, a.Trustee, a.Share)
+}
+
+// Fill in the threshold and the shares trustees have approved so far
+// The caller must have checked the request was signed with the new device's key
+func (s *RecoveryShares) Collect(store Store) error {
+	request, ok := recoveryRequests.Get(s.Request)
+	if !ok || request.Username != s.Username {
+		return errNoRecoveryRequest
+	}
+	recovery, err := store.GetRecovery(s.Username)
+	if err != nil {
+		return err
+	}
+	s.Threshold = recovery.Threshold
+	s.Shares = make([][]byte, 0, len(request.Approvals))
+	for _, share := range request.Approvals {
+		s.Shares = append(s.Shares, share)
+	}
+	return nil
+}
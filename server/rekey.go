@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Rekeys, new versions and the expiry purge change files one at a time, so two rekeys can't both pass
+// the check of the file's keys and a version can't undo a change to the file it wasn't checked against
+var rekeyMu sync.Mutex
+
+// Rekey Struct, moves a file to a new key epoch with a new shared secret in one request
+// FileKeys is the complete new set of file keys and Revoked the users who lose access.
+// Upload is a completed but uncommitted upload session holding the file encrypted with the new secret,
+// without one the file keeps its data and is left pending re-encryption, EpochKey then holds
+// the current secret encrypted with the new one so readers can still decrypt it
+type Rekey struct {
+	Owner       string
+	Name        string
+	Upload      string
+	Manifest    *Manifest
+	PreviousKey []byte
+	EpochKey    []byte
+	FileKeys    []FileKey
+	Revoked     []string
+}
+
+// Check the rekey and apply it, the file and its keys are replaced together
+// The caller must have checked the request was signed by the owner or a manager
+func (r *Rekey) Apply(store Store) error {
+	rekeyMu.Lock()
+	defer rekeyMu.Unlock()
+	current, err := store.GetFile(r.Owner, r.Name)
+	if err != nil {
+		return err
+	}
+	epoch := current.KeyEpoch + 1
+	err = r.checkFileKeys(epoch, store)
+	if err != nil {
+		return err
+	}
+	if r.Upload == "" {
+		return r.applyLazy(current, store)
+	}
+	session, err := GetUploadSession(r.Upload, store)
+	if err != nil {
+		return err
+	}
+	if session.Owner != r.Owner || session.Name != r.Name {
+		return errors.New("Upload does not belong to this file")
+	}
+	if len(session.Received) != session.Chunks {
+		return fmt.Errorf("Upload is incomplete: received %d of %d chunks", len(session.Received), session.Chunks)
+	}
+	if session.Epoch != epoch {
+		return fmt.Errorf("Upload must be encrypted with the new file key of epoch %d", epoch)
+	}
+	file := &File{Owner: r.Owner, Name: r.Name, Header: session.Header, Chunks: session.Chunks, Session: session.Id,
+		Manifest: r.Manifest, PreviousKey: r.PreviousKey, Epoch: session.Epoch}
+	err = file.prepare(current, store)
+	if err != nil {
+		return err
+	}
+	err = archiveFile(current, store)
+	if err != nil {
+		return err
+	}
+	err = store.RekeyFile(file, r.FileKeys, r.Revoked)
+	if err != nil {
+		return err
+	}
+	return store.DeleteUploadSession(session.Id)
+}
+
+// Give the file keys of the new epoch out without re-encrypting the file, it is re-encrypted with its next upload
+// Until then the data stays under the old epoch, which the revoked users may still have the secret of
+func (r *Rekey) applyLazy(file *File, store Store) error {
+	if len(r.EpochKey) == 0 {
+		return errors.New("Rekey needs an upload or the current key encrypted with the new one")
+	}
+	file.KeyEpoch++
+	file.EpochKeys = append(file.EpochKeys, EpochKey{file.KeyEpoch, r.EpochKey})
+	file.Pending = true
+	file.NeedsRekey = false
+	return store.RekeyFile(file, r.FileKeys, r.Revoked)
+}
+
+// Check the new file keys are for exactly the file's owner and current users except the revoked ones,
+// each encrypted for all of its user's devices and in the new key epoch. Users keep their roles, expiry and grants.
+// Users whose shares expired but aren't purged yet are revoked along with them
+func (r *Rekey) checkFileKeys(epoch int, store Store) error {
+	users, err := store.GetFileUsers(r.Owner, r.Name)
+	if err != nil {
+		return err
+	}
+	// The owner always keeps a key
+	remaining := map[string]bool{r.Owner: true}
+	var expired []string
+	for _, user := range users {
+		_, err = GetFileKey(r.Owner, r.Name, user, store)
+		if err == errShareExpired {
+			expired = append(expired, user)
+			continue
+		}
+		if err != nil && err != errNoFileAccess {
+			return err
+		}
+		remaining[user] = true
+	}
+	for _, user := range r.Revoked {
+		if user == r.Owner {
+			return errors.New("Can't revoke own file access")
+		}
+		if !remaining[user] {
+			return fmt.Errorf("%s does not have access to this file", user)
+		}
+		delete(remaining, user)
+	}
+	r.Revoked = append(r.Revoked, expired...)
+	for i := range r.FileKeys {
+		filekey := &r.FileKeys[i]
+		if filekey.Owner != r.Owner || filekey.Name != r.Name {
+			return errors.New("File key does not match file")
+		}
+		if !remaining[filekey.User] {
+			return fmt.Errorf("Unexpected file key for %s", filekey.User)
+		}
+		if filekey.Epoch != epoch {
+			return fmt.Errorf("File keys must be for the new key epoch %d", epoch)
+		}
+		current, err := store.GetFileKey(r.Owner, r.Name, filekey.User)
+		if err != nil && err != errNoFileAccess {
+			return err
+		}
+		filekey.Role = ""
+		filekey.Expires = time.Time{}
+		filekey.Grant = nil
+		if current != nil {
+			filekey.Role = current.Role
+			filekey.Expires = current.Expires
+			filekey.Grant = current.Grant
+		}
+		user, err := GetUser(filekey.User, store)
+		if err != nil {
+			return err
+		}
+		err = filekey.checkDevices(user)
+		if err != nil {
+			return err
+		}
+		delete(remaining, filekey.User)
+	}
+	if len(remaining) != 0 {
+		return errFileKeysChanged
+	}
+	return nil
+}
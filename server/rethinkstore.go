@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"log"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+)
+
+// DB tables
+var userTable r.Term = r.Table("users")
+var fileTable r.Term = r.Table("files")
+var fileKeyTable r.Term = r.Table("filekeys")
+var fileChunkTable r.Term = r.Table("filechunks")
+var uploadTable r.Term = r.Table("uploads")
+var recoveryTable r.Term = r.Table("recoveries")
+var logTable r.Term = r.Table("log")
+var versionTable r.Term = r.Table("versions")
+
+// RethinkDB storage backend
+type rethinkStore struct {
+	session *r.Session
+}
+
+// User as stored in RethinkDB, the legacy RSA public key is gob encoded
+type dbUser struct {
+	Id       string   `gorethink:"id,omitempty"`
+	Username string   `gorethink:"username"`
+	PubKey   []byte   `gorethink:"pubkey"`
+	Keys     KeySet   `gorethink:"keys"`
+	Devices  []Device `gorethink:"devices"`
+}
+
+// Connect to RethinkDB
+func newRethinkStore(host string) (*rethinkStore, error) {
+	session, err := r.Connect(r.ConnectOpts{
+		Address:  host + ":28015",
+		Database: "Lab2",
+		MaxIdle:  10,
+		MaxOpen:  10,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rethinkStore{session}, nil
+}
+
+// Inserts user into DB
+func (s *rethinkStore) InsertUser(u *User) error {
+	res, err := userTable.GetAllByIndex("username", u.Username).Run(s.session)
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+	if !res.IsNil() {
+		return errDuplicateUser
+	}
+	user, err := newDBUser(u)
+	if err != nil {
+		return err
+	}
+	_, err = userTable.Insert(user).RunWrite(s.session)
+	return err
+}
+
+// Replace an existing user's keys and devices in the DB
+func (s *rethinkStore) UpdateUser(u *User) error {
+	user, err := newDBUser(u)
+	if err != nil {
+		return err
+	}
+	res, err := userTable.GetAllByIndex("username", u.Username).Update(map[string]interface{}{"pubkey": user.PubKey, "keys": user.Keys, "devices": user.Devices}).RunWrite(s.session)
+	if err != nil {
+		return err
+	}
+	if res.Replaced == 0 && res.Unchanged == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+// Convert a user to its DB form, gob encoding the legacy public key
+func newDBUser(u *User) (user dbUser, err error) {
+	user.Id = u.Id
+	user.Username = u.Username
+	user.Keys = u.Keys
+	user.Devices = u.Devices
+	if u.PubKey != nil {
+		var pubKey bytes.Buffer
+		enc := gob.NewEncoder(&pubKey)
+		err = enc.Encode(u.PubKey)
+		if err != nil {
+			return
+		}
+		user.PubKey = pubKey.Bytes()
+	}
+	return
+}
+
+// Gets a user from the DB
+func (s *rethinkStore) GetUser(username string) (user *User, err error) {
+	res, err := userTable.GetAllByIndex("username", username).Run(s.session)
+	if err != nil {
+		return
+	}
+	defer res.Close()
+	if res.IsNil() {
+		err = errUserNotFound
+		return
+	}
+	u := new(dbUser)
+	err = res.One(&u)
+	if err != nil {
+		return
+	}
+	user = new(User)
+	user.Id = u.Id
+	user.Username = u.Username
+	user.Keys = u.Keys
+	user.Devices = u.Devices
+	if len(u.PubKey) > 0 {
+		pubKey := bytes.NewBuffer(u.PubKey)
+		dec := gob.NewDecoder(pubKey)
+		err = dec.Decode(&user.PubKey)
+	}
+	return
+}
+
+// Inserts file into DB, Updates file if it already exists
+func (s *rethinkStore) InsertFile(f *File) error {
+	dbRes, err := fileTable.GetAllByIndex("name", f.Name).Filter(map[string]interface{}{"owner": f.Owner}).Run(s.session)
+	if err != nil {
+		return err
+	}
+	defer dbRes.Close()
+	if !dbRes.IsNil() {
+		file := new(File)
+		err = dbRes.One(&file)
+		if err != nil {
+			return err
+		}
+		f.Id = file.Id
+		_, err = fileTable.Get(f.Id).Update(f).RunWrite(s.session)
+		return err
+	}
+	_, err = fileTable.Insert(f).RunWrite(s.session)
+	return err
+}
+
+// Get a file from DB
+func (s *rethinkStore) GetFile(owner string, filename string) (file *File, err error) {
+	res, err := fileTable.GetAllByIndex("name", filename).Filter(map[string]interface{}{"owner": owner}).Run(s.session)
+	if err != nil {
+		return
+	}
+	defer res.Close()
+	if res.IsNil() {
+		err = errFileNotFound
+		return
+	}
+	file = new(File)
+	err = res.One(&file)
+	return
+}
+
+// Replace a file and its file keys in DB
+// RethinkDB has no transactions across documents, so the file's key epoch points to the file keys in use.
+// The new keys are staged under the new epoch, then the file is moved to it in a single write, which is when
+// readers switch to them and the revoked users lose access. Keys of other epochs are deleted last,
+// a failure part way leaves keys that are never used
+func (s *rethinkStore) RekeyFile(f *File, filekeys []FileKey, revoked []string) error {
+	// Keys staged by an earlier rekey that failed before moving the file may include revoked users
+	_, err := fileKeyTable.GetAllByIndex("name", f.Name).Filter(map[string]interface{}{"owner": f.Owner, "epoch": f.KeyEpoch}).Delete().RunWrite(s.session)
+	if err != nil {
+		return err
+	}
+	for i := range filekeys {
+		_, err = fileKeyTable.Insert(&filekeys[i]).RunWrite(s.session)
+		if err != nil {
+			return err
+		}
+	}
+	err = s.InsertFile(f)
+	if err != nil {
+		return err
+	}
+	// The rekey has taken effect, so failing to clean up is only logged
+	_, err = fileKeyTable.GetAllByIndex("name", f.Name).Filter(map[string]interface{}{"owner": f.Owner}).Filter(r.Row.Field("epoch").Ne(f.KeyEpoch)).Delete().RunWrite(s.session)
+	if err != nil {
+		log.Printf("Couldn't delete the old file keys of %s/%s: %s\n", f.Owner, f.Name, err.Error())
+	}
+	return nil
+}
+
+// Keeps a replaced version of a file in DB, Updates the version if it is already kept
+func (s *rethinkStore) InsertFileVersion(f *File) error {
+	dbRes, err := versionTable.GetAllByIndex("name", f.Name).Filter(map[string]interface{}{"owner": f.Owner, "version": f.Version}).Run(s.session)
+	if err != nil {
+		return err
+	}
+	defer dbRes.Close()
+	if !dbRes.IsNil() {
+		file := new(File)
+		err = dbRes.One(&file)
+		if err != nil {
+			return err
+		}
+		f.Id = file.Id
+		_, err = versionTable.Get(f.Id).Update(f).RunWrite(s.session)
+		return err
+	}
+	_, err = versionTable.Insert(f).RunWrite(s.session)
+	return err
+}
+
+// Get a kept version of a file from DB
+func (s *rethinkStore) GetFileVersion(owner string, filename string, version int) (file *File, err error) {
+	res, err := versionTable.GetAllByIndex("name", filename).Filter(map[string]interface{}{"owner": owner, "version": version}).Run(s.session)
+	if err != nil {
+		return
+	}
+	defer res.Close()
+	if res.IsNil() {
+		err = errVersionNotFound
+		return
+	}
+	file = new(File)
+	err = res.One(&file)
+	return
+}
+
+// Get the kept versions of a file from DB, oldest first
+func (s *rethinkStore) GetFileVersions(owner string, filename string) (versions []File, err error) {
+	res, err := versionTable.GetAllByIndex("name", filename).Filter(map[string]interface{}{"owner": owner}).OrderBy("version").Run(s.session)
+	if err != nil {
+		return
+	}
+	defer res.Close()
+	versions = make([]File, 0)
+	err = res.All(&versions)
+	return
+}
+
+// Delete a kept version of a file from DB
+func (s *rethinkStore) DeleteFileVersion(owner string, filename string, version int) error {
+	_, err := versionTable.GetAllByIndex("name", filename).Filter(map[string]interface{}{"owner": owner, "version": version}).Delete().RunWrite(s.session)
+	return err
+}
+
+// Inserts file chunk into DB, Updates file chunk if it already exists
+func (s *rethinkStore) InsertFileChunk(c *FileChunk) error {
+	dbRes, err := fileChunkTable.GetAllByIndex("name", c.Name).Filter(map[string]interface{}{"owner": c.Owner, "session": c.Session, "index": c.Index}).Run(s.session)
+	if err != nil {
+		return err
+	}
+	defer dbRes.Close()
+	if !dbRes.IsNil() {
+		chunk := new(FileChunk)
+		err = dbRes.One(&chunk)
+		if err != nil {
+			return err
+		}
+		c.Id = chunk.Id
+		_, err = fileChunkTable.Get(c.Id).Update(c).RunWrite(s.session)
+		return err
+	}
+	_, err = fileChunkTable.Insert(c).RunWrite(s.session)
+	return err
+}
+
+// Get file chunk from DB
+func (s *rethinkStore) GetFileChunk(owner string, filename string, upload string, index int) (chunk *FileChunk, err error) {
+	res, err := fileChunkTable.GetAllByIndex("name", filename).Filter(map[string]interface{}{"owner": owner, "session": upload, "index": index}).Run(s.session)
+	if err != nil {
+		return
+	}
+	defer res.Close()
+	if res.IsNil() {
+		err = errChunkNotFound
+		return
+	}
+	chunk = new(FileChunk)
+	err = res.One(&chunk)
+	return
+}
+
+// Get the sorted indices of an upload's chunks from DB
+func (s *rethinkStore) GetFileChunkIndices(owner string, filename string, upload string) (indices []int, err error) {
+	res, err := fileChunkTable.GetAllByIndex("name", filename).Filter(map[string]interface{}{"owner": owner, "session": upload}).OrderBy("index").Pluck("index").Run(s.session)
+	if err != nil {
+		return
+	}
+	defer res.Close()
+	var indexMap []map[string]int
+	err = res.All(&indexMap)
+	if err != nil {
+		return
+	}
+	indices = make([]int, 0, len(indexMap))
+	for _, index := range indexMap {
+		indices = append(indices, index["index"])
+	}
+	return
+}
+
+// Delete an upload's chunks from DB
+func (s *rethinkStore) DeleteFileChunks(owner string, filename string, upload string) error {
+	_, err := fileChunkTable.GetAllByIndex("name", filename).Filter(map[string]interface{}{"owner": owner, "session": upload}).Delete().RunWrite(s.session)
+	return err
+}
+
+// Inserts upload session into DB
+func (s *rethinkStore) InsertUploadSession(u *UploadSession) error {
+	_, err := uploadTable.Insert(u).RunWrite(s.session)
+	return err
+}
+
+// Get upload session from DB
+func (s *rethinkStore) GetUploadSession(id string) (session *UploadSession, err error) {
+	res, err := uploadTable.Get(id).Run(s.session)
+	if err != nil {
+		return
+	}
+	defer res.Close()
+	if res.IsNil() {
+		err = errNoUpload
+		return
+	}
+	session = new(UploadSession)
+	err = res.One(&session)
+	return
+}
+
+// Delete upload session from DB
+func (s *rethinkStore) DeleteUploadSession(id string) error {
+	_, err := uploadTable.Get(id).Delete().RunWrite(s.session)
+	return err
+}
+
+// Filter selecting the file keys of a file that are in use, those of the file's key epoch
+// Keys of other epochs are left over from a rekey that failed part way, see RekeyFile
+func (s *rethinkStore) fileKeyFilter(owner string, filename string) (map[string]interface{}, error) {
+	filter := map[string]interface{}{"owner": owner}
+	file, err := s.GetFile(owner, filename)
+	if err == errFileNotFound {
+		return filter, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	filter["epoch"] = file.KeyEpoch
+	return filter, nil
+}
+
+// Inserts file key into DB, Updates file key if it already exists
+func (s *rethinkStore) InsertFileKey(f *FileKey) error {
+	dbRes, err := fileKeyTable.GetAllByIndex("name", f.Name).Filter(map[string]interface{}{"owner": f.Owner, "user": f.User, "epoch": f.Epoch}).Run(s.session)
+	if err != nil {
+		return err
+	}
+	defer dbRes.Close()
+	if !dbRes.IsNil() {
+		filekey := new(FileKey)
+		err = dbRes.One(&filekey)
+		if err != nil {
+			return err
+		}
+		f.Id = filekey.Id
+		_, err = fileKeyTable.Get(f.Id).Update(f).RunWrite(s.session)
+		return err
+	}
+	_, err = fileKeyTable.Insert(f).RunWrite(s.session)
+	return err
+}
+
+// Delete file key from DB
+func (s *rethinkStore) DeleteFileKey(owner string, filename string, user string) error {
+	_, err := fileKeyTable.GetAllByIndex("name", filename).Filter(map[string]interface{}{"owner": owner, "user": user}).Delete().RunWrite(s.session)
+	return err
+}
+
+// Get file key from DB
+func (s *rethinkStore) GetFileKey(owner string, filename string, user string) (filekey *FileKey, err error) {
+	filter, err := s.fileKeyFilter(owner, filename)
+	if err != nil {
+		return
+	}
+	filter["user"] = user
+	res, err := fileKeyTable.GetAllByIndex("name", filename).Filter(filter).Run(s.session)
+	if err != nil {
+		return
+	}
+	defer res.Close()
+	if res.IsNil() {
+		err = errNoFileAccess
+		return
+	}
+	filekey = new(FileKey)
+	err = res.One(&filekey)
+	return
+}
+
+// Get a slice (array) of users who have keys to the file
+func (s *rethinkStore) GetFileUsers(owner string, filename string) (users []string, err error) {
+	filter, err := s.fileKeyFilter(owner, filename)
+	if err != nil {
+		return
+	}
+	res, err := fileKeyTable.GetAllByIndex("name", filename).Filter(filter).Pluck("user").Run(s.session)
+	if err != nil {
+		return
+	}
+	defer res.Close()
+	var userMap []map[string]string
+	err = res.All(&userMap)
+	if err != nil {
+		return
+	}
+	users = make([]string, 0, len(userMap))
+	for _, user := range userMap {
+		users = append(users, user["user"])
+	}
+	return
+}
+
+// Get all file keys shared with a user
+func (s *rethinkStore) GetUserFileKeys(user string) (filekeys []FileKey, err error) {
+	res, err := fileKeyTable.GetAllByIndex("user", user).Run(s.session)
+	if err != nil {
+		return
+	}
+	defer res.Close()
+	all := make([]FileKey, 0)
+	err = res.All(&all)
+	if err != nil {
+		return
+	}
+	filekeys = make([]FileKey, 0, len(all))
+	for _, filekey := range all {
+		file, err := s.GetFile(filekey.Owner, filekey.Name)
+		if err != nil && err != errFileNotFound {
+			return nil, err
+		}
+		if file == nil || file.KeyEpoch == filekey.Epoch {
+			filekeys = append(filekeys, filekey)
+		}
+	}
+	sortFileKeys(filekeys)
+	return
+}
+
+// Delete the file keys that expired by now and mark their files as needing a rekey
+// Files are marked before their keys are deleted, so a failure part way never loses a needed rekey
+func (s *rethinkStore) PurgeExpiredFileKeys(now time.Time) (filekeys []FileKey, err error) {
+	res, err := fileKeyTable.Filter(r.Row.Field("expires").Gt(time.Time{}).And(r.Row.Field("expires").Le(now))).Run(s.session)
+	if err != nil {
+		return
+	}
+	defer res.Close()
+	filekeys = make([]FileKey, 0)
+	err = res.All(&filekeys)
+	if err != nil {
+		return
+	}
+	for _, filekey := range filekeys {
+		_, err = fileTable.GetAllByIndex("name", filekey.Name).Filter(map[string]interface{}{"owner": filekey.Owner}).Update(map[string]interface{}{"needsrekey": true}).RunWrite(s.session)
+		if err != nil {
+			return
+		}
+		err = s.DeleteFileKey(filekey.Owner, filekey.Name, filekey.User)
+		if err != nil {
+			return
+		}
+	}
+	sortFileKeys(filekeys)
+	return
+}
+
+// Inserts recovery into DB, replacing the user's earlier one
+func (s *rethinkStore) InsertRecovery(recovery *Recovery) error {
+	res, err := recoveryTable.GetAllByIndex("username", recovery.Username).Run(s.session)
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+	if !res.IsNil() {
+		existing := new(Recovery)
+		err = res.One(&existing)
+		if err != nil {
+			return err
+		}
+		recovery.Id = existing.Id
+		_, err = recoveryTable.Get(recovery.Id).Replace(recovery).RunWrite(s.session)
+		return err
+	}
+	_, err = recoveryTable.Insert(recovery).RunWrite(s.session)
+	return err
+}
+
+// Get a user's recovery from DB
+func (s *rethinkStore) GetRecovery(username string) (recovery *Recovery, err error) {
+	res, err := recoveryTable.GetAllByIndex("username", username).Run(s.session)
+	if err != nil {
+		return
+	}
+	defer res.Close()
+	if res.IsNil() {
+		err = errRecoveryNotFound
+		return
+	}
+	recovery = new(Recovery)
+	err = res.One(&recovery)
+	return
+}
+
+// Appends entry to the key log in DB, the entry's index is its primary key
+func (s *rethinkStore) InsertLogEntry(entry *LogEntry) error {
+	_, err := logTable.Insert(entry).RunWrite(s.session)
+	return err
+}
+
+// Get all key log entries from DB
+func (s *rethinkStore) GetLogEntries() (entries []LogEntry, err error) {
+	res, err := logTable.OrderBy(r.Asc("id")).Run(s.session)
+	if err != nil {
+		return
+	}
+	defer res.Close()
+	entries = make([]LogEntry, 0)
+	err = res.All(&entries)
+	return
+}
+
+// Close DB connection
+func (s *rethinkStore) Close() error {
+	return s.session.Close()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+// Key Rotation Struct, replaces the keys of one of the user's devices
+// FileKeys carries the user's file keys re-encrypted for the new set of device keys
+// Manifests carries the manifests of the user's files the device signed, signed again with the new key
+// Grants carries the grants the device signed, see GetUserGrants, signed again the same way
+// Signature is made with the new signing key, proving the user holds it
+type KeyRotation struct {
+	Username  string
+	Device    string
+	Keys      KeySet
+	FileKeys  []FileKey
+	Manifests []Manifest
+	Grants    []Grant
+	Signature []byte
+}
+
+// Data covered by the new key's signature, must match the client's
+type rotationData struct {
+	Username string
+	Device   string
+	Keys     KeySet
+}
+
+// User's File Keys Struct
+type UserFileKeys struct {
+	FileKeys []FileKey
+}
+
+// Replace a device's keys and every file key shared with the user, retiring the old keys
+// The caller must have checked the request was signed with the device's old key
+func (k *KeyRotation) Rotate(store Store) error {
+	user, err := GetUser(k.Username, store)
+	if err != nil {
+		return err
+	}
+	device := user.Device(k.Device)
+	if device == nil {
+		return errDeviceNotFound
+	}
+	if k.Keys.Signing.Algorithm == device.Keys.Signing.Algorithm && bytes.Equal(k.Keys.Signing.Key, device.Keys.Signing.Key) {
+		return errors.New("New signing key is the same as the old one")
+	}
+	device.Keys = k.Keys
+	err = user.setDevices(user.Devices)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(rotationData{k.Username, k.Device, k.Keys})
+	if err != nil {
+		return err
+	}
+	if !verify(k.Keys.Signing, data, k.Signature) {
+		return errors.New("Could not verify new key signature")
+	}
+	// Rekeys and new versions change files and their keys under rekeyMu, so the ones checked are the ones replaced
+	rekeyMu.Lock()
+	defer rekeyMu.Unlock()
+	// Every file key must be replaced, or the user would lose access to the files left out
+	err = checkFileKeys(user, k.FileKeys, store)
+	if err != nil {
+		return err
+	}
+	files, err := checkManifests(user, k.Device, k.Manifests, store)
+	if err != nil {
+		return err
+	}
+	grants, err := checkGrants(user, k.Device, k.Grants, store)
+	if err != nil {
+		return err
+	}
+	err = replaceFileKeys(k.FileKeys, store)
+	if err != nil {
+		return err
+	}
+	err = replaceManifests(files, store)
+	if err != nil {
+		return err
+	}
+	err = replaceGrants(user.Username, k.Device, grants, store)
+	if err != nil {
+		return err
+	}
+	err = keyLog.Write(user, store.UpdateUser)
+	if err != nil {
+		return err
+	}
+	// Sessions opened with the old key end with it
+	tokens.RemoveUser(k.Username)
+	return nil
+}
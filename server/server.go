@@ -1,65 +1,163 @@
 package main
 
 import (
+	"crypto/tls"
 	"log"
 	"net/http"
+	"time"
 
-	r "github.com/dancannon/gorethink"
 	"github.com/julienschmidt/httprouter"
 	"github.com/spf13/viper"
 	ren "github.com/unrolled/render"
 )
 
 // Global Variables
-var dbSession *r.Session
+var store Store
 var render *ren.Render = ren.New(ren.Options{StreamingJSON: true})
-var DBHost, Port string
+var Storage, DBHost, DBPath, Port string
+var TLS, GenerateCert bool
+var TLSCert, TLSKey, ClientCerts string
+var TLSHosts []string
+var LogKeyPath string
+var KeepVersions int
+var PurgeInterval time.Duration
 
 // Initialize server settings
 func init() {
-	var err error
-	// Initialize DB connection
-	dbSession, err = r.Connect(r.ConnectOpts{
-		Address:  DBHost + ":28015",
-		Database: "Lab2",
-		MaxIdle:  10,
-		MaxOpen:  10,
-	})
-	if err != nil {
-		log.Fatalln(err.Error())
-	}
 	// Initialize config
+	viper.SetDefault("Storage", "rethinkdb")
 	viper.SetDefault("DBHost", "127.0.0.1")
+	viper.SetDefault("DBPath", "lab2.db")
 	viper.SetDefault("Port", "3000")
+	viper.SetDefault("TLS", true)
+	viper.SetDefault("TLSCert", "cert.pem")
+	viper.SetDefault("TLSKey", "key.pem")
+	viper.SetDefault("GenerateCert", false)
+	viper.SetDefault("TLSHosts", []string{"localhost", "127.0.0.1"})
+	viper.SetDefault("ClientCerts", "none")
+	viper.SetDefault("LogKey", "logkey.pem")
+	viper.SetDefault("KeepVersions", 10)
+	viper.SetDefault("PurgeInterval", "1m")
 	viper.SetConfigName("config")
 	viper.AddConfigPath(".")
 	viper.SetConfigType("toml")
-	err = viper.ReadInConfig()
+	err := viper.ReadInConfig()
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
+	Storage = viper.GetString("Storage")
 	DBHost = viper.GetString("DBHost")
+	DBPath = viper.GetString("DBPath")
 	Port = viper.GetString("Port")
+	TLS = viper.GetBool("TLS")
+	TLSCert = viper.GetString("TLSCert")
+	TLSKey = viper.GetString("TLSKey")
+	GenerateCert = viper.GetBool("GenerateCert")
+	TLSHosts = viper.GetStringSlice("TLSHosts")
+	ClientCerts = viper.GetString("ClientCerts")
+	LogKeyPath = viper.GetString("LogKey")
+	KeepVersions = viper.GetInt("KeepVersions")
+	PurgeInterval = viper.GetDuration("PurgeInterval")
 }
 
-// Main function, initialize routes and start server
-func main() {
+// Create router with all server routes
+func newRouter() *httprouter.Router {
 	router := httprouter.New()
 	router.POST("/register", register)
+	router.POST("/challenge", getChallenge)
+	router.POST("/login", login)
 	router.POST("/uploadfile", uploadFile)
+	router.POST("/startupload", startUpload)
+	router.POST("/uploadchunk", uploadChunk)
+	router.POST("/commitupload", commitUpload)
 	router.POST("/sharefile", shareFile)
 	router.POST("/revokefile", revokeFile)
+	router.POST("/rekey", rekeyFile)
+	router.POST("/rotatekey", rotateKey)
+	router.GET("/filekeys", getUserFileKeys)
+	router.GET("/grants", getUserGrants)
+	router.GET("/rekeys", getRekeyFiles)
+	router.POST("/enroll", enrollDevice)
+	router.GET("/devices", getDevices)
+	router.POST("/approvedevice", approveDevice)
+	router.POST("/removedevice", removeDevice)
+	router.POST("/recovery", setupRecovery)
+	router.POST("/recover", startRecovery)
+	router.GET("/recoveryrequests", getRecoveryRequests)
+	router.POST("/approverecovery", approveRecovery)
+	router.POST("/recoveryshares", getRecoveryShares)
+	router.GET("/log/head", getLogHead)
+	router.GET("/log/key", getLogKey)
+	router.GET("/log/consistency", getLogConsistency)
+	router.GET("/log/users/:username", getUserLogProof)
+	router.GET("/uploads/:upload", getUploadSession)
 	router.GET("/users/:username", getUser)
 	router.GET("/users/:username/:filename", getFile)
 	router.GET("/users/:username/:filename/users", getFileUsers)
+	router.GET("/users/:username/:filename/versions", getFileVersions)
+	router.GET("/users/:username/:filename/chunks/:index", getFileChunk)
 	router.GET("/users/:username/:filename/key/:user", getFileKey)
+	return router
+}
+
+// Main function, open storage backend, initialize routes and start HTTPS server
+func main() {
+	var err error
+	store, err = openStore(Storage)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	defer store.Close()
+	logKey, generated, err := loadLogKey(LogKeyPath)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	if generated {
+		log.Printf("Generated key log signing key %s\n", LogKeyPath)
+	}
+	keyLog, err = newKeyLog(store, logKey)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	// Print the log key so clients can pin it instead of trusting it on first use
+	log.Printf("Key log public key: %x\n", keyLog.PublicKey().PublicKey)
+	go purgeExpiredFileKeys(PurgeInterval)
+	go sweepNonces(time.Minute)
+	go sweepSessions(time.Minute)
 
 	server := http.Server{
 		Addr:    ":" + Port,
-		Handler: router,
+		Handler: newRouter(),
+	}
+	if !TLS {
+		err = server.ListenAndServe()
+		if err != nil {
+			log.Fatalf("Error: %v\n", err)
+		}
+		return
+	}
+	if GenerateCert {
+		generated, err := ensureCertificate(TLSCert, TLSKey, TLSHosts)
+		if err != nil {
+			log.Fatalf("Error: %v\n", err)
+		}
+		if generated {
+			log.Printf("Generated self-signed certificate %s\n", TLSCert)
+		}
+	}
+	clientAuth, err := clientAuthType(ClientCerts)
+	if err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	server.TLSConfig = &tls.Config{ClientAuth: clientAuth}
+	// Print the fingerprint so clients of self-signed deployments can pin it
+	fingerprint, err := certificateFingerprint(TLSCert)
+	if err != nil {
+		log.Fatalf("Error: %v\n", err)
 	}
-	err := server.ListenAndServe()
+	log.Printf("TLS certificate fingerprint: %s\n", fingerprint)
+	err = server.ListenAndServeTLS(TLSCert, TLSKey)
 	if err != nil {
-		log.Fatalln("Error: %v", err)
+		log.Fatalf("Error: %v\n", err)
 	}
 }
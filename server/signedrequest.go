@@ -1,7 +1,212 @@
 package main
 
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How far a signed request's timestamp may be from the server's clock
+const requestWindow = 5 * time.Minute
+
 // Signed Request Struct
+// The signature covers the message, the endpoint path, the timestamp and the
+// nonce, so a captured request can't be replayed or posted to another endpoint
+// Username names the signer, whose keys the signature is checked against
 type SignedRequest struct {
+	Username  string
 	Message   []byte
+	Path      string
+	Timestamp int64
+	Nonce     []byte
 	Signature []byte
 }
+
+// Data covered by a request signature, must match the client's
+type signedData struct {
+	Path      string
+	Timestamp int64
+	Nonce     []byte
+	Message   []byte
+}
+
+// Most nonces remembered at once, about 100MB. Requests are refused while the cache is full
+// rather than forgetting nonces that could still be replayed
+const maxNonces = 1 << 20
+
+var (
+	errReplayed        = errors.New("Request has already been used")
+	errTooManyRequests = errors.New("Too many requests, try again later")
+)
+
+// Nonces seen within the request window
+var seenNonces = newNonceCache(maxNonces)
+
+// Cache of recently used nonces, expired ones are removed by Sweep
+type nonceCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+	max  int
+}
+
+func newNonceCache(max int) *nonceCache {
+	return &nonceCache{seen: make(map[string]time.Time), max: max}
+}
+
+// Record a nonce until it expires, fails if it has already been used or the cache is full
+func (c *nonceCache) Use(nonce []byte, expires time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.seen[string(nonce)]; ok && !e.Before(time.Now()) {
+		return errReplayed
+	}
+	if len(c.seen) >= c.max {
+		return errTooManyRequests
+	}
+	c.seen[string(nonce)] = expires
+	return nil
+}
+
+// Remove the nonces that expired by now
+func (c *nonceCache) Sweep(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for n, e := range c.seen {
+		if e.Before(now) {
+			delete(c.seen, n)
+		}
+	}
+}
+
+// Remove expired nonces every interval, runs until the server stops
+func sweepNonces(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		seenNonces.Sweep(now)
+	}
+}
+
+// Verify a signed request sent to path was signed with one of the public keys
+func (s *SignedRequest) Verify(publicKeys []PublicKey, path string) error {
+	data, err := json.Marshal(signedData{s.Path, s.Timestamp, s.Nonce, s.Message})
+	if err != nil {
+		return err
+	}
+	if !verifyAny(publicKeys, data, s.Signature) {
+		return errors.New("Could not verify signature")
+	}
+	if s.Path != path {
+		return errors.New("Request was signed for another endpoint")
+	}
+	timestamp := time.Unix(s.Timestamp, 0)
+	if time.Since(timestamp) > requestWindow || time.Until(timestamp) > requestWindow {
+		return errors.New("Request has expired")
+	}
+	if len(s.Nonce) < 16 {
+		return errors.New("Request nonce is too short")
+	}
+	// Nonces only need to be remembered until their timestamp leaves the window
+	return seenNonces.Use(s.Nonce, timestamp.Add(requestWindow))
+}
+
+// Verify that a request was made by username, with a session token, a client certificate or the request signature
+func (s *SignedRequest) Authenticate(req *http.Request, username string) error {
+	if token := bearerToken(req); token != "" {
+		tokenUsername, err := tokenUser(token)
+		if err != nil {
+			return err
+		}
+		if tokenUsername != username {
+			return errors.New("Token was issued to another user")
+		}
+		return nil
+	}
+	certUser, err := certificateUser(req)
+	if err != nil {
+		return err
+	}
+	if certUser != nil {
+		if certUser.Username != username {
+			return errors.New("Client certificate belongs to another user")
+		}
+		return nil
+	}
+	user, err := GetUser(username, store)
+	if err != nil {
+		return err
+	}
+	return s.Verify(user.SigningKeys(), req.URL.Path)
+}
+
+// Authenticate the user who made a request, with a session token, a client certificate or the request signature
+// Clients that don't name the signer are checked against claimed, the user the request says it acts for
+func (s *SignedRequest) Principal(req *http.Request, claimed string) (*User, error) {
+	if token := bearerToken(req); token != "" {
+		username, err := tokenUser(token)
+		if err != nil {
+			return nil, err
+		}
+		return GetUser(username, store)
+	}
+	certUser, err := certificateUser(req)
+	if err != nil || certUser != nil {
+		return certUser, err
+	}
+	username := s.Username
+	if username == "" {
+		username = claimed
+	}
+	user, err := GetUser(username, store)
+	if err != nil {
+		return nil, err
+	}
+	err = s.Verify(user.SigningKeys(), req.URL.Path)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Authenticate the user who made a GET request, with a session token, a client certificate or signature headers
+func authenticate(req *http.Request) (*User, error) {
+	if token := bearerToken(req); token != "" {
+		username, err := tokenUser(token)
+		if err != nil {
+			return nil, err
+		}
+		return GetUser(username, store)
+	}
+	certUser, err := certificateUser(req)
+	if err != nil || certUser != nil {
+		return certUser, err
+	}
+	username := req.Header.Get("X-User")
+	if username == "" {
+		return nil, errors.New("Request is not signed")
+	}
+	user, err := GetUser(username, store)
+	if err != nil {
+		return nil, err
+	}
+	s := &SignedRequest{Path: req.URL.Path}
+	s.Timestamp, err = strconv.ParseInt(req.Header.Get("X-Timestamp"), 10, 64)
+	if err != nil {
+		return nil, errors.New("Invalid request timestamp")
+	}
+	s.Nonce, err = base64.StdEncoding.DecodeString(req.Header.Get("X-Nonce"))
+	if err != nil {
+		return nil, errors.New("Invalid request nonce")
+	}
+	s.Signature, err = base64.StdEncoding.DecodeString(req.Header.Get("X-Signature"))
+	if err != nil {
+		return nil, errors.New("Invalid request signature")
+	}
+	err = s.Verify(user.SigningKeys(), req.URL.Path)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Errors shared by all storage backends
+var (
+	errDuplicateUser    = errors.New("Duplicate account")
+	errUserNotFound     = errors.New("User does not exist")
+	errFileNotFound     = errors.New("File does not exist")
+	errNoFileAccess     = errors.New("You do not have access to this file")
+	errChunkNotFound    = errors.New("File chunk does not exist")
+	errNoUpload         = errors.New("Upload session does not exist")
+	errRecoveryNotFound = errors.New("User has not set up recovery")
+	errVersionNotFound  = errors.New("File version does not exist")
+	errInvalidName      = errors.New("Names can't be empty or contain NUL")
+)
+
+// Check a user or file name can be stored, the backends join names with NUL to build their keys
+func validName(name string) bool {
+	return name != "" && !strings.Contains(name, "\x00")
+}
+
+// Storage backend interface for users, files and file keys
+type Store interface {
+	// Insert a new user, fails if the username is taken
+	InsertUser(user *User) error
+	// Get a user by username
+	GetUser(username string) (*User, error)
+	// Replace an existing user's keys
+	UpdateUser(user *User) error
+	// Insert a file, updates the file if it already exists
+	InsertFile(file *File) error
+	// Get a file by owner and name
+	GetFile(owner string, filename string) (*File, error)
+	// Replace a file and its file keys together, deleting the file keys of the revoked users
+	// Readers must see either the old file and keys or the new ones, never a mix
+	RekeyFile(file *File, filekeys []FileKey, revoked []string) error
+	// Keep a replaced version of a file, updates the version if it is already kept
+	InsertFileVersion(file *File) error
+	// Get a kept version of a file by owner, file name and version
+	GetFileVersion(owner string, filename string, version int) (*File, error)
+	// Get the kept versions of a file, oldest first
+	GetFileVersions(owner string, filename string) ([]File, error)
+	// Delete a kept version of a file, its chunks are kept
+	DeleteFileVersion(owner string, filename string, version int) error
+	// Insert a file chunk, updates the chunk if it already exists
+	InsertFileChunk(chunk *FileChunk) error
+	// Get a file chunk by owner, file name, upload and index
+	GetFileChunk(owner string, filename string, upload string, index int) (*FileChunk, error)
+	// Get the sorted indices of the chunks an upload has stored
+	GetFileChunkIndices(owner string, filename string, upload string) ([]int, error)
+	// Delete all chunks of an upload
+	DeleteFileChunks(owner string, filename string, upload string) error
+	// Insert a new upload session
+	InsertUploadSession(session *UploadSession) error
+	// Get an upload session by id
+	GetUploadSession(id string) (*UploadSession, error)
+	// Delete an upload session, its chunks are kept
+	DeleteUploadSession(id string) error
+	// Insert a file key, updates the file key if it already exists
+	InsertFileKey(filekey *FileKey) error
+	// Delete a file key, does nothing if it doesn't exist
+	DeleteFileKey(owner string, filename string, user string) error
+	// Get a file key by owner, file name and user
+	GetFileKey(owner string, filename string, user string) (*FileKey, error)
+	// Get the users who have keys to a file
+	GetFileUsers(owner string, filename string) ([]string, error)
+	// Get all file keys shared with a user, sorted by owner and file name
+	GetUserFileKeys(user string) ([]FileKey, error)
+	// Delete the file keys that expired by now and mark their files as needing a rekey, returns the deleted keys
+	PurgeExpiredFileKeys(now time.Time) ([]FileKey, error)
+	// Insert a user's recovery shares, replaces the user's earlier ones
+	InsertRecovery(recovery *Recovery) error
+	// Get a user's recovery shares
+	GetRecovery(username string) (*Recovery, error)
+	// Append an entry to the key log, entries are never changed or removed
+	InsertLogEntry(entry *LogEntry) error
+	// Get all key log entries in log order
+	GetLogEntries() ([]LogEntry, error)
+	// Close the backend
+	Close() error
+}
+
+// Open the storage backend selected in config
+func openStore(backend string) (Store, error) {
+	switch backend {
+	case "rethinkdb":
+		return newRethinkStore(DBHost)
+	case "bolt":
+		return newBoltStore(DBPath)
+	case "memory":
+		return newMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("Unknown storage backend: %s", backend)
+}
+
+// Generate a random document id for backends that don't create their own
+func newId() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
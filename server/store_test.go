@@ -0,0 +1,437 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Run a test against every backend that doesn't need a database daemon
+func forEachStore(t *testing.T, test func(t *testing.T, s Store)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, newMemoryStore())
+	})
+	t.Run("bolt", func(t *testing.T) {
+		s, err := newBoltStore(filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		test(t, s)
+	})
+}
+
+func TestStoreUsers(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forEachStore(t, func(t *testing.T, s Store) {
+		if _, err := s.GetUser("alice"); err != errUserNotFound {
+			t.Fatalf("GetUser on empty store: got %v, want %v", err, errUserNotFound)
+		}
+		user := &User{Username: "alice", PubKey: &key.PublicKey}
+		if err := s.InsertUser(user); err != nil {
+			t.Fatal(err)
+		}
+		if user.Id == "" {
+			t.Error("InsertUser did not assign an id")
+		}
+		if err := s.InsertUser(&User{Username: "alice", PubKey: &key.PublicKey}); err != errDuplicateUser {
+			t.Errorf("duplicate InsertUser: got %v, want %v", err, errDuplicateUser)
+		}
+		got, err := s.GetUser("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Username != "alice" || got.PubKey.N.Cmp(key.N) != 0 || got.PubKey.E != key.E {
+			t.Errorf("GetUser returned %+v", got)
+		}
+
+		keys := KeySet{PublicKey{algorithmEd25519, []byte("signing")}, PublicKey{algorithmX25519, []byte("encryption")}}
+		if err := s.UpdateUser(&User{Username: "bob", Keys: keys}); err != errUserNotFound {
+			t.Errorf("UpdateUser for missing user: got %v, want %v", err, errUserNotFound)
+		}
+		devices := []Device{{Name: "laptop", Keys: keys}}
+		if err := s.UpdateUser(&User{Username: "alice", Keys: keys, Devices: devices}); err != nil {
+			t.Fatal(err)
+		}
+		got, err = s.GetUser("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Id != user.Id || got.PubKey != nil || !reflect.DeepEqual(got.Keys, keys) || !reflect.DeepEqual(got.Devices, devices) {
+			t.Errorf("GetUser after UpdateUser returned %+v", got)
+		}
+	})
+}
+
+func TestStoreFiles(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		if _, err := s.GetFile("alice", "a.txt"); err != errFileNotFound {
+			t.Fatalf("GetFile on empty store: got %v, want %v", err, errFileNotFound)
+		}
+		file := &File{Owner: "alice", Name: "a.txt", Data: []byte("one")}
+		if err := s.InsertFile(file); err != nil {
+			t.Fatal(err)
+		}
+		id := file.Id
+		manifest := &Manifest{Owner: "alice", Name: "a.txt", Version: 2, Hash: []byte("hash"), Timestamp: 1, Device: defaultDevice, Signature: []byte("signature")}
+		update := &File{Owner: "alice", Name: "a.txt", Data: []byte("two"), Manifest: manifest}
+		if err := s.InsertFile(update); err != nil {
+			t.Fatal(err)
+		}
+		if update.Id != id {
+			t.Errorf("InsertFile on existing file changed id from %q to %q", id, update.Id)
+		}
+		got, err := s.GetFile("alice", "a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got.Data) != "two" {
+			t.Errorf("GetFile data = %q, want %q", got.Data, "two")
+		}
+		if got.Manifest == nil || !reflect.DeepEqual(*got.Manifest, *manifest) {
+			t.Errorf("GetFile manifest = %+v, want %+v", got.Manifest, manifest)
+		}
+		if _, err := s.GetFile("bob", "a.txt"); err != errFileNotFound {
+			t.Errorf("GetFile for other owner: got %v, want %v", err, errFileNotFound)
+		}
+	})
+}
+
+func TestStoreFileVersions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		if _, err := s.GetFileVersion("alice", "a.txt", 1); err != errVersionNotFound {
+			t.Fatalf("GetFileVersion on empty store: got %v, want %v", err, errVersionNotFound)
+		}
+		for _, version := range []int{10, 2, 1} {
+			file := &File{Owner: "alice", Name: "a.txt", Version: version, Data: []byte(fmt.Sprint("data ", version))}
+			if err := s.InsertFileVersion(file); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.InsertFileVersion(&File{Owner: "alice", Name: "b.txt", Version: 1}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.InsertFileVersion(&File{Owner: "alice", Name: "a.txt", Version: 2, Data: []byte("updated")}); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.GetFileVersion("alice", "a.txt", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got.Data) != "updated" {
+			t.Errorf("GetFileVersion data = %q, want %q", got.Data, "updated")
+		}
+		versions, err := s.GetFileVersions("alice", "a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != 3 || versions[0].Version != 1 || versions[1].Version != 2 || versions[2].Version != 10 {
+			t.Errorf("GetFileVersions = %+v", versions)
+		}
+		if err := s.DeleteFileVersion("alice", "a.txt", 2); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetFileVersion("alice", "a.txt", 2); err != errVersionNotFound {
+			t.Errorf("GetFileVersion after delete: got %v, want %v", err, errVersionNotFound)
+		}
+		if versions, _ := s.GetFileVersions("bob", "a.txt"); len(versions) != 0 {
+			t.Errorf("GetFileVersions for other owner = %+v", versions)
+		}
+	})
+}
+
+func TestStoreFileKeys(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		for _, user := range []string{"alice", "carol", "bob"} {
+			filekey := &FileKey{User: user, Owner: "alice", Name: "a.txt", Key: []byte(user)}
+			if err := s.InsertFileKey(filekey); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.InsertFileKey(&FileKey{User: "bob", Owner: "alice", Name: "b.txt", Key: []byte("b")}); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.GetFileKey("alice", "a.txt", "bob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got.Key) != "bob" {
+			t.Errorf("GetFileKey key = %q, want %q", got.Key, "bob")
+		}
+		users, err := s.GetFileUsers("alice", "a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"alice", "bob", "carol"}; !reflect.DeepEqual(users, want) {
+			t.Errorf("GetFileUsers = %v, want %v", users, want)
+		}
+		if err := s.DeleteFileKey("alice", "a.txt", "bob"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetFileKey("alice", "a.txt", "bob"); err != errNoFileAccess {
+			t.Errorf("GetFileKey after delete: got %v, want %v", err, errNoFileAccess)
+		}
+		if _, err := s.GetFileKey("alice", "b.txt", "bob"); err != nil {
+			t.Errorf("DeleteFileKey removed key for another file: %v", err)
+		}
+		deviceKeys := map[string][]byte{"laptop": []byte("c")}
+		if err := s.InsertFileKey(&FileKey{User: "carol", Owner: "bob", Name: "c.txt", Key: []byte("c"), DeviceKeys: deviceKeys, Role: roleWriter}); err != nil {
+			t.Fatal(err)
+		}
+		filekeys, err := s.GetUserFileKeys("carol")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, filekey := range filekeys {
+			names = append(names, filekey.Owner+"/"+filekey.Name+"="+string(filekey.Key))
+		}
+		if want := []string{"alice/a.txt=carol", "bob/c.txt=c"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("GetUserFileKeys = %v, want %v", names, want)
+		}
+		if len(filekeys) == 2 && !reflect.DeepEqual(filekeys[1].DeviceKeys, deviceKeys) {
+			t.Errorf("GetUserFileKeys device keys = %v, want %v", filekeys[1].DeviceKeys, deviceKeys)
+		}
+		if len(filekeys) == 2 && filekeys[1].Role != roleWriter {
+			t.Errorf("GetUserFileKeys role = %q, want %q", filekeys[1].Role, roleWriter)
+		}
+		if filekeys, err := s.GetUserFileKeys("nobody"); err != nil || len(filekeys) != 0 {
+			t.Errorf("GetUserFileKeys for user without keys = %v, %v", filekeys, err)
+		}
+		if err := s.DeleteFileKey("alice", "a.txt", "nobody"); err != nil {
+			t.Errorf("DeleteFileKey for missing key: %v", err)
+		}
+		users, err = s.GetFileUsers("alice", "missing.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(users) != 0 {
+			t.Errorf("GetFileUsers for missing file = %v, want empty", users)
+		}
+	})
+}
+
+func TestStoreRekeyFile(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		file := &File{Owner: "alice", Name: "a.txt", Data: []byte("one")}
+		if err := s.RekeyFile(file, nil, nil); err != errFileNotFound {
+			t.Fatalf("RekeyFile for missing file: got %v, want %v", err, errFileNotFound)
+		}
+		if err := s.InsertFile(file); err != nil {
+			t.Fatal(err)
+		}
+		for _, user := range []string{"alice", "bob", "carol"} {
+			if err := s.InsertFileKey(&FileKey{User: user, Owner: "alice", Name: "a.txt", Key: []byte(user)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		update := &File{Owner: "alice", Name: "a.txt", Data: []byte("two"), Version: 2}
+		filekeys := []FileKey{
+			{User: "alice", Owner: "alice", Name: "a.txt", Key: []byte("new alice")},
+			{User: "carol", Owner: "alice", Name: "a.txt", Key: []byte("new carol")},
+		}
+		if err := s.RekeyFile(update, filekeys, []string{"bob"}); err != nil {
+			t.Fatal(err)
+		}
+		if update.Id != file.Id {
+			t.Errorf("RekeyFile changed file id from %q to %q", file.Id, update.Id)
+		}
+		got, err := s.GetFile("alice", "a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got.Data) != "two" || got.Version != 2 {
+			t.Errorf("GetFile after rekey = %+v", got)
+		}
+		users, err := s.GetFileUsers("alice", "a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"alice", "carol"}; !reflect.DeepEqual(users, want) {
+			t.Errorf("GetFileUsers after rekey = %v, want %v", users, want)
+		}
+		if filekey, err := s.GetFileKey("alice", "a.txt", "carol"); err != nil || string(filekey.Key) != "new carol" {
+			t.Errorf("GetFileKey after rekey = %+v, %v", filekey, err)
+		}
+	})
+}
+
+func TestStorePurgeExpiredFileKeys(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		now := time.Now()
+		for _, name := range []string{"a.txt", "b.txt"} {
+			if err := s.InsertFile(&File{Owner: "alice", Name: name, Data: []byte("one")}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		filekeys := []FileKey{
+			{User: "alice", Owner: "alice", Name: "a.txt"},
+			{User: "bob", Owner: "alice", Name: "a.txt", Expires: now.Add(-time.Minute)},
+			{User: "carol", Owner: "alice", Name: "a.txt", Expires: now.Add(time.Hour)},
+			{User: "carol", Owner: "alice", Name: "b.txt"},
+		}
+		for i := range filekeys {
+			if err := s.InsertFileKey(&filekeys[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		purged, err := s.PurgeExpiredFileKeys(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(purged) != 1 || purged[0].User != "bob" || purged[0].Name != "a.txt" {
+			t.Errorf("PurgeExpiredFileKeys = %+v, want bob's key to a.txt", purged)
+		}
+		users, err := s.GetFileUsers("alice", "a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"alice", "carol"}; !reflect.DeepEqual(users, want) {
+			t.Errorf("GetFileUsers after purge = %v, want %v", users, want)
+		}
+		if file, err := s.GetFile("alice", "a.txt"); err != nil || !file.NeedsRekey || string(file.Data) != "one" {
+			t.Errorf("GetFile with purged key = %+v, %v", file, err)
+		}
+		if file, err := s.GetFile("alice", "b.txt"); err != nil || file.NeedsRekey {
+			t.Errorf("GetFile without purged keys = %+v, %v", file, err)
+		}
+		if purged, err := s.PurgeExpiredFileKeys(now); err != nil || len(purged) != 0 {
+			t.Errorf("PurgeExpiredFileKeys again = %+v, %v", purged, err)
+		}
+	})
+}
+
+func TestStoreFileChunks(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		for i := 11; i >= 0; i-- {
+			chunk := &FileChunk{Owner: "alice", Name: "a.txt", Session: "u1", Index: i, Data: []byte{byte(i)}}
+			if err := s.InsertFileChunk(chunk); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.InsertFileChunk(&FileChunk{Owner: "alice", Name: "a.txt", Session: "u1", Index: 3, Data: []byte("new")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.InsertFileChunk(&FileChunk{Owner: "alice", Name: "a.txt", Session: "u2", Index: 5, Data: []byte("u2")}); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.GetFileChunk("alice", "a.txt", "u1", 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got.Data) != "new" {
+			t.Errorf("GetFileChunk data = %q, want %q", got.Data, "new")
+		}
+		indices, err := s.GetFileChunkIndices("alice", "a.txt", "u1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}; !reflect.DeepEqual(indices, want) {
+			t.Errorf("GetFileChunkIndices = %v, want %v", indices, want)
+		}
+		if err := s.DeleteFileChunks("alice", "a.txt", "u1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetFileChunk("alice", "a.txt", "u1", 0); err != errChunkNotFound {
+			t.Errorf("GetFileChunk after delete: got %v, want %v", err, errChunkNotFound)
+		}
+		if indices, _ := s.GetFileChunkIndices("alice", "a.txt", "u1"); len(indices) != 0 {
+			t.Errorf("GetFileChunkIndices after delete = %v, want empty", indices)
+		}
+		if _, err := s.GetFileChunk("alice", "a.txt", "u2", 5); err != nil {
+			t.Errorf("DeleteFileChunks removed chunk of another upload: %v", err)
+		}
+	})
+}
+
+func TestStoreUploadSessions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		if _, err := s.GetUploadSession("u1"); err != errNoUpload {
+			t.Fatalf("GetUploadSession on empty store: got %v, want %v", err, errNoUpload)
+		}
+		session := &UploadSession{Id: "u1", Owner: "alice", Name: "a.txt", Header: []byte("header"), Chunks: 2}
+		if err := s.InsertUploadSession(session); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.GetUploadSession("u1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Owner != "alice" || got.Name != "a.txt" || string(got.Header) != "header" || got.Chunks != 2 {
+			t.Errorf("GetUploadSession = %+v", got)
+		}
+		if err := s.DeleteUploadSession("u1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetUploadSession("u1"); err != errNoUpload {
+			t.Errorf("GetUploadSession after delete: got %v, want %v", err, errNoUpload)
+		}
+	})
+}
+
+func TestStoreRecoveries(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		if _, err := s.GetRecovery("alice"); err != errRecoveryNotFound {
+			t.Fatalf("GetRecovery on empty store: got %v, want %v", err, errRecoveryNotFound)
+		}
+		shares := []RecoveryShare{{Trustee: "bob", Key: []byte("bob"), DeviceKeys: map[string][]byte{"laptop": []byte("bob")}}}
+		recovery := &Recovery{Username: "alice", Threshold: 1, Shares: shares}
+		if err := s.InsertRecovery(recovery); err != nil {
+			t.Fatal(err)
+		}
+		id := recovery.Id
+		replaced := &Recovery{Username: "alice", Threshold: 1, Shares: []RecoveryShare{{Trustee: "carol", Key: []byte("carol")}}}
+		if err := s.InsertRecovery(replaced); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.GetRecovery("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Id != id || len(got.Shares) != 1 || got.Shares[0].Trustee != "carol" || string(got.Shares[0].Key) != "carol" {
+			t.Errorf("GetRecovery after replacing = %+v", got)
+		}
+		if err := s.InsertRecovery(recovery); err != nil {
+			t.Fatal(err)
+		}
+		got, err = s.GetRecovery("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.Shares, shares) {
+			t.Errorf("GetRecovery shares = %+v, want %+v", got.Shares, shares)
+		}
+	})
+}
+
+func TestStoreLogEntries(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		entries, err := s.GetLogEntries()
+		if err != nil || len(entries) != 0 {
+			t.Fatalf("empty log: got %v %v", entries, err)
+		}
+		key := PublicKey{algorithmEd25519, []byte("signing key")}
+		for i := 0; i < 12; i++ {
+			entry := LogEntry{i, fmt.Sprint("user", i), []LogDevice{{defaultDevice, KeySet{key, key}}}, int64(i)}
+			if err := s.InsertLogEntry(&entry); err != nil {
+				t.Fatal(err)
+			}
+		}
+		entries, err = s.GetLogEntries()
+		if err != nil || len(entries) != 12 {
+			t.Fatalf("get log entries: got %d %v", len(entries), err)
+		}
+		for i, entry := range entries {
+			if entry.Index != i || entry.Username != fmt.Sprint("user", i) || !reflect.DeepEqual(entry.Devices[0].Keys.Signing, key) {
+				t.Errorf("entry %d: got %+v", i, entry)
+			}
+		}
+	})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// How long a generated self-signed certificate is valid for
+const certLifetime = 365 * 24 * time.Hour
+
+// Generate a self-signed certificate and key for hosts and save them as PEM files
+func generateCertificate(certPath string, keyPath string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"CS3031 Lab2"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(certLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	if len(hosts) > 0 {
+		template.Subject.CommonName = hosts[0]
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	// Write the key first so a certificate is never left without its key
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// Generate a self-signed certificate if neither the certificate nor the key exist yet
+// Returns true if a new certificate was generated
+func ensureCertificate(certPath string, keyPath string, hosts []string) (bool, error) {
+	_, certErr := os.Stat(certPath)
+	_, keyErr := os.Stat(keyPath)
+	if certErr == nil && keyErr == nil {
+		return false, nil
+	}
+	// Never overwrite half of an existing pair
+	if !os.IsNotExist(certErr) || !os.IsNotExist(keyErr) {
+		return false, errors.New("TLS certificate or key is missing")
+	}
+	return true, generateCertificate(certPath, keyPath, hosts)
+}
+
+// SHA-256 fingerprint of the first certificate in a PEM file, used for pinning by clients
+func certificateFingerprint(certPath string) (string, error) {
+	data, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", errors.New("Invalid TLS certificate")
+	}
+	sum := sha256.Sum256(block.Bytes)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// TLS client authentication for the ClientCerts setting
+// Client certificates are self-signed, they are checked against users' registered keys instead of a CA
+func clientAuthType(mode string) (tls.ClientAuthType, error) {
+	switch mode {
+	case "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.RequestClientCert, nil
+	case "require":
+		return tls.RequireAnyClientCert, nil
+	}
+	return tls.NoClientCert, errors.New("Unknown ClientCerts setting: " + mode)
+}
+
+// Get the user identified by the request's client certificate, nil if no certificate was sent
+// The certificate's common name is the username and its key must be the signing key of one of the user's devices
+func certificateUser(req *http.Request) (*User, error) {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return nil, nil
+	}
+	cert := req.TLS.PeerCertificates[0]
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, errors.New("Client certificate has expired")
+	}
+	user, err := GetUser(cert.Subject.CommonName, store)
+	if err != nil {
+		return nil, err
+	}
+	key, err := publicKeyFrom(cert.PublicKey)
+	if err == nil {
+		for _, signingKey := range user.SigningKeys() {
+			if key.Algorithm == signingKey.Algorithm && bytes.Equal(key.Key, signingKey.Key) {
+				return user, nil
+			}
+		}
+	}
+	return nil, errors.New("Client certificate does not match the user's key")
+}
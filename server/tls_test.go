@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGenerateCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	generated, err := ensureCertificate(certPath, keyPath, []string{"localhost", "127.0.0.1"})
+	if err != nil || !generated {
+		t.Fatalf("ensureCertificate = %v, %v", generated, err)
+	}
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(keyPath); info.Mode().Perm() != 0600 {
+		t.Errorf("key file mode = %v, want 0600", info.Mode().Perm())
+	}
+	fingerprint, err := certificateFingerprint(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(pair.Certificate[0])
+	if fingerprint != hex.EncodeToString(sum[:]) {
+		t.Errorf("fingerprint = %s, want %x", fingerprint, sum)
+	}
+
+	// An existing certificate is kept
+	before, _ := ioutil.ReadFile(certPath)
+	if generated, err := ensureCertificate(certPath, keyPath, nil); err != nil || generated {
+		t.Errorf("ensureCertificate with existing pair = %v, %v", generated, err)
+	}
+	if after, _ := ioutil.ReadFile(certPath); string(after) != string(before) {
+		t.Error("ensureCertificate replaced an existing certificate")
+	}
+	// Half a pair is an error rather than being overwritten
+	os.Remove(keyPath)
+	if _, err := ensureCertificate(certPath, keyPath, nil); err == nil {
+		t.Error("ensureCertificate with missing key succeeded")
+	}
+}
+
+// Start a TLS server backed by a fresh in-memory store, with the given client authentication
+func newTLSTestServer(t *testing.T, clientAuth tls.ClientAuthType) *httptest.Server {
+	store = newMemoryStore()
+	newTestKeyLog(t)
+	server := httptest.NewUnstartedServer(newRouter())
+	server.TLS = &tls.Config{ClientAuth: clientAuth}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Present a self-signed client certificate for username and key, like the client's certificate command
+func (c *testClient) useCertificate(username string, key crypto.Signer, notAfter time.Time) {
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: username},
+		NotBefore:    notAfter.Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	transport := c.server.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}
+	c.client = &http.Client{Transport: transport}
+}
+
+// Post a message without a signature, relying on the client certificate
+func (c *testClient) postUnsigned(path string, v interface{}) (int, testResponse) {
+	message, _ := json.Marshal(v)
+	body, _ := json.Marshal(SignedRequest{Message: message, Path: path})
+	return c.post(path, body)
+}
+
+func TestClientCertificates(t *testing.T) {
+	server := newTLSTestServer(t, tls.RequestClientCert)
+	alice := newTestClient(t, server, "alice")
+	mallory := newTestClient(t, server, "mallory")
+	alice.register()
+	mallory.register()
+	alice.upload("a.txt", []byte("ciphertext"), []byte("key"))
+	// Signed requests still work without a certificate
+	var file File
+	if status, res := alice.get("/users/alice/a.txt", &file); status != http.StatusOK {
+		t.Fatalf("signed get: got %d %+v", status, res)
+	}
+
+	alice.useCertificate("alice", alice.key, time.Now().Add(time.Hour))
+	if status, res := alice.getWithHeaders("/users/alice/a.txt", make(http.Header), &file); status != http.StatusOK || string(file.Data) != "ciphertext" {
+		t.Errorf("get with certificate: got %d %+v", status, res)
+	}
+	expectSuccess(t, "upload with certificate", func() (int, testResponse) {
+		return alice.postUnsigned("/uploadfile", File{Owner: "alice", Name: "b.txt", Data: []byte("b")})
+	})
+	expectFailure(t, "certificate for another owner", http.StatusForbidden, errNotWriter.Error(), func() (int, testResponse) {
+		return alice.postUnsigned("/uploadfile", File{Owner: "mallory", Name: "b.txt"})
+	})
+
+	mallory.useCertificate("alice", mallory.key, time.Now().Add(time.Hour))
+	expectFailure(t, "certificate with wrong key", http.StatusUnauthorized, "Client certificate does not match the user's key", func() (int, testResponse) {
+		return mallory.postUnsigned("/uploadfile", File{Owner: "alice", Name: "a.txt"})
+	})
+	mallory.useCertificate("nobody", mallory.key, time.Now().Add(time.Hour))
+	expectFailure(t, "certificate for missing user", http.StatusUnauthorized, "User does not exist", func() (int, testResponse) {
+		return mallory.getWithHeaders("/users/alice/a.txt", make(http.Header), &file)
+	})
+	mallory.useCertificate("mallory", mallory.key, time.Now().Add(-time.Hour))
+	expectFailure(t, "expired certificate", http.StatusUnauthorized, "Client certificate has expired", func() (int, testResponse) {
+		return mallory.postUnsigned("/uploadfile", File{Owner: "mallory", Name: "m.txt"})
+	})
+
+	// Ed25519 users present a certificate for their signing key
+	carol := newEd25519TestClient(t, server, "carol")
+	carol.register()
+	carol.useCertificate("carol", carol.edKey, time.Now().Add(time.Hour))
+	expectSuccess(t, "upload with Ed25519 certificate", func() (int, testResponse) {
+		return carol.postUnsigned("/uploadfile", File{Owner: "carol", Name: "c.txt", Data: []byte("c")})
+	})
+}
+
+func TestRequireClientCertificates(t *testing.T) {
+	server := newTLSTestServer(t, tls.RequireAnyClientCert)
+	alice := newTestClient(t, server, "alice")
+	if _, err := alice.client.Get(server.URL + "/users/alice"); err == nil {
+		t.Fatal("request without a client certificate succeeded")
+	}
+	alice.useCertificate("alice", alice.key, time.Now().Add(time.Hour))
+	alice.register()
+	alice.upload("a.txt", []byte("ciphertext"), []byte("key"))
+}
+
+func TestClientAuthType(t *testing.T) {
+	for mode, want := range map[string]tls.ClientAuthType{"none": tls.NoClientCert, "request": tls.RequestClientCert, "require": tls.RequireAnyClientCert} {
+		if got, err := clientAuthType(mode); err != nil || got != want {
+			t.Errorf("clientAuthType(%q) = %v, %v", mode, got, err)
+		}
+	}
+	if _, err := clientAuthType("always"); err == nil {
+		t.Error("clientAuthType accepted an unknown setting")
+	}
+}
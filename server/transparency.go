@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kyrillzorin/CS3031_Lab2/lab2"
+)
+
+// Key transparency log, an append-only Merkle tree of every user's keys as they change
+// Hashing follows RFC 6962, so clients can check the keys they are given are in the log
+// and that the log only ever grows
+
+var errNotLogged = errors.New("User is not in the key log")
+
+// Log Entry Struct, a user's devices and keys after a registration or key change
+type LogEntry struct {
+	Index     int         `gorethink:"id"`
+	Username  string      `gorethink:"username"`
+	Devices   []LogDevice `gorethink:"devices"`
+	Timestamp int64       `gorethink:"timestamp"`
+}
+
+// Logged Device Struct, a device's name and keys
+type LogDevice struct {
+	Name string `gorethink:"name"`
+	Keys KeySet `gorethink:"keys"`
+}
+
+// Signed Tree Head Struct, the log's root hash at a size signed with the log key
+type SignedTreeHead struct {
+	TreeSize  int
+	RootHash  []byte
+	Timestamp int64
+	Signature []byte
+}
+
+// Data covered by the tree head signature, must match the client's
+type treeHeadData struct {
+	TreeSize  int
+	RootHash  []byte
+	Timestamp int64
+}
+
+// Log Key Struct, the public key tree heads are signed with
+type LogKey struct {
+	PublicKey []byte
+}
+
+// Inclusion proof of a user's latest entry in the tree of the given size
+type UserLogProof struct {
+	Entry     LogEntry
+	TreeSize  int
+	AuditPath [][]byte
+}
+
+// Consistency proof that the tree of size First is a prefix of the tree of size Second
+type ConsistencyProof struct {
+	First  int
+	Second int
+	Proof  [][]byte
+}
+
+// The server's key log
+var keyLog *KeyLog
+
+// Key log kept in memory, backed by the store's log entries
+type KeyLog struct {
+	mu      sync.Mutex
+	store   Store
+	key     ed25519.PrivateKey
+	entries []LogEntry
+	leaves  [][]byte
+}
+
+// Load the log entries from the store
+func newKeyLog(store Store, key ed25519.PrivateKey) (*KeyLog, error) {
+	entries, err := store.GetLogEntries()
+	if err != nil {
+		return nil, err
+	}
+	l := &KeyLog{store: store, key: key}
+	for i, entry := range entries {
+		if entry.Index != i {
+			return nil, errors.New("Key log is missing entries")
+		}
+		err = l.add(entry)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Add an entry to the in-memory tree
+func (l *KeyLog) add(entry LogEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	l.entries = append(l.entries, entry)
+	l.leaves = append(l.leaves, lab2.LeafHash(data))
+	return nil
+}
+
+// Store and add an entry with the user's current devices
+func (l *KeyLog) append(user *User) error {
+	entry := LogEntry{Index: len(l.entries), Username: user.Username, Timestamp: time.Now().Unix()}
+	for _, device := range user.Devices {
+		entry.Devices = append(entry.Devices, LogDevice{device.Name, device.Keys})
+	}
+	err := l.store.InsertLogEntry(&entry)
+	if err != nil {
+		return err
+	}
+	return l.add(entry)
+}
+
+// Write a user with write, then log their keys
+// The log stays locked across both so entries are in the same order as the writes
+func (l *KeyLog) Write(user *User, write func(*User) error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := write(user)
+	if err != nil {
+		return err
+	}
+	return l.append(user)
+}
+
+// Log a user registered before the key log existed
+func (l *KeyLog) Ensure(user *User) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.latest(user.Username, len(l.entries)) != nil {
+		return nil
+	}
+	return l.append(user)
+}
+
+// Latest entry of a user among the first size entries, nil if there is none
+func (l *KeyLog) latest(username string, size int) *LogEntry {
+	for i := size - 1; i >= 0; i-- {
+		if l.entries[i].Username == username {
+			return &l.entries[i]
+		}
+	}
+	return nil
+}
+
+// Sign the current tree head
+func (l *KeyLog) TreeHead() (*SignedTreeHead, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	head := &SignedTreeHead{TreeSize: len(l.leaves), RootHash: lab2.MerkleRoot(l.leaves), Timestamp: time.Now().Unix()}
+	data, err := json.Marshal(treeHeadData{head.TreeSize, head.RootHash, head.Timestamp})
+	if err != nil {
+		return nil, err
+	}
+	head.Signature = ed25519.Sign(l.key, data)
+	return head, nil
+}
+
+// Public key of the log
+func (l *KeyLog) PublicKey() *LogKey {
+	return &LogKey{l.key.Public().(ed25519.PublicKey)}
+}
+
+// Prove a user's latest entry is in the tree of the given size
+func (l *KeyLog) UserProof(username string, size int) (*UserLogProof, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if size < 1 || size > len(l.leaves) {
+		return nil, errors.New("Invalid tree size")
+	}
+	entry := l.latest(username, size)
+	if entry == nil {
+		return nil, errNotLogged
+	}
+	return &UserLogProof{*entry, size, lab2.InclusionPath(entry.Index, l.leaves[:size])}, nil
+}
+
+// Prove the tree of size first is a prefix of the tree of size second
+func (l *KeyLog) ConsistencyProof(first int, second int) (*ConsistencyProof, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if first < 1 || first > second || second > len(l.leaves) {
+		return nil, errors.New("Invalid tree sizes")
+	}
+	return &ConsistencyProof{first, second, lab2.ConsistencyPath(first, l.leaves[:second])}, nil
+}
+
+// Load the log's signing key, generating it if it doesn't exist yet
+// Returns true if a new key was generated
+func loadLogKey(path string) (ed25519.PrivateKey, bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, false, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, false, err
+		}
+		err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+		if err != nil {
+			return nil, false, err
+		}
+		return key, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, false, errors.New("Invalid log key file: " + path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, false, err
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, false, errors.New("Log key must be an Ed25519 key")
+	}
+	return key, false, nil
+}
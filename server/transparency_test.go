@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kyrillzorin/CS3031_Lab2/lab2"
+)
+
+// Get the log's tree head and check its signature
+func (c *testClient) treeHead(logKey ed25519.PublicKey) SignedTreeHead {
+	var head SignedTreeHead
+	if status, res := c.getWithHeaders("/log/head", nil, &head); status != http.StatusOK {
+		c.t.Fatalf("get tree head: got %d %+v", status, res)
+	}
+	data, err := json.Marshal(treeHeadData{head.TreeSize, head.RootHash, head.Timestamp})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if !ed25519.Verify(logKey, data, head.Signature) {
+		c.t.Fatalf("tree head signature does not verify")
+	}
+	return head
+}
+
+// Get a user's latest log entry in the tree of head and check its inclusion proof
+func (c *testClient) logEntry(username string, head SignedTreeHead) LogEntry {
+	var proof UserLogProof
+	path := fmt.Sprintf("/log/users/%s?size=%d", username, head.TreeSize)
+	if status, res := c.getWithHeaders(path, nil, &proof); status != http.StatusOK {
+		c.t.Fatalf("get log proof of %s: got %d %+v", username, status, res)
+	}
+	data, err := json.Marshal(proof.Entry)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if proof.TreeSize != head.TreeSize || !lab2.VerifyInclusion(proof.Entry.Index, head.TreeSize, lab2.LeafHash(data), proof.AuditPath, head.RootHash) {
+		c.t.Fatalf("log proof of %s does not verify", username)
+	}
+	return proof.Entry
+}
+
+func TestKeyLog(t *testing.T) {
+	server := newTestServer(t)
+	alice := newTestClient(t, server, "alice")
+	bob := newEd25519TestClient(t, server, "bob")
+
+	var logKey LogKey
+	if status, res := alice.getWithHeaders("/log/key", nil, &logKey); status != http.StatusOK {
+		t.Fatalf("get log key: got %d %+v", status, res)
+	}
+	if head := alice.treeHead(logKey.PublicKey); head.TreeSize != 0 {
+		t.Fatalf("empty log: got size %d", head.TreeSize)
+	}
+	alice.register()
+	bob.register()
+	head := alice.treeHead(logKey.PublicKey)
+	if head.TreeSize != 2 {
+		t.Fatalf("after registering: got size %d", head.TreeSize)
+	}
+	entry := alice.logEntry("bob", head)
+	if entry.Username != "bob" || len(entry.Devices) != 1 || entry.Devices[0].Name != defaultDevice ||
+		!reflect.DeepEqual(entry.Devices[0].Keys.Signing, bob.keySet().Signing) {
+		t.Errorf("bob's entry: got %+v", entry)
+	}
+
+	// Rotating a key appends an entry, the old tree is a prefix of the new one
+	newBob := newEd25519TestClient(t, server, "bob")
+	keys := newBob.keySet()
+	expectSuccess(t, "rotate", func() (int, testResponse) {
+		return bob.postSigned("/rotatekey", bob.rotation(newBob, keys, []FileKey{}))
+	})
+	newHead := alice.treeHead(logKey.PublicKey)
+	if newHead.TreeSize != 3 {
+		t.Fatalf("after rotating: got size %d", newHead.TreeSize)
+	}
+	if entry := alice.logEntry("bob", newHead); entry.Index != 2 || !reflect.DeepEqual(entry.Devices[0].Keys, keys) {
+		t.Errorf("bob's entry after rotating: got %+v", entry)
+	}
+	if entry := alice.logEntry("bob", head); entry.Index != 1 {
+		t.Errorf("bob's entry in the old tree: got %+v", entry)
+	}
+	var proof ConsistencyProof
+	path := fmt.Sprintf("/log/consistency?first=%d&second=%d", head.TreeSize, newHead.TreeSize)
+	if status, res := alice.getWithHeaders(path, nil, &proof); status != http.StatusOK ||
+		!lab2.VerifyConsistency(head.TreeSize, newHead.TreeSize, head.RootHash, newHead.RootHash, proof.Proof) {
+		t.Errorf("consistency proof: got %d %+v %+v", status, res, proof)
+	}
+
+	expectFailure(t, "missing user", http.StatusBadRequest, errNotLogged.Error(), func() (int, testResponse) {
+		return alice.getWithHeaders("/log/users/carol?size=3", nil, nil)
+	})
+	expectFailure(t, "user not in tree", http.StatusBadRequest, errNotLogged.Error(), func() (int, testResponse) {
+		return alice.getWithHeaders("/log/users/bob?size=1", nil, nil)
+	})
+	for _, size := range []string{"", "0", "4", "x"} {
+		expectFailure(t, "proof size "+size, http.StatusBadRequest, "Invalid tree size", func() (int, testResponse) {
+			return alice.getWithHeaders("/log/users/bob?size="+size, nil, nil)
+		})
+	}
+	for _, sizes := range []string{"first=0&second=3", "first=3&second=2", "first=1&second=4", "first=1"} {
+		expectFailure(t, "consistency "+sizes, http.StatusBadRequest, "Invalid tree sizes", func() (int, testResponse) {
+			return alice.getWithHeaders("/log/consistency?"+sizes, nil, nil)
+		})
+	}
+
+	// Users stored before the log existed are logged when their keys are first given out
+	carol := newEd25519TestClient(t, server, "carol")
+	legacy := &User{Username: "carol", Keys: carol.keySet()}
+	if err := store.InsertUser(legacy); err != nil {
+		t.Fatal(err)
+	}
+	var user User
+	if status, res := alice.get("/users/carol", &user); status != http.StatusOK {
+		t.Fatalf("get carol: got %d %+v", status, res)
+	}
+	alice.get("/users/carol", &user)
+	head = alice.treeHead(logKey.PublicKey)
+	if entry := alice.logEntry("carol", head); head.TreeSize != 4 || entry.Index != 3 {
+		t.Errorf("carol's entry: got size %d %+v", head.TreeSize, entry)
+	}
+}
+
+func TestKeyLogReload(t *testing.T) {
+	store = newMemoryStore()
+	newTestKeyLog(t)
+	for _, username := range []string{"alice", "bob", "carol"} {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &testClient{t: t, username: username, edKey: key}
+		if err := (&User{Username: username, Keys: c.keySet()}).Insert(store); err != nil {
+			t.Fatal(err)
+		}
+	}
+	head, err := keyLog.TreeHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := newKeyLog(store, keyLog.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloadedHead, err := reloaded.TreeHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloadedHead.TreeSize != 3 || !bytes.Equal(reloadedHead.RootHash, head.RootHash) {
+		t.Errorf("reloaded log: got %+v, want %+v", reloadedHead, head)
+	}
+}
+
+func TestLogKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logkey.pem")
+	key, generated, err := loadLogKey(path)
+	if err != nil || !generated {
+		t.Fatalf("generate log key: got %v %v", generated, err)
+	}
+	loaded, generated, err := loadLogKey(path)
+	if err != nil || generated || !key.Equal(loaded) {
+		t.Errorf("load log key: got %v %v", generated, err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Upload Session Struct, tracks a chunked upload until the owner or the writer who started it commits it
+// Uploader is the user who started it, sessions started before writers have none and belong to the owner
+// Epoch is the key epoch of the file key the chunks are encrypted with
+// Manifest and PreviousKey are only sent with the commit, signing the file the chunks make up
+// and linking its shared secret to the version it replaces
+type UploadSession struct {
+	Id          string    `gorethink:"id,omitempty"`
+	Owner       string    `gorethink:"owner"`
+	Name        string    `gorethink:"name"`
+	Uploader    string    `gorethink:"uploader"`
+	Header      []byte    `gorethink:"header"`
+	Chunks      int       `gorethink:"chunks"`
+	Epoch       int       `gorethink:"epoch"`
+	New         bool      `gorethink:"new"`
+	Created     time.Time `gorethink:"created"`
+	Received    []int     `gorethink:"-"`
+	Manifest    *Manifest `gorethink:"-" json:",omitempty"`
+	PreviousKey []byte    `gorethink:"-" json:",omitempty"`
+}
+
+// Inserts a new upload session into store
+func (s *UploadSession) Insert(store Store) error {
+	if !validName(s.Name) {
+		return errInvalidName
+	}
+	if s.Chunks < 1 {
+		return errors.New("Upload must have at least one chunk")
+	}
+	if s.New {
+		_, err := store.GetFile(s.Owner, s.Name)
+		if err == nil {
+			err = checkNoOwnerKey(s.Owner, s.Name, store)
+		}
+		if err != nil && err != errFileNotFound {
+			return err
+		}
+	}
+	id, err := newId()
+	if err != nil {
+		return err
+	}
+	s.Id = id
+	s.Created = time.Now().UTC()
+	s.Received = []int{}
+	return store.InsertUploadSession(s)
+}
+
+// The user who started the upload
+func (s *UploadSession) uploader() string {
+	if s.Uploader == "" {
+		return s.Owner
+	}
+	return s.Uploader
+}
+
+// Check that a chunk belongs to this upload
+func (s *UploadSession) Accepts(chunk *FileChunk) error {
+	if chunk.Owner != s.Owner || chunk.Name != s.Name {
+		return errors.New("Chunk does not belong to this upload")
+	}
+	if chunk.Index < 0 || chunk.Index >= s.Chunks {
+		return errors.New("Invalid chunk index")
+	}
+	return nil
+}
+
+// Make the upload the current version of its file once every chunk has arrived
+func (s *UploadSession) Commit(store Store) error {
+	received, err := store.GetFileChunkIndices(s.Owner, s.Name, s.Id)
+	if err != nil {
+		return err
+	}
+	if len(received) != s.Chunks {
+		return fmt.Errorf("Upload is incomplete: received %d of %d chunks", len(received), s.Chunks)
+	}
+	file := &File{Owner: s.Owner, Name: s.Name, Header: s.Header, Chunks: s.Chunks, Session: s.Id, Manifest: s.Manifest,
+		PreviousKey: s.PreviousKey, Epoch: s.Epoch, New: s.New}
+	err = file.Insert(store)
+	if err != nil {
+		return err
+	}
+	return store.DeleteUploadSession(s.Id)
+}
+
+// Get an upload session and the chunks it has received from store
+func GetUploadSession(id string, store Store) (*UploadSession, error) {
+	session, err := store.GetUploadSession(id)
+	if err != nil {
+		return nil, err
+	}
+	session.Received, err = store.GetFileChunkIndices(session.Owner, session.Name, session.Id)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
@@ -3,70 +3,167 @@ package main
 import (
 	"bytes"
 	"crypto/rsa"
-	"encoding/gob"
+	"crypto/x509"
 	"errors"
-
-	r "github.com/dancannon/gorethink"
+	"time"
 )
 
-// User DB table
-var userTable r.Term = r.Table("users")
+// Name of the device of users registered before devices
+const defaultDevice = "default"
 
+// User Struct
+// PubKey is the RSA key users registered before key sets, Keys is filled from it when they are loaded
+// Keys are the keys of the user's first device, for clients that predate devices
 type User struct {
 	Id       string
 	Username string
-	PubKey   *rsa.PublicKey
+	PubKey   *rsa.PublicKey `json:",omitempty"`
+	Keys     KeySet
+	Devices  []Device
+}
+
+// Device Struct, a machine holding one of the user's key pairs
+type Device struct {
+	Name  string
+	Keys  KeySet
+	Added time.Time
 }
 
-type dbUser struct {
-	Id       string `gorethink:"id,omitempty"`
-	Username string `gorethink:"username"`
-	PubKey   []byte `gorethink:"pubkey"`
+// Public keys a user signs requests with and receives file keys under
+type KeySet struct {
+	Signing    PublicKey
+	Encryption PublicKey
 }
 
-// Inserts user into DB
-func (u *User) Insert(dbSession *r.Session) (wRes r.WriteResponse, err error) {
-	res, err := userTable.GetAllByIndex("username", u.Username).Run(dbSession)
+// Inserts user into store with their first device, other devices are enrolled later
+func (u *User) Insert(store Store) error {
+	if !validName(u.Username) {
+		return errInvalidName
+	}
+	device := Device{Name: defaultDevice, Keys: u.Keys, Added: time.Now()}
+	if device.Keys.Signing.Algorithm == "" && u.PubKey != nil {
+		device.Keys = rsaKeySet(u.PubKey)
+	}
+	if len(u.Devices) > 1 {
+		return errors.New("Other devices must be enrolled from the first one")
+	}
+	if len(u.Devices) == 1 {
+		device.Name = u.Devices[0].Name
+		device.Keys = u.Devices[0].Keys
+	}
+	err := u.setDevices([]Device{device})
 	if err != nil {
-		return wRes, err
+		return err
 	}
-	if !res.IsNil() {
-		return wRes, errors.New("Duplicate account")
+	return keyLog.Write(u, store.InsertUser)
+}
+
+// Check and set a user's devices, the first device's keys become the user's Keys
+func (u *User) setDevices(devices []Device) error {
+	if len(devices) == 0 {
+		return errors.New("User must have at least one device")
+	}
+	names := make(map[string]bool)
+	for i, device := range devices {
+		if device.Name == "" {
+			return errors.New("Device name can't be empty")
+		}
+		if names[device.Name] {
+			return errors.New("Duplicate device: " + device.Name)
+		}
+		names[device.Name] = true
+		err := device.Keys.validate()
+		if err != nil {
+			return err
+		}
+		for _, other := range devices[:i] {
+			if bytes.Equal(device.Keys.Signing.Key, other.Keys.Signing.Key) {
+				return errors.New("Devices can't share a signing key")
+			}
+		}
 	}
-	var user dbUser
-	user.Id = u.Id
-	user.Username = u.Username
-	var pubKey bytes.Buffer
-	enc := gob.NewEncoder(&pubKey)
-	err = enc.Encode(u.PubKey)
+	err := u.setKeys(devices[0].Keys)
 	if err != nil {
-		return wRes, err
+		return err
 	}
-	user.PubKey = pubKey.Bytes()
-	wRes, err = userTable.Insert(user).RunWrite(dbSession)
-	return
+	u.Devices = devices
+	return nil
 }
 
-// Gets a user from the DB
-func GetUser(username string, dbSession *r.Session) (user *User, err error) {
-	res, err := userTable.GetAllByIndex("username", username).Run(dbSession)
+// Check and set a user's keys
+func (u *User) setKeys(keys KeySet) error {
+	err := keys.validate()
 	if err != nil {
-		return
+		return err
 	}
-	if res.IsNil() {
-		err = errors.New("User does not exist")
-		return
+	// Only keep the legacy key for RSA users so older clients can still share with them
+	var pubKey *rsa.PublicKey
+	if keys.Encryption.Algorithm == algorithmRSA {
+		pubKey, err = x509.ParsePKCS1PublicKey(keys.Encryption.Key)
+		if err != nil {
+			return err
+		}
 	}
-	u := new(dbUser)
-	err = res.One(&u)
+	u.Keys = keys
+	u.PubKey = pubKey
+	return nil
+}
+
+// Gets a user from the store
+func GetUser(username string, store Store) (*User, error) {
+	user, err := store.GetUser(username)
 	if err != nil {
-		return
-	}
-	user = new(User)
-	user.Id = u.Id
-	user.Username = u.Username
-	pubKey := bytes.NewBuffer(u.PubKey)
-	dec := gob.NewDecoder(pubKey)
-	err = dec.Decode(&user.PubKey)
-	return
+		return nil, err
+	}
+	if user.Keys.Signing.Algorithm == "" && user.PubKey != nil {
+		user.Keys = rsaKeySet(user.PubKey)
+	}
+	if len(user.Devices) == 0 {
+		user.Devices = []Device{{Name: defaultDevice, Keys: user.Keys}}
+	}
+	return user, nil
+}
+
+// Get one of the user's devices by name, nil if there is no such device
+func (u *User) Device(name string) *Device {
+	for i := range u.Devices {
+		if u.Devices[i].Name == name {
+			return &u.Devices[i]
+		}
+	}
+	return nil
+}
+
+// Signing keys of all the user's devices
+func (u *User) SigningKeys() []PublicKey {
+	keys := make([]PublicKey, 0, len(u.Devices))
+	for _, device := range u.Devices {
+		keys = append(keys, device.Keys.Signing)
+	}
+	return keys
+}
+
+// Key set of a user with a single RSA key
+func rsaKeySet(publicKey *rsa.PublicKey) KeySet {
+	key := PublicKey{algorithmRSA, x509.MarshalPKCS1PublicKey(publicKey)}
+	return KeySet{Signing: key, Encryption: key}
+}
+
+// Check a new user's keys are supported and strong enough
+func (k KeySet) validate() error {
+	if k.Signing.Algorithm == "" || k.Encryption.Algorithm == "" {
+		return errors.New("User has no public keys")
+	}
+	if k.Signing.Algorithm == algorithmX25519 {
+		return errors.New("X25519 keys can't be used for signing")
+	}
+	if k.Encryption.Algorithm == algorithmEd25519 {
+		return errors.New("Ed25519 keys can't be used for encryption")
+	}
+	for _, key := range []PublicKey{k.Signing, k.Encryption} {
+		if err := key.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
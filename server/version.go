@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// File Version Struct, a summary of one stored version of a file
+// PreviousKey lets holders of this version's shared secret decrypt the version before it
+// Pending is set on the current version while it waits to be re-encrypted after a revoke
+type FileVersion struct {
+	Version     int
+	Size        int64
+	Created     time.Time
+	Current     bool
+	Pending     bool
+	Manifest    *Manifest
+	PreviousKey []byte
+}
+
+// File Versions Struct, oldest first
+type FileVersions struct {
+	Versions []FileVersion
+}
+
+// Keep a version replaced by a newer one, removing the oldest kept versions past KeepVersions
+func archiveFile(old *File, store Store) error {
+	if KeepVersions < 1 {
+		return deleteFileData(old, store)
+	}
+	old.Id = ""
+	err := store.InsertFileVersion(old)
+	if err != nil {
+		return err
+	}
+	versions, err := store.GetFileVersions(old.Owner, old.Name)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(versions)-KeepVersions; i++ {
+		err = deleteFileData(&versions[i], store)
+		if err != nil {
+			return err
+		}
+		err = store.DeleteFileVersion(versions[i].Owner, versions[i].Name, versions[i].Version)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove the chunks of a version that is no longer kept
+func deleteFileData(f *File, store Store) error {
+	if f.Chunks == 0 {
+		return nil
+	}
+	return store.DeleteFileChunks(f.Owner, f.Name, f.Session)
+}
+
+// Summarise a version of a file
+func (f *File) summary(current bool) FileVersion {
+	return FileVersion{f.Version, f.Size, f.Created, current, current && f.Pending, f.Manifest, f.PreviousKey}
+}
+
+// Get the kept versions of a file and its current version from store
+func GetFileVersions(owner string, filename string, store Store) (*FileVersions, error) {
+	file, err := store.GetFile(owner, filename)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := store.GetFileVersions(owner, filename)
+	if err != nil {
+		return nil, err
+	}
+	list := &FileVersions{make([]FileVersion, 0, len(versions)+1)}
+	for i := range versions {
+		list.Versions = append(list.Versions, versions[i].summary(false))
+	}
+	list.Versions = append(list.Versions, file.summary(true))
+	return list, nil
+}
+
+// Get a version of a file from store, version 0 is the current version
+func GetFileVersion(owner string, filename string, version int, store Store) (*File, error) {
+	file, err := store.GetFile(owner, filename)
+	if err != nil {
+		return nil, err
+	}
+	if version == 0 || version == file.Version {
+		return file, nil
+	}
+	return store.GetFileVersion(owner, filename, version)
+}
+
+// Get the version requested with the version query parameter, 0 if there is none
+func versionParam(req *http.Request) (int, error) {
+	param := req.URL.Query().Get("version")
+	if param == "" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(param)
+	if err != nil || version < 1 {
+		return 0, errors.New("Invalid file version")
+	}
+	return version, nil
+}